@@ -0,0 +1,220 @@
+package control
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+const (
+	// AuditSuccess, AuditDenied and AuditFailure are the results of an audited operation
+	AuditSuccess = "success"
+	AuditDenied  = "denied"
+	AuditFailure = "failure"
+)
+
+var (
+	ErrAuditTampered = errors.New("audit log is tampered")
+)
+
+// AuditLog keep the audit entries of the operations, the entries are never updated
+type AuditLog interface {
+	Append(entry *AuditEntry) error
+	// Query returns the entries of the query in the order they were appended
+	Query(query AuditQuery) ([]AuditEntry, error)
+}
+
+// AuditEntry is who made an operation on what, and how it ended
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	// UserID, AccessKeyID and Anonymous are the principal of the request, they are empty for an internal call
+	UserID      int64  `json:"user_id,omitempty"`
+	AccessKeyID string `json:"access_key_id,omitempty"`
+	Anonymous   bool   `json:"anonymous,omitempty"`
+	// Node is the node calling a peer rpc
+	Node       int64  `json:"node,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// Operation is the ctrl entry point or the peer rpc, or the action authorized for the gateway
+	Operation string `json:"operation"`
+	BucketID  int64  `json:"bucket_id,omitempty"`
+	Bucket    string `json:"bucket,omitempty"`
+	Key       string `json:"key,omitempty"`
+	ObjectID  int64  `json:"object_id,omitempty"`
+	Bytes     int64  `json:"bytes,omitempty"`
+	Result    string `json:"result"`
+	Error     string `json:"error,omitempty"`
+	// Latency is the duration of the operation in microseconds
+	Latency int64 `json:"latency_us"`
+	// Prev and Hash chain the entries when the log hashes them, Hash covers the entry and Prev
+	Prev string `json:"prev,omitempty"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// AuditQuery select the entries of a time range, and of a bucket when BucketID or Bucket is set
+type AuditQuery struct {
+	// From is inclusive and To is exclusive, a zero time is unbounded
+	From     time.Time
+	To       time.Time
+	BucketID int64
+	Bucket   string
+	// Limit is the max number of the entries, 0 is unlimited
+	Limit int
+}
+
+// Match reports whether the entry is selected by the query
+func (q *AuditQuery) Match(entry *AuditEntry) bool {
+	if !q.From.IsZero() && entry.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !entry.Time.Before(q.To) {
+		return false
+	}
+	if q.BucketID != 0 && entry.BucketID != q.BucketID {
+		return false
+	}
+	return q.Bucket == "" || entry.Bucket == q.Bucket
+}
+
+type requestIDKey struct{}
+
+type rpcAuditKey struct{}
+
+type requestAuditKey struct{}
+
+// WithRequestID returns a context carrying the id of the request down to the audit log
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestIDFromContext returns the id of the request, empty for an internal call
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// withRPCAudit returns a context carrying the entry of the peer rpc, the ctrl completes it instead of appending its own
+func withRPCAudit(ctx context.Context, entry *AuditEntry) context.Context {
+	return context.WithValue(ctx, rpcAuditKey{}, entry)
+}
+
+func rpcAuditFromContext(ctx context.Context) *AuditEntry {
+	entry, _ := ctx.Value(rpcAuditKey{}).(*AuditEntry)
+	return entry
+}
+
+// requestAudit is the entry of a gateway request, it is named after the first operation made for the request
+type requestAudit struct {
+	entry *AuditEntry
+	named bool
+}
+
+func requestAuditFromContext(ctx context.Context) *requestAudit {
+	audit, _ := ctx.Value(requestAuditKey{}).(*requestAudit)
+	return audit
+}
+
+// complete fill the fields of the request entry the operations made for it before left empty,
+// the first failure is the result of the request
+func (a *requestAudit) complete(entry *AuditEntry, err error) {
+	if !a.named {
+		a.entry.Operation, a.named = entry.Operation, true
+	}
+	if a.entry.BucketID == 0 {
+		a.entry.BucketID, a.entry.Bucket = entry.BucketID, entry.Bucket
+	}
+	if a.entry.Key == "" {
+		a.entry.Key = entry.Key
+	}
+	if a.entry.ObjectID == 0 {
+		a.entry.ObjectID = entry.ObjectID
+	}
+	if a.entry.Bytes == 0 {
+		a.entry.Bytes = entry.Bytes
+	}
+	if err != nil && a.entry.Result == "" {
+		a.entry.Result, a.entry.Error = auditResult(err), err.Error()
+	}
+}
+
+// AuditRequest returns a context under which the ctrl completes one entry for the gateway request instead of
+// appending an entry per operation, the entry is named operation until an operation of the ctrl names it. end observe and append
+// the entry once the request ended with err.
+func (c *ctrl) AuditRequest(ctx context.Context, operation string) (_ context.Context, end func(err error)) {
+	start := time.Now()
+	audit := &requestAudit{entry: &AuditEntry{Operation: operation}}
+	ctx = context.WithValue(ctx, requestAuditKey{}, audit)
+	return ctx, func(err error) {
+		if err != nil && audit.entry.Result == "" {
+			audit.entry.Result, audit.entry.Error = auditResult(err), err.Error()
+		}
+		if audit.entry.Result == "" {
+			audit.entry.Result = AuditSuccess
+		}
+		c.record(ctx, audit.entry, start)
+	}
+}
+
+// auditResult returns the result of an operation ended with err
+func auditResult(err error) string {
+	switch {
+	case err == nil:
+		return AuditSuccess
+	case errors.Is(err, ErrAccessDenied):
+		return AuditDenied
+	}
+	return AuditFailure
+}
+
+// audit observe and append the entry of the operation started at start and ended with *err, it is deferred by
+// the entry points. Under a peer rpc or a gateway request the entry of the rpc or of the request is completed instead.
+func (c *ctrl) audit(ctx context.Context, entry *AuditEntry, start time.Time, err *error) {
+	if rpc := rpcAuditFromContext(ctx); rpc != nil {
+		rpc.BucketID, rpc.ObjectID = entry.BucketID, entry.ObjectID
+		if entry.Bytes > 0 {
+			rpc.Bytes = entry.Bytes
+		}
+		if *err != nil {
+			rpc.Result, rpc.Error = auditResult(*err), (*err).Error()
+		}
+		return
+	}
+	if request := requestAuditFromContext(ctx); request != nil {
+		request.complete(entry, *err)
+		return
+	}
+	entry.Result = auditResult(*err)
+	if *err != nil {
+		entry.Error = (*err).Error()
+	}
+	c.record(ctx, entry, start)
+}
+
+// record observe and append the entry of the operation started at start
+func (c *ctrl) record(ctx context.Context, entry *AuditEntry, start time.Time) {
+	latency := time.Since(start)
+	c.observe(entry, latency)
+	if c.opt.AuditLog == nil {
+		return
+	}
+	entry.Time = start.UTC()
+	entry.Latency = latency.Microseconds()
+	entry.RequestID = RequestIDFromContext(ctx)
+	if principal := PrincipalFromContext(ctx); principal != nil {
+		entry.UserID, entry.AccessKeyID, entry.Anonymous = principal.UserID, principal.AccessKeyID, principal.Anonymous
+		entry.RemoteAddr = principal.SourceIP
+	}
+	if entry.Bucket == "" && entry.BucketID != 0 {
+		if bucket, e := c.bucketMeta.GetBucketByID(entry.BucketID); e == nil {
+			entry.Bucket = bucket.Name
+		}
+	}
+	c.appendAudit(entry)
+}
+
+func (c *ctrl) appendAudit(entry *AuditEntry) {
+	if err := c.opt.AuditLog.Append(entry); err != nil {
+		log.Errorf("append audit entry of %s failed: %v", entry.Operation, err)
+	}
+}
@@ -0,0 +1,111 @@
+package control_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"oss/internal/control"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+type memAuditLog struct {
+	sync.Mutex
+	entries []control.AuditEntry
+}
+
+func (l *memAuditLog) Append(entry *control.AuditEntry) error {
+	l.Lock()
+	defer l.Unlock()
+	l.entries = append(l.entries, *entry)
+	return nil
+}
+
+func (l *memAuditLog) Query(query control.AuditQuery) ([]control.AuditEntry, error) {
+	l.Lock()
+	defer l.Unlock()
+	return append([]control.AuditEntry{}, l.entries...), nil
+}
+
+// requestCtrl is the part of the ctrl a gateway request is audited with
+type requestCtrl interface {
+	Authorize(ctx context.Context, bucket *control.BucketMeta, request control.AccessRequest) error
+	AuditRequest(ctx context.Context, operation string) (context.Context, func(err error))
+}
+
+func TestAuditRequest(t *testing.T) {
+	errRequest := errors.New("request failed")
+	data := testData(1000, 1)
+
+	cases := []struct {
+		name string
+		// do make the operations of the request under ctx
+		do     func(t *testing.T, env *testEnv, ctx context.Context) error
+		entry  control.AuditEntry
+		hasErr bool
+	}{
+		{name: "put", do: func(t *testing.T, env *testEnv, ctx context.Context) error {
+			if err := env.ctrl.(requestCtrl).Authorize(ctx, env.bucket, control.AccessRequest{Action: control.ActionPutObject, Key: "object"}); err != nil {
+				return err
+			}
+			file := objectFile(t, data)
+			defer file.Close()
+			_, err := env.ctrl.UploadObject(ctx, []*os.File{file}, "object", int64(len(data)), 1, control.ObjectTypeStreamOctet)
+			return err
+		}, entry: control.AuditEntry{Operation: string(control.ActionPutObject), BucketID: 1, Key: "object", ObjectID: 1, Bytes: int64(len(data)), Result: control.AuditSuccess}},
+		{name: "get missing", do: func(t *testing.T, env *testEnv, ctx context.Context) error {
+			if err := env.ctrl.(requestCtrl).Authorize(ctx, env.bucket, control.AccessRequest{Action: control.ActionGetObject, Key: "object"}); err != nil {
+				return err
+			}
+			_, err := env.ctrl.DownloadObject(ctx, 1, 7)
+			return err
+		}, entry: control.AuditEntry{Operation: string(control.ActionGetObject), BucketID: 1, Key: "object", ObjectID: 7, Result: control.AuditFailure}, hasErr: true},
+		{name: "no operation", do: func(t *testing.T, env *testEnv, ctx context.Context) error {
+			return errRequest
+		}, entry: control.AuditEntry{Operation: "GET", Result: control.AuditFailure, Error: errRequest.Error()}, hasErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			log := &memAuditLog{}
+			env := newTestEnv(t, control.CodecReedSolomon, control.WithAuditLog(log))
+			ctx, end := env.ctrl.(requestCtrl).AuditRequest(control.WithRequestID(context.Background(), "request"), "GET")
+			end(tc.do(t, env, ctx))
+
+			// the request is audited once, with what its operations were made on
+			if len(log.entries) != 1 {
+				t.Fatalf("%d entries, want 1", len(log.entries))
+			}
+			got := log.entries[0]
+			if got.Operation != tc.entry.Operation || got.BucketID != tc.entry.BucketID || got.Key != tc.entry.Key ||
+				got.ObjectID != tc.entry.ObjectID || got.Bytes != tc.entry.Bytes || got.Result != tc.entry.Result || got.RequestID != "request" {
+				t.Fatalf("entry %+v, want %+v", got, tc.entry)
+			}
+			if (got.Error != "") != tc.hasErr {
+				t.Fatalf("entry error %q", got.Error)
+			}
+		})
+	}
+}
+
+func TestAuditOperationWithoutRequest(t *testing.T) {
+	log := &memAuditLog{}
+	env := newTestEnv(t, control.CodecReedSolomon, control.WithAuditLog(log))
+	env.upload(t, testData(1000, 1))
+	if len(log.entries) != 1 || log.entries[0].Operation != "UploadObject" || log.entries[0].Result != control.AuditSuccess {
+		t.Fatalf("entries %+v, want one UploadObject", log.entries)
+	}
+}
+
+// objectFile returns a file of the data at offset 0
+func objectFile(t *testing.T, data []byte) *os.File {
+	name := filepath.Join(t.TempDir(), "object")
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
@@ -0,0 +1,81 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrAccessDenied = errors.New("access denied")
+)
+
+// Principal is the identity a request is made for, resolved from the signature of the request
+type Principal struct {
+	UserID      int64
+	AccessKeyID string
+	// Anonymous is a request without signature
+	Anonymous bool
+	// SourceIP is the address the request comes from, the policies may condition the access on it
+	SourceIP string
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a context carrying the principal of the request down to the ctrl
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the principal of the request, nil for an internal call
+func PrincipalFromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey{}).(*Principal)
+	return principal
+}
+
+// Authorize check the principal of ctx may make the request on the bucket with its policy and its acl,
+// a context without principal is an internal call and is trusted. Under a gateway request the authorization
+// names the entry of the request after the action.
+func (c *ctrl) Authorize(ctx context.Context, bucket *BucketMeta, request AccessRequest) (err error) {
+	entry := &AuditEntry{Operation: string(request.Action), BucketID: bucket.ID, Bucket: bucket.Name, Key: request.Key}
+	defer c.audit(ctx, entry, time.Now(), &err)
+	return c.check(ctx, bucket, request)
+}
+
+// check check the principal of ctx may make the request on the bucket, without audit
+func (c *ctrl) check(ctx context.Context, bucket *BucketMeta, request AccessRequest) error {
+	request.Principal = PrincipalFromContext(ctx)
+	if !EvaluateAccess(bucket, request).Allowed {
+		return ErrAccessDenied
+	}
+	return nil
+}
+
+// SimulateAccess returns the decision on the request of its principal without making it, to debug the policy
+// of the bucket. Only the principals allowed to read the policy may simulate it.
+func (c *ctrl) SimulateAccess(ctx context.Context, bucketID int64, request AccessRequest) (_ *AccessDecision, err error) {
+	defer c.audit(ctx, &AuditEntry{Operation: "SimulateAccess", BucketID: bucketID, Key: request.Key}, time.Now(), &err)
+	bucket, err := c.bucketMeta.GetBucketByID(bucketID)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.check(ctx, bucket, AccessRequest{Action: ActionGetBucketPolicy}); err != nil {
+		return nil, err
+	}
+	if request.Principal == nil {
+		request.Principal = &Principal{Anonymous: true}
+	}
+	return EvaluateAccess(bucket, request), nil
+}
+
+// authorize check the principal of ctx may make the action on the object key of the bucket of id
+func (c *ctrl) authorize(ctx context.Context, bucketID int64, action Action, key string) error {
+	if PrincipalFromContext(ctx) == nil {
+		return nil
+	}
+	bucket, err := c.bucketMeta.GetBucketByID(bucketID)
+	if err != nil {
+		return err
+	}
+	return c.check(ctx, bucket, AccessRequest{Action: action, Key: key})
+}
@@ -1,27 +1,64 @@
 package control
 
-import "io"
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+var (
+	ErrBlockNotFound = errors.New("block not found")
+)
 
 type BlockRepo interface {
-	StoreBlock(meta BlockMeta, data io.Reader) error
-	GetBlock(bucketID int64, objectID int64, blockID int64) (io.Reader, error)
-	DeleteBlock(bucketID int64, objectID int64, blockID int64) error
-	GetBlockMeta(bucketID int64, objectID int64, blockID int64) (*BlockMeta, error)
+	StoreBlock(ctx context.Context, meta BlockMeta, data io.Reader) error
+	GetBlock(ctx context.Context, bucketID int64, objectID int64, blockID int64) (io.Reader, error)
+	DeleteBlock(ctx context.Context, bucketID int64, objectID int64, blockID int64) error
+	GetBlockMeta(ctx context.Context, bucketID int64, objectID int64, blockID int64) (*BlockMeta, error)
 }
 
+// BlockMeta is the meta of a block. Digest is the checksum of the block computed by ChecksumAlgorithm,
+// the blocks stored before the algorithm was recorded only have the crc32 Checksum.
 type BlockMeta struct {
-	ID        int64      `json:"id,omitempty"`
-	BucketID  int64      `json:"bucket_id,omitempty"`
-	ObjectID  int64      `json:"object_id,omitempty"`
-	Size      int64      `json:"size,omitempty"`
-	Checksum  uint32     `json:"checksum,omitempty"`
-	CreatedAt int64      `json:"created_at,omitempty"`
-	UpdatedAt int64      `json:"updated_at,omitempty"`
-	Path      string     `json:"path,omitempty"`
-	Locations []Location `json:"locations,omitempty"`
+	ID                int64      `json:"id,omitempty"`
+	BucketID          int64      `json:"bucket_id,omitempty"`
+	ObjectID          int64      `json:"object_id,omitempty"`
+	Size              int64      `json:"size,omitempty"`
+	Checksum          uint32     `json:"checksum,omitempty"`
+	ChecksumAlgorithm string     `json:"checksum_algorithm,omitempty"`
+	Digest            []byte     `json:"digest,omitempty"`
+	CreatedAt         int64      `json:"created_at,omitempty"`
+	UpdatedAt         int64      `json:"updated_at,omitempty"`
+	Path              string     `json:"path,omitempty"`
+	Locations         []Location `json:"locations,omitempty"`
 }
 
 type Location struct {
 	NID      int64
 	Location string
 }
+
+const (
+	DiskStateOK         DiskState = "ok"
+	DiskStateReadOnly   DiskState = "readonly"
+	DiskStateFailed     DiskState = "failed"
+	DiskStateRebuilding DiskState = "rebuilding"
+)
+
+// DiskState is the health of a disk, only the ok disks take new blocks
+type DiskState string
+
+// DiskUsage is the usage of one disk of a BlockRepo
+type DiskUsage struct {
+	Path   string    `json:"path"`
+	State  DiskState `json:"state"`
+	Weight float64   `json:"weight"`
+	Total  int64     `json:"total"`
+	Free   int64     `json:"free"`
+	Used   int64     `json:"used"`
+}
+
+// CapacityReporter is implemented by the BlockRepo that report the usage of their disks
+type CapacityReporter interface {
+	Usage() []DiskUsage
+}
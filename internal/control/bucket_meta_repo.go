@@ -1,9 +1,20 @@
 package control
 
+import "errors"
+
+var (
+	ErrBucketNotFound = errors.New("bucket not found")
+	ErrBucketExists   = errors.New("bucket already exists")
+)
+
 type BucketMetaRepo interface {
 	CreateBucket(name string, ownerID int64) (*BucketMeta, error)
 	GetBucketByID(id int64) (*BucketMeta, error)
+	// GetBucketByName returns ErrBucketNotFound when there is no bucket of the name
+	GetBucketByName(name string) (*BucketMeta, error)
 	GetBucketByOwnerID(ownerID int64) ([]*BucketMeta, error)
+	// UpdateBucket replace the meta of the bucket
+	UpdateBucket(meta *BucketMeta) error
 
 	DeleteBucket(id int64) error
 }
@@ -15,4 +26,19 @@ type BucketMeta struct {
 	UpdatedAt int64  `json:"updated_at,omitempty"`
 
 	OwnerID int64 `json:"owner_id,omitempty"`
+
+	// Codec is the erasure codec of the objects uploaded to the bucket, empty is the default codec
+	Codec string `json:"codec,omitempty"`
+	// Dedup cut the objects uploaded to the bucket into content defined chunks stored once across objects
+	Dedup bool `json:"dedup,omitempty"`
+	// Compression is the compression algorithm of the objects uploaded to the bucket, empty is no compression
+	Compression string `json:"compression,omitempty"`
+	// Encryption encrypt the objects uploaded to the bucket with the master keys of the key ring
+	Encryption bool `json:"encryption,omitempty"`
+	// Policy grant or deny the access to the bucket and its objects, the owner is allowed unless explicitly denied
+	Policy *BucketPolicy `json:"policy,omitempty"`
+	// ACL is the canned ACL of the bucket, empty is private
+	ACL string `json:"acl,omitempty"`
+	// Notification deliver the events of the bucket to the targets of its rules
+	Notification *NotificationConfig `json:"notification,omitempty"`
 }
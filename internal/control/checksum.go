@@ -0,0 +1,63 @@
+package control
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"oss/internal/utils"
+)
+
+var (
+	ErrBlockCorrupted = errors.New("block corrupted")
+)
+
+// BlockChecksumReader hash the block data while it is read. At EOF it fails with
+// ErrBlockCorrupted when the data does not match the digest of the block meta.
+type BlockChecksumReader struct {
+	r      io.Reader
+	hash   hash.Hash
+	expect []byte
+	sum    []byte
+}
+
+// NewBlockChecksumReader returns a reader verifying data against meta,
+// the digest is only computed when meta has an algorithm but no digest
+func NewBlockChecksumReader(data io.Reader, meta BlockMeta) (*BlockChecksumReader, error) {
+	algorithm, expect := meta.ChecksumAlgorithm, meta.Digest
+	if algorithm == "" {
+		algorithm = utils.ChecksumCRC32
+		expect = binary.BigEndian.AppendUint32(nil, meta.Checksum)
+	}
+	h, err := utils.NewHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return &BlockChecksumReader{r: data, hash: h, expect: expect}, nil
+}
+
+func (c *BlockChecksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.hash.Write(p[:n])
+	if err == io.EOF {
+		c.sum = c.hash.Sum(nil)
+		if c.expect != nil && !bytes.Equal(c.sum, c.expect) {
+			return n, ErrBlockCorrupted
+		}
+	}
+	return n, err
+}
+
+// Sum returns the digest of the data once it is read to EOF
+func (c *BlockChecksumReader) Sum() []byte {
+	return c.sum
+}
+
+// Close close the block data
+func (c *BlockChecksumReader) Close() error {
+	if closer, ok := c.r.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
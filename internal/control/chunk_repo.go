@@ -0,0 +1,37 @@
+package control
+
+import "errors"
+
+var (
+	ErrChunkNotFound = errors.New("chunk not found")
+)
+
+// ChunkMeta is a content defined chunk stored once and shared by the objects holding it
+type ChunkMeta struct {
+	// Hash is the hex SHA-256 of the chunk
+	Hash    string         `json:"hash"`
+	Size    int64          `json:"size"`
+	Erasure ErasureProfile `json:"erasure"`
+	Stripes []StripeMeta   `json:"stripes"`
+	// Refs is the number of references of the objects to the chunk
+	Refs int64 `json:"refs"`
+}
+
+// ChunkRef is a reference of an object to a chunk
+type ChunkRef struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// ChunkRepo is the chunk hash index with the reference counts of the chunks
+type ChunkRepo interface {
+	// AcquireChunk add a reference to a stored chunk, ErrChunkNotFound when it is not stored
+	AcquireChunk(hash string) (*ChunkMeta, error)
+	// StoreChunk store a new chunk with one reference, when the chunk was stored meanwhile
+	// a reference is added to the stored one and stored is false
+	StoreChunk(meta *ChunkMeta) (stored bool, err error)
+	// ReleaseChunk drop a reference to the chunk, the chunk is removed with its last
+	// reference and returned so that its blocks are deleted
+	ReleaseChunk(hash string) (removed *ChunkMeta, err error)
+	GetChunk(hash string) (*ChunkMeta, error)
+}
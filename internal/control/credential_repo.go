@@ -0,0 +1,42 @@
+package control
+
+import "errors"
+
+var (
+	ErrUserNotFound      = errors.New("user not found")
+	ErrUserExists        = errors.New("user already exists")
+	ErrAccessKeyNotFound = errors.New("access key not found")
+)
+
+// CredentialRepo keep the users and their access keys
+type CredentialRepo interface {
+	CreateUser(name string) (*User, error)
+	GetUser(id int64) (*User, error)
+	GetUserByName(name string) (*User, error)
+	// DeleteUser delete the user and its access keys
+	DeleteUser(id int64) error
+
+	// CreateAccessKey generate a new key pair for the user
+	CreateAccessKey(userID int64) (*AccessKey, error)
+	// GetAccessKey returns ErrAccessKeyNotFound when there is no key of the id
+	GetAccessKey(accessKeyID string) (*AccessKey, error)
+	GetAccessKeys(userID int64) ([]*AccessKey, error)
+	// SetAccessKeyStatus enable or disable the key, a disabled key can not sign requests
+	SetAccessKeyStatus(accessKeyID string, disabled bool) error
+	DeleteAccessKey(accessKeyID string) error
+}
+
+type User struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// AccessKey is a key pair of a user, the requests of the user are signed with the secret key
+type AccessKey struct {
+	AccessKeyID string `json:"access_key_id"`
+	SecretKey   string `json:"secret_key"`
+	UserID      int64  `json:"user_id"`
+	CreatedAt   int64  `json:"created_at"`
+	Disabled    bool   `json:"disabled,omitempty"`
+}
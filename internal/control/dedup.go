@@ -0,0 +1,112 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"oss/internal/utils"
+)
+
+var (
+	ErrNoChunkRepo = errors.New("chunk repo is not configured")
+)
+
+// uploadChunks cut data into content defined chunks and upload the chunks not stored yet,
+// the references are released on failure
+func (c *ctrl) uploadChunks(ctx context.Context, op *tempOp, object *Object, policy *uploadPolicy, data io.Reader) ([]ChunkRef, error) {
+	chunker := utils.NewChunker(data, c.opt.ChunkMinSize, c.opt.ChunkAvgSize, c.opt.ChunkMaxSize)
+	refs := make([]ChunkRef, 0)
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return refs, nil
+		}
+		if err == nil {
+			var ref ChunkRef
+			if ref, err = c.uploadChunk(ctx, op, object, policy, chunk); err == nil {
+				refs = append(refs, ref)
+				continue
+			}
+		}
+		c.releaseChunks(ctx, refs)
+		return nil, err
+	}
+}
+
+// uploadChunk add a reference to the chunk, the chunk is uploaded when it is not stored yet
+func (c *ctrl) uploadChunk(ctx context.Context, op *tempOp, object *Object, policy *uploadPolicy, chunk []byte) (ChunkRef, error) {
+	sum := sha256.Sum256(chunk)
+	ref := ChunkRef{Hash: hex.EncodeToString(sum[:]), Size: int64(len(chunk))}
+	_, err := c.opt.ChunkRepo.AcquireChunk(ref.Hash)
+	if err == nil || !errors.Is(err, ErrChunkNotFound) {
+		return ref, err
+	}
+
+	stripes, err := c.uploadStripes(ctx, op, object, policy, bytes.NewReader(chunk), ref.Size)
+	if err != nil {
+		return ref, err
+	}
+	// the chunk uploaded meanwhile by another object is kept, this copy is deleted
+	stored, err := c.opt.ChunkRepo.StoreChunk(&ChunkMeta{Hash: ref.Hash, Size: ref.Size, Erasure: policy.profile, Stripes: stripes})
+	if err != nil || !stored {
+		c.deleteStripes(ctx, stripes)
+	}
+	return ref, err
+}
+
+// releaseChunks drop the references to the chunks and delete the chunks left without reference
+func (c *ctrl) releaseChunks(ctx context.Context, refs []ChunkRef) {
+	if len(refs) == 0 {
+		return
+	}
+	if c.opt.ChunkRepo == nil {
+		log.Debugf("release chunks failed: %v", ErrNoChunkRepo)
+		return
+	}
+	for _, ref := range refs {
+		chunk, err := c.opt.ChunkRepo.ReleaseChunk(ref.Hash)
+		if err != nil {
+			log.Debugf("release chunk %s failed: %v", ref.Hash, err)
+			continue
+		}
+		if chunk != nil {
+			c.deleteStripes(ctx, chunk.Stripes)
+		}
+	}
+}
+
+// getChunks returns the metas of the referenced chunks
+func (c *ctrl) getChunks(refs []ChunkRef) ([]*ChunkMeta, error) {
+	if len(refs) == 0 {
+		return nil, nil
+	}
+	if c.opt.ChunkRepo == nil {
+		return nil, ErrNoChunkRepo
+	}
+	chunks := make([]*ChunkMeta, len(refs))
+	for i, ref := range refs {
+		chunk, err := c.opt.ChunkRepo.GetChunk(ref.Hash)
+		if err != nil {
+			return nil, err
+		}
+		chunks[i] = chunk
+	}
+	return chunks, nil
+}
+
+// downloadChunk write the content of the chunk to dst, the stripes out of the range of dst are skipped
+func (c *ctrl) downloadChunk(ctx context.Context, op *tempOp, chunk *ChunkMeta, dst *rangeWriter) error {
+	for i := range chunk.Stripes {
+		if dst.skip(chunk.Stripes[i].ContentSize()) {
+			continue
+		}
+		if err := c.downloadStripe(ctx, op, chunk.Erasure, &chunk.Stripes[i], nil, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package control_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"oss/internal/control"
+	"oss/internal/data/chunk"
+	"testing"
+)
+
+func TestDedupDownloadReservesChunkProfile(t *testing.T) {
+	env := newTestEnv(t, control.CodecReedSolomon,
+		control.WithDedup(chunk.NewChunkIndex(t.TempDir())), control.WithChunkSize(16*1024, 32*1024, 64*1024))
+	env.bucket.Dedup = true
+	data := testData(256*1024, 1)
+
+	// the chunks are stored by the lrc upload and shared by the rs upload
+	if _, err := env.put(t, data, control.WithCodec(control.CodecLRC)); err != nil {
+		t.Fatal(err)
+	}
+	blocks := env.op.count()
+	obj, err := env.put(t, data, control.WithCodec(control.CodecReedSolomon))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := env.op.count(); n != blocks {
+		t.Fatalf("%d blocks after the duplicate upload, want %d", n, blocks)
+	}
+
+	downloaded, err := env.ctrl.DownloadObject(context.Background(), 1, obj.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer downloaded.Close()
+	// the shards of the lrc stripes of the chunks are reserved, not the ones of the rs profile of the object
+	lrcShards := int64(5+4) * testShardSize
+	if used := env.ctrl.(control.TempReporter).TempUsage().Used; used != int64(len(data))+lrcShards {
+		t.Fatalf("temp reserved %d, want %d", used, int64(len(data))+lrcShards)
+	}
+	got, err := io.ReadAll(downloaded.Files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded data does not match")
+	}
+}
@@ -0,0 +1,61 @@
+package control
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+)
+
+var (
+	ErrBadDigest       = errors.New("content digest does not match")
+	ErrObjectCorrupted = errors.New("object content does not match its hash")
+	ErrContentTooShort = errors.New("content is shorter than the object size")
+)
+
+// contentHash hash the content of an object as it streams
+type contentHash struct {
+	md5    hash.Hash
+	sha256 hash.Hash
+	// size is the number of bytes hashed
+	size int64
+}
+
+func newContentHash() *contentHash {
+	return &contentHash{md5: md5.New(), sha256: sha256.New()}
+}
+
+func (h *contentHash) Write(p []byte) (int, error) {
+	h.md5.Write(p)
+	h.sha256.Write(p)
+	h.size += int64(len(p))
+	return len(p), nil
+}
+
+// ETag returns the hex MD5 of the content
+func (h *contentHash) ETag() string {
+	return hex.EncodeToString(h.md5.Sum(nil))
+}
+
+// SHA256 returns the hex SHA-256 of the content
+func (h *contentHash) SHA256() string {
+	return hex.EncodeToString(h.sha256.Sum(nil))
+}
+
+// verify check the content against the digests given by the client, a nil digest is not checked
+func (h *contentHash) verify(contentMD5 []byte, contentSHA256 []byte) error {
+	if contentMD5 != nil && !bytes.Equal(h.md5.Sum(nil), contentMD5) {
+		return ErrBadDigest
+	}
+	if contentSHA256 != nil && !bytes.Equal(h.sha256.Sum(nil), contentSHA256) {
+		return ErrBadDigest
+	}
+	return nil
+}
+
+// match check the content against the hashes recorded in the object meta, an empty hash is not checked
+func (h *contentHash) match(meta *ObjectMeta) bool {
+	return (meta.ETag == "" || h.ETag() == meta.ETag) && (meta.SHA256 == "" || h.SHA256() == meta.SHA256)
+}
@@ -0,0 +1,186 @@
+package control_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"oss/internal/control"
+	"oss/internal/data/chunk"
+	"path/filepath"
+	"testing"
+)
+
+// testData returns size bytes of random data, the same for a seed
+func testData(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestUploadContentDigest(t *testing.T) {
+	data := testData(3*testShardSize, 1)
+	md5Sum := md5.Sum(data)
+	sha256Sum := sha256.Sum256(data)
+	wrong := testData(3*testShardSize, 2)
+	wrongMD5 := md5.Sum(wrong)
+	wrongSHA256 := sha256.Sum256(wrong)
+
+	cases := []struct {
+		name string
+		opt  []control.UploadOption
+		err  error
+	}{
+		{name: "no digest"},
+		{name: "md5", opt: []control.UploadOption{control.WithContentMD5(md5Sum[:])}},
+		{name: "sha256", opt: []control.UploadOption{control.WithContentSHA256(sha256Sum[:])}},
+		{name: "md5 and sha256", opt: []control.UploadOption{control.WithContentMD5(md5Sum[:]), control.WithContentSHA256(sha256Sum[:])}},
+		{name: "bad md5", opt: []control.UploadOption{control.WithContentMD5(wrongMD5[:])}, err: control.ErrBadDigest},
+		{name: "bad sha256", opt: []control.UploadOption{control.WithContentSHA256(wrongSHA256[:])}, err: control.ErrBadDigest},
+		{name: "bad sha256 with good md5", opt: []control.UploadOption{control.WithContentMD5(md5Sum[:]), control.WithContentSHA256(wrongSHA256[:])}, err: control.ErrBadDigest},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			env := newTestEnv(t, control.CodecReedSolomon)
+			obj, err := env.put(t, data, tc.opt...)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("upload error %v, want %v", err, tc.err)
+			}
+			if tc.err != nil {
+				// the shards of a rejected upload are deleted
+				if n := env.op.count(); n != 0 {
+					t.Fatalf("%d blocks left by the rejected upload", n)
+				}
+				return
+			}
+			if obj.ETag != hex.EncodeToString(md5Sum[:]) || obj.SHA256 != hex.EncodeToString(sha256Sum[:]) {
+				t.Fatalf("object hashes %s %s do not match the content", obj.ETag, obj.SHA256)
+			}
+		})
+	}
+}
+
+func TestDownloadVerify(t *testing.T) {
+	data := testData(2*5*testShardSize+1000, 1)
+
+	cases := []struct {
+		name    string
+		corrupt func(meta *control.ObjectMeta)
+		opt     []control.DownloadOption
+		err     error
+	}{
+		{name: "intact", opt: []control.DownloadOption{control.WithVerify()}},
+		{name: "etag mismatch", corrupt: func(meta *control.ObjectMeta) { meta.ETag = hex.EncodeToString(make([]byte, md5.Size)) },
+			opt: []control.DownloadOption{control.WithVerify()}, err: control.ErrObjectCorrupted},
+		{name: "sha256 mismatch", corrupt: func(meta *control.ObjectMeta) { meta.SHA256 = hex.EncodeToString(make([]byte, sha256.Size)) },
+			opt: []control.DownloadOption{control.WithVerify()}, err: control.ErrObjectCorrupted},
+		{name: "mismatch not verified", corrupt: func(meta *control.ObjectMeta) { meta.ETag = hex.EncodeToString(make([]byte, md5.Size)) }},
+		{name: "range read not verified", corrupt: func(meta *control.ObjectMeta) { meta.ETag = hex.EncodeToString(make([]byte, md5.Size)) },
+			opt: []control.DownloadOption{control.WithVerify(), control.WithRange(0, int64(len(data)/2))}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			env := newTestEnv(t, control.CodecReedSolomon)
+			obj := env.upload(t, data)
+			if tc.corrupt != nil {
+				meta, err := env.objects.GetMeta(1, obj.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tc.corrupt(meta)
+			}
+			got, err := env.download(obj.ID, tc.opt...)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("download error %v, want %v", err, tc.err)
+			}
+			if tc.err == nil && !bytes.HasPrefix(data, got) {
+				t.Fatal("downloaded data does not match")
+			}
+		})
+	}
+}
+
+func TestUploadDeletesReplicasOfFailedShard(t *testing.T) {
+	errPeerFailed := errors.New("peer failed")
+	env := newTestEnv(t, control.CodecReedSolomon)
+	// every shard is written to op and a replica, the second replica fails
+	replica := &memOperator{blocks: make(map[int64][]byte)}
+	failed := &memOperator{blocks: make(map[int64][]byte), fail: errPeerFailed}
+	env.peer.replicas = []*memOperator{replica, failed}
+
+	if _, err := env.put(t, testData(3*testShardSize, 1)); !errors.Is(err, errPeerFailed) {
+		t.Fatalf("upload error %v, want %v", err, errPeerFailed)
+	}
+	for name, op := range map[string]*memOperator{"op": env.op, "replica": replica, "failed": failed} {
+		if n := op.count(); n != 0 {
+			t.Fatalf("%d blocks left on %s", n, name)
+		}
+	}
+}
+
+func TestUploadShortContent(t *testing.T) {
+	cases := []struct {
+		name  string
+		size  int
+		dedup bool
+	}{
+		{name: "inline", size: 1000},
+		{name: "stripes", size: 3 * testShardSize},
+		{name: "chunks", size: 3 * testShardSize, dedup: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			env := newTestEnv(t, control.CodecReedSolomon, control.WithDedup(chunk.NewChunkIndex(t.TempDir())))
+			env.bucket.Dedup = tc.dedup
+			file, err := os.Create(filepath.Join(t.TempDir(), "object"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			if _, err = file.Write(testData(tc.size, 1)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = file.Seek(0, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			// the file ends 100 bytes before the size
+			_, err = env.ctrl.UploadObject(context.Background(), []*os.File{file}, "object", int64(tc.size+100), 1, control.ObjectTypeStreamOctet)
+			if !errors.Is(err, control.ErrContentTooShort) {
+				t.Fatalf("upload error %v, want ErrContentTooShort", err)
+			}
+			if n := env.op.count(); n != 0 {
+				t.Fatalf("%d blocks left by the short upload", n)
+			}
+		})
+	}
+}
+
+func TestInlineObject(t *testing.T) {
+	for _, size := range []int{0, 1000, 16 * 1024} {
+		env := newTestEnv(t, control.CodecReedSolomon)
+		data := testData(size, 1)
+		obj := env.upload(t, data)
+		meta, err := env.objects.GetMeta(1, obj.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(meta.Inline)) != meta.Size || len(meta.StripesMeta()) != 0 {
+			t.Fatalf("object of %d bytes has %d inline bytes and %d stripes", size, len(meta.Inline), len(meta.StripesMeta()))
+		}
+		if n := env.op.count(); n != 0 {
+			t.Fatalf("%d blocks stored for an inline object", n)
+		}
+		got, err := env.download(obj.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("downloaded inline object of %d bytes differs", size)
+		}
+	}
+}
@@ -5,9 +5,105 @@ import (
 	"os"
 )
 
+const (
+	// CodecReedSolomon is the codec every object stored before the erasure profile was recorded is coded with
+	CodecReedSolomon = "reedsolomon"
+	// CodecReplication store full copies of the object without coding
+	CodecReplication = "replication"
+	// CodecLRC is a locally repairable code, a single lost data shard is repaired from its local group
+	CodecLRC = "lrc"
+)
+
+// ErasureProfile describe how the stripes of an object are erasure coded,
+// it is stored with the object so that the object decodes under the profile that wrote it
+type ErasureProfile struct {
+	Codec        string `json:"codec"`
+	Version      int    `json:"version"`
+	DataShards   int    `json:"data_shards"`
+	ParityShards int    `json:"parity_shards"`
+	ShardSize    int64  `json:"shard_size"`
+	// LocalGroups is the number of local groups of a locally repairable code,
+	// the first LocalGroups parity shards are the local parities and the rest are global
+	LocalGroups int `json:"local_groups,omitempty"`
+}
+
+// StripeSize returns the size of the data of a full stripe
+func (p ErasureProfile) StripeSize() int64 {
+	return int64(p.DataShards) * p.ShardSize
+}
+
+// LocalGroup returns the local group of the data shard, the data shards are spread over the groups
+// and the first DataShards % LocalGroups groups have one more shard.
+// The version 1 layout groups them by ceil(DataShards / LocalGroups), it is kept for the objects it wrote
+func (p ErasureProfile) LocalGroup(shard int) int {
+	if p.Codec == CodecLRC && p.Version == 1 {
+		groupSize := (p.DataShards + p.LocalGroups - 1) / p.LocalGroups
+		return shard / groupSize
+	}
+	size, extra := p.DataShards/p.LocalGroups, p.DataShards%p.LocalGroups
+	if shard < extra*(size+1) {
+		return shard / (size + 1)
+	}
+	return extra + (shard-extra*(size+1))/size
+}
+
+// RepairShards returns the parity shards in the order they should be fetched to repair the data shard,
+// indexed after the data shards
+func (p ErasureProfile) RepairShards(shard int) []int {
+	shards := make([]int, 0, p.ParityShards)
+	if p.LocalGroups > 0 {
+		local := p.DataShards + p.LocalGroup(shard)
+		shards = append(shards, local)
+		for i := p.DataShards + p.LocalGroups; i < p.DataShards+p.ParityShards; i++ {
+			shards = append(shards, i)
+		}
+		for i := p.DataShards; i < p.DataShards+p.LocalGroups; i++ {
+			if i != local {
+				shards = append(shards, i)
+			}
+		}
+		return shards
+	}
+	for i := p.DataShards; i < p.DataShards+p.ParityShards; i++ {
+		shards = append(shards, i)
+	}
+	return shards
+}
+
+// Decodable reports whether the data shards can be rebuilt from the present shards,
+// indexed like the shards of RepairShards. Any DataShards shards decode a MDS code, but
+// the shards of a locally repairable code must cover every local group they repair.
+func (p ErasureProfile) Decodable(present []bool) bool {
+	count := 0
+	for i := 0; i < p.DataShards+p.ParityShards; i++ {
+		if i < len(present) && present[i] && (p.LocalGroups == 0 || i < p.DataShards || i >= p.DataShards+p.LocalGroups) {
+			count++
+		}
+	}
+	if p.LocalGroups == 0 {
+		return count >= p.DataShards
+	}
+	// a local group missing a single shard is repaired by its local parity
+	for g := 0; g < p.LocalGroups; g++ {
+		missing := 0
+		for i := 0; i < p.DataShards; i++ {
+			if p.LocalGroup(i) == g && !present[i] {
+				missing++
+			}
+		}
+		if missing == 1 && present[p.DataShards+g] {
+			count++
+		}
+	}
+	return count >= p.DataShards
+}
+
 type Divider interface {
-	CalcShardsNum(size int64) (dataShard int, parityShard int)
-	Encode(data []io.Reader, size int64, dataShards []*os.File, parityShards []*os.File) error
-	Verify(dataShards []*os.File, parityShards []*os.File) (bool, error)
-	Reconstruct(dataShards []*os.File, parityShards []*os.File, fill []*os.File) error
+	// Profile returns the stripe profile of codec, an empty codec is the default one
+	Profile(codec string) (ErasureProfile, error)
+	Encode(profile ErasureProfile, data []io.Reader, size int64, dataShards []*os.File, parityShards []*os.File) error
+	Verify(profile ErasureProfile, dataShards []*os.File, parityShards []*os.File) (bool, error)
+	Reconstruct(profile ErasureProfile, dataShards []*os.File, parityShards []*os.File, fill []*os.File) error
+	// Join write size bytes of the data of a stripe to dst
+	Join(profile ErasureProfile, dst io.Writer, dataShards []*os.File, size int64) error
 }
@@ -0,0 +1,97 @@
+package control_test
+
+import (
+	"oss/internal/control"
+	"slices"
+	"testing"
+)
+
+var (
+	// lrcProfile has the local groups {0, 1, 2} and {3, 4}, the local parities 5 and 6 and the global parities 7 and 8
+	lrcProfile = control.ErasureProfile{Codec: control.CodecLRC, DataShards: 5, ParityShards: 4, LocalGroups: 2}
+	rsProfile  = control.ErasureProfile{Codec: control.CodecReedSolomon, DataShards: 4, ParityShards: 2}
+)
+
+// presentShards returns the present flags of n shards where the given shards are present
+func presentShards(n int, shards ...int) []bool {
+	present := make([]bool, n)
+	for _, i := range shards {
+		present[i] = true
+	}
+	return present
+}
+
+func TestErasureProfileLocalGroup(t *testing.T) {
+	cases := []struct {
+		name    string
+		profile control.ErasureProfile
+		want    []int
+	}{
+		{name: "even groups", profile: control.ErasureProfile{Codec: control.CodecLRC, DataShards: 6, LocalGroups: 3}, want: []int{0, 0, 1, 1, 2, 2}},
+		{name: "first group larger", profile: lrcProfile, want: []int{0, 0, 0, 1, 1}},
+		{name: "groups of one", profile: control.ErasureProfile{Codec: control.CodecLRC, DataShards: 5, LocalGroups: 4}, want: []int{0, 0, 1, 2, 3}},
+		{name: "last groups smaller", profile: control.ErasureProfile{Codec: control.CodecLRC, DataShards: 7, LocalGroups: 3}, want: []int{0, 0, 0, 1, 1, 2, 2}},
+		{name: "version 1 layout", profile: control.ErasureProfile{Codec: control.CodecLRC, Version: 1, DataShards: 7, LocalGroups: 3}, want: []int{0, 0, 0, 1, 1, 1, 2}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := make([]int, tc.profile.DataShards)
+			for i := range got {
+				got[i] = tc.profile.LocalGroup(i)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Fatalf("local groups %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestErasureProfileRepairShards(t *testing.T) {
+	cases := []struct {
+		name    string
+		profile control.ErasureProfile
+		shard   int
+		want    []int
+	}{
+		{name: "rs", profile: rsProfile, shard: 1, want: []int{4, 5}},
+		{name: "lrc first group", profile: lrcProfile, shard: 0, want: []int{5, 7, 8, 6}},
+		{name: "lrc last shard of first group", profile: lrcProfile, shard: 2, want: []int{5, 7, 8, 6}},
+		{name: "lrc second group", profile: lrcProfile, shard: 4, want: []int{6, 7, 8, 5}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.profile.RepairShards(tc.shard); !slices.Equal(got, tc.want) {
+				t.Fatalf("RepairShards(%d) = %v, want %v", tc.shard, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestErasureProfileDecodable(t *testing.T) {
+	cases := []struct {
+		name    string
+		profile control.ErasureProfile
+		present []bool
+		want    bool
+	}{
+		{name: "rs all shards", profile: rsProfile, present: presentShards(6, 0, 1, 2, 3, 4, 5), want: true},
+		{name: "rs data shards", profile: rsProfile, present: presentShards(6, 0, 1, 2, 3), want: true},
+		{name: "rs any data shards number of shards", profile: rsProfile, present: presentShards(6, 0, 2, 4, 5), want: true},
+		{name: "rs too few shards", profile: rsProfile, present: presentShards(6, 0, 4, 5)},
+		{name: "lrc data shards", profile: lrcProfile, present: presentShards(9, 0, 1, 2, 3, 4), want: true},
+		{name: "lrc local repair", profile: lrcProfile, present: presentShards(9, 1, 2, 3, 4, 5), want: true},
+		{name: "lrc local parity of another group", profile: lrcProfile, present: presentShards(9, 1, 2, 3, 4, 6)},
+		{name: "lrc global repair without local parity", profile: lrcProfile, present: presentShards(9, 1, 2, 3, 4, 7), want: true},
+		{name: "lrc local parity of a group missing two shards", profile: lrcProfile, present: presentShards(9, 2, 3, 4, 5, 7)},
+		{name: "lrc global parities of a group missing two shards", profile: lrcProfile, present: presentShards(9, 2, 3, 4, 7, 8), want: true},
+		{name: "lrc local and global repair", profile: lrcProfile, present: presentShards(9, 1, 2, 4, 5, 7), want: true},
+		{name: "lrc local parities only", profile: lrcProfile, present: presentShards(9, 2, 3, 4, 5, 6, 7)},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.profile.Decodable(tc.present); got != tc.want {
+				t.Fatalf("Decodable(%v) = %v, want %v", tc.present, got, tc.want)
+			}
+		})
+	}
+}
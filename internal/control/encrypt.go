@@ -0,0 +1,215 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"oss/internal/utils"
+	"time"
+)
+
+const (
+	EncryptionAES256GCM = "AES256-GCM"
+
+	// stripeNonceSize is the random prefix of the frame nonces of a stripe, the frame index completes it
+	stripeNonceSize = 8
+)
+
+var (
+	ErrNoKeyRing           = errors.New("key ring is not configured")
+	ErrCustomerKeyRequired = errors.New("object is encrypted with a customer key")
+	ErrCustomerKeyMismatch = errors.New("customer key does not match")
+	ErrUnknownEncryption   = errors.New("unknown encryption algorithm")
+	ErrObjectNotEncrypted  = errors.New("object is not encrypted")
+)
+
+// dataKey is the unwrapped data key of an encrypted object
+type dataKey struct {
+	key       []byte
+	frameSize int
+}
+
+// newEncryption returns the encryption meta and the random data key of a new object, the data key
+// is wrapped by the customer key when one is given, by the current master key otherwise
+func (c *ctrl) newEncryption(customerKey []byte) (*EncryptionMeta, *dataKey, error) {
+	key, err := utils.RandomKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	encryption := &EncryptionMeta{Algorithm: EncryptionAES256GCM, FrameSize: c.opt.EncryptionFrameSize}
+	if err = c.wrapDataKey(encryption, key, customerKey); err != nil {
+		return nil, nil, err
+	}
+	return encryption, &dataKey{key: key, frameSize: encryption.FrameSize}, nil
+}
+
+// wrapDataKey wrap the data key into the encryption meta
+func (c *ctrl) wrapDataKey(encryption *EncryptionMeta, dataKey []byte, customerKey []byte) error {
+	if customerKey != nil {
+		wrapped, err := utils.Seal(customerKey, dataKey, nil)
+		if err != nil {
+			return err
+		}
+		sum := md5.Sum(customerKey)
+		encryption.KeyID, encryption.WrappedKey, encryption.CustomerKeyMD5 = "", wrapped, sum[:]
+		return nil
+	}
+	if c.opt.KeyRing == nil {
+		return ErrNoKeyRing
+	}
+	keyID, wrapped, err := c.opt.KeyRing.WrapKey(dataKey)
+	if err != nil {
+		return err
+	}
+	encryption.KeyID, encryption.WrappedKey, encryption.CustomerKeyMD5 = keyID, wrapped, nil
+	return nil
+}
+
+// unwrapDataKey returns the data key of the object, nil when the object is not encrypted
+func (c *ctrl) unwrapDataKey(encryption *EncryptionMeta, customerKey []byte) (*dataKey, error) {
+	if encryption == nil {
+		return nil, nil
+	}
+	if encryption.Algorithm != EncryptionAES256GCM || encryption.FrameSize <= 0 {
+		return nil, ErrUnknownEncryption
+	}
+	var (
+		key []byte
+		err error
+	)
+	if encryption.CustomerKeyMD5 != nil {
+		if customerKey == nil {
+			return nil, ErrCustomerKeyRequired
+		}
+		sum := md5.Sum(customerKey)
+		if !bytes.Equal(sum[:], encryption.CustomerKeyMD5) {
+			return nil, ErrCustomerKeyMismatch
+		}
+		key, err = utils.Open(customerKey, encryption.WrappedKey, nil)
+	} else if c.opt.KeyRing == nil {
+		return nil, ErrNoKeyRing
+	} else {
+		key, err = c.opt.KeyRing.UnwrapKey(encryption.KeyID, encryption.WrappedKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &dataKey{key: key, frameSize: encryption.FrameSize}, nil
+}
+
+// seal encrypt the data of a stripe in frames of frameSize bytes, every frame is authenticated
+// with its index and whether it is the last one so that frames can not be reordered or dropped
+func (k *dataKey) seal(data []byte) (nonce []byte, sealed []byte, err error) {
+	frameSize := k.frameSize
+	gcm, err := utils.NewGCM(k.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce = make([]byte, stripeNonceSize)
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	frames := (len(data) + frameSize - 1) / frameSize
+	sealed = make([]byte, 0, len(data)+frames*gcm.Overhead())
+	for i := 0; i < frames; i++ {
+		frame := data[i*frameSize : min((i+1)*frameSize, len(data))]
+		sealed = gcm.Seal(sealed, frameNonce(nonce, i), frame, frameAAD(i == frames-1))
+	}
+	return nonce, sealed, nil
+}
+
+// open decrypt the data of a stripe encrypted by seal
+func (k *dataKey) open(nonce []byte, sealed []byte) ([]byte, error) {
+	gcm, err := utils.NewGCM(k.key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != stripeNonceSize {
+		return nil, utils.ErrDecryptFailed
+	}
+	sealedFrameSize := k.frameSize + gcm.Overhead()
+	frames := (len(sealed) + sealedFrameSize - 1) / sealedFrameSize
+	data := make([]byte, 0, len(sealed))
+	for i := 0; i < frames; i++ {
+		frame := sealed[i*sealedFrameSize : min((i+1)*sealedFrameSize, len(sealed))]
+		if data, err = gcm.Open(data, frameNonce(nonce, i), frame, frameAAD(i == frames-1)); err != nil {
+			return nil, utils.ErrDecryptFailed
+		}
+	}
+	return data, nil
+}
+
+func frameNonce(prefix []byte, index int) []byte {
+	nonce := make([]byte, stripeNonceSize+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[stripeNonceSize:], uint32(index))
+	return nonce
+}
+
+func frameAAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// RotateObjectKey re-wrap the data key of the object without rewriting its content, with the current
+// master key, or with newCustomerKey when given. customerKey is the client key the object is encrypted with.
+func (c *ctrl) RotateObjectKey(ctx context.Context, bucketID int64, objectID int64, customerKey []byte, newCustomerKey []byte) (err error) {
+	entry := &AuditEntry{Operation: "RotateObjectKey", BucketID: bucketID, ObjectID: objectID}
+	defer c.audit(ctx, entry, time.Now(), &err)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	meta, err := c.objMeta.GetMeta(bucketID, objectID)
+	if err != nil {
+		return err
+	}
+	entry.Key = meta.Name
+	if err = c.authorize(ctx, bucketID, ActionRotateKey, meta.Name); err != nil {
+		return err
+	}
+	if meta.Encryption == nil {
+		return ErrObjectNotEncrypted
+	}
+	key, err := c.unwrapDataKey(meta.Encryption, customerKey)
+	if err != nil {
+		return err
+	}
+	if err = c.wrapDataKey(meta.Encryption, key.key, newCustomerKey); err != nil {
+		return err
+	}
+	return c.objMeta.UpdateMeta(meta)
+}
+
+// RotateBucketKeys re-wrap with the current master key the data keys of the objects of the bucket
+// wrapped by an older one, it returns the number of the rotated objects
+func (c *ctrl) RotateBucketKeys(ctx context.Context, bucketID int64) (_ int, err error) {
+	defer c.audit(ctx, &AuditEntry{Operation: "RotateBucketKeys", BucketID: bucketID}, time.Now(), &err)
+	if c.opt.KeyRing == nil {
+		return 0, ErrNoKeyRing
+	}
+	// every object is authorized as it is rotated
+	if err := c.authorize(ctx, bucketID, ActionListBucket, ""); err != nil {
+		return 0, err
+	}
+	metas, err := c.objMeta.GetMetaList(bucketID)
+	if err != nil {
+		return 0, err
+	}
+	current := c.opt.KeyRing.CurrentKeyID()
+	rotated := 0
+	for _, meta := range metas {
+		if meta.Encryption == nil || meta.Encryption.KeyID == "" || meta.Encryption.KeyID == current {
+			continue
+		}
+		if err = c.RotateObjectKey(ctx, bucketID, meta.ID, nil, nil); err != nil {
+			return rotated, err
+		}
+		rotated++
+	}
+	return rotated, nil
+}
@@ -0,0 +1,203 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"oss/internal/utils"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrNotEnoughShards = errors.New("not enough shards to reconstruct object")
+)
+
+type shardFetch struct {
+	idx  int
+	file *os.File
+	err  error
+	cost time.Duration
+}
+
+// fetchShards download shards until the arrived ones decode the data shards.
+// metas and peers are indexed by shard, data shards first and parity shards after.
+// Data shards are fetched first, a fetch slower than the hedge delay is hedged to
+// another replica of the same shard or to a parity shard in the repair order of the
+// profile, and the leftover fetches are cancelled once enough shards arrived.
+// The returned slice holds nil for every shard that was not fetched.
+func (c *ctrl) fetchShards(ctx context.Context, temp *tempOp, profile ErasureProfile, metas []BlockMeta, peers [][]Operator) ([]*os.File, error) {
+	n, dataShardNum := len(metas), profile.DataShards
+	attempts := 0
+	for i := range peers {
+		attempts += len(peers[i])
+	}
+
+	var (
+		shards   = make([]*os.File, n)
+		tried    = make([]int, n)
+		inflight = make([]int, n)
+		started  = make([]bool, n)
+		present  = make([]bool, n)
+		got      = 0
+		running  = 0
+
+		// buffered by attempts so that leftover fetches and timers never block
+		results = make(chan shardFetch, attempts)
+		hedges  = make(chan int, attempts)
+	)
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		cancel()
+		// collect the fetches still running and drop their files
+		go func(running int) {
+			for ; running > 0; running-- {
+				if r := <-results; r.file != nil {
+					discardFile(r.file)
+				}
+			}
+		}(running)
+	}()
+
+	// launch fetch shard i from its next untried replica
+	launch := func(i int) bool {
+		if tried[i] >= len(peers[i]) {
+			return false
+		}
+		op := peers[i][tried[i]]
+		tried[i]++
+		inflight[i]++
+		running++
+		started[i] = true
+		go c.fetchShard(ctx, temp, i, op, metas[i], results)
+		time.AfterFunc(c.hedgeDelay(), func() {
+			hedges <- i
+		})
+		return true
+	}
+	// startRepair launch the first parity shard in the repair order of shard i that has not been started yet
+	startRepair := func(i int) bool {
+		if i >= dataShardNum {
+			i = 0
+		}
+		for _, j := range profile.RepairShards(i) {
+			if !started[j] && launch(j) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for i := 0; i < dataShardNum; i++ {
+		if !launch(i) {
+			startRepair(i)
+		}
+	}
+	for got < dataShardNum || !profile.Decodable(present) {
+		if running == 0 {
+			// the arrived shards do not decode, fetch the missing ones
+			for i := range shards {
+				if shards[i] == nil {
+					launch(i)
+				}
+			}
+		}
+		if running == 0 {
+			discardFiles(shards)
+			return nil, ErrNotEnoughShards
+		}
+		select {
+		case r := <-results:
+			running--
+			inflight[r.idx]--
+			// a slow failing peer delays the download as much as a slow one, it raises the hedge delay too
+			c.latency.Observe(r.cost)
+			if r.err != nil {
+				if shards[r.idx] == nil && inflight[r.idx] == 0 && !launch(r.idx) {
+					startRepair(r.idx)
+				}
+				continue
+			}
+			if shards[r.idx] != nil {
+				// lost the race against a hedged fetch of the same shard
+				discardFile(r.file)
+				continue
+			}
+			shards[r.idx] = r.file
+			present[r.idx] = true
+			got++
+		case i := <-hedges:
+			if shards[i] != nil || inflight[i] == 0 {
+				continue
+			}
+			if !launch(i) {
+				startRepair(i)
+			}
+		case <-ctx.Done():
+			discardFiles(shards)
+			return nil, ctx.Err()
+		}
+	}
+	return shards, nil
+}
+
+func (c *ctrl) fetchShard(ctx context.Context, temp *tempOp, idx int, op Operator, meta BlockMeta, results chan<- shardFetch) {
+	start := time.Now()
+	file, err := downloadShard(ctx, temp, idx, op, meta)
+	cost := time.Since(start)
+	// the fetches left running are canceled once enough shards arrived, they are not failures of the peer
+	if ctx.Err() == nil {
+		c.observeShardFetch(op, cost, err)
+	}
+	results <- shardFetch{idx: idx, file: file, err: err, cost: cost}
+}
+
+func downloadShard(ctx context.Context, temp *tempOp, idx int, op Operator, meta BlockMeta) (*os.File, error) {
+	reader, err := op.DownloadBlock(ctx, meta)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := reader.(io.Closer); ok {
+		defer c.Close()
+	}
+	// a corrupt shard fails at EOF and is treated as missing
+	verified, err := NewBlockChecksumReader(utils.NewContextReader(ctx, reader), meta)
+	if err != nil {
+		return nil, err
+	}
+	file, err := temp.Create(strconv.Itoa(idx) + sourceSuffix)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(file, verified); err != nil {
+		discardFile(file)
+		return nil, err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		discardFile(file)
+		return nil, err
+	}
+	return file, nil
+}
+
+// hedgeDelay returns how long a fetch may run before it is hedged
+func (c *ctrl) hedgeDelay() time.Duration {
+	if d, ok := c.latency.Percentile(c.opt.HedgePercentile); ok {
+		return d
+	}
+	return c.opt.HedgeDelay
+}
+
+func discardFile(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+func discardFiles(files []*os.File) {
+	for _, f := range files {
+		if f != nil {
+			discardFile(f)
+		}
+	}
+}
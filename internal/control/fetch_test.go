@@ -0,0 +1,429 @@
+package control_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"oss/internal/control"
+	"oss/internal/divider"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testShardSize is the shard size of the stripes of the tests
+const testShardSize = 64 * 1024
+
+var errBlockMissing = errors.New("block is missing")
+
+// memOperator keep the blocks in memory, every shard of a test is stored on it
+type memOperator struct {
+	control.Operator
+	sync.Mutex
+	blocks map[int64][]byte
+	// fail is returned by the uploads once the block is stored
+	fail error
+	// slow are the blocks whose download hangs until it is canceled
+	slow     map[int64]bool
+	canceled atomic.Int32
+	// open is the number of the downloaded blocks whose reader is not closed
+	open atomic.Int32
+}
+
+// memReader read a downloaded block, it is open until closed
+type memReader struct {
+	*bytes.Reader
+	open *atomic.Int32
+	once sync.Once
+}
+
+func (r *memReader) Close() error {
+	r.once.Do(func() { r.open.Add(-1) })
+	return nil
+}
+
+func (o *memOperator) UploadBlock(ctx context.Context, meta *control.BlockMeta, data io.Reader) error {
+	block, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	o.Lock()
+	defer o.Unlock()
+	o.blocks[meta.ID] = block
+	return o.fail
+}
+
+func (o *memOperator) DownloadBlock(ctx context.Context, meta control.BlockMeta) (io.Reader, error) {
+	o.Lock()
+	block, ok := o.blocks[meta.ID]
+	slow := o.slow[meta.ID]
+	o.Unlock()
+	if slow {
+		select {
+		case <-ctx.Done():
+			o.canceled.Add(1)
+			return nil, ctx.Err()
+		case <-time.After(5 * time.Second):
+			return nil, errBlockMissing
+		}
+	}
+	if !ok {
+		return nil, errBlockMissing
+	}
+	o.open.Add(1)
+	return &memReader{Reader: bytes.NewReader(block), open: &o.open}, nil
+}
+
+func (o *memOperator) DeleteBlock(ctx context.Context, meta control.BlockMeta) error {
+	o.remove(meta.ID)
+	return nil
+}
+
+func (o *memOperator) remove(id int64) {
+	o.Lock()
+	defer o.Unlock()
+	delete(o.blocks, id)
+}
+
+func (o *memOperator) count() int {
+	o.Lock()
+	defer o.Unlock()
+	return len(o.blocks)
+}
+
+func (o *memOperator) Addr() string {
+	return "mem"
+}
+
+func (o *memOperator) NID() int64 {
+	return 1
+}
+
+type memPeer struct {
+	control.Peer
+	op *memOperator
+	// replicas are picked after op for every block
+	replicas []*memOperator
+}
+
+func (p *memPeer) PickByBlock(bucketID, objectID int64, block *os.File) ([]control.Operator, error) {
+	ops := []control.Operator{p.op}
+	for _, op := range p.replicas {
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+func (p *memPeer) PickByStripe(stripe *control.StripeMeta) ([][]control.Operator, [][]control.Operator, error) {
+	dataShardPeer := make([][]control.Operator, len(stripe.DataShardsMeta))
+	for i := range dataShardPeer {
+		dataShardPeer[i] = []control.Operator{p.op}
+	}
+	parityShardPeer := make([][]control.Operator, len(stripe.ParityShardsMeta))
+	for i := range parityShardPeer {
+		parityShardPeer[i] = []control.Operator{p.op}
+	}
+	return dataShardPeer, parityShardPeer, nil
+}
+
+func (p *memPeer) GetNID() int64 {
+	return 1
+}
+
+func (p *memPeer) GetAddr() string {
+	return "mem"
+}
+
+type memObjectMeta struct {
+	control.ObjectMetaRepo
+	sync.Mutex
+	metas map[int64]*control.ObjectMeta
+}
+
+func (r *memObjectMeta) StoreMeta(meta *control.ObjectMeta) error {
+	r.Lock()
+	defer r.Unlock()
+	r.metas[meta.ID] = meta
+	return nil
+}
+
+func (r *memObjectMeta) GetMeta(bucketID int64, objectID int64) (*control.ObjectMeta, error) {
+	r.Lock()
+	defer r.Unlock()
+	meta, ok := r.metas[objectID]
+	if !ok {
+		return nil, errors.New("object not found")
+	}
+	return meta, nil
+}
+
+type memBucketMeta struct {
+	control.BucketMetaRepo
+	bucket *control.BucketMeta
+}
+
+func (r *memBucketMeta) GetBucketByID(id int64) (*control.BucketMeta, error) {
+	return r.bucket, nil
+}
+
+type sequence struct {
+	n atomic.Int64
+}
+
+func (s *sequence) GenerateID() int64 {
+	return s.n.Add(1)
+}
+
+// objectCtrl is the part of the ctrl the tests use
+type objectCtrl interface {
+	UploadObject(ctx context.Context, data []*os.File, name string, size int64, bucketID int64, objType control.ObjectType, opt ...control.UploadOption) (*control.Object, error)
+	DownloadObject(ctx context.Context, bucketID int64, objectID int64, opt ...control.DownloadOption) (*control.Object, error)
+}
+
+type testEnv struct {
+	ctrl    objectCtrl
+	op      *memOperator
+	peer    *memPeer
+	bucket  *control.BucketMeta
+	objects *memObjectMeta
+	// tmp is the temp dir of the ctrl
+	tmp string
+}
+
+func newTestEnv(t *testing.T, codec string, opt ...control.Option) *testEnv {
+	env := &testEnv{
+		op:      &memOperator{blocks: make(map[int64][]byte)},
+		bucket:  &control.BucketMeta{ID: 1, Codec: codec},
+		objects: &memObjectMeta{metas: make(map[int64]*control.ObjectMeta)},
+		tmp:     t.TempDir(),
+	}
+	env.peer = &memPeer{op: env.op}
+	env.ctrl = control.NewCtrl(env.tmp, &sequence{}, &sequence{}, nil, &memBucketMeta{bucket: env.bucket}, env.objects,
+		divider.NewDivider(divider.WithGeometry(5, 2, testShardSize)), env.peer, opt...)
+	return env
+}
+
+func (env *testEnv) upload(t *testing.T, data []byte) *control.Object {
+	obj, err := env.put(t, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
+
+// put upload the data with the options and returns the error of the upload
+func (env *testEnv) put(t *testing.T, data []byte, opt ...control.UploadOption) (*control.Object, error) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err = file.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	return env.ctrl.UploadObject(context.Background(), []*os.File{file}, "object", int64(len(data)), 1, control.ObjectTypeStreamOctet, opt...)
+}
+
+func (env *testEnv) download(objectID int64, opt ...control.DownloadOption) ([]byte, error) {
+	obj, err := env.ctrl.DownloadObject(context.Background(), 1, objectID, opt...)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	readers := make([]io.Reader, len(obj.Files))
+	for i := range obj.Files {
+		readers[i] = obj.Files[i]
+	}
+	return io.ReadAll(io.MultiReader(readers...))
+}
+
+func TestDownloadLRCWithMissingShards(t *testing.T) {
+	// stripes of 5 data shards in the local groups {0, 1, 2} and {3, 4}, the parity shards are the
+	// local parities of the groups followed by 2 global parities
+	data := make([]byte, 2*5*testShardSize+1000)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	cases := []struct {
+		name   string
+		data   []int
+		parity []int
+		err    error
+	}{
+		{name: "data shard and its local parity", data: []int{0}, parity: []int{0}},
+		{name: "two data shards of a group", data: []int{0, 1}},
+		{name: "a data shard of every group", data: []int{0, 3}},
+		{name: "data shards of a group and the local parity of the other", data: []int{3, 4}, parity: []int{0}},
+		{name: "two data shards of a group and the global parities", data: []int{0, 1}, parity: []int{2, 3}, err: control.ErrNotEnoughShards},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			env := newTestEnv(t, control.CodecLRC)
+			obj := env.upload(t, data)
+			meta, err := env.objects.GetMeta(1, obj.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the shards are removed from every stripe
+			for _, stripe := range meta.StripesMeta() {
+				for _, i := range tc.data {
+					env.op.remove(stripe.DataShardsMeta[i].ID)
+				}
+				for _, i := range tc.parity {
+					env.op.remove(stripe.ParityShardsMeta[i].ID)
+				}
+			}
+			got, err := env.download(obj.ID)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("download error %v, want %v", err, tc.err)
+			}
+			if tc.err == nil && (len(got) < len(data) || !bytes.Equal(got[:len(data)], data)) {
+				t.Fatal("downloaded data does not match")
+			}
+		})
+	}
+}
+
+func TestDownloadLRCWithUnevenGroups(t *testing.T) {
+	// 5 data shards in 4 local groups {0, 1}, {2}, {3} and {4}, the parity shards are the 4 local parities
+	// followed by 2 global parities
+	data := make([]byte, 2*5*testShardSize+1000)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	cases := []struct {
+		name   string
+		data   []int
+		parity []int
+		err    error
+	}{
+		{name: "shard of a group of one", data: []int{4}},
+		{name: "a data shard of every group", data: []int{0, 2, 3, 4}},
+		{name: "a group and its local parity", data: []int{2}, parity: []int{1}},
+		{name: "two data shards of a group and the global parities", data: []int{0, 1}, parity: []int{4, 5}, err: control.ErrNotEnoughShards},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			env := newTestEnv(t, control.CodecLRC)
+			env.ctrl = control.NewCtrl(env.tmp, &sequence{}, &sequence{}, nil, &memBucketMeta{bucket: env.bucket}, env.objects,
+				divider.NewDivider(divider.WithGeometry(5, 2, testShardSize), divider.WithLocalGroups(4, 2)), env.peer)
+			obj := env.upload(t, data)
+			meta, err := env.objects.GetMeta(1, obj.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta.Erasure.LocalGroups != 4 {
+				t.Fatalf("stored %d local groups, want 4", meta.Erasure.LocalGroups)
+			}
+			for _, stripe := range meta.StripesMeta() {
+				for _, i := range tc.data {
+					env.op.remove(stripe.DataShardsMeta[i].ID)
+				}
+				for _, i := range tc.parity {
+					env.op.remove(stripe.ParityShardsMeta[i].ID)
+				}
+			}
+			got, err := env.download(obj.ID)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("download error %v, want %v", err, tc.err)
+			}
+			if tc.err == nil && (len(got) < len(data) || !bytes.Equal(got[:len(data)], data)) {
+				t.Fatal("downloaded data does not match")
+			}
+		})
+	}
+}
+
+func TestDownloadClosesShardReaders(t *testing.T) {
+	data := make([]byte, 2*5*testShardSize)
+	rand.New(rand.NewSource(1)).Read(data)
+	env := newTestEnv(t, control.CodecReedSolomon)
+	obj := env.upload(t, data)
+	meta, err := env.objects.GetMeta(1, obj.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the corrupted shards fail their checksum and are rebuilt from the parities
+	env.op.Lock()
+	for _, stripe := range meta.StripesMeta() {
+		env.op.blocks[stripe.DataShardsMeta[0].ID][0]++
+	}
+	env.op.Unlock()
+
+	got, err := env.download(obj.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[:len(data)], data) {
+		t.Fatal("downloaded data does not match")
+	}
+	if n := env.op.open.Load(); n != 0 {
+		t.Fatalf("%d shard readers not closed", n)
+	}
+}
+
+func TestDownloadHedgesSlowShard(t *testing.T) {
+	data := make([]byte, 2*5*testShardSize)
+	rand.New(rand.NewSource(1)).Read(data)
+	env := newTestEnv(t, control.CodecReedSolomon, control.WithHedge(0.95, 10*time.Millisecond))
+	obj := env.upload(t, data)
+	meta, err := env.objects.GetMeta(1, obj.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first data shard of every stripe hangs, it is hedged to a parity shard
+	stripes := meta.StripesMeta()
+	env.op.slow = make(map[int64]bool)
+	for _, stripe := range stripes {
+		env.op.slow[stripe.DataShardsMeta[0].ID] = true
+	}
+
+	start := time.Now()
+	got, err := env.download(obj.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[:len(data)], data) {
+		t.Fatal("downloaded data does not match")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("download took %v, the slow shards were not hedged", elapsed)
+	}
+	// the hanging fetches are canceled once the stripes decode
+	deadline := time.Now().Add(time.Second)
+	for int(env.op.canceled.Load()) != len(stripes) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d slow fetches canceled, want %d", env.op.canceled.Load(), len(stripes))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCanceledContext(t *testing.T) {
+	data := make([]byte, 5*testShardSize)
+	rand.New(rand.NewSource(1)).Read(data)
+	env := newTestEnv(t, control.CodecReedSolomon)
+	obj := env.upload(t, data)
+	blocks := env.op.count()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := env.ctrl.DownloadObject(ctx, 1, obj.ID); !errors.Is(err, context.Canceled) {
+		t.Fatalf("download error %v, want context canceled", err)
+	}
+	file := objectFile(t, data)
+	defer file.Close()
+	if _, err := env.ctrl.UploadObject(ctx, []*os.File{file}, "other", int64(len(data)), 1, control.ObjectTypeStreamOctet); !errors.Is(err, context.Canceled) {
+		t.Fatalf("upload error %v, want context canceled", err)
+	}
+	// the canceled upload leaves no block
+	if got := env.op.count(); got != blocks {
+		t.Fatalf("%d blocks after the canceled upload, want %d", got, blocks)
+	}
+}
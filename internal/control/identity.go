@@ -0,0 +1,23 @@
+package control
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+)
+
+var (
+	ErrNoNodeID      = errors.New("certificate has no node id")
+	ErrUnknownNode   = errors.New("node is not a member of the cluster")
+	ErrNodeIDInvalid = errors.New("certificate is not issued to the node")
+)
+
+// NodeIdentity is the certificate of the node and the CA of the cluster, the peers authenticate each other with mTLS
+type NodeIdentity interface {
+	// ServerTLSConfig returns the tls config of the peer server, the clients must present a node certificate
+	ServerTLSConfig() *tls.Config
+	// ClientTLSConfig returns the tls config dialing the peer server of the node nid
+	ClientTLSConfig(nid int64) *tls.Config
+	// NodeID returns the NID the verified certificate is issued to
+	NodeID(cert *x509.Certificate) (int64, error)
+}
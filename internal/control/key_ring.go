@@ -0,0 +1,17 @@
+package control
+
+import "errors"
+
+var (
+	ErrKeyNotFound = errors.New("master key not found")
+)
+
+// KeyRing hold the master keys wrapping the data keys of the encrypted objects
+type KeyRing interface {
+	// CurrentKeyID returns the id of the master key wrapping the new data keys
+	CurrentKeyID() string
+	// WrapKey encrypt the data key with the current master key
+	WrapKey(dataKey []byte) (keyID string, wrapped []byte, err error)
+	// UnwrapKey decrypt a data key wrapped by the master key of keyID
+	UnwrapKey(keyID string, wrapped []byte) ([]byte, error)
+}
@@ -0,0 +1,55 @@
+package control
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// minLatencySamples is the number of samples needed before percentiles are trusted
+const minLatencySamples = 16
+
+// latencyWindow keeps the most recent shard fetch latencies
+type latencyWindow struct {
+	sync.Mutex
+	samples []time.Duration
+	next    int
+	full    bool
+}
+
+func newLatencyWindow(size int) *latencyWindow {
+	return &latencyWindow{samples: make([]time.Duration, size)}
+}
+
+func (w *latencyWindow) Observe(d time.Duration) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % len(w.samples)
+	if w.next == 0 {
+		w.full = true
+	}
+}
+
+// Percentile returns the p-th percentile of the observed latencies,
+// ok is false if there are not enough samples yet
+func (w *latencyWindow) Percentile(p float64) (d time.Duration, ok bool) {
+	w.Lock()
+	n := w.next
+	if w.full {
+		n = len(w.samples)
+	}
+	if n < minLatencySamples {
+		w.Unlock()
+		return 0, false
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, w.samples[:n])
+	w.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	return sorted[int(p*float64(n-1))], true
+}
@@ -0,0 +1,92 @@
+package control
+
+import (
+	"path"
+	"strconv"
+	"time"
+)
+
+// Metrics observe the operations of the ctrl and of the peer server
+type Metrics interface {
+	// ObserveOperation observe an entry point or a peer rpc ended with result, received and sent are the bytes of
+	// the content it moved
+	ObserveOperation(operation string, result string, latency time.Duration, received int64, sent int64)
+	// ObserveShardFetch observe a shard fetched from the peer, err is the failure of the fetch
+	ObserveShardFetch(peer string, latency time.Duration, err error)
+	// ObserveReconstruction observe the reconstruction of the missing data shards of a stripe
+	ObserveReconstruction(codec string, shards int, err error)
+	// ObserveCoding observe the encoding or the decoding of size bytes of a stripe, a decoding is the reconstruction
+	// of the missing data shards, if any, and the join of the data shards
+	ObserveCoding(codec string, encode bool, size int64, cost time.Duration)
+}
+
+// TempReporter is implemented by the ctrl, it reports the usage of its temp dir
+type TempReporter interface {
+	TempUsage() TempUsage
+}
+
+// TempUsage is the usage of the temp dir
+type TempUsage struct {
+	// Used is the bytes reserved by the running operations
+	Used int64
+	// Orphan is the bytes of the temp dirs left by the crashed operations
+	Orphan int64
+	// Quota is the max bytes of the temp dir, 0 means unlimited
+	Quota int64
+}
+
+// TempUsage returns the usage of the temp dir
+func (c *ctrl) TempUsage() TempUsage {
+	c.temp.Lock()
+	defer c.temp.Unlock()
+	return TempUsage{Used: c.temp.used, Orphan: c.temp.orphan, Quota: c.temp.quota}
+}
+
+// transferred returns the bytes received and sent by the operation, a peer rpc is named after its method
+func transferred(operation string, bytes int64) (received int64, sent int64) {
+	switch path.Base(operation) {
+	case "UploadObject", "UploadBlock", string(ActionPutObject):
+		return bytes, 0
+	case "DownloadObject", "DownloadBlock", "FetchBlock", string(ActionGetObject):
+		return 0, bytes
+	}
+	return 0, 0
+}
+
+// observe observe the operation of the entry, it is completed by the audit
+func (c *ctrl) observe(entry *AuditEntry, latency time.Duration) {
+	if c.opt.Metrics == nil {
+		return
+	}
+	received, sent := transferred(entry.Operation, entry.Bytes)
+	c.opt.Metrics.ObserveOperation(entry.Operation, entry.Result, latency, received, sent)
+}
+
+func (c *ctrl) observeShardFetch(op Operator, latency time.Duration, err error) {
+	if c.opt.Metrics == nil {
+		return
+	}
+	c.opt.Metrics.ObserveShardFetch(strconv.FormatInt(op.NID(), 10), latency, err)
+}
+
+func (c *ctrl) observeReconstruction(profile ErasureProfile, shards int, err error) {
+	if c.opt.Metrics == nil {
+		return
+	}
+	c.opt.Metrics.ObserveReconstruction(profile.Codec, shards, err)
+}
+
+// observeDecode observe the decoding of a stripe, the reconstruction of its missing shards and the join
+func (c *ctrl) observeDecode(profile ErasureProfile, size int64, start time.Time, err error) {
+	if c.opt.Metrics == nil || err != nil {
+		return
+	}
+	c.opt.Metrics.ObserveCoding(profile.Codec, false, size, time.Since(start))
+}
+
+func (c *ctrl) observeEncode(profile ErasureProfile, size int64, start time.Time, err error) {
+	if c.opt.Metrics == nil || err != nil {
+		return
+	}
+	c.opt.Metrics.ObserveCoding(profile.Codec, true, size, time.Since(start))
+}
@@ -0,0 +1,91 @@
+package control_test
+
+import (
+	"bufio"
+	"bytes"
+	"math/rand"
+	"net/http/httptest"
+	"oss/internal/control"
+	"oss/internal/metrics"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrape returns the samples served by the metrics, keyed by their name and their labels as exposed
+func scrape(t *testing.T, m *metrics.Metrics) map[string]float64 {
+	t.Helper()
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", metrics.Path, nil))
+	samples := make(map[string]float64)
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("sample %q: %v", line, err)
+		}
+		samples[line[:i]] = value
+	}
+	return samples
+}
+
+func TestMetricsOfUploadAndDownload(t *testing.T) {
+	data := make([]byte, 2*5*testShardSize+1000)
+	rand.New(rand.NewSource(1)).Read(data)
+	m := metrics.NewMetrics()
+	env := newTestEnv(t, control.CodecReedSolomon, control.WithMetrics(m))
+	m.WatchTemp(env.ctrl.(control.TempReporter))
+	obj := env.upload(t, data)
+	meta, err := env.objects.GetMeta(1, obj.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the lost shard is reconstructed from the parities
+	env.op.remove(meta.StripesMeta()[0].DataShardsMeta[0].ID)
+	got, err := env.download(obj.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded data does not match")
+	}
+
+	samples := scrape(t, m)
+	size := float64(len(data))
+	for series, want := range map[string]float64{
+		`oss_operations_total{operation="UploadObject",result="success"}`:             1,
+		`oss_operations_total{operation="DownloadObject",result="success"}`:           1,
+		`oss_operation_duration_seconds_count{operation="UploadObject"}`:              1,
+		`oss_operation_duration_seconds_bucket{operation="DownloadObject",le="+Inf"}`: 1,
+		`oss_received_bytes_total{operation="UploadObject"}`:                          size,
+		`oss_sent_bytes_total{operation="DownloadObject"}`:                            size,
+		`oss_shard_fetch_failures_total{peer="1"}`:                                    1,
+		`oss_reconstructions_total{codec="reedsolomon",result="success"}`:             1,
+		`oss_reconstructed_shards_total{codec="reedsolomon"}`:                         1,
+		`oss_temp_used_bytes`: 0,
+	} {
+		if got, ok := samples[series]; !ok || got != want {
+			t.Errorf("%s = %v, want %v", series, got, want)
+		}
+	}
+	// the samples of the shards and of the coding depend on the stripes
+	for _, series := range []string{
+		`oss_shard_fetches_total{peer="1"}`,
+		`oss_shard_fetch_duration_seconds_count{peer="1"}`,
+		`oss_erasure_coded_bytes_total{codec="reedsolomon",op="encode"}`,
+		`oss_erasure_coded_bytes_total{codec="reedsolomon",op="decode"}`,
+		`oss_erasure_coding_seconds_total{codec="reedsolomon",op="encode"}`,
+	} {
+		if samples[series] <= 0 {
+			t.Errorf("%s = %v, want > 0", series, samples[series])
+		}
+	}
+	if _, ok := samples[`go_goroutines`]; !ok {
+		t.Error("go collector not registered")
+	}
+}
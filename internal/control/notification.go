@@ -0,0 +1,265 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"oss/internal/event"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// TargetWebhook and TargetQueue are the kinds of the notification targets, a target is named by the ARN
+	// arn:oss:<kind>:::<name> and is registered to the notifier
+	TargetWebhook = "webhook"
+	TargetQueue   = "queue"
+
+	targetARNPrefix = "arn:oss:"
+
+	// EventFieldBucketID is the path of the bucket id in the JSON of an EventRecord, a subscriber of the events
+	// of a bucket filters them with event_bus.WithField(EventFieldBucketID, id)
+	EventFieldBucketID = "s3.bucket.id"
+
+	eventVersion = "2.1"
+	eventSource  = "oss:s3"
+)
+
+var (
+	ErrInvalidNotification = errors.New("invalid notification configuration")
+	ErrBucketNotEmpty      = errors.New("bucket is not empty")
+
+	targetNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+)
+
+// EventPublisher publish the events of the ctrl, the event bus is one
+type EventPublisher interface {
+	Publish(eventName string, data any) error
+}
+
+// NotificationConfig is the notification configuration of a bucket, every rule matching an event delivers it
+type NotificationConfig struct {
+	Rules []NotificationRule `json:"rules"`
+}
+
+// NotificationRule deliver the events of a type to the target, when the key has the prefix and the suffix
+type NotificationRule struct {
+	ID string `json:"id,omitempty"`
+	// Events are the event types, s3:ObjectCreated:* matches every object creation
+	Events []string `json:"events"`
+	Prefix string   `json:"prefix,omitempty"`
+	Suffix string   `json:"suffix,omitempty"`
+	// Target is the ARN of the target
+	Target string `json:"target"`
+}
+
+// Match reports whether the event of the key is delivered by the rule
+func (r *NotificationRule) Match(eventName string, key string) bool {
+	if !strings.HasPrefix(key, r.Prefix) || !strings.HasSuffix(key, r.Suffix) {
+		return false
+	}
+	for _, pattern := range r.Events {
+		if wildcardMatch(pattern, eventName) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateNotification check the event types and the targets of the rules
+func ValidateNotification(config *NotificationConfig) error {
+	for _, rule := range config.Rules {
+		if len(rule.Events) == 0 {
+			return ErrInvalidNotification
+		}
+		for _, eventName := range rule.Events {
+			if !strings.HasPrefix(eventName, "s3:") || strings.Count(eventName, ":") != 2 {
+				return ErrInvalidNotification
+			}
+		}
+		if _, _, err := ParseTargetARN(rule.Target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TargetARN returns the ARN of the target of the kind and of the name
+func TargetARN(kind string, name string) string {
+	return targetARNPrefix + kind + ":::" + name
+}
+
+// ParseTargetARN returns the kind and the name of the target of arn
+func ParseTargetARN(arn string) (kind string, name string, err error) {
+	rest, ok := strings.CutPrefix(arn, targetARNPrefix)
+	if !ok {
+		return "", "", ErrInvalidNotification
+	}
+	kind, name, ok = strings.Cut(rest, ":::")
+	if !ok || kind != TargetWebhook && kind != TargetQueue || !targetNamePattern.MatchString(name) {
+		return "", "", ErrInvalidNotification
+	}
+	return kind, name, nil
+}
+
+// EventMessage is the payload delivered to the targets, shaped as the S3 one
+type EventMessage struct {
+	Records []EventRecord `json:"Records"`
+}
+
+// EventRecord is an S3 event record, the event name has no s3: prefix and the key is url encoded as S3 does
+type EventRecord struct {
+	EventVersion      string            `json:"eventVersion"`
+	EventSource       string            `json:"eventSource"`
+	AwsRegion         string            `json:"awsRegion"`
+	EventTime         string            `json:"eventTime"`
+	EventName         string            `json:"eventName"`
+	UserIdentity      EventIdentity     `json:"userIdentity"`
+	RequestParameters map[string]string `json:"requestParameters"`
+	S3                EventS3           `json:"s3"`
+}
+
+type EventIdentity struct {
+	PrincipalID string `json:"principalId"`
+}
+
+type EventS3 struct {
+	SchemaVersion   string      `json:"s3SchemaVersion"`
+	ConfigurationID string      `json:"configurationId"`
+	Bucket          EventBucket `json:"bucket"`
+	Object          EventObject `json:"object"`
+}
+
+type EventBucket struct {
+	Name          string        `json:"name"`
+	OwnerIdentity EventIdentity `json:"ownerIdentity"`
+	ARN           string        `json:"arn"`
+	// ID is not in the S3 record, it is the id of the bucket
+	ID int64 `json:"id"`
+}
+
+type EventObject struct {
+	Key  string `json:"key,omitempty"`
+	Size int64  `json:"size,omitempty"`
+	ETag string `json:"eTag,omitempty"`
+	// Sequencer order the events of a key, it is the hex id of the object
+	Sequencer string `json:"sequencer,omitempty"`
+	// ID is not in the S3 record, it is the id of the object
+	ID int64 `json:"id,omitempty"`
+}
+
+// Name returns the event name of the record with its s3: prefix, the one the rules match
+func (r *EventRecord) Name() string {
+	return "s3:" + r.EventName
+}
+
+// Key returns the decoded key of the object of the record
+func (r *EventRecord) Key() string {
+	key, err := url.QueryUnescape(r.S3.Object.Key)
+	if err != nil {
+		return r.S3.Object.Key
+	}
+	return key
+}
+
+// publish publish the event of the bucket, and of the object when meta is not nil, the subscribers of its type get it
+func (c *ctrl) publish(ctx context.Context, eventName string, bucket *BucketMeta, meta *ObjectMeta) {
+	if c.opt.EventPublisher == nil {
+		return
+	}
+	record := EventRecord{
+		EventVersion:      eventVersion,
+		EventSource:       eventSource,
+		EventTime:         time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+		EventName:         strings.TrimPrefix(eventName, "s3:"),
+		RequestParameters: map[string]string{},
+		S3: EventS3{
+			SchemaVersion: "1.0",
+			Bucket: EventBucket{
+				Name:          bucket.Name,
+				OwnerIdentity: EventIdentity{PrincipalID: strconv.FormatInt(bucket.OwnerID, 10)},
+				ARN:           resourcePrefix + bucket.Name,
+				ID:            bucket.ID,
+			},
+		},
+	}
+	if principal := PrincipalFromContext(ctx); principal != nil {
+		if !principal.Anonymous {
+			record.UserIdentity.PrincipalID = strconv.FormatInt(principal.UserID, 10)
+		}
+		record.RequestParameters["sourceIPAddress"] = principal.SourceIP
+	}
+	if meta != nil {
+		record.S3.Object = EventObject{
+			Key:       url.QueryEscape(meta.Name),
+			Size:      meta.Size,
+			ETag:      meta.ETag,
+			Sequencer: strings.ToUpper(strconv.FormatInt(meta.ID, 16)),
+			ID:        meta.ID,
+		}
+	}
+	// an event without subscriber is dropped
+	c.opt.EventPublisher.Publish(eventName, record)
+}
+
+// publishObject publish the event of the object
+func (c *ctrl) publishObject(ctx context.Context, eventName string, meta *ObjectMeta) {
+	if c.opt.EventPublisher == nil {
+		return
+	}
+	bucket, err := c.bucketMeta.GetBucketByID(meta.BucketID)
+	if err != nil {
+		return
+	}
+	c.publish(ctx, eventName, bucket, meta)
+}
+
+// CreateBucket create the bucket of the principal of ctx
+func (c *ctrl) CreateBucket(ctx context.Context, name string) (_ *BucketMeta, err error) {
+	entry := &AuditEntry{Operation: "CreateBucket", Bucket: name}
+	defer c.audit(ctx, entry, time.Now(), &err)
+	principal := PrincipalFromContext(ctx)
+	if principal != nil && principal.Anonymous {
+		return nil, ErrAccessDenied
+	}
+	var ownerID int64
+	if principal != nil {
+		ownerID = principal.UserID
+	}
+	bucket, err := c.bucketMeta.CreateBucket(name, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	c.publish(ctx, event.EventBucketCreatedPut, bucket, nil)
+	entry.BucketID = bucket.ID
+	return bucket, nil
+}
+
+// DeleteBucket delete the bucket, only an empty bucket is deleted
+func (c *ctrl) DeleteBucket(ctx context.Context, bucketID int64) (err error) {
+	entry := &AuditEntry{Operation: "DeleteBucket", BucketID: bucketID}
+	defer c.audit(ctx, entry, time.Now(), &err)
+	bucket, err := c.bucketMeta.GetBucketByID(bucketID)
+	if err != nil {
+		return err
+	}
+	// the name is kept as the bucket is gone once audited
+	entry.Bucket = bucket.Name
+	if err = c.check(ctx, bucket, AccessRequest{Action: ActionDeleteBucket}); err != nil {
+		return err
+	}
+	metas, err := c.objMeta.GetMetaList(bucketID)
+	if err != nil {
+		return err
+	}
+	if len(metas) > 0 {
+		return ErrBucketNotEmpty
+	}
+	if err = c.bucketMeta.DeleteBucket(bucketID); err != nil {
+		return err
+	}
+	c.publish(ctx, event.EventBucketRemovedDelete, bucket, nil)
+	return nil
+}
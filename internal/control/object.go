@@ -1,17 +1,25 @@
 package control
 
 import (
+	"context"
 	"io"
 	"os"
+	"oss/internal/event"
 	"oss/internal/utils"
-	"path/filepath"
-	"strconv"
-	"sync"
 	"time"
 )
 
 // UploadObject upload object to peer
-func (c *ctrl) UploadObject(data []*os.File, name string, size int64, bucketID int64, objType ObjectType) (*Object, error) {
+func (c *ctrl) UploadObject(ctx context.Context, data []*os.File, name string, size int64, bucketID int64, objType ObjectType, opt ...UploadOption) (_ *Object, err error) {
+	entry := &AuditEntry{Operation: "UploadObject", BucketID: bucketID, Key: name, Bytes: size}
+	defer c.audit(ctx, entry, time.Now(), &err)
+	uploadOpt := UploadOption{}
+	for _, o := range opt {
+		o.apply(&uploadOpt)
+	}
+	if err := c.authorize(ctx, bucketID, ActionPutObject, name); err != nil {
+		return nil, err
+	}
 	obj := &Object{
 		ID:        c.objectIDGenerator.GenerateID(),
 		Name:      name,
@@ -40,76 +48,101 @@ func (c *ctrl) UploadObject(data []*os.File, name string, size int64, bucketID i
 			NID:      c.peer.GetNID(),
 			Location: c.peer.GetAddr(),
 		},
-		DataShardsMeta:   make(map[int]BlockMeta),
-		ParityShardsMeta: make(map[int]BlockMeta),
+	}
+	if principal := PrincipalFromContext(ctx); principal != nil {
+		meta.OwnerID = principal.UserID
 	}
 
-	// generate object template files
-	dataShards, parityShards, err := c.generateObjectTemplateFiles(obj)
+	// the content is hashed as it streams
+	readers := make([]io.Reader, len(obj.Files))
+	for i := range obj.Files {
+		readers[i] = obj.Files[i]
+	}
+	hash := newContentHash()
+	reader := io.TeeReader(utils.NewContextReader(ctx, io.MultiReader(readers...)), hash)
+
+	policy, err := c.uploadPolicy(bucketID, objType, uploadOpt)
 	if err != nil {
 		return nil, err
 	}
+	meta.Encryption = policy.encryption
 
-	// pick a control to upload dataShards
-	dataShardsPeer, parityShardsPeer := make([][]Operator, len(dataShards)), make([][]Operator, len(parityShards))
-	for i := range dataShards {
-		peer, err := c.peer.PickByBlock(bucketID, obj.ID, dataShards[i])
-		if err != nil {
+	// the meta is not encrypted, an encrypted object is never inlined
+	if c.inline(size) && policy.encryption == nil {
+		// small object is stored inline in its meta instead of being erasure coded
+		meta.Inline = make([]byte, size)
+		// a short content is reported by the size check below
+		if _, err := io.ReadFull(reader, meta.Inline); err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
 			return nil, err
 		}
-		dataShardsPeer[i] = peer
-	}
+	} else {
+		meta.Erasure = policy.profile
+		meta.Compression = policy.compression
 
-	for i := range parityShards {
-		peer, err := c.peer.PickByBlock(bucketID, obj.ID, parityShards[i])
-		if err != nil {
-			return nil, err
-		}
-		parityShardsPeer[i] = peer
-	}
-	// upload dataShards and parityShards
-	for i := range dataShards {
-		blockMeta, err := c.generateBlockMeta(obj, dataShards[i], dataShardsPeer[i])
+		// the template files of a stripe are removed once the stripe is uploaded
+		op, err := c.temp.Begin(bucketID, obj.ID, shardsSize(policy.profile))
 		if err != nil {
 			return nil, err
 		}
-		for j := range dataShardsPeer[i] {
-			err = dataShardsPeer[i][j].UploadBlock(blockMeta, dataShards[i])
-			if err != nil {
-				return nil, err
-			}
+		defer op.Release()
+		if policy.dedup {
+			meta.Chunks, err = c.uploadChunks(ctx, op, obj, policy, io.LimitReader(reader, size))
+		} else {
+			meta.Stripes, err = c.uploadStripes(ctx, op, obj, policy, reader, size)
 		}
-		meta.DataShardsMeta[i] = *blockMeta
-	}
-	for i := range parityShards {
-		blockMeta, err := c.generateBlockMeta(obj, dataShards[i], dataShardsPeer[i])
 		if err != nil {
 			return nil, err
 		}
-		for j := range parityShardsPeer[i] {
-			err = parityShardsPeer[i][j].UploadBlock(blockMeta, parityShards[i])
-			if err != nil {
-				return nil, err
-			}
-		}
-		meta.ParityShardsMeta[i] = *blockMeta
 	}
 
+	// the files ending before size bytes leave the object short
+	if hash.size != size {
+		c.discardContent(ctx, meta)
+		return nil, ErrContentTooShort
+	}
+	// reject the content that does not match the digests given by the client
+	if err := hash.verify(uploadOpt.ContentMD5, uploadOpt.ContentSHA256); err != nil {
+		c.discardContent(ctx, meta)
+		return nil, err
+	}
+	meta.ETag, meta.SHA256 = hash.ETag(), hash.SHA256()
+	obj.ETag, obj.SHA256 = meta.ETag, meta.SHA256
+
 	// store object object
-	if err = c.objMeta.StoreMeta(meta); err != nil {
+	if err := c.objMeta.StoreMeta(meta); err != nil {
+		c.discardContent(ctx, meta)
 		return nil, err
 	}
+	c.publishObject(ctx, event.EventObjectCreatedPut, meta)
+	entry.ObjectID = obj.ID
 	return obj, nil
 }
 
 // DownloadObject download object from peer
-func (c *ctrl) DownloadObject(bucketID int64, objectID int64) (*Object, error) {
+func (c *ctrl) DownloadObject(ctx context.Context, bucketID int64, objectID int64, opt ...DownloadOption) (_ *Object, err error) {
+	entry := &AuditEntry{Operation: "DownloadObject", BucketID: bucketID, ObjectID: objectID}
+	defer c.audit(ctx, entry, time.Now(), &err)
+	downloadOpt := DownloadOption{}
+	for _, o := range opt {
+		o.apply(&downloadOpt)
+	}
 	meta, err := c.objMeta.GetMeta(bucketID, objectID)
 	if err != nil {
 		return nil, err
 	}
-	dataShardNum, parityShardNum := len(meta.DataShardsMeta), len(meta.ParityShardsMeta)
-	n := dataShardNum + parityShardNum
+	entry.Key = meta.Name
+	if err = c.authorize(ctx, bucketID, ActionGetObject, meta.Name); err != nil {
+		return nil, err
+	}
+	profile := meta.ErasureProfile()
+	start, end, err := downloadOpt.bounds(meta.Size)
+	if err != nil {
+		return nil, err
+	}
+	key, err := c.unwrapDataKey(meta.Encryption, downloadOpt.CustomerKey)
+	if err != nil {
+		return nil, err
+	}
 
 	object := &Object{
 		ID:        meta.ID,
@@ -121,97 +154,119 @@ func (c *ctrl) DownloadObject(bucketID int64, objectID int64) (*Object, error) {
 		BucketID:  meta.BucketID,
 		FilesNum:  meta.FilesNum,
 		Replicas:  meta.Replicas,
+		ETag:      meta.ETag,
+		SHA256:    meta.SHA256,
 	}
-	dir, err := c.getObjectTempDir(object)
+	// the chunks are decoded with their own profiles, the shards of the largest stripe are reserved
+	chunks, err := c.getChunks(meta.Chunks)
 	if err != nil {
 		return nil, err
 	}
-
-	// create source files
-	sourceFiles := make([]*os.File, n)
-	for i := range sourceFiles {
-		sourceFiles[i], err = os.CreateTemp(dir, strconv.Itoa(i)+sourceSuffix)
-		if err != nil {
-			return nil, err
+	reserved := shardsSize(profile)
+	for _, chunk := range chunks {
+		if size := shardsSize(chunk.Erasure); size > reserved {
+			reserved = size
 		}
 	}
-
-	fill := make([]*os.File, n)
-	dataShards := make([]*os.File, dataShardNum)
-	parityShards := make([]*os.File, parityShardNum)
-
-	// pick a control to download dataShards and parityShards
-	dataShardPeer, parityShardPeer, err := c.peer.PickByMeta(meta)
+	// the temp files back the returned object until it is closed
+	op, err := c.temp.Begin(bucketID, objectID, end-start+reserved)
 	if err != nil {
 		return nil, err
 	}
+	keep := false
+	defer func() {
+		if !keep {
+			op.Release()
+		}
+	}()
 
-	wg := sync.WaitGroup{}
-	wg.Add(n)
-	// download dataShards
-	for i := range dataShardPeer {
-		go func(i int) {
-			defer wg.Done()
-			for _, peers := range dataShardPeer[i] {
-				reader, err := peers.DownloadBlock(meta.DataShardsMeta[i])
-				if err != nil {
-					continue
-				}
-				_, err = io.Copy(sourceFiles[i], reader)
-				if err != nil {
-					continue
-				}
-				fill[i] = nil
-				dataShards[i] = sourceFiles[i]
-				return
-			}
-			fill[i] = sourceFiles[i]
-			dataShards[i] = nil
-		}(i)
-	}
-	// download parityShards
-	for i := range parityShardPeer {
-		go func(i int) {
-			defer wg.Done()
-			for _, peers := range parityShardPeer[i] {
-				reader, err := peers.DownloadBlock(meta.ParityShardsMeta[i])
-				if err != nil {
-					continue
-				}
-				_, err = io.Copy(sourceFiles[dataShardNum+i], reader)
-				if err != nil {
-					continue
-				}
-				fill[dataShardNum+i] = nil
-				parityShards[i] = sourceFiles[dataShardNum+i]
-				return
-			}
-			fill[dataShardNum+i] = sourceFiles[dataShardNum+i]
-			parityShards[i] = nil
-		}(i)
-	}
-
-	wg.Wait()
-
-	// verify and reconstruct
-	ok, err := c.divider.Verify(dataShards, parityShards)
+	// download and decode stripe by stripe
+	file, err := op.Create(sourceSuffix)
 	if err != nil {
 		return nil, err
 	}
-	if !ok {
-		err := c.divider.Reconstruct(dataShards, parityShards, fill)
-		if err != nil {
+	// the reconstructed content is hashed to verify it end to end
+	verify := downloadOpt.Verify && start == 0 && end == meta.Size
+	var dst io.Writer = file
+	hash := newContentHash()
+	if verify {
+		dst = io.MultiWriter(file, hash)
+	}
+	// the stripes and the chunks out of the range are not downloaded
+	w := &rangeWriter{w: dst, start: start, end: end}
+	if meta.Inline != nil {
+		if _, err = w.Write(meta.Inline); err != nil {
+			return nil, err
+		}
+	}
+	stripes := meta.StripesMeta()
+	for i := range stripes {
+		if w.skip(stripes[i].ContentSize()) {
+			continue
+		}
+		if err = c.downloadStripe(ctx, op, profile, &stripes[i], key, w); err != nil {
+			return nil, err
+		}
+	}
+	for i, ref := range meta.Chunks {
+		if w.skip(ref.Size) {
+			continue
+		}
+		if err = c.downloadChunk(ctx, op, chunks[i], w); err != nil {
 			return nil, err
 		}
 	}
+	if verify && !hash.match(meta) {
+		return nil, ErrObjectCorrupted
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
 
-	object.Files = sourceFiles[:dataShardNum]
+	object.Files = []*os.File{file}
+	object.temp = op
+	keep = true
+	entry.Bytes = end - start
 	return object, nil
 }
 
+// DeleteObject delete the object meta, then its blocks and its references to the shared chunks
+func (c *ctrl) DeleteObject(ctx context.Context, bucketID int64, objectID int64) (err error) {
+	entry := &AuditEntry{Operation: "DeleteObject", BucketID: bucketID, ObjectID: objectID}
+	defer c.audit(ctx, entry, time.Now(), &err)
+	meta, err := c.objMeta.GetMeta(bucketID, objectID)
+	if err != nil {
+		return err
+	}
+	entry.Key, entry.Bytes = meta.Name, meta.Size
+	if err = c.authorize(ctx, bucketID, ActionDeleteObject, meta.Name); err != nil {
+		return err
+	}
+	// an object replaced by a newer one of its name is removed without event
+	latest, err := c.objMeta.GetMetaByName(bucketID, meta.Name)
+	superseded := err == nil && latest.ID != objectID
+	// blocks left by a failure after the meta is deleted are only leaked, never dangling
+	if err = c.objMeta.DeleteMeta(bucketID, objectID); err != nil {
+		return err
+	}
+	c.discardContent(ctx, meta)
+	if !superseded {
+		c.publishObject(ctx, event.EventObjectRemovedDelete, meta)
+	}
+	return nil
+}
+
+// discardContent delete the stripes of the object and drop its references to chunks
+func (c *ctrl) discardContent(ctx context.Context, meta *ObjectMeta) {
+	c.deleteStripes(ctx, meta.StripesMeta())
+	c.releaseChunks(ctx, meta.Chunks)
+}
+
 // UploadBlock upload block to local disk
-func (c *ctrl) UploadBlock(meta BlockMeta, data io.Reader) error {
-	err := c.blockRepo.StoreBlock(meta, data)
+func (c *ctrl) UploadBlock(ctx context.Context, meta BlockMeta, data io.Reader) (err error) {
+	entry := &AuditEntry{Operation: "UploadBlock", BucketID: meta.BucketID, ObjectID: meta.ObjectID, Bytes: meta.Size}
+	defer c.audit(ctx, entry, time.Now(), &err)
+	err = c.blockRepo.StoreBlock(ctx, meta, data)
 	if err != nil {
 		return err
 	}
@@ -219,61 +274,119 @@ func (c *ctrl) UploadBlock(meta BlockMeta, data io.Reader) error {
 }
 
 // DownloadBlock download block from local disk
-func (c *ctrl) DownloadBlock(meta BlockMeta) (io.Reader, error) {
-	data, err := c.blockRepo.GetBlock(meta.BucketID, meta.ObjectID, meta.ID)
+func (c *ctrl) DownloadBlock(ctx context.Context, meta BlockMeta) (_ io.Reader, err error) {
+	entry := &AuditEntry{Operation: "DownloadBlock", BucketID: meta.BucketID, ObjectID: meta.ObjectID}
+	defer c.audit(ctx, entry, time.Now(), &err)
+	data, err := c.blockRepo.GetBlock(ctx, meta.BucketID, meta.ObjectID, meta.ID)
 	if err != nil {
 		return nil, err
 	}
 	return data, nil
 }
 
-func (c *ctrl) generateObjectTemplateFiles(object *Object) (dataShards []*os.File, parityShards []*os.File, err error) {
-	// create temp dir
-	dir, err := c.getObjectTempDir(object)
+// DeleteBlock delete block from local disk
+func (c *ctrl) DeleteBlock(ctx context.Context, meta BlockMeta) (err error) {
+	entry := &AuditEntry{Operation: "DeleteBlock", BucketID: meta.BucketID, ObjectID: meta.ObjectID}
+	defer c.audit(ctx, entry, time.Now(), &err)
+	return c.blockRepo.DeleteBlock(ctx, meta.BucketID, meta.ObjectID, meta.ID)
+}
+
+// FetchBlock download the block from the other peers holding a replica of it
+func (c *ctrl) FetchBlock(ctx context.Context, meta BlockMeta) (_ io.Reader, err error) {
+	entry := &AuditEntry{Operation: "FetchBlock", BucketID: meta.BucketID, ObjectID: meta.ObjectID, Bytes: meta.Size}
+	defer c.audit(ctx, entry, time.Now(), &err)
+	peers, err := c.peer.Discover()
 	if err != nil {
-		return nil, nil, err
-	}
-	// fill dataShards and parityShards
-	dataShard, parityShard := c.divider.CalcShardsNum(object.Size)
-	dataShards = make([]*os.File, dataShard)
-	parityShards = make([]*os.File, parityShard)
-	for i := 0; i < dataShard; i++ {
-		dataShards[i], err = os.CreateTemp(dir, strconv.Itoa(i)+dataSuffix)
-		if err != nil {
-			return nil, nil, err
-		}
+		return nil, err
 	}
-	for i := 0; i < parityShard; i++ {
-		parityShards[i], err = os.CreateTemp(dir, strconv.Itoa(i)+paritySuffix)
-		if err != nil {
-			return nil, nil, err
+	err = ErrBlockNotFound
+	for _, location := range meta.Locations {
+		if location.NID == c.peer.GetNID() {
+			continue
+		}
+		for _, op := range peers {
+			if op.NID() != location.NID {
+				continue
+			}
+			data, e := op.DownloadBlock(ctx, meta)
+			if e == nil {
+				return data, nil
+			}
+			err = e
 		}
 	}
-	data := make([]io.Reader, len(object.Files))
-	for i := range object.Files {
-		data[i] = object.Files[i]
+	return nil, err
+}
+
+// Capacity returns the usage of the local disks, nil when the BlockRepo does not report it
+func (c *ctrl) Capacity(ctx context.Context) (_ []DiskUsage, err error) {
+	defer c.audit(ctx, &AuditEntry{Operation: "Capacity"}, time.Now(), &err)
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	// encode data to dataShards and parityShards
-	err = c.divider.Encode(data, object.Size, dataShards, parityShards)
-	if err != nil {
-		return nil, nil, err
+	if reporter, ok := c.blockRepo.(CapacityReporter); ok {
+		return reporter.Usage(), nil
 	}
-	return dataShards, parityShards, nil
+	return nil, nil
 }
 
-func (c *ctrl) getObjectTempDir(object *Object) (string, error) {
-	dir := filepath.Join(c.tmpBaseDir, strconv.FormatInt(object.BucketID, 10), strconv.FormatInt(object.ID, 10))
-	if _, err := os.Stat(dir); err != nil {
-		if os.IsNotExist(err) {
-			err = os.MkdirAll(dir, 0755)
-			if err != nil {
-				return "", err
-			}
-		} else {
-			return "", err
+// uploadPolicy is how the content of a new object is stored
+type uploadPolicy struct {
+	profile     ErasureProfile
+	dedup       bool
+	compression string
+	encryption  *EncryptionMeta
+	dataKey     *dataKey
+}
+
+// uploadPolicy returns the policy of a new object, the codec, the compression and the encryption are
+// the given ones, or the ones of the bucket. Objects of an already compressed type are not compressed.
+func (c *ctrl) uploadPolicy(bucketID int64, objType ObjectType, opt UploadOption) (*uploadPolicy, error) {
+	bucket, err := c.bucketMeta.GetBucketByID(bucketID)
+	if err != nil {
+		return nil, err
+	}
+	codec := opt.Codec
+	if codec == "" {
+		codec = bucket.Codec
+	}
+	profile, err := c.divider.Profile(codec)
+	if err != nil {
+		return nil, err
+	}
+	compression := opt.Compression
+	if compression == "" {
+		compression = bucket.Compression
+	}
+	if compression == CompressionNone || objType.Compressed() {
+		compression = ""
+	}
+	if !utils.ValidCompression(compression) {
+		return nil, utils.ErrUnknownCompression
+	}
+	policy := &uploadPolicy{
+		profile:     profile,
+		compression: compression,
+	}
+	// the shared chunks can not be encrypted with the data key of one object
+	if opt.Encryption || opt.CustomerKey != nil || bucket.Encryption {
+		if policy.encryption, policy.dataKey, err = c.newEncryption(opt.CustomerKey); err != nil {
+			return nil, err
 		}
+	} else {
+		policy.dedup = c.opt.ChunkRepo != nil && bucket.Dedup
 	}
-	return dir, nil
+	return policy, nil
+}
+
+// inline reports whether an object of size is stored inline in its meta
+func (c *ctrl) inline(size int64) bool {
+	return c.opt.InlineThreshold >= 0 && size <= c.opt.InlineThreshold
+}
+
+// shardsSize returns the size taken by the shards of a stripe
+func shardsSize(profile ErasureProfile) int64 {
+	return profile.ShardSize * int64(profile.DataShards+profile.ParityShards)
 }
 
 func (c *ctrl) generateBlockMeta(object *Object, block *os.File, operators []Operator) (*BlockMeta, error) {
@@ -281,16 +394,17 @@ func (c *ctrl) generateBlockMeta(object *Object, block *os.File, operators []Ope
 	if err != nil {
 		return nil, err
 	}
-	checksum, err := utils.ChecksumByFile(block)
+	digest, err := utils.SumByFile(block, c.opt.ChecksumAlgorithm)
 	if err != nil {
 		return nil, err
 	}
 	blockMeta := &BlockMeta{
-		ID:       c.bucketIDGenerator.GenerateID(),
-		BucketID: object.BucketID,
-		ObjectID: object.ID,
-		Size:     stat.Size(),
-		Checksum: checksum,
+		ID:                c.bucketIDGenerator.GenerateID(),
+		BucketID:          object.BucketID,
+		ObjectID:          object.ID,
+		Size:              stat.Size(),
+		ChecksumAlgorithm: c.opt.ChecksumAlgorithm,
+		Digest:            digest,
 	}
 	for i := range operators {
 		blockMeta.Locations = append(blockMeta.Locations, Location{Location: operators[i].Addr(), NID: operators[i].NID()})
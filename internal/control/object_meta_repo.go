@@ -1,6 +1,13 @@
 package control
 
-import "os"
+import (
+	"errors"
+	"os"
+)
+
+var (
+	ErrObjectNotFound = errors.New("object not found")
+)
 
 const (
 	ObjectTypeTextPlain       ObjectType = "text/plain"
@@ -25,6 +32,17 @@ const (
 // ObjectType is the type of object.
 type ObjectType string
 
+// Compressed reports whether the content of the type is already compressed
+func (t ObjectType) Compressed() bool {
+	switch t {
+	case ObjectTypeImageJpeg, ObjectTypeImagePng, ObjectTypeImageGif, ObjectTypeImageWebp,
+		ObjectTypeAudioMpeg, ObjectTypeAudioOgg,
+		ObjectTypeVideoMpeg, ObjectTypeVideoMp4, ObjectTypeVideoWebm, ObjectTypeVideoOgg:
+		return true
+	}
+	return false
+}
+
 type ObjectMeta struct {
 	ID               int64             `json:"id"`
 	Name             string            `json:"name"`
@@ -38,12 +56,101 @@ type ObjectMeta struct {
 	DataShardsMeta   map[int]BlockMeta `json:"data_shards_location"`
 	ParityShardsMeta map[int]BlockMeta `json:"parity_shards_location"`
 	Replicas         int               `json:"replicas"`
+	Erasure          ErasureProfile    `json:"erasure"`
+	Stripes          []StripeMeta      `json:"stripes"`
+	// Compression is the compression algorithm of the object, a stripe compressing badly is kept as is
+	Compression string `json:"compression,omitempty"`
+	// Encryption is the envelope key of an encrypted object
+	Encryption *EncryptionMeta `json:"encryption,omitempty"`
+	// ETag is the hex MD5 and SHA256 the hex SHA-256 of the content, computed during upload
+	ETag   string `json:"etag,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	// Chunks are the content defined chunks of a deduplicated object, shared with the other objects holding them
+	Chunks []ChunkRef `json:"chunks,omitempty"`
+	// Inline is the content of an object smaller than the inline threshold, it has no stripes
+	Inline []byte `json:"inline,omitempty"`
+	// OwnerID is the user who uploaded the object, 0 for an internal upload
+	OwnerID int64 `json:"owner_id,omitempty"`
+}
+
+// StripeMeta is the shards of one stripe of an object
+type StripeMeta struct {
+	Size             int64             `json:"size"`
+	ShardSize        int64             `json:"shard_size"`
+	DataShardsMeta   map[int]BlockMeta `json:"data_shards_location"`
+	ParityShardsMeta map[int]BlockMeta `json:"parity_shards_location"`
+	// Compression is the compression algorithm of the stripe data, RawSize the size of the data
+	// before it was compressed or encrypted, 0 when it is stored as is
+	Compression string `json:"compression,omitempty"`
+	RawSize     int64  `json:"raw_size,omitempty"`
+	// Nonce is the nonce prefix of the encrypted frames of the stripe
+	Nonce []byte `json:"nonce,omitempty"`
+}
+
+// EncryptionMeta is the data key of an object wrapped by a master key of the key ring,
+// or by a key of the client that is never stored
+type EncryptionMeta struct {
+	Algorithm string `json:"algorithm"`
+	FrameSize int    `json:"frame_size"`
+	// KeyID is the master key wrapping the data key, empty when the client key wraps it
+	KeyID      string `json:"key_id,omitempty"`
+	WrappedKey []byte `json:"wrapped_key"`
+	// CustomerKeyMD5 is the MD5 of the client key, it tells a wrong key from a corrupted data key
+	CustomerKeyMD5 []byte `json:"customer_key_md5,omitempty"`
+}
+
+// ContentSize returns the size of the object content held by the stripe
+func (s *StripeMeta) ContentSize() int64 {
+	if s.RawSize > 0 {
+		return s.RawSize
+	}
+	return s.Size
+}
+
+// StripesMeta returns the stripes of the object,
+// objects stored before stripes were recorded are a single stripe
+func (m *ObjectMeta) StripesMeta() []StripeMeta {
+	if len(m.Stripes) > 0 || len(m.DataShardsMeta) == 0 {
+		return m.Stripes
+	}
+	stripe := StripeMeta{
+		Size:             m.Size,
+		DataShardsMeta:   m.DataShardsMeta,
+		ParityShardsMeta: m.ParityShardsMeta,
+	}
+	if block, ok := m.DataShardsMeta[0]; ok {
+		stripe.ShardSize = block.Size
+	}
+	return []StripeMeta{stripe}
+}
+
+// ErasureProfile returns the profile the object is coded with,
+// objects stored before the profile was recorded are Reed-Solomon coded with one shard per block meta
+func (m *ObjectMeta) ErasureProfile() ErasureProfile {
+	if m.Erasure.Codec != "" {
+		return m.Erasure
+	}
+	profile := ErasureProfile{
+		Codec:        CodecReedSolomon,
+		Version:      1,
+		DataShards:   len(m.DataShardsMeta),
+		ParityShards: len(m.ParityShardsMeta),
+	}
+	if block, ok := m.DataShardsMeta[0]; ok {
+		profile.ShardSize = block.Size
+	}
+	return profile
 }
 
 type ObjectMetaRepo interface {
 	StoreMeta(meta *ObjectMeta) error
 	GetMeta(bucketID int64, objectID int64) (*ObjectMeta, error)
 	GetMetaList(bucketID int64) ([]*ObjectMeta, error)
+	// GetMetaByName returns the latest object of the name in the bucket, ErrObjectNotFound when there is none
+	GetMetaByName(bucketID int64, name string) (*ObjectMeta, error)
+	DeleteMeta(bucketID int64, objectID int64) error
+	// UpdateMeta replace the meta of a stored object
+	UpdateMeta(meta *ObjectMeta) error
 }
 
 const (
@@ -63,4 +170,16 @@ type Object struct {
 	FilesNum  int
 	Files     []*os.File
 	Replicas  int
+	ETag      string
+	SHA256    string
+
+	temp *tempOp
+}
+
+// Close release the temp files backing the object
+func (o *Object) Close() error {
+	if o.temp == nil {
+		return nil
+	}
+	return o.temp.Release()
 }
@@ -0,0 +1,341 @@
+package control
+
+import (
+	"oss/internal/event"
+	"oss/internal/utils"
+	"time"
+)
+
+const (
+	defaultHedgePercentile = 0.95
+	defaultHedgeDelay      = 50 * time.Millisecond
+	defaultLatencyWindow   = 1024
+
+	defaultTempMaxAge          = time.Hour
+	defaultTempJanitorInterval = 10 * time.Minute
+
+	defaultInlineThreshold = 16 * 1024
+
+	defaultChecksumAlgorithm = utils.ChecksumXXHash64
+
+	defaultCompressionMinRatio = 1.1
+
+	// CompressionNone disables the compression of the bucket for an object
+	CompressionNone = "none"
+
+	defaultEncryptionFrameSize = 64 * 1024
+
+	defaultChunkMinSize = 256 * 1024
+	defaultChunkAvgSize = 1024 * 1024
+	defaultChunkMaxSize = 4 * 1024 * 1024
+)
+
+type Option struct {
+	// HedgePercentile is the shard fetch latency percentile after which a hedged request is sent
+	HedgePercentile float64
+	// HedgeDelay is the hedge delay used until enough fetch latencies are observed
+	HedgeDelay time.Duration
+
+	// TempQuota is the max bytes the temp files may take, 0 means unlimited
+	TempQuota int64
+	// TempMaxAge is the age after which a temp dir not owned by a running operation is removed
+	TempMaxAge time.Duration
+	// TempJanitorInterval is the interval between two temp dir cleanups
+	TempJanitorInterval time.Duration
+
+	// InlineThreshold is the max size of an object stored inline in its meta, negative disables inlining
+	InlineThreshold int64
+
+	// ChecksumAlgorithm is the checksum algorithm of the new blocks
+	ChecksumAlgorithm string
+
+	// CompressionMinRatio is the min ratio of the raw size to the compressed size of a stripe kept compressed
+	CompressionMinRatio float64
+
+	// KeyRing is the key ring of the master keys, it is required by the encryption without a client key
+	KeyRing KeyRing
+	// EncryptionFrameSize is the size of the encrypted frames of a stripe
+	EncryptionFrameSize int
+
+	// ChunkRepo is the chunk index of the deduplicated buckets, nil disables deduplication
+	ChunkRepo ChunkRepo
+	// ChunkMinSize, ChunkAvgSize and ChunkMaxSize bound the content defined chunks
+	ChunkMinSize int
+	ChunkAvgSize int
+	ChunkMaxSize int
+
+	// EventPublisher publish the object and the bucket events, it is the event bus unless given
+	EventPublisher EventPublisher
+
+	// AuditLog keep the audit entries of the entry points and of the peer rpcs, nil disables the audit
+	AuditLog AuditLog
+
+	// Metrics observe the entry points, the peer rpcs, the shard fetches and the erasure coding, nil disables them
+	Metrics Metrics
+}
+
+func WithHedge(percentile float64, delay time.Duration) Option {
+	return Option{HedgePercentile: percentile, HedgeDelay: delay}
+}
+
+func WithTempQuota(quota int64) Option {
+	return Option{TempQuota: quota}
+}
+
+func WithTempJanitor(interval time.Duration, maxAge time.Duration) Option {
+	return Option{TempJanitorInterval: interval, TempMaxAge: maxAge}
+}
+
+func WithInlineThreshold(threshold int64) Option {
+	return Option{InlineThreshold: threshold}
+}
+
+func WithChecksum(algorithm string) Option {
+	return Option{ChecksumAlgorithm: algorithm}
+}
+
+func WithCompressionMinRatio(ratio float64) Option {
+	return Option{CompressionMinRatio: ratio}
+}
+
+func WithKeyRing(ring KeyRing) Option {
+	return Option{KeyRing: ring}
+}
+
+func WithEncryptionFrameSize(size int) Option {
+	return Option{EncryptionFrameSize: size}
+}
+
+func WithDedup(repo ChunkRepo) Option {
+	return Option{ChunkRepo: repo}
+}
+
+func WithChunkSize(min int, avg int, max int) Option {
+	return Option{ChunkMinSize: min, ChunkAvgSize: avg, ChunkMaxSize: max}
+}
+
+func WithEventPublisher(publisher EventPublisher) Option {
+	return Option{EventPublisher: publisher}
+}
+
+func WithAuditLog(auditLog AuditLog) Option {
+	return Option{AuditLog: auditLog}
+}
+
+func WithMetrics(metrics Metrics) Option {
+	return Option{Metrics: metrics}
+}
+
+func (o Option) apply(opt *Option) {
+	if o.HedgePercentile > 0 && o.HedgePercentile < 1 {
+		opt.HedgePercentile = o.HedgePercentile
+	}
+	if o.HedgeDelay > 0 {
+		opt.HedgeDelay = o.HedgeDelay
+	}
+	if o.TempQuota > 0 {
+		opt.TempQuota = o.TempQuota
+	}
+	if o.TempMaxAge > 0 {
+		opt.TempMaxAge = o.TempMaxAge
+	}
+	if o.TempJanitorInterval > 0 {
+		opt.TempJanitorInterval = o.TempJanitorInterval
+	}
+	if o.InlineThreshold != 0 {
+		opt.InlineThreshold = o.InlineThreshold
+	}
+	if o.ChecksumAlgorithm != "" {
+		opt.ChecksumAlgorithm = o.ChecksumAlgorithm
+	}
+	if o.CompressionMinRatio > 0 {
+		opt.CompressionMinRatio = o.CompressionMinRatio
+	}
+	if o.KeyRing != nil {
+		opt.KeyRing = o.KeyRing
+	}
+	if o.EncryptionFrameSize > 0 {
+		opt.EncryptionFrameSize = o.EncryptionFrameSize
+	}
+	if o.ChunkRepo != nil {
+		opt.ChunkRepo = o.ChunkRepo
+	}
+	if o.ChunkMinSize > 0 && o.ChunkMinSize <= o.ChunkAvgSize && o.ChunkAvgSize <= o.ChunkMaxSize {
+		opt.ChunkMinSize, opt.ChunkAvgSize, opt.ChunkMaxSize = o.ChunkMinSize, o.ChunkAvgSize, o.ChunkMaxSize
+	}
+	if o.EventPublisher != nil {
+		opt.EventPublisher = o.EventPublisher
+	}
+	if o.AuditLog != nil {
+		opt.AuditLog = o.AuditLog
+	}
+	if o.Metrics != nil {
+		opt.Metrics = o.Metrics
+	}
+}
+
+func NewCtrl(
+	tmpBaseDir string,
+	bucketIDGenerator UniqueIDGenerator,
+	objectIDGenerator UniqueIDGenerator,
+	blockRepo BlockRepo,
+	bucketMeta BucketMetaRepo,
+	objMeta ObjectMetaRepo,
+	divider Divider,
+	peer Peer,
+	opt ...Option,
+) *ctrl {
+	c := &ctrl{
+		tmpBaseDir:        tmpBaseDir,
+		bucketIDGenerator: bucketIDGenerator,
+		objectIDGenerator: objectIDGenerator,
+		blockRepo:         blockRepo,
+		bucketMeta:        bucketMeta,
+		objMeta:           objMeta,
+		divider:           divider,
+		peer:              peer,
+		opt: Option{
+			HedgePercentile: defaultHedgePercentile,
+			HedgeDelay:      defaultHedgeDelay,
+
+			TempMaxAge:          defaultTempMaxAge,
+			TempJanitorInterval: defaultTempJanitorInterval,
+
+			InlineThreshold: defaultInlineThreshold,
+
+			ChecksumAlgorithm: defaultChecksumAlgorithm,
+
+			CompressionMinRatio: defaultCompressionMinRatio,
+
+			EncryptionFrameSize: defaultEncryptionFrameSize,
+
+			ChunkMinSize: defaultChunkMinSize,
+			ChunkAvgSize: defaultChunkAvgSize,
+			ChunkMaxSize: defaultChunkMaxSize,
+
+			EventPublisher: event.Bus,
+		},
+		latency: newLatencyWindow(defaultLatencyWindow),
+	}
+	for _, o := range opt {
+		o.apply(&c.opt)
+	}
+	c.temp = newTempSpace(tmpBaseDir, c.opt.TempQuota)
+	return c
+}
+
+// UploadOption is the per object option of UploadObject
+type UploadOption struct {
+	// Codec is the erasure codec of the object, it overrides the codec of the bucket
+	Codec string
+	// ContentMD5 and ContentSHA256 are the digests given by the client, the upload is rejected when the content does not match
+	ContentMD5    []byte
+	ContentSHA256 []byte
+	// Compression is the compression algorithm of the object, it overrides the compression of the bucket,
+	// CompressionNone disables it
+	Compression string
+	// Encryption encrypt the object with the master keys of the key ring, whatever the bucket says
+	Encryption bool
+	// CustomerKey is the 32 bytes key of the client encrypting the object, it is never stored
+	CustomerKey []byte
+}
+
+func WithCodec(codec string) UploadOption {
+	return UploadOption{Codec: codec}
+}
+
+func WithCompression(algorithm string) UploadOption {
+	return UploadOption{Compression: algorithm}
+}
+
+func WithEncryption() UploadOption {
+	return UploadOption{Encryption: true}
+}
+
+func WithCustomerKey(key []byte) UploadOption {
+	return UploadOption{CustomerKey: key}
+}
+
+func WithContentMD5(digest []byte) UploadOption {
+	return UploadOption{ContentMD5: digest}
+}
+
+func WithContentSHA256(digest []byte) UploadOption {
+	return UploadOption{ContentSHA256: digest}
+}
+
+func (o UploadOption) apply(opt *UploadOption) {
+	if o.Codec != "" {
+		opt.Codec = o.Codec
+	}
+	if o.Compression != "" {
+		opt.Compression = o.Compression
+	}
+	if o.Encryption {
+		opt.Encryption = true
+	}
+	if o.CustomerKey != nil {
+		opt.CustomerKey = o.CustomerKey
+	}
+	if o.ContentMD5 != nil {
+		opt.ContentMD5 = o.ContentMD5
+	}
+	if o.ContentSHA256 != nil {
+		opt.ContentSHA256 = o.ContentSHA256
+	}
+}
+
+// DownloadOption is the per object option of DownloadObject
+type DownloadOption struct {
+	// Verify hash the reconstructed content and compare it with the hashes recorded at upload
+	// Verify is ignored by range reads as only the whole content is hashed
+	Verify bool
+	// Offset and Length are the range of the content to read, a Length of 0 reads to the end
+	Offset int64
+	Length int64
+	// CustomerKey is the key of the client the object was encrypted with
+	CustomerKey []byte
+}
+
+func WithVerify() DownloadOption {
+	return DownloadOption{Verify: true}
+}
+
+func WithRange(offset int64, length int64) DownloadOption {
+	return DownloadOption{Offset: offset, Length: length}
+}
+
+func WithDownloadCustomerKey(key []byte) DownloadOption {
+	return DownloadOption{CustomerKey: key}
+}
+
+func (o DownloadOption) apply(opt *DownloadOption) {
+	if o.Verify {
+		opt.Verify = true
+	}
+	if o.Offset != 0 {
+		opt.Offset = o.Offset
+	}
+	if o.Length != 0 {
+		opt.Length = o.Length
+	}
+	if o.CustomerKey != nil {
+		opt.CustomerKey = o.CustomerKey
+	}
+}
+
+// ServerOption is the option of the peer server
+type ServerOption struct {
+	// Identity enables mTLS between the peers, the callers must be the members of the cluster
+	Identity NodeIdentity
+}
+
+func WithIdentity(identity NodeIdentity) ServerOption {
+	return ServerOption{Identity: identity}
+}
+
+func (o ServerOption) apply(opt *ServerOption) {
+	if o.Identity != nil {
+		opt.Identity = o.Identity
+	}
+}
@@ -1,6 +1,7 @@
 package control
 
 import (
+	"context"
 	"io"
 	"os"
 )
@@ -16,12 +17,15 @@ type Picker interface {
 	PickByBlock(bucketID, objectID int64, block *os.File) (peers []Operator, err error)
 	PickByObject(param any) (peers []Operator, err error)
 
-	PickByMeta(meta *ObjectMeta) (dataShardPeer [][]Operator, parityShardPeer [][]Operator, err error)
+	PickByStripe(stripe *StripeMeta) (dataShardPeer [][]Operator, parityShardPeer [][]Operator, err error)
 }
 
 type Operator interface {
-	UploadBlock(meta *BlockMeta, data io.Reader) error
-	DownloadBlock(meta BlockMeta) (data io.Reader, err error)
+	UploadBlock(ctx context.Context, meta *BlockMeta, data io.Reader) error
+	DownloadBlock(ctx context.Context, meta BlockMeta) (data io.Reader, err error)
+	DeleteBlock(ctx context.Context, meta BlockMeta) error
+	// Capacity returns the usage of the disks of the peer
+	Capacity(ctx context.Context) (disks []DiskUsage, err error)
 
 	// Peer Info Getter
 
@@ -47,9 +51,14 @@ type ctrl struct {
 	bucketIDGenerator UniqueIDGenerator
 	objectIDGenerator UniqueIDGenerator
 
-	blockRepo BlockRepo
-	objMeta   ObjectMetaRepo
+	blockRepo  BlockRepo
+	bucketMeta BucketMetaRepo
+	objMeta    ObjectMetaRepo
 
 	divider Divider
 	peer    Peer
+
+	opt     Option
+	latency *latencyWindow
+	temp    *tempSpace
 }
@@ -0,0 +1,389 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Action is an operation on a bucket or on an object, named like the S3 ones
+type Action string
+
+const (
+	ActionGetObject                Action = "s3:GetObject"
+	ActionPutObject                Action = "s3:PutObject"
+	ActionDeleteObject             Action = "s3:DeleteObject"
+	ActionAbortMultipartUpload     Action = "s3:AbortMultipartUpload"
+	ActionListMultipartUploadParts Action = "s3:ListMultipartUploadParts"
+	ActionListBucket               Action = "s3:ListBucket"
+	ActionGetBucketLocation        Action = "s3:GetBucketLocation"
+	ActionDeleteBucket             Action = "s3:DeleteBucket"
+	ActionGetBucketPolicy          Action = "s3:GetBucketPolicy"
+	ActionPutBucketPolicy          Action = "s3:PutBucketPolicy"
+	ActionDeleteBucketPolicy       Action = "s3:DeleteBucketPolicy"
+	ActionGetBucketAcl             Action = "s3:GetBucketAcl"
+	ActionPutBucketAcl             Action = "s3:PutBucketAcl"
+	ActionGetBucketNotification    Action = "s3:GetBucketNotification"
+	ActionPutBucketNotification    Action = "s3:PutBucketNotification"
+	// ActionRotateKey re-wrap the data keys of the objects
+	ActionRotateKey Action = "oss:RotateKey"
+)
+
+// objectAction reports whether the resource of the action is an object rather than the bucket
+func (a Action) objectAction() bool {
+	switch a {
+	case ActionGetObject, ActionPutObject, ActionDeleteObject, ActionAbortMultipartUpload, ActionListMultipartUploadParts, ActionRotateKey:
+		return true
+	}
+	return false
+}
+
+// managementAction reports whether the action manage the access to the bucket
+func (a Action) managementAction() bool {
+	switch a {
+	case ActionGetBucketPolicy, ActionPutBucketPolicy, ActionDeleteBucketPolicy, ActionGetBucketAcl, ActionPutBucketAcl:
+		return true
+	}
+	return false
+}
+
+const (
+	// ACLPrivate only grant the owner of the bucket, it is the ACL of a bucket without one
+	ACLPrivate = "private"
+	// ACLPublicRead grant everyone, anonymous included, to list the bucket and to read its objects
+	ACLPublicRead = "public-read"
+
+	EffectAllow = "Allow"
+	EffectDeny  = "Deny"
+
+	// resourcePrefix is the prefix of the resources of a policy, arn:aws:s3:::bucket and arn:aws:s3:::bucket/key
+	resourcePrefix = "arn:aws:s3:::"
+
+	conditionSourceIP = "aws:SourceIp"
+	conditionUserID   = "aws:userid"
+	conditionPrefix   = "s3:prefix"
+)
+
+var (
+	ErrMalformedPolicy = errors.New("malformed bucket policy")
+	ErrInvalidACL      = errors.New("invalid canned acl")
+)
+
+// BucketPolicy is an S3 like JSON policy, the principals are the ids of the users or "*" for everyone
+type BucketPolicy struct {
+	Version   string            `json:"Version,omitempty"`
+	ID        string            `json:"Id,omitempty"`
+	Statement []PolicyStatement `json:"Statement"`
+}
+
+type PolicyStatement struct {
+	Sid       string          `json:"Sid,omitempty"`
+	Effect    string          `json:"Effect"`
+	Principal PolicyPrincipal `json:"Principal"`
+	Action    StringList      `json:"Action"`
+	Resource  StringList      `json:"Resource"`
+	// Condition is operator -> condition key -> values, all of them must hold
+	Condition map[string]map[string]StringList `json:"Condition,omitempty"`
+}
+
+// StringList is a JSON string or a JSON array of strings
+type StringList []string
+
+func (l *StringList) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*l = StringList{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// PolicyPrincipal is "*" for everyone, or {"AWS": [user ids]}
+type PolicyPrincipal struct {
+	Any   bool
+	Users StringList
+}
+
+func (p *PolicyPrincipal) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		if s != "*" {
+			return ErrMalformedPolicy
+		}
+		p.Any = true
+		return nil
+	}
+	var m map[string]StringList
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	for name, users := range m {
+		if name != "AWS" {
+			return ErrMalformedPolicy
+		}
+		for _, user := range users {
+			if user == "*" {
+				p.Any = true
+			}
+		}
+		p.Users = users
+	}
+	return nil
+}
+
+func (p PolicyPrincipal) MarshalJSON() ([]byte, error) {
+	if p.Any && len(p.Users) == 0 {
+		return json.Marshal("*")
+	}
+	return json.Marshal(map[string]StringList{"AWS": p.Users})
+}
+
+// ParseBucketPolicy decode and validate a JSON bucket policy of the bucket
+func ParseBucketPolicy(data []byte, bucket string) (*BucketPolicy, error) {
+	policy := &BucketPolicy{}
+	if err := json.Unmarshal(data, policy); err != nil {
+		return nil, ErrMalformedPolicy
+	}
+	if len(policy.Statement) == 0 {
+		return nil, ErrMalformedPolicy
+	}
+	for _, statement := range policy.Statement {
+		if statement.Effect != EffectAllow && statement.Effect != EffectDeny {
+			return nil, ErrMalformedPolicy
+		}
+		if !statement.Principal.Any && len(statement.Principal.Users) == 0 || len(statement.Action) == 0 || len(statement.Resource) == 0 {
+			return nil, ErrMalformedPolicy
+		}
+		for _, user := range statement.Principal.Users {
+			if _, err := strconv.ParseInt(user, 10, 64); err != nil && user != "*" {
+				return nil, ErrMalformedPolicy
+			}
+		}
+		// a policy only covers the bucket it is attached to
+		for _, resource := range statement.Resource {
+			name, _, _ := strings.Cut(strings.TrimPrefix(resource, resourcePrefix), "/")
+			if !strings.HasPrefix(resource, resourcePrefix) || name != bucket {
+				return nil, ErrMalformedPolicy
+			}
+		}
+		for operator, conditions := range statement.Condition {
+			if _, ok := conditionOperators[operator]; !ok {
+				return nil, ErrMalformedPolicy
+			}
+			if strings.HasSuffix(operator, "IpAddress") {
+				for _, values := range conditions {
+					for _, value := range values {
+						if parseIPNet(value) == nil {
+							return nil, ErrMalformedPolicy
+						}
+					}
+				}
+			}
+		}
+	}
+	return policy, nil
+}
+
+// ValidACL reports whether acl is a supported canned ACL
+func ValidACL(acl string) bool {
+	return acl == ACLPrivate || acl == ACLPublicRead
+}
+
+// AccessRequest is an action of a principal on a bucket or on an object of it
+type AccessRequest struct {
+	Principal *Principal
+	Action    Action
+	// Key is the object of an object action
+	Key string
+	// Prefix is the listed prefix of ActionListBucket
+	Prefix string
+}
+
+const (
+	ReasonInternal      = "internal call"
+	ReasonExplicitDeny  = "explicit deny"
+	ReasonOwner         = "bucket owner"
+	ReasonPolicyAllow   = "policy allow"
+	ReasonPublicReadACL = "public-read acl"
+	ReasonImplicitDeny  = "implicit deny"
+)
+
+// AccessDecision is the result of the evaluation of an access request
+type AccessDecision struct {
+	Allowed bool
+	Reason  string
+	// Statement is the Sid of the statement deciding the access, if any
+	Statement string
+}
+
+// EvaluateAccess decide the access request on the bucket. An explicit deny of the policy wins over
+// everything, then the owner, an allow of the policy and the canned ACL grant the access in that order.
+func EvaluateAccess(bucket *BucketMeta, request AccessRequest) *AccessDecision {
+	if request.Principal == nil {
+		return &AccessDecision{Allowed: true, Reason: ReasonInternal}
+	}
+	owner := !request.Principal.Anonymous && request.Principal.UserID == bucket.OwnerID
+	// the policy can not lock the owner out of the policy and the acl
+	if owner && request.Action.managementAction() {
+		return &AccessDecision{Allowed: true, Reason: ReasonOwner}
+	}
+	var allow *PolicyStatement
+	if bucket.Policy != nil {
+		resource := resourcePrefix + bucket.Name
+		if request.Action.objectAction() {
+			resource += "/" + request.Key
+		}
+		for i := range bucket.Policy.Statement {
+			statement := &bucket.Policy.Statement[i]
+			if !statement.matches(request, resource) {
+				continue
+			}
+			if statement.Effect == EffectDeny {
+				return &AccessDecision{Reason: ReasonExplicitDeny, Statement: statement.Sid}
+			}
+			if allow == nil {
+				allow = statement
+			}
+		}
+	}
+	switch {
+	case owner:
+		return &AccessDecision{Allowed: true, Reason: ReasonOwner}
+	case allow != nil:
+		return &AccessDecision{Allowed: true, Reason: ReasonPolicyAllow, Statement: allow.Sid}
+	case bucket.ACL == ACLPublicRead && (request.Action == ActionGetObject || request.Action == ActionListBucket):
+		return &AccessDecision{Allowed: true, Reason: ReasonPublicReadACL}
+	}
+	return &AccessDecision{Reason: ReasonImplicitDeny}
+}
+
+func (s *PolicyStatement) matches(request AccessRequest, resource string) bool {
+	if !s.Principal.Any {
+		if request.Principal.Anonymous || !matchAny(s.Principal.Users, strconv.FormatInt(request.Principal.UserID, 10)) {
+			return false
+		}
+	}
+	if !matchAny(s.Action, string(request.Action)) || !matchAny(s.Resource, resource) {
+		return false
+	}
+	values := map[string]string{
+		conditionSourceIP: request.Principal.SourceIP,
+		conditionPrefix:   request.Prefix,
+	}
+	if !request.Principal.Anonymous {
+		values[conditionUserID] = strconv.FormatInt(request.Principal.UserID, 10)
+	}
+	for operator, conditions := range s.Condition {
+		for key, expected := range conditions {
+			value, ok := values[key]
+			if key == conditionPrefix && request.Action != ActionListBucket || key == conditionSourceIP && value == "" {
+				ok = false
+			}
+			if !conditionOperators[operator](value, ok, expected) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// conditionOperators evaluate a condition on the value of its key, a missing key only satisfies the negated operators
+var conditionOperators = map[string]func(value string, ok bool, expected []string) bool{
+	"StringEquals": func(value string, ok bool, expected []string) bool {
+		return ok && containsString(expected, value)
+	},
+	"StringNotEquals": func(value string, ok bool, expected []string) bool {
+		return !ok || !containsString(expected, value)
+	},
+	"StringLike": func(value string, ok bool, expected []string) bool {
+		return ok && matchAny(expected, value)
+	},
+	"StringNotLike": func(value string, ok bool, expected []string) bool {
+		return !ok || !matchAny(expected, value)
+	},
+	"IpAddress": func(value string, ok bool, expected []string) bool {
+		return ok && inNets(expected, value)
+	},
+	"NotIpAddress": func(value string, ok bool, expected []string) bool {
+		return !ok || !inNets(expected, value)
+	},
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if wildcardMatch(pattern, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcardMatch match s against a pattern where * is any sequence and ? any single character
+func wildcardMatch(pattern string, s string) bool {
+	p, i := 0, 0
+	star, next := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, i
+			p++
+		case star >= 0:
+			// backtrack, the last * takes one more character
+			next++
+			p, i = star+1, next
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+func inNets(nets []string, value string) bool {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return false
+	}
+	for _, s := range nets {
+		if n := parseIPNet(s); n != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIPNet parse a CIDR or a single address
+func parseIPNet(s string) *net.IPNet {
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		return n
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
@@ -0,0 +1,74 @@
+package control_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"oss/internal/control"
+	"oss/internal/divider"
+	"testing"
+)
+
+func TestErasureProfilePersisted(t *testing.T) {
+	data := make([]byte, 2*5*testShardSize+1000)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	for _, codec := range []string{control.CodecReplication, control.CodecReedSolomon, control.CodecLRC} {
+		t.Run(codec, func(t *testing.T) {
+			env := newTestEnv(t, codec)
+			obj := env.upload(t, data)
+			meta, err := env.objects.GetMeta(1, obj.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := divider.NewDivider(divider.WithGeometry(5, 2, testShardSize)).Profile(codec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta.Erasure != want {
+				t.Fatalf("stored profile %+v, want %+v", meta.Erasure, want)
+			}
+
+			// the profile survives the encoding of the meta
+			raw, err := json.Marshal(meta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded control.ObjectMeta
+			if err = json.Unmarshal(raw, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if got := decoded.ErasureProfile(); got != want {
+				t.Fatalf("decoded profile %+v, want %+v", got, want)
+			}
+
+			// a ctrl of another geometry decodes the object with the profile it was stored with
+			ctrl := control.NewCtrl(t.TempDir(), &sequence{}, &sequence{}, nil, &memBucketMeta{bucket: env.bucket}, env.objects,
+				divider.NewDivider(divider.WithGeometry(3, 1, 2*testShardSize), divider.WithCopies(2)), env.peer)
+			other := &testEnv{ctrl: ctrl, op: env.op, peer: env.peer, bucket: env.bucket, objects: env.objects}
+			got, err := other.download(obj.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("downloaded data differs from the uploaded data")
+			}
+		})
+	}
+}
+
+func TestErasureProfileOfOldObject(t *testing.T) {
+	// objects stored before the profile was recorded have a single stripe of Reed-Solomon shards
+	meta := control.ObjectMeta{
+		DataShardsMeta:   map[int]control.BlockMeta{0: {Size: 100}, 1: {Size: 100}, 2: {Size: 100}},
+		ParityShardsMeta: map[int]control.BlockMeta{0: {Size: 100}, 1: {Size: 100}},
+	}
+	want := control.ErasureProfile{Codec: control.CodecReedSolomon, Version: 1, DataShards: 3, ParityShards: 2, ShardSize: 100}
+	if got := meta.ErasureProfile(); got != want {
+		t.Fatalf("profile %+v, want %+v", got, want)
+	}
+	meta.Erasure = lrcProfile
+	if got := meta.ErasureProfile(); got != lrcProfile {
+		t.Fatalf("recorded profile %+v, want %+v", got, lrcProfile)
+	}
+}
@@ -0,0 +1,53 @@
+package control
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	ErrInvalidRange = errors.New("invalid range")
+)
+
+// bounds returns the [start, end) bytes of an object of size read by the option
+func (o DownloadOption) bounds(size int64) (int64, int64, error) {
+	if o.Offset < 0 || o.Offset > size || o.Length < 0 {
+		return 0, 0, ErrInvalidRange
+	}
+	end := size
+	if o.Length > 0 {
+		end = min(size, o.Offset+o.Length)
+	}
+	return o.Offset, end, nil
+}
+
+// rangeWriter write the bytes of [start, end) of the content written to it to w,
+// the parts of the content out of the range are skipped without being read
+type rangeWriter struct {
+	w     io.Writer
+	pos   int64
+	start int64
+	end   int64
+}
+
+// skip reports whether the next n bytes of the content are out of the range, they are skipped if so
+func (r *rangeWriter) skip(n int64) bool {
+	if r.pos+n <= r.start || r.pos >= r.end {
+		r.pos += n
+		return true
+	}
+	return false
+}
+
+func (r *rangeWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	from := max(r.start-r.pos, 0)
+	to := min(r.end-r.pos, int64(n))
+	r.pos += int64(n)
+	if from < to {
+		if _, err := r.w.Write(p[from:to]); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
@@ -1,37 +1,70 @@
 package control
 
 import (
-	"bytes"
+	"context"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	grpcpeer "google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 	"io"
 	"net"
 	"oss/internal/proto"
+	"time"
 )
 
+// streamChunkSize is the size of the block chunk carried by one stream message
+const streamChunkSize = 64 * 1024
+
 type PeerServer struct {
 	proto.UnimplementedOperatorServer
 	coreCtrl *ctrl
 	addr     string
 	nid      int64
+	opt      ServerOption
 }
 
 func (p *PeerServer) DownloadBlock(request *proto.DownloadBlockRequest, server proto.Operator_DownloadBlockServer) error {
-	data, err := p.coreCtrl.DownloadBlock(request.BucketID, request.ObjectID, request.BlockID)
+	meta := BlockMeta{
+		ID:       request.BlockID,
+		BucketID: request.BucketID,
+		ObjectID: request.ObjectID,
+	}
+	data, err := p.coreCtrl.DownloadBlock(server.Context(), meta)
 	if err != nil {
 		log.Debugf("download block failed: %v", err)
-		server.Send(&proto.DownloadBlockResponse{Success: false})
+		server.Send(&proto.DownloadBlockResponse{Success: false, Message: err.Error()})
 		return nil
 	}
-	block, err := io.ReadAll(data)
-	if err != nil {
-		log.Debugf("read block data failed: %v", err)
-		server.Send(&proto.DownloadBlockResponse{Success: false})
-		return nil
+	if c, ok := data.(io.Closer); ok {
+		defer c.Close()
+	}
+	entry := rpcAuditFromContext(server.Context())
+	buf := make([]byte, streamChunkSize)
+	for {
+		n, err := io.ReadFull(data, buf)
+		if n > 0 {
+			if err := server.Send(&proto.DownloadBlockResponse{Success: true, Block: buf[:n]}); err != nil {
+				log.Debugf("send block data failed: %v", err)
+				return err
+			}
+			if entry != nil {
+				entry.Bytes += int64(n)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			log.Debugf("read block data failed: %v", err)
+			if entry != nil {
+				entry.Result, entry.Error = AuditFailure, err.Error()
+			}
+			server.Send(&proto.DownloadBlockResponse{Success: false, Message: err.Error()})
+			return nil
+		}
 	}
-
-	server.Send(&proto.DownloadBlockResponse{Success: true, Block: block})
-	return nil
 }
 
 func (p *PeerServer) UploadBlock(server proto.Operator_UploadBlockServer) error {
@@ -41,25 +74,27 @@ func (p *PeerServer) UploadBlock(server proto.Operator_UploadBlockServer) error
 		return nil
 	}
 	meta := &BlockMeta{
-		BucketID:  request.BlockMeta.BlockID,
-		ObjectID:  request.BlockMeta.ObjectID,
-		ID:        request.BlockMeta.BlockID,
-		Size:      request.BlockMeta.Size,
-		Checksum:  request.BlockMeta.Checksum,
-		CreatedAt: request.BlockMeta.CreatedAt,
-		UpdatedAt: request.BlockMeta.UpdatedAt,
-		Path:      request.BlockMeta.Path,
-		Locations: make([]Location, 0),
+		BucketID:          request.BlockMeta.BucketID,
+		ObjectID:          request.BlockMeta.ObjectID,
+		ID:                request.BlockMeta.BlockID,
+		Size:              request.BlockMeta.Size,
+		Checksum:          request.BlockMeta.Checksum,
+		ChecksumAlgorithm: request.BlockMeta.ChecksumAlgorithm,
+		Digest:            request.BlockMeta.Digest,
+		CreatedAt:         request.BlockMeta.CreatedAt,
+		UpdatedAt:         request.BlockMeta.UpdatedAt,
+		Path:              request.BlockMeta.Path,
+		Locations:         make([]Location, 0),
 	}
 	for _, location := range request.BlockMeta.Locations {
 		meta.Locations = append(meta.Locations, Location{
-			NID:  location.NID,
-			Addr: location.Addr,
+			NID:      location.NID,
+			Location: location.Addr,
 		})
 
 	}
-	reader := bytes.NewReader(request.Block)
-	if err := p.coreCtrl.UploadBlock(*meta, reader); err != nil {
+	reader := &uploadStreamReader{server: server, buf: request.Block}
+	if err := p.coreCtrl.UploadBlock(server.Context(), *meta, reader); err != nil {
 		log.Debugf("upload block failed: %v", err)
 		server.SendAndClose(&proto.UploadBlockResponse{Success: false, Message: err.Error()})
 		return nil
@@ -68,12 +103,68 @@ func (p *PeerServer) UploadBlock(server proto.Operator_UploadBlockServer) error
 	return nil
 }
 
-func NewPeerServer(addr string, nid int64, coreCtrl *ctrl) *PeerServer {
-	return &PeerServer{
+func (p *PeerServer) DeleteBlock(ctx context.Context, request *proto.DeleteBlockRequest) (*proto.DeleteBlockResponse, error) {
+	meta := BlockMeta{
+		BucketID: request.BucketID,
+		ObjectID: request.ObjectID,
+		ID:       request.BlockID,
+	}
+	if err := p.coreCtrl.DeleteBlock(ctx, meta); err != nil {
+		log.Debugf("delete block failed: %v", err)
+		return &proto.DeleteBlockResponse{Success: false, Message: err.Error()}, nil
+	}
+	return &proto.DeleteBlockResponse{Success: true}, nil
+}
+
+func (p *PeerServer) Capacity(ctx context.Context, request *proto.CapacityRequest) (*proto.CapacityResponse, error) {
+	disks, err := p.coreCtrl.Capacity(ctx)
+	if err != nil {
+		log.Debugf("get capacity failed: %v", err)
+		return &proto.CapacityResponse{Success: false, Message: err.Error()}, nil
+	}
+	response := &proto.CapacityResponse{Success: true}
+	for _, disk := range disks {
+		response.Disks = append(response.Disks, &proto.DiskUsage{
+			Path:   disk.Path,
+			State:  string(disk.State),
+			Weight: disk.Weight,
+			Total:  disk.Total,
+			Free:   disk.Free,
+			Used:   disk.Used,
+		})
+	}
+	return response, nil
+}
+
+// uploadStreamReader read the block chunks of an upload stream
+type uploadStreamReader struct {
+	server proto.Operator_UploadBlockServer
+	buf    []byte
+}
+
+func (r *uploadStreamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		request, err := r.server.Recv()
+		if err != nil {
+			return 0, err
+		}
+		r.buf = request.Block
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func NewPeerServer(addr string, nid int64, coreCtrl *ctrl, opt ...ServerOption) *PeerServer {
+	server := &PeerServer{
 		addr:     addr,
 		nid:      nid,
 		coreCtrl: coreCtrl,
 	}
+	for _, o := range opt {
+		o.apply(&server.opt)
+	}
+	return server
 }
 
 func RunServer(server *PeerServer) {
@@ -81,10 +172,121 @@ func RunServer(server *PeerServer) {
 	if err != nil {
 		panic(err)
 	}
-	s := grpc.NewServer()
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(server.unaryInterceptor),
+		grpc.StreamInterceptor(server.streamInterceptor),
+	}
+	if server.opt.Identity != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(server.opt.Identity.ServerTLSConfig())))
+	}
+	s := grpc.NewServer(opts...)
 	proto.RegisterOperatorServer(s, server)
 	log.Debugf("server listen on %s", server.addr)
 	if err := s.Serve(ln); err != nil {
 		panic(err)
 	}
 }
+
+func (p *PeerServer) unaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (_ any, err error) {
+	entry := rpcEntry(ctx, info.FullMethod)
+	defer p.audit(entry, time.Now(), &err)
+	if entry.Node, err = p.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	return handler(withRPCAudit(ctx, entry), req)
+}
+
+func (p *PeerServer) streamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	entry := rpcEntry(ss.Context(), info.FullMethod)
+	defer p.audit(entry, time.Now(), &err)
+	if entry.Node, err = p.authenticate(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, &auditStream{ServerStream: ss, ctx: withRPCAudit(ss.Context(), entry)})
+}
+
+// auditStream carry the entry of the rpc in the context of the stream
+type auditStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *auditStream) Context() context.Context {
+	return s.ctx
+}
+
+// rpcEntry returns the entry of the rpc of method, the ctrl completes it with what the rpc is made on
+func rpcEntry(ctx context.Context, method string) *AuditEntry {
+	entry := &AuditEntry{Operation: method}
+	if caller, ok := grpcpeer.FromContext(ctx); ok && caller.Addr != nil {
+		entry.RemoteAddr = caller.Addr.String()
+	}
+	return entry
+}
+
+// audit observe and append the entry of the rpc started at start, a rejected caller is audited as denied
+func (p *PeerServer) audit(entry *AuditEntry, start time.Time, err *error) {
+	latency := time.Since(start)
+	if *err != nil {
+		entry.Result, entry.Error = AuditFailure, (*err).Error()
+		if code := status.Code(*err); code == codes.Unauthenticated || code == codes.PermissionDenied {
+			entry.Result = AuditDenied
+		}
+	}
+	if entry.Result == "" {
+		entry.Result = AuditSuccess
+	}
+	p.coreCtrl.observe(entry, latency)
+	if p.coreCtrl.opt.AuditLog == nil {
+		return
+	}
+	entry.Time = start.UTC()
+	entry.Latency = latency.Microseconds()
+	p.coreCtrl.appendAudit(entry)
+}
+
+// authenticate check the caller presents the certificate of a node of the cluster and returns its id, any
+// caller is accepted without identity
+func (p *PeerServer) authenticate(ctx context.Context) (int64, error) {
+	if p.opt.Identity == nil {
+		return 0, nil
+	}
+	caller, ok := grpcpeer.FromContext(ctx)
+	if !ok {
+		return 0, status.Error(codes.Unauthenticated, ErrNoNodeID.Error())
+	}
+	info, ok := caller.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 {
+		return 0, status.Error(codes.Unauthenticated, ErrNoNodeID.Error())
+	}
+	nid, err := p.opt.Identity.NodeID(info.State.VerifiedChains[0][0])
+	if err != nil {
+		return 0, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if !p.member(nid) {
+		log.Debugf("reject node %d from %s: %v", nid, caller.Addr, ErrUnknownNode)
+		return nid, status.Error(codes.PermissionDenied, ErrUnknownNode.Error())
+	}
+	return nid, nil
+}
+
+// member reports whether the node nid is this node or a discovered peer
+func (p *PeerServer) member(nid int64) bool {
+	if nid == p.nid {
+		return true
+	}
+	if p.coreCtrl.peer == nil {
+		return false
+	}
+	peers, err := p.coreCtrl.peer.Discover()
+	if err != nil {
+		log.Debugf("discover peers failed: %v", err)
+		return false
+	}
+	for _, op := range peers {
+		if op.NID() == nid {
+			return true
+		}
+	}
+	return false
+}
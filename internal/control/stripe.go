@@ -0,0 +1,292 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"oss/internal/utils"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrShardsMetaMismatch = errors.New("shards meta does not match erasure profile")
+	ErrStripeSizeMismatch = errors.New("unpacked stripe size does not match")
+)
+
+// uploadStripes cut size bytes of data into stripes and upload them, the uploaded shards are deleted on failure
+func (c *ctrl) uploadStripes(ctx context.Context, op *tempOp, object *Object, policy *uploadPolicy, data io.Reader, size int64) ([]StripeMeta, error) {
+	stripeSize := policy.profile.StripeSize()
+	stripes := make([]StripeMeta, 0, (size+stripeSize-1)/stripeSize)
+	for offset := int64(0); offset < size; offset += stripeSize {
+		n := min(stripeSize, size-offset)
+		var (
+			stripe *StripeMeta
+			err    error
+		)
+		if policy.compression != "" || policy.dataKey != nil {
+			stripe, err = c.uploadPackedStripe(ctx, op, object, policy, io.LimitReader(data, n), n)
+		} else {
+			stripe, err = c.uploadStripe(ctx, op, object, policy.profile, io.LimitReader(data, n), n)
+		}
+		if err != nil {
+			c.deleteStripes(ctx, stripes)
+			return nil, err
+		}
+		stripes = append(stripes, *stripe)
+	}
+	return stripes, nil
+}
+
+// uploadPackedStripe compress then encrypt size bytes of data and upload them as a stripe,
+// the data is kept uncompressed when it compresses worse than the min ratio
+func (c *ctrl) uploadPackedStripe(ctx context.Context, op *tempOp, object *Object, policy *uploadPolicy, data io.Reader, size int64) (*StripeMeta, error) {
+	raw := make([]byte, size)
+	if _, err := io.ReadFull(data, raw); err != nil {
+		return nil, err
+	}
+	payload, compression := raw, ""
+	if policy.compression != "" {
+		compressed, err := utils.Compress(policy.compression, raw)
+		if err != nil {
+			return nil, err
+		}
+		if float64(len(compressed))*c.opt.CompressionMinRatio <= float64(size) {
+			payload, compression = compressed, policy.compression
+		}
+	}
+	var nonce []byte
+	if policy.dataKey != nil {
+		var err error
+		if nonce, payload, err = policy.dataKey.seal(payload); err != nil {
+			return nil, err
+		}
+	}
+	stripe, err := c.uploadStripe(ctx, op, object, policy.profile, bytes.NewReader(payload), int64(len(payload)))
+	if err != nil {
+		return nil, err
+	}
+	stripe.Compression = compression
+	stripe.RawSize = size
+	stripe.Nonce = nonce
+	return stripe, nil
+}
+
+// uploadStripe encode size bytes of data to the shards of a stripe and upload them
+func (c *ctrl) uploadStripe(ctx context.Context, op *tempOp, object *Object, profile ErasureProfile, data io.Reader, size int64) (_ *StripeMeta, err error) {
+	dataShards, parityShards, err := c.generateStripeFiles(op, profile, data, size)
+	defer discardFiles(dataShards)
+	defer discardFiles(parityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	stripe := &StripeMeta{
+		Size:             size,
+		ShardSize:        (size + int64(profile.DataShards) - 1) / int64(profile.DataShards),
+		DataShardsMeta:   make(map[int]BlockMeta),
+		ParityShardsMeta: make(map[int]BlockMeta),
+	}
+	defer func() {
+		if err != nil {
+			c.deleteStripes(ctx, []StripeMeta{*stripe})
+		}
+	}()
+	// upload dataShards and parityShards
+	for i := range dataShards {
+		blockMeta, err := c.uploadShard(ctx, object, dataShards[i])
+		if err != nil {
+			return nil, err
+		}
+		stripe.DataShardsMeta[i] = *blockMeta
+	}
+	for i := range parityShards {
+		blockMeta, err := c.uploadShard(ctx, object, parityShards[i])
+		if err != nil {
+			return nil, err
+		}
+		stripe.ParityShardsMeta[i] = *blockMeta
+	}
+	return stripe, nil
+}
+
+// uploadShard upload the shard to every peer picked for it, the replicas already written
+// are deleted when a peer fails
+func (c *ctrl) uploadShard(ctx context.Context, object *Object, shard *os.File) (*BlockMeta, error) {
+	peers, err := c.peer.PickByBlock(object.BucketID, object.ID, shard)
+	if err != nil {
+		return nil, err
+	}
+	blockMeta, err := c.generateBlockMeta(object, shard, peers)
+	if err != nil {
+		return nil, err
+	}
+	for i := range peers {
+		if _, err = shard.Seek(0, io.SeekStart); err != nil {
+			c.deleteShard(context.WithoutCancel(ctx), *blockMeta, peers[:i])
+			return nil, err
+		}
+		if err = peers[i].UploadBlock(ctx, blockMeta, shard); err != nil {
+			// the failed peer may hold a part of the block too
+			c.deleteShard(context.WithoutCancel(ctx), *blockMeta, peers[:i+1])
+			return nil, err
+		}
+	}
+	return blockMeta, nil
+}
+
+// deleteStripes delete the shards of the stripes from their peers, it is best effort and
+// still runs when ctx is canceled as it cleans up a failed upload
+func (c *ctrl) deleteStripes(ctx context.Context, stripes []StripeMeta) {
+	ctx = context.WithoutCancel(ctx)
+	for i := range stripes {
+		dataShardPeer, parityShardPeer, err := c.peer.PickByStripe(&stripes[i])
+		if err != nil {
+			log.Debugf("pick peers of stripe failed: %v", err)
+			continue
+		}
+		for j, meta := range stripes[i].DataShardsMeta {
+			if j < len(dataShardPeer) {
+				c.deleteShard(ctx, meta, dataShardPeer[j])
+			}
+		}
+		for j, meta := range stripes[i].ParityShardsMeta {
+			if j < len(parityShardPeer) {
+				c.deleteShard(ctx, meta, parityShardPeer[j])
+			}
+		}
+	}
+}
+
+func (c *ctrl) deleteShard(ctx context.Context, meta BlockMeta, peers []Operator) {
+	for _, op := range peers {
+		if err := op.DeleteBlock(ctx, meta); err != nil {
+			log.Debugf("delete block %d from %s failed: %v", meta.ID, op.Addr(), err)
+		}
+	}
+}
+
+func (c *ctrl) generateStripeFiles(op *tempOp, profile ErasureProfile, data io.Reader, size int64) (dataShards []*os.File, parityShards []*os.File, err error) {
+	// fill dataShards and parityShards
+	dataShards = make([]*os.File, profile.DataShards)
+	parityShards = make([]*os.File, profile.ParityShards)
+	for i := 0; i < profile.DataShards; i++ {
+		dataShards[i], err = op.Create(strconv.Itoa(i) + dataSuffix)
+		if err != nil {
+			return dataShards, parityShards, err
+		}
+	}
+	for i := 0; i < profile.ParityShards; i++ {
+		parityShards[i], err = op.Create(strconv.Itoa(i) + paritySuffix)
+		if err != nil {
+			return dataShards, parityShards, err
+		}
+	}
+	// encode data to dataShards and parityShards
+	start := time.Now()
+	err = c.divider.Encode(profile, []io.Reader{data}, size, dataShards, parityShards)
+	c.observeEncode(profile, size, start, err)
+	return dataShards, parityShards, err
+}
+
+// downloadStripe fetch enough shards of the stripe, reconstruct the missing data shards and write the stripe data to dst,
+// key is the data key of an encrypted stripe
+func (c *ctrl) downloadStripe(ctx context.Context, op *tempOp, profile ErasureProfile, stripe *StripeMeta, key *dataKey, dst io.Writer) error {
+	dataShardNum, parityShardNum := profile.DataShards, profile.ParityShards
+	if len(stripe.DataShardsMeta) != dataShardNum || len(stripe.ParityShardsMeta) != parityShardNum {
+		return ErrShardsMetaMismatch
+	}
+	n := dataShardNum + parityShardNum
+
+	// pick a control to download dataShards and parityShards
+	dataShardPeer, parityShardPeer, err := c.peer.PickByStripe(stripe)
+	if err != nil {
+		return err
+	}
+	metas := make([]BlockMeta, 0, n)
+	peers := make([][]Operator, 0, n)
+	for i := 0; i < dataShardNum; i++ {
+		metas = append(metas, stripe.DataShardsMeta[i])
+		peers = append(peers, dataShardPeer[i])
+	}
+	for i := 0; i < parityShardNum; i++ {
+		metas = append(metas, stripe.ParityShardsMeta[i])
+		peers = append(peers, parityShardPeer[i])
+	}
+
+	// download until enough shards arrived
+	shards, err := c.fetchShards(ctx, op, profile, metas, peers)
+	if err != nil {
+		return err
+	}
+	defer discardFiles(shards)
+	dataShards, parityShards := shards[:dataShardNum], shards[dataShardNum:]
+
+	// reconstruct the missing dataShards
+	fill := make([]*os.File, n)
+	defer discardFiles(fill)
+	missing := 0
+	for i := range dataShards {
+		if dataShards[i] != nil {
+			continue
+		}
+		fill[i], err = op.Create(strconv.Itoa(i) + sourceSuffix)
+		if err != nil {
+			return err
+		}
+		missing++
+	}
+	// the decoding is the reconstruction and the join of the dataShards
+	start := time.Now()
+	if missing > 0 {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		err = c.divider.Reconstruct(profile, dataShards, parityShards, fill)
+		c.observeReconstruction(profile, missing, err)
+		if err != nil {
+			return err
+		}
+		dataShards = append([]*os.File{}, dataShards...)
+		for i := range dataShards {
+			if fill[i] != nil {
+				dataShards[i] = fill[i]
+			}
+		}
+	}
+	if stripe.Compression == "" && stripe.Nonce == nil {
+		err = c.divider.Join(profile, dst, dataShards, stripe.Size)
+		c.observeDecode(profile, stripe.Size, start, err)
+		return err
+	}
+
+	// a packed stripe is about a stripe of data, it is decrypted and decompressed in memory
+	packed := bytes.NewBuffer(make([]byte, 0, stripe.Size))
+	err = c.divider.Join(profile, packed, dataShards, stripe.Size)
+	c.observeDecode(profile, stripe.Size, start, err)
+	if err != nil {
+		return err
+	}
+	payload := packed.Bytes()
+	if stripe.Nonce != nil {
+		if key == nil {
+			return ErrUnknownEncryption
+		}
+		if payload, err = key.open(stripe.Nonce, payload); err != nil {
+			return err
+		}
+	}
+	if stripe.Compression != "" {
+		if payload, err = utils.Decompress(stripe.Compression, payload, stripe.RawSize); err != nil {
+			return err
+		}
+	}
+	if int64(len(payload)) != stripe.RawSize {
+		return ErrStripeSizeMismatch
+	}
+	_, err = dst.Write(payload)
+	return err
+}
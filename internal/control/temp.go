@@ -0,0 +1,202 @@
+package control
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTempQuotaExceeded = errors.New("temp dir quota exceeded")
+	ErrTempReleased      = errors.New("temp files already released")
+)
+
+// tempSpace manage the temp files under tmpBaseDir.
+// Every operation owns a dir tmpBaseDir/<bucket>/<object>/<op>, the dirs that are
+// not owned by a running operation are orphans and removed by the janitor.
+type tempSpace struct {
+	sync.Mutex
+	baseDir string
+	quota   int64
+	used    int64
+	orphan  int64
+	active  map[string]struct{}
+}
+
+func newTempSpace(baseDir string, quota int64) *tempSpace {
+	return &tempSpace{
+		baseDir: baseDir,
+		quota:   quota,
+		active:  make(map[string]struct{}),
+	}
+}
+
+// Begin create the temp dir of an operation and reserve size bytes of the quota
+func (t *tempSpace) Begin(bucketID int64, objectID int64, size int64) (*tempOp, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.quota > 0 && t.used+t.orphan+size > t.quota {
+		return nil, ErrTempQuotaExceeded
+	}
+	parent := filepath.Join(t.baseDir, strconv.FormatInt(bucketID, 10), strconv.FormatInt(objectID, 10))
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(parent, "op")
+	if err != nil {
+		return nil, err
+	}
+	t.used += size
+	t.active[dir] = struct{}{}
+	return &tempOp{space: t, dir: dir, reserved: size}, nil
+}
+
+func (t *tempSpace) end(op *tempOp) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.used -= op.reserved
+	delete(t.active, op.dir)
+}
+
+// Clean remove the orphan temp dirs older than maxAge and the empty bucket and object dirs
+func (t *tempSpace) Clean(maxAge time.Duration) error {
+	buckets, err := os.ReadDir(t.baseDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var orphan int64
+	deadline := time.Now().Add(-maxAge)
+	for _, bucket := range buckets {
+		bucketDir := filepath.Join(t.baseDir, bucket.Name())
+		objects, err := os.ReadDir(bucketDir)
+		if err != nil {
+			continue
+		}
+		for _, object := range objects {
+			objectDir := filepath.Join(bucketDir, object.Name())
+			ops, err := os.ReadDir(objectDir)
+			if err != nil {
+				continue
+			}
+			for _, op := range ops {
+				opDir := filepath.Join(objectDir, op.Name())
+				t.Lock()
+				_, ok := t.active[opDir]
+				t.Unlock()
+				if ok {
+					continue
+				}
+				info, err := op.Info()
+				if err != nil {
+					continue
+				}
+				if info.ModTime().After(deadline) {
+					orphan += dirSize(opDir)
+					continue
+				}
+				if err = os.RemoveAll(opDir); err != nil {
+					log.Debugf("remove temp dir %s failed: %v", opDir, err)
+				}
+			}
+			t.removeIfEmpty(objectDir)
+		}
+		t.removeIfEmpty(bucketDir)
+	}
+
+	t.Lock()
+	t.orphan = orphan
+	t.Unlock()
+	return nil
+}
+
+// removeIfEmpty is locked so that it does not race with Begin creating the dir
+func (t *tempSpace) removeIfEmpty(dir string) {
+	t.Lock()
+	defer t.Unlock()
+
+	entries, err := os.ReadDir(dir)
+	if err == nil && len(entries) == 0 {
+		os.Remove(dir)
+	}
+}
+
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// tempOp is the temp files of one operation, Release remove all of them
+type tempOp struct {
+	sync.Mutex
+	space    *tempSpace
+	dir      string
+	reserved int64
+	files    []*os.File
+	released bool
+}
+
+func (op *tempOp) Create(pattern string) (*os.File, error) {
+	op.Lock()
+	defer op.Unlock()
+
+	if op.released {
+		return nil, ErrTempReleased
+	}
+	f, err := os.CreateTemp(op.dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	op.files = append(op.files, f)
+	return f, nil
+}
+
+func (op *tempOp) Release() error {
+	op.Lock()
+	if op.released {
+		op.Unlock()
+		return nil
+	}
+	op.released = true
+	files := op.files
+	op.files = nil
+	op.Unlock()
+
+	for _, f := range files {
+		f.Close()
+	}
+	err := os.RemoveAll(op.dir)
+	op.space.end(op)
+	return err
+}
+
+// RunTempJanitor clean the orphan temp dirs at startup and every TempJanitorInterval until ctx is done
+func (c *ctrl) RunTempJanitor(ctx context.Context) {
+	ticker := time.NewTicker(c.opt.TempJanitorInterval)
+	defer ticker.Stop()
+	for {
+		if err := c.temp.Clean(c.opt.TempMaxAge); err != nil {
+			log.Debugf("clean temp dir failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package control_test
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"os"
+	"oss/internal/control"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// janitorCtrl is the part of the ctrl cleaning the temp dir
+type janitorCtrl interface {
+	RunTempJanitor(ctx context.Context)
+}
+
+// runJanitor run one cleanup of the temp dir
+func runJanitor(env *testEnv) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	env.ctrl.(janitorCtrl).RunTempJanitor(ctx)
+}
+
+// tempDirs returns the op dirs of the temp dir
+func tempDirs(t *testing.T, env *testEnv) []string {
+	t.Helper()
+	dirs, err := filepath.Glob(filepath.Join(env.tmp, "*", "*", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dirs
+}
+
+func TestTempQuota(t *testing.T) {
+	data := make([]byte, 5*testShardSize)
+	rand.New(rand.NewSource(1)).Read(data)
+	// a download reserves its content and the shards of a stripe, 768K, two of them do not fit
+	env := newTestEnv(t, control.CodecReedSolomon, control.WithTempQuota(1<<20))
+	obj := env.upload(t, data)
+	if dirs := tempDirs(t, env); len(dirs) != 0 {
+		t.Fatalf("temp dirs %v left by the upload", dirs)
+	}
+
+	first, err := env.ctrl.DownloadObject(context.Background(), 1, obj.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = env.ctrl.DownloadObject(context.Background(), 1, obj.ID); !errors.Is(err, control.ErrTempQuotaExceeded) {
+		t.Fatalf("second download error %v, want ErrTempQuotaExceeded", err)
+	}
+	// the temp files of the object are released once it is closed
+	if err = first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if dirs := tempDirs(t, env); len(dirs) != 0 {
+		t.Fatalf("temp dirs %v left by the closed object", dirs)
+	}
+	second, err := env.ctrl.DownloadObject(context.Background(), 1, obj.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.Close()
+}
+
+func TestTempJanitor(t *testing.T) {
+	env := newTestEnv(t, control.CodecReedSolomon, control.WithTempQuota(1<<20), control.WithTempJanitor(time.Hour, time.Hour))
+	orphan := func(name string, size int, age time.Duration) string {
+		dir := filepath.Join(env.tmp, "9", name, "op1")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "shard"), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		at := time.Now().Add(-age)
+		if err := os.Chtimes(dir, at, at); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+	old := orphan("1", 1000, 2*time.Hour)
+	young := orphan("2", 1<<20, time.Minute)
+
+	runJanitor(env)
+	if _, err := os.Stat(filepath.Dir(old)); !os.IsNotExist(err) {
+		t.Fatalf("old orphan not removed with its object dir: %v", err)
+	}
+	if _, err := os.Stat(young); err != nil {
+		t.Fatalf("young orphan removed: %v", err)
+	}
+	// the young orphan may still be in use, it takes the quota until it is removed
+	if _, err := env.put(t, make([]byte, 5*testShardSize)); !errors.Is(err, control.ErrTempQuotaExceeded) {
+		t.Fatalf("upload error %v, want ErrTempQuotaExceeded", err)
+	}
+	at := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(young, at, at); err != nil {
+		t.Fatal(err)
+	}
+	runJanitor(env)
+	if entries, err := os.ReadDir(env.tmp); err != nil || len(entries) != 0 {
+		t.Fatalf("temp dir holds %d entries after the cleanup: %v", len(entries), err)
+	}
+	if _, err := env.put(t, make([]byte, 5*testShardSize)); err != nil {
+		t.Fatal(err)
+	}
+}
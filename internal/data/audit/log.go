@@ -0,0 +1,387 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"oss/internal/control"
+	"oss/internal/utils"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	filePrefix = "audit-"
+	fileExt    = ".jsonl"
+
+	defaultMaxFileSize    = 64 << 20
+	defaultRotateInterval = 24 * time.Hour
+)
+
+type Option struct {
+	// MaxFileSize is the size after which the entries are appended to a new file
+	MaxFileSize int64
+	// RotateInterval is the age after which the entries are appended to a new file
+	RotateInterval time.Duration
+	// MaxFiles is the number of the files kept, the oldest ones are removed beyond it, 0 keeps them all
+	MaxFiles int
+	// HashChain chain the entries with the hash of the previous one, Verify detects an entry changed or removed
+	HashChain bool
+	// Sync fsync the file after every entry
+	Sync bool
+}
+
+func WithRotation(maxFileSize int64, interval time.Duration, maxFiles int) Option {
+	return Option{MaxFileSize: maxFileSize, RotateInterval: interval, MaxFiles: maxFiles}
+}
+
+func WithHashChain() Option {
+	return Option{HashChain: true}
+}
+
+func WithSync() Option {
+	return Option{Sync: true}
+}
+
+func (o Option) apply(opt *Option) {
+	if o.MaxFileSize > 0 {
+		opt.MaxFileSize = o.MaxFileSize
+	}
+	if o.RotateInterval > 0 {
+		opt.RotateInterval = o.RotateInterval
+	}
+	if o.MaxFiles > 0 {
+		opt.MaxFiles = o.MaxFiles
+	}
+	if o.HashChain {
+		opt.HashChain = true
+	}
+	if o.Sync {
+		opt.Sync = true
+	}
+}
+
+// fileLog is an AuditLog appending the entries as JSON lines to files of dir, a file is named after the time it
+// is started at and holds the entries until the next one is started
+type fileLog struct {
+	sync.Mutex
+	dir  string
+	opt  Option
+	file *os.File
+	// start and size are the ones of the current file
+	start time.Time
+	size  int64
+	// last is the hash of the last entry
+	last string
+}
+
+// NewFileAuditLog open the audit log of dir, the entries are appended to its last file
+func NewFileAuditLog(dir string, opt ...Option) (*fileLog, error) {
+	l := &fileLog{
+		dir: dir,
+		opt: Option{
+			MaxFileSize:    defaultMaxFileSize,
+			RotateInterval: defaultRotateInterval,
+		},
+	}
+	for _, o := range opt {
+		o.apply(&l.opt)
+	}
+	if err := utils.CreateDirIfNotExists(dir); err != nil {
+		return nil, err
+	}
+	starts, err := l.files()
+	if err != nil {
+		return nil, err
+	}
+	if len(starts) == 0 {
+		if err = l.rotate(time.Now()); err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
+	if err = l.reopen(starts[len(starts)-1]); err != nil {
+		return nil, err
+	}
+	// the last file is empty when it was started just before the restart, the chain goes on from the older ones
+	for i := len(starts) - 2; i >= 0 && l.last == ""; i-- {
+		err = l.scan(starts[i], func(entry *control.AuditEntry, err error) bool {
+			if err == nil && entry.Hash != "" {
+				l.last = entry.Hash
+			}
+			return true
+		})
+		if err != nil {
+			l.file.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l *fileLog) path(start time.Time) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%s%020d%s", filePrefix, start.UnixNano(), fileExt))
+}
+
+// files returns the start times of the files in order
+func (l *fileLog) files() ([]time.Time, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	var starts []time.Time
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, filePrefix) || !strings.HasSuffix(name, fileExt) {
+			continue
+		}
+		nano, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, filePrefix), fileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		starts = append(starts, time.Unix(0, nano))
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+	return starts, nil
+}
+
+// reopen open the last file to append, the partial line left by a crash is truncated. The complete lines are
+// kept even when they are not valid entries, so that Verify reports them, the chain goes on from the last valid entry.
+func (l *fileLog) reopen(start time.Time) error {
+	file, err := os.OpenFile(l.path(start), os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	var valid int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return err
+		}
+		valid += int64(len(line))
+		entry := &control.AuditEntry{}
+		if json.Unmarshal(line, entry) == nil && entry.Hash != "" {
+			l.last = entry.Hash
+		}
+	}
+	if err = file.Truncate(valid); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err = file.Seek(valid, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.start, l.size = file, start, valid
+	return nil
+}
+
+// rotate start a new file at now, and remove the oldest files beyond MaxFiles
+func (l *fileLog) rotate(now time.Time) error {
+	file, err := os.OpenFile(l.path(now), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file, l.start, l.size = file, now, 0
+	if l.opt.MaxFiles <= 0 {
+		return nil
+	}
+	starts, err := l.files()
+	if err != nil {
+		return err
+	}
+	for len(starts) > l.opt.MaxFiles {
+		if err = os.Remove(l.path(starts[0])); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		starts = starts[1:]
+	}
+	return nil
+}
+
+// hash returns the hash of the entry chained to prev, its Hash is not hashed
+func hash(entry control.AuditEntry) (string, error) {
+	entry.Hash = ""
+	data, err := json.Marshal(&entry)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (l *fileLog) Append(entry *control.AuditEntry) error {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	if l.size >= l.opt.MaxFileSize || now.Sub(l.start) >= l.opt.RotateInterval {
+		if err := l.rotate(now); err != nil {
+			return err
+		}
+	}
+	if l.opt.HashChain {
+		entry.Prev = l.last
+		h, err := hash(*entry)
+		if err != nil {
+			return err
+		}
+		entry.Hash = h
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err = l.file.Write(line); err != nil {
+		l.rollback()
+		return err
+	}
+	if l.opt.Sync {
+		if err = l.file.Sync(); err != nil {
+			l.rollback()
+			return err
+		}
+	}
+	l.size += int64(len(line))
+	l.last = entry.Hash
+	return nil
+}
+
+// rollback drop what a failed append left after the last entry, so the next entry starts a line. When the file
+// can not be truncated the next append starts a new file and the partial line is left to Verify.
+func (l *fileLog) rollback() {
+	if err := l.file.Truncate(l.size); err != nil {
+		l.start = time.Time{}
+		return
+	}
+	if _, err := l.file.Seek(l.size, io.SeekStart); err != nil {
+		l.start = time.Time{}
+	}
+}
+
+// Query read the files from the one holding the start of the time range of the query
+func (l *fileLog) Query(query control.AuditQuery) ([]control.AuditEntry, error) {
+	starts, err := l.files()
+	if err != nil {
+		return nil, err
+	}
+	var entries []control.AuditEntry
+	for i, start := range starts {
+		// a file holds the entries appended until the next file is started, the later files may still hold
+		// the entries of the operations started before To
+		if !query.From.IsZero() && i+1 < len(starts) && !starts[i+1].After(query.From) {
+			continue
+		}
+		done := false
+		err = l.scan(start, func(entry *control.AuditEntry, err error) bool {
+			if err == nil && query.Match(entry) {
+				entries = append(entries, *entry)
+			}
+			done = query.Limit > 0 && len(entries) >= query.Limit
+			return !done
+		})
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// scan call fn with the entries of the file started at start until it returns false, with the error of a line
+// not decoded. A file removed by the rotation is skipped.
+func (l *fileLog) scan(start time.Time, fn func(entry *control.AuditEntry, err error) bool) error {
+	file, err := os.Open(l.path(start))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// the entry being appended is not complete yet
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		entry := &control.AuditEntry{}
+		if err = json.Unmarshal(line, entry); err != nil {
+			entry = nil
+		}
+		if !fn(entry, err) {
+			return nil
+		}
+	}
+}
+
+// Verify check the hash chain of the entries kept, the first one is trusted as the older files may be removed.
+// An entry changed, inserted or removed breaks the chain, so does a line which is not an entry.
+func (l *fileLog) Verify() error {
+	l.Lock()
+	defer l.Unlock()
+	starts, err := l.files()
+	if err != nil {
+		return err
+	}
+	prev, chained := "", false
+	var broken error
+	for _, start := range starts {
+		err = l.scan(start, func(entry *control.AuditEntry, err error) bool {
+			if err != nil {
+				broken = fmt.Errorf("%w: a line of %s is not an entry: %v", control.ErrAuditTampered, filepath.Base(l.path(start)), err)
+				return false
+			}
+			if entry.Hash == "" {
+				// the entries appended before the chain was enabled
+				if chained {
+					broken = fmt.Errorf("%w: entry of %s at %s is not hashed", control.ErrAuditTampered, entry.Operation, entry.Time)
+					return false
+				}
+				return true
+			}
+			h, e := hash(*entry)
+			if e != nil || h != entry.Hash || chained && entry.Prev != prev {
+				broken = fmt.Errorf("%w: chain broken at the entry of %s at %s", control.ErrAuditTampered, entry.Operation, entry.Time)
+				return false
+			}
+			prev, chained = entry.Hash, true
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		if broken != nil {
+			return broken
+		}
+	}
+	return nil
+}
+
+func (l *fileLog) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	return l.file.Close()
+}
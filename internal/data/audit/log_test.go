@@ -0,0 +1,167 @@
+package audit_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"oss/internal/control"
+	"oss/internal/data/audit"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// appendEntries append n entries of the bucket to the log
+func appendEntries(t *testing.T, l control.AuditLog, bucketID int64, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		entry := &control.AuditEntry{Time: time.Now().UTC(), Operation: "UploadObject", BucketID: bucketID, ObjectID: int64(i + 1), Result: control.AuditSuccess}
+		if err := l.Append(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// logFiles returns the files of the log in order
+func logFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "audit-*.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// rewrite replace the content of the file with the one returned by fn
+func rewrite(t *testing.T, name string, fn func(data []byte) []byte) {
+	t.Helper()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(name, fn(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rewriteLines replace the lines of the file with the ones returned by fn
+func rewriteLines(t *testing.T, name string, fn func(lines [][]byte) [][]byte) {
+	t.Helper()
+	rewrite(t, name, func(data []byte) []byte {
+		lines := bytes.SplitAfter(data, []byte("\n"))
+		return bytes.Join(fn(lines[:len(lines)-1]), nil)
+	})
+}
+
+func TestVerify(t *testing.T) {
+	cases := []struct {
+		name string
+		// tamper change the last file of the log before it is reopened
+		tamper   func(t *testing.T, name string)
+		entries  int
+		tampered bool
+	}{
+		{name: "intact", tamper: func(t *testing.T, name string) {}, entries: 6},
+		{name: "changed entry", tamper: func(t *testing.T, name string) {
+			rewrite(t, name, func(data []byte) []byte {
+				return bytes.Replace(data, []byte(`"object_id":2`), []byte(`"object_id":9`), 1)
+			})
+		}, entries: 6, tampered: true},
+		{name: "removed entry", tamper: func(t *testing.T, name string) {
+			rewriteLines(t, name, func(lines [][]byte) [][]byte { return append(lines[:1], lines[2:]...) })
+		}, entries: 5, tampered: true},
+		{name: "tampered line", tamper: func(t *testing.T, name string) {
+			rewriteLines(t, name, func(lines [][]byte) [][]byte {
+				lines[1] = []byte("not an entry\n")
+				return lines
+			})
+		}, entries: 5, tampered: true},
+		{name: "tampered last line", tamper: func(t *testing.T, name string) {
+			rewriteLines(t, name, func(lines [][]byte) [][]byte {
+				lines[len(lines)-1] = []byte("{\"time\":\"2\n")
+				return lines
+			})
+		}, entries: 5, tampered: true},
+		{name: "truncated last line", tamper: func(t *testing.T, name string) {
+			rewrite(t, name, func(data []byte) []byte { return append(data, `{"time":"2`...) })
+		}, entries: 6},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			l, err := audit.NewFileAuditLog(dir, audit.WithHashChain())
+			if err != nil {
+				t.Fatal(err)
+			}
+			appendEntries(t, l, 1, 3)
+			if err = l.Close(); err != nil {
+				t.Fatal(err)
+			}
+			files := logFiles(t, dir)
+			tc.tamper(t, files[len(files)-1])
+
+			// the entries appended after the restart are chained to the ones before
+			l, err = audit.NewFileAuditLog(dir, audit.WithHashChain())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			appendEntries(t, l, 2, 3)
+			if err = l.Verify(); errors.Is(err, control.ErrAuditTampered) != tc.tampered {
+				t.Fatalf("verify error %v, tampered %v", err, tc.tampered)
+			}
+			entries, err := l.Query(control.AuditQuery{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != tc.entries {
+				t.Fatalf("%d entries, want %d", len(entries), tc.entries)
+			}
+		})
+	}
+}
+
+func TestRotation(t *testing.T) {
+	dir := t.TempDir()
+	// an entry is about 300 bytes, a file holds 2 entries
+	l, err := audit.NewFileAuditLog(dir, audit.WithHashChain(), audit.WithRotation(400, time.Hour, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendEntries(t, l, 1, 10)
+	if err = l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if files := logFiles(t, dir); len(files) != 3 {
+		t.Fatalf("%d files kept, want 3", len(files))
+	}
+
+	// a file started just before the restart is empty, the chain goes on from the file before it
+	empty := filepath.Join(dir, fmt.Sprintf("audit-%020d.jsonl", time.Now().UnixNano()))
+	if err = os.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err = audit.NewFileAuditLog(dir, audit.WithHashChain(), audit.WithRotation(400, time.Hour, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	appendEntries(t, l, 2, 1)
+	// the first entry kept is trusted
+	if err = l.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := l.Query(control.AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 || entries[len(entries)-1].BucketID != 2 {
+		t.Fatalf("entries %+v, want the last one of bucket 2", entries)
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Prev != entries[i-1].Hash {
+			t.Fatalf("entry %d is not chained to the one before", i)
+		}
+	}
+}
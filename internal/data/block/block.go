@@ -1,74 +1,154 @@
 package block
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"oss/internal/control"
+	"oss/internal/utils"
 	"path/filepath"
 	"strconv"
 )
 
+const (
+	dataFile = "data"
+	metaFile = "object.json"
+	// tempDir hold the blocks being written, they are renamed to their dir once durable
+	tempDir = ".tmp"
+)
+
+// NewBlockStore returns a BlockRepo storing every block in its own directory
+func NewBlockStore(baseDir string) control.BlockRepo {
+	repo, err := OpenBlockStore(baseDir)
+	if err != nil {
+		panic(err)
+	}
+	return repo
+}
+
+// OpenBlockStore is NewBlockStore returning the error instead of panicking
+func OpenBlockStore(baseDir string) (control.BlockRepo, error) {
+	if err := utils.CreateDirIfNotExists(baseDir); err != nil {
+		return nil, err
+	}
+	// the blocks left by interrupted writes, it fails on a read-only disk that is still readable
+	os.RemoveAll(filepath.Join(baseDir, tempDir))
+
+	return &store{baseDir: baseDir}, nil
+}
+
 type store struct {
 	baseDir string
 }
 
-func (s *store) StoreBlock(meta control.BlockMeta, data io.Reader) error {
-	dir, err := s.getBlockDir(meta.BucketID, meta.ObjectID, meta.ID)
+// StoreBlock write the data and the meta of the block to a temp dir, verify the checksum,
+// fsync them and rename the temp dir to the block dir.
+// The digest is computed and recorded when the meta has an algorithm but no digest.
+func (s *store) StoreBlock(ctx context.Context, meta control.BlockMeta, data io.Reader) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := utils.CreateDirIfNotExists(filepath.Join(s.baseDir, tempDir)); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Join(s.baseDir, tempDir), "block")
 	if err != nil {
 		return err
 	}
-	// Store data
-	filename := filepath.Join(dir, "data")
-	file, err := os.Create(filename)
+	defer os.RemoveAll(tmp)
+
+	// Store data, the checksum is verified as it streams
+	reader, err := control.NewBlockChecksumReader(utils.NewContextReader(ctx, data), meta)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-	n, err := io.Copy(file, data)
+	n, err := writeFile(filepath.Join(tmp, dataFile), reader)
 	if err != nil {
 		return err
 	}
 	if n != meta.Size {
 		return fmt.Errorf("write size not match, expect %d, got %d", meta.Size, n)
 	}
+	if meta.ChecksumAlgorithm != "" && meta.Digest == nil {
+		meta.Digest = reader.Sum()
+	}
 	// Store meta
-	filename = filepath.Join(dir, "object.json")
-	metaFile, err := os.Create(filename)
+	metaData, err := json.Marshal(meta)
 	if err != nil {
 		return err
 	}
-	defer metaFile.Close()
+	if _, err = writeFile(filepath.Join(tmp, metaFile), bytes.NewReader(metaData)); err != nil {
+		return err
+	}
+	if err = utils.SyncDir(tmp); err != nil {
+		return err
+	}
 
-	return json.NewEncoder(file).Encode(meta)
+	// Move the block to its dir, a stored block is renamed aside and deleted once it is replaced
+	dir := s.getBlockDir(meta.BucketID, meta.ObjectID, meta.ID)
+	if err = utils.CreateDirIfNotExists(filepath.Dir(dir)); err != nil {
+		return err
+	}
+	old := tmp + ".old"
+	if err = os.Rename(dir, old); err == nil {
+		defer os.RemoveAll(old)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err = os.Rename(tmp, dir); err != nil {
+		// put the stored block back
+		os.Rename(old, dir)
+		return err
+	}
+	return utils.SyncDir(filepath.Dir(dir))
 }
 
-func (s *store) GetBlock(bucketID int64, objectID int64, blockID int64) (io.Reader, error) {
-	dir, err := s.getBlockDir(bucketID, objectID, blockID)
+func (s *store) GetBlock(ctx context.Context, bucketID int64, objectID int64, blockID int64) (io.Reader, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	meta, err := s.GetBlockMeta(ctx, bucketID, objectID, blockID)
+	if err != nil {
+		return nil, err
+	}
+	dir := s.getBlockDir(bucketID, objectID, blockID)
+	file, err := os.Open(filepath.Join(dir, dataFile))
 	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, control.ErrBlockNotFound
+		}
 		return nil, err
 	}
-	filename := filepath.Join(dir, "data")
-	return os.Open(filename)
+	// the data is verified as it is read
+	reader, err := control.NewBlockChecksumReader(file, *meta)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return reader, nil
 }
 
-func (s *store) DeleteBlock(bucketID int64, objectID int64, blockID int64) error {
-	dir, err := s.getBlockDir(bucketID, objectID, blockID)
-	if err != nil {
+func (s *store) DeleteBlock(ctx context.Context, bucketID int64, objectID int64, blockID int64) error {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
+	dir := s.getBlockDir(bucketID, objectID, blockID)
 	return os.RemoveAll(dir)
 }
 
-func (s *store) GetBlockMeta(bucketID int64, objectID int64, blockID int64) (*control.BlockMeta, error) {
-	dir, err := s.getBlockDir(bucketID, objectID, blockID)
-	if err != nil {
+func (s *store) GetBlockMeta(ctx context.Context, bucketID int64, objectID int64, blockID int64) (*control.BlockMeta, error) {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
-	filename := filepath.Join(dir, "object.json")
-	file, err := os.Open(filename)
+	dir := s.getBlockDir(bucketID, objectID, blockID)
+	file, err := os.Open(filepath.Join(dir, metaFile))
 	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, control.ErrBlockNotFound
+		}
 		return nil, err
 	}
 	defer file.Close()
@@ -77,22 +157,28 @@ func (s *store) GetBlockMeta(bucketID int64, objectID int64, blockID int64) (*co
 	return meta, err
 }
 
-func (s *store) getBlockDir(bucketID int64, objectID int64, blockID int64) (string, error) {
-	dir := filepath.Join(
+func (s *store) getBlockDir(bucketID int64, objectID int64, blockID int64) string {
+	return filepath.Join(
 		s.baseDir,
 		strconv.FormatInt(bucketID, 10),
 		strconv.FormatInt(objectID, 10),
 		strconv.FormatInt(blockID, 10),
 	)
-	if _, err := os.Stat(dir); err != nil {
-		if os.IsNotExist(err) {
-			err = os.MkdirAll(dir, 0755)
-			if err != nil {
-				return "", err
-			}
-		} else {
-			return "", err
-		}
+}
+
+// writeFile create the file, copy data to it and fsync it
+func writeFile(filename string, data io.Reader) (int64, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	n, err := io.Copy(file, data)
+	if err != nil {
+		return n, err
+	}
+	if err = file.Sync(); err != nil {
+		return n, err
 	}
-	return dir, nil
+	return n, file.Close()
 }
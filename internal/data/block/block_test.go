@@ -0,0 +1,168 @@
+package block_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"oss/internal/control"
+	"oss/internal/data/block"
+	"path/filepath"
+	"testing"
+)
+
+// blockMeta returns the meta of block 3 of object 2 of bucket 1 holding data
+func blockMeta(data []byte) control.BlockMeta {
+	return control.BlockMeta{ID: 3, BucketID: 1, ObjectID: 2, Size: int64(len(data)), Checksum: crc32.ChecksumIEEE(data)}
+}
+
+// readBlock returns the data of the block, the reader is closed
+func readBlock(repo control.BlockRepo, meta control.BlockMeta) ([]byte, error) {
+	r, err := repo.GetBlock(context.Background(), meta.BucketID, meta.ObjectID, meta.ID)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+	return io.ReadAll(r)
+}
+
+// cancelReader cancel the context once the data is read
+type cancelReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (r *cancelReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		r.cancel()
+	}
+	return n, err
+}
+
+func TestStoreBlockCanceled(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := block.OpenBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("block"), 1000)
+	meta := blockMeta(data)
+
+	// canceled while the data is written
+	ctx, cancel := context.WithCancel(context.Background())
+	r := io.MultiReader(&cancelReader{r: bytes.NewReader(data[:100]), cancel: cancel}, bytes.NewReader(data[100:]))
+	if err = repo.StoreBlock(ctx, meta, r); !errors.Is(err, context.Canceled) {
+		t.Fatalf("store error %v, want context canceled", err)
+	}
+	if _, err = readBlock(repo, meta); !errors.Is(err, control.ErrBlockNotFound) {
+		t.Fatalf("read of the canceled block: %v, want ErrBlockNotFound", err)
+	}
+	temps, err := os.ReadDir(filepath.Join(dir, ".tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(temps) != 0 {
+		t.Fatalf("%d temp blocks left", len(temps))
+	}
+
+	// the calls of a done context fail before they start
+	if err = repo.StoreBlock(context.Background(), meta, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = repo.GetBlock(ctx, meta.BucketID, meta.ObjectID, meta.ID); !errors.Is(err, context.Canceled) {
+		t.Fatalf("get error %v, want context canceled", err)
+	}
+	if err = repo.DeleteBlock(ctx, meta.BucketID, meta.ObjectID, meta.ID); !errors.Is(err, context.Canceled) {
+		t.Fatalf("delete error %v, want context canceled", err)
+	}
+	if got, err := readBlock(repo, meta); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("block not kept: %v", err)
+	}
+}
+
+func TestStoreBlockReplace(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := block.OpenBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := bytes.Repeat([]byte("old"), 1000)
+	if err = repo.StoreBlock(context.Background(), blockMeta(old), bytes.NewReader(old)); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed store keeps the stored block
+	data := bytes.Repeat([]byte("new"), 1000)
+	corrupted := blockMeta(data)
+	corrupted.Checksum++
+	short := blockMeta(data)
+	short.Size++
+	for name, meta := range map[string]control.BlockMeta{"checksum": corrupted, "size": short} {
+		if err = repo.StoreBlock(context.Background(), meta, bytes.NewReader(data)); err == nil {
+			t.Fatalf("store of a block of a wrong %s succeeded", name)
+		}
+		if got, err := readBlock(repo, blockMeta(old)); err != nil || !bytes.Equal(got, old) {
+			t.Fatalf("block not kept after a store of a wrong %s: %v", name, err)
+		}
+	}
+
+	// the block and its meta are replaced together
+	meta := blockMeta(data)
+	if err = repo.StoreBlock(context.Background(), meta, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readBlock(repo, meta); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("block not replaced: %v", err)
+	}
+	stored, err := repo.GetBlockMeta(context.Background(), meta.BucketID, meta.ObjectID, meta.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Checksum != meta.Checksum {
+		t.Fatalf("stored checksum %x, want %x", stored.Checksum, meta.Checksum)
+	}
+	temps, err := os.ReadDir(filepath.Join(dir, ".tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(temps) != 0 {
+		t.Fatalf("%d temp blocks left", len(temps))
+	}
+}
+
+func TestBlockNotFound(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := block.OpenBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("block")
+	meta := blockMeta(data)
+	notFound := func(when string) {
+		t.Helper()
+		if _, err := readBlock(repo, meta); !errors.Is(err, control.ErrBlockNotFound) {
+			t.Fatalf("get of the block %s: %v, want ErrBlockNotFound", when, err)
+		}
+		if _, err := repo.GetBlockMeta(context.Background(), meta.BucketID, meta.ObjectID, meta.ID); !errors.Is(err, control.ErrBlockNotFound) {
+			t.Fatalf("get meta of the block %s: %v, want ErrBlockNotFound", when, err)
+		}
+	}
+
+	notFound("never stored")
+	// a read does not create the dirs of the block
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Fatalf("store dir holds %d entries after the reads: %v", len(entries), err)
+	}
+	if err = repo.StoreBlock(context.Background(), meta, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err = repo.DeleteBlock(context.Background(), meta.BucketID, meta.ObjectID, meta.ID); err != nil {
+		t.Fatal(err)
+	}
+	notFound("deleted")
+}
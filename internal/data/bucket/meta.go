@@ -0,0 +1,160 @@
+package bucket
+
+import (
+	"encoding/json"
+	"os"
+	"oss/internal/control"
+	"oss/internal/utils"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBucketNotFound = control.ErrBucketNotFound
+	ErrBucketExists   = control.ErrBucketExists
+)
+
+func NewBucketMetaStore(baseDir string, idGenerator control.UniqueIDGenerator) control.BucketMetaRepo {
+	err := utils.CreateDirIfNotExists(baseDir)
+	if err != nil {
+		panic(err)
+	}
+	return &store{baseDir: baseDir, idGenerator: idGenerator}
+}
+
+// store keep a json file per bucket, the buckets are few so the names are looked up by listing them
+type store struct {
+	sync.Mutex
+	baseDir     string
+	idGenerator control.UniqueIDGenerator
+}
+
+func (s *store) CreateBucket(name string, ownerID int64) (*control.BucketMeta, error) {
+	s.Lock()
+	defer s.Unlock()
+	if _, err := s.getByName(name); err == nil {
+		return nil, ErrBucketExists
+	}
+	now := time.Now().UnixMilli()
+	meta := &control.BucketMeta{
+		ID:        s.idGenerator.GenerateID(),
+		Name:      name,
+		CreatedAt: now,
+		UpdatedAt: now,
+		OwnerID:   ownerID,
+	}
+	if err := s.write(meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func (s *store) GetBucketByID(id int64) (*control.BucketMeta, error) {
+	data, err := os.ReadFile(s.path(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrBucketNotFound
+		}
+		return nil, err
+	}
+	meta := &control.BucketMeta{}
+	if err = json.Unmarshal(data, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func (s *store) GetBucketByName(name string) (*control.BucketMeta, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.getByName(name)
+}
+
+func (s *store) GetBucketByOwnerID(ownerID int64) ([]*control.BucketMeta, error) {
+	list, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	buckets := make([]*control.BucketMeta, 0)
+	for _, meta := range list {
+		if meta.OwnerID == ownerID {
+			buckets = append(buckets, meta)
+		}
+	}
+	return buckets, nil
+}
+
+func (s *store) UpdateBucket(meta *control.BucketMeta) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, err := os.Stat(s.path(meta.ID)); err != nil {
+		if os.IsNotExist(err) {
+			return ErrBucketNotFound
+		}
+		return err
+	}
+	return s.write(meta)
+}
+
+func (s *store) DeleteBucket(id int64) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := os.Remove(s.path(id)); err != nil {
+		if os.IsNotExist(err) {
+			return ErrBucketNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *store) getByName(name string) (*control.BucketMeta, error) {
+	list, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	for _, meta := range list {
+		if meta.Name == name {
+			return meta, nil
+		}
+	}
+	return nil, ErrBucketNotFound
+}
+
+func (s *store) list() ([]*control.BucketMeta, error) {
+	matches, err := filepath.Glob(filepath.Join(s.baseDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*control.BucketMeta, 0, len(matches))
+	for _, match := range matches {
+		data, err := os.ReadFile(match)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		meta := &control.BucketMeta{}
+		if err = json.Unmarshal(data, meta); err != nil {
+			return nil, err
+		}
+		list = append(list, meta)
+	}
+	return list, nil
+}
+
+// write replace the file of the bucket atomically
+func (s *store) write(meta *control.BucketMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(s.path(meta.ID), data, 0644)
+}
+
+func (s *store) path(id int64) string {
+	return filepath.Join(s.baseDir, strconv.FormatInt(id, 10)+".json")
+}
@@ -0,0 +1,119 @@
+package chunk
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"oss/internal/control"
+	"oss/internal/utils"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	ErrInvalidHash = errors.New("invalid chunk hash")
+)
+
+func NewChunkIndex(baseDir string) control.ChunkRepo {
+	err := utils.CreateDirIfNotExists(baseDir)
+	if err != nil {
+		panic(err)
+	}
+	return &index{baseDir: baseDir}
+}
+
+// index keep a json file per chunk, the reference counts are updated under the lock
+type index struct {
+	sync.Mutex
+	baseDir string
+}
+
+func (i *index) AcquireChunk(hash string) (*control.ChunkMeta, error) {
+	i.Lock()
+	defer i.Unlock()
+	meta, err := i.read(hash)
+	if err != nil {
+		return nil, err
+	}
+	meta.Refs++
+	if err = i.write(meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func (i *index) StoreChunk(meta *control.ChunkMeta) (bool, error) {
+	i.Lock()
+	defer i.Unlock()
+	stored, err := i.read(meta.Hash)
+	if err == nil {
+		stored.Refs++
+		return false, i.write(stored)
+	}
+	if !errors.Is(err, control.ErrChunkNotFound) {
+		return false, err
+	}
+	m := *meta
+	m.Refs = 1
+	return true, i.write(&m)
+}
+
+func (i *index) ReleaseChunk(hash string) (*control.ChunkMeta, error) {
+	i.Lock()
+	defer i.Unlock()
+	meta, err := i.read(hash)
+	if err != nil {
+		return nil, err
+	}
+	meta.Refs--
+	if meta.Refs > 0 {
+		return nil, i.write(meta)
+	}
+	if err = os.Remove(i.path(hash)); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func (i *index) GetChunk(hash string) (*control.ChunkMeta, error) {
+	i.Lock()
+	defer i.Unlock()
+	return i.read(hash)
+}
+
+// path returns the file of the chunk, the chunks are spread over dirs by the first byte of their hash
+func (i *index) path(hash string) string {
+	return filepath.Join(i.baseDir, hash[:2], hash+".json")
+}
+
+func (i *index) read(hash string) (*control.ChunkMeta, error) {
+	if b, err := hex.DecodeString(hash); err != nil || len(b) == 0 {
+		return nil, ErrInvalidHash
+	}
+	data, err := os.ReadFile(i.path(hash))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, control.ErrChunkNotFound
+		}
+		return nil, err
+	}
+	meta := &control.ChunkMeta{}
+	if err = json.Unmarshal(data, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// write replace the file of the chunk atomically
+func (i *index) write(meta *control.ChunkMeta) error {
+	filename := i.path(meta.Hash)
+	if err := utils.CreateDirIfNotExists(filepath.Dir(filename)); err != nil {
+		return err
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(filename, data, 0644)
+}
@@ -0,0 +1,90 @@
+package chunk_test
+
+import (
+	"errors"
+	"oss/internal/control"
+	"oss/internal/data/chunk"
+	"strings"
+	"testing"
+)
+
+func TestChunkRefs(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	meta := &control.ChunkMeta{Hash: hash, Size: 10, Stripes: []control.StripeMeta{{Size: 10}}}
+
+	// every step runs on the index left by the previous ones
+	steps := []struct {
+		name    string
+		do      func(repo control.ChunkRepo) (*control.ChunkMeta, bool, error)
+		refs    int64
+		stored  bool
+		removed bool
+		err     error
+	}{
+		{name: "acquire missing", do: acquire(hash), err: control.ErrChunkNotFound},
+		{name: "release missing", do: release(hash), err: control.ErrChunkNotFound},
+		{name: "store", do: store(meta), refs: 1, stored: true},
+		{name: "store again", do: store(meta), refs: 2},
+		{name: "acquire", do: acquire(hash), refs: 3},
+		{name: "release", do: release(hash), refs: 2},
+		{name: "release", do: release(hash), refs: 1},
+		{name: "release last", do: release(hash), removed: true},
+		{name: "get removed", do: get(hash), err: control.ErrChunkNotFound},
+		{name: "store removed", do: store(meta), refs: 1, stored: true},
+		{name: "invalid hash", do: get("not a hash"), err: chunk.ErrInvalidHash},
+	}
+	repo := chunk.NewChunkIndex(t.TempDir())
+	for _, step := range steps {
+		removed, stored, err := step.do(repo)
+		if !errors.Is(err, step.err) {
+			t.Fatalf("%s: error %v, want %v", step.name, err, step.err)
+		}
+		if err != nil {
+			continue
+		}
+		if stored != step.stored {
+			t.Fatalf("%s: stored %v, want %v", step.name, stored, step.stored)
+		}
+		if (removed != nil) != step.removed {
+			t.Fatalf("%s: removed %v, want %v", step.name, removed != nil, step.removed)
+		}
+		if step.removed {
+			continue
+		}
+		got, err := repo.GetChunk(hash)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if got.Refs != step.refs || got.Size != meta.Size || len(got.Stripes) != 1 {
+			t.Fatalf("%s: chunk %+v, want %d refs", step.name, got, step.refs)
+		}
+	}
+}
+
+func acquire(hash string) func(repo control.ChunkRepo) (*control.ChunkMeta, bool, error) {
+	return func(repo control.ChunkRepo) (*control.ChunkMeta, bool, error) {
+		_, err := repo.AcquireChunk(hash)
+		return nil, false, err
+	}
+}
+
+func store(meta *control.ChunkMeta) func(repo control.ChunkRepo) (*control.ChunkMeta, bool, error) {
+	return func(repo control.ChunkRepo) (*control.ChunkMeta, bool, error) {
+		stored, err := repo.StoreChunk(meta)
+		return nil, stored, err
+	}
+}
+
+func release(hash string) func(repo control.ChunkRepo) (*control.ChunkMeta, bool, error) {
+	return func(repo control.ChunkRepo) (*control.ChunkMeta, bool, error) {
+		removed, err := repo.ReleaseChunk(hash)
+		return removed, false, err
+	}
+}
+
+func get(hash string) func(repo control.ChunkRepo) (*control.ChunkMeta, bool, error) {
+	return func(repo control.ChunkRepo) (*control.ChunkMeta, bool, error) {
+		_, err := repo.GetChunk(hash)
+		return nil, false, err
+	}
+}
@@ -0,0 +1,238 @@
+package credential
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"oss/internal/control"
+	"oss/internal/utils"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// accessKeyPrefix mark the access keys of the store, the ids are 20 characters like the AWS ones
+	accessKeyPrefix = "OSS"
+	accessKeyIDLen  = 20
+	secretKeyBytes  = 30
+)
+
+// credentialFile is the credential file, the secret keys are kept in clear as SigV4 needs them to check the signatures
+type credentialFile struct {
+	NextUserID int64                         `json:"next_user_id"`
+	Users      map[string]*control.User      `json:"users"`
+	Keys       map[string]*control.AccessKey `json:"keys"`
+}
+
+type store struct {
+	sync.RWMutex
+	path string
+	file credentialFile
+}
+
+// NewFileCredentialStore open the credential file at path, an empty one is created when it does not exist
+func NewFileCredentialStore(path string) (*store, error) {
+	s := &store{path: path}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err = json.Unmarshal(data, &s.file); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err = utils.CreateDirIfNotExists(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	s.file = credentialFile{
+		NextUserID: 1,
+		Users:      make(map[string]*control.User),
+		Keys:       make(map[string]*control.AccessKey),
+	}
+	if err = s.write(&s.file); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *store) CreateUser(name string) (*control.User, error) {
+	s.Lock()
+	defer s.Unlock()
+	for _, user := range s.file.Users {
+		if user.Name == name {
+			return nil, control.ErrUserExists
+		}
+	}
+	f := s.clone()
+	user := &control.User{ID: f.NextUserID, Name: name, CreatedAt: time.Now().UnixMilli()}
+	f.NextUserID++
+	f.Users[strconv.FormatInt(user.ID, 10)] = user
+	if err := s.write(f); err != nil {
+		return nil, err
+	}
+	s.file = *f
+	u := *user
+	return &u, nil
+}
+
+func (s *store) GetUser(id int64) (*control.User, error) {
+	s.RLock()
+	defer s.RUnlock()
+	user, ok := s.file.Users[strconv.FormatInt(id, 10)]
+	if !ok {
+		return nil, control.ErrUserNotFound
+	}
+	u := *user
+	return &u, nil
+}
+
+func (s *store) GetUserByName(name string) (*control.User, error) {
+	s.RLock()
+	defer s.RUnlock()
+	for _, user := range s.file.Users {
+		if user.Name == name {
+			u := *user
+			return &u, nil
+		}
+	}
+	return nil, control.ErrUserNotFound
+}
+
+func (s *store) DeleteUser(id int64) error {
+	s.Lock()
+	defer s.Unlock()
+	userID := strconv.FormatInt(id, 10)
+	if _, ok := s.file.Users[userID]; !ok {
+		return control.ErrUserNotFound
+	}
+	f := s.clone()
+	delete(f.Users, userID)
+	for accessKeyID, key := range f.Keys {
+		if key.UserID == id {
+			delete(f.Keys, accessKeyID)
+		}
+	}
+	if err := s.write(f); err != nil {
+		return err
+	}
+	s.file = *f
+	return nil
+}
+
+func (s *store) CreateAccessKey(userID int64) (*control.AccessKey, error) {
+	id := make([]byte, 15)
+	secret := make([]byte, secretKeyBytes)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	key := &control.AccessKey{
+		AccessKeyID: (accessKeyPrefix + base32.StdEncoding.EncodeToString(id))[:accessKeyIDLen],
+		SecretKey:   base64.StdEncoding.EncodeToString(secret),
+		UserID:      userID,
+		CreatedAt:   time.Now().UnixMilli(),
+	}
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.file.Users[strconv.FormatInt(userID, 10)]; !ok {
+		return nil, control.ErrUserNotFound
+	}
+	f := s.clone()
+	f.Keys[key.AccessKeyID] = key
+	if err := s.write(f); err != nil {
+		return nil, err
+	}
+	s.file = *f
+	k := *key
+	return &k, nil
+}
+
+func (s *store) GetAccessKey(accessKeyID string) (*control.AccessKey, error) {
+	s.RLock()
+	defer s.RUnlock()
+	key, ok := s.file.Keys[accessKeyID]
+	if !ok {
+		return nil, control.ErrAccessKeyNotFound
+	}
+	k := *key
+	return &k, nil
+}
+
+func (s *store) GetAccessKeys(userID int64) ([]*control.AccessKey, error) {
+	s.RLock()
+	defer s.RUnlock()
+	keys := make([]*control.AccessKey, 0)
+	for _, key := range s.file.Keys {
+		if key.UserID == userID {
+			k := *key
+			keys = append(keys, &k)
+		}
+	}
+	return keys, nil
+}
+
+func (s *store) SetAccessKeyStatus(accessKeyID string, disabled bool) error {
+	s.Lock()
+	defer s.Unlock()
+	key, ok := s.file.Keys[accessKeyID]
+	if !ok {
+		return control.ErrAccessKeyNotFound
+	}
+	f := s.clone()
+	k := *key
+	k.Disabled = disabled
+	f.Keys[accessKeyID] = &k
+	if err := s.write(f); err != nil {
+		return err
+	}
+	s.file = *f
+	return nil
+}
+
+func (s *store) DeleteAccessKey(accessKeyID string) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.file.Keys[accessKeyID]; !ok {
+		return control.ErrAccessKeyNotFound
+	}
+	f := s.clone()
+	delete(f.Keys, accessKeyID)
+	if err := s.write(f); err != nil {
+		return err
+	}
+	s.file = *f
+	return nil
+}
+
+// clone returns a copy of the file to update, the file of the store is only replaced once the copy is written
+func (s *store) clone() *credentialFile {
+	f := &credentialFile{
+		NextUserID: s.file.NextUserID,
+		Users:      make(map[string]*control.User, len(s.file.Users)),
+		Keys:       make(map[string]*control.AccessKey, len(s.file.Keys)),
+	}
+	for id, user := range s.file.Users {
+		f.Users[id] = user
+	}
+	for id, key := range s.file.Keys {
+		f.Keys[id] = key
+	}
+	return f
+}
+
+// write replace the credential file atomically, it is only readable by its owner
+func (s *store) write(f *credentialFile) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(s.path, data, 0600)
+}
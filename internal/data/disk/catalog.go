@@ -0,0 +1,176 @@
+package disk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"oss/internal/control"
+	"oss/internal/utils"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	catalogExt = ".catalog"
+
+	recordDisk = "disk"
+	recordPut  = "put"
+	recordDel  = "del"
+)
+
+type key struct {
+	bucketID int64
+	objectID int64
+	blockID  int64
+}
+
+func metaKey(meta control.BlockMeta) key {
+	return key{bucketID: meta.BucketID, objectID: meta.ObjectID, blockID: meta.ID}
+}
+
+type catalogRecord struct {
+	Op     string             `json:"op"`
+	DiskID string             `json:"disk_id,omitempty"`
+	Meta   *control.BlockMeta `json:"meta,omitempty"`
+}
+
+// catalog is the log of the blocks stored on a disk. It is kept outside of the disk
+// so that the blocks of a replaced disk are known and can be rebuilt from peers.
+// DiskID is the id of the disk the blocks were stored on, it is updated once a
+// replaced disk is rebuilt.
+type catalog struct {
+	sync.Mutex
+	path   string
+	file   *os.File
+	diskID string
+}
+
+func catalogPath(dir string, diskPath string) string {
+	name := strings.ReplaceAll(strings.Trim(filepath.Clean(diskPath), string(filepath.Separator)), string(filepath.Separator), "_")
+	return filepath.Join(dir, name+catalogExt)
+}
+
+// openCatalog open the catalog and returns the blocks it holds, the catalog is rewritten without the deleted blocks
+func openCatalog(path string) (*catalog, map[key]control.BlockMeta, error) {
+	c := &catalog{path: path}
+	blocks, err := c.load()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = c.rewrite(blocks); err != nil {
+		return nil, nil, err
+	}
+	return c, blocks, nil
+}
+
+// load read the blocks of the catalog, a partial record left by a crash ends it
+func (c *catalog) load() (map[key]control.BlockMeta, error) {
+	blocks := make(map[key]control.BlockMeta)
+	file, err := os.Open(c.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return blocks, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		record := catalogRecord{}
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			break
+		}
+		switch record.Op {
+		case recordDisk:
+			c.diskID = record.DiskID
+		case recordPut:
+			if record.Meta != nil {
+				blocks[metaKey(*record.Meta)] = *record.Meta
+			}
+		case recordDel:
+			if record.Meta != nil {
+				delete(blocks, metaKey(*record.Meta))
+			}
+		}
+	}
+	return blocks, nil
+}
+
+// rewrite write the blocks to a new catalog and rename it over the catalog
+func (c *catalog) rewrite(blocks map[key]control.BlockMeta) error {
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	if c.diskID != "" {
+		if err := encoder.Encode(catalogRecord{Op: recordDisk, DiskID: c.diskID}); err != nil {
+			return err
+		}
+	}
+	for _, meta := range blocks {
+		meta := meta
+		if err := encoder.Encode(catalogRecord{Op: recordPut, Meta: &meta}); err != nil {
+			return err
+		}
+	}
+	if err := utils.WriteFileAtomic(c.path, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	var err error
+	c.file, err = os.OpenFile(c.path, os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+// append write the record and fsync it, the block is known once it returns
+func (c *catalog) append(record catalogRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	if _, err = c.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return c.file.Sync()
+}
+
+func (c *catalog) put(meta control.BlockMeta) error {
+	return c.append(catalogRecord{Op: recordPut, Meta: &meta})
+}
+
+func (c *catalog) del(k key) error {
+	return c.append(catalogRecord{Op: recordDel, Meta: &control.BlockMeta{BucketID: k.bucketID, ObjectID: k.objectID, ID: k.blockID}})
+}
+
+func (c *catalog) getDiskID() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.diskID
+}
+
+func (c *catalog) setDiskID(id string) error {
+	data, err := json.Marshal(catalogRecord{Op: recordDisk, DiskID: id})
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	if _, err = c.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err = c.file.Sync(); err != nil {
+		return err
+	}
+	c.diskID = id
+	return nil
+}
+
+func (c *catalog) close() error {
+	if c.file == nil {
+		return nil
+	}
+	return c.file.Close()
+}
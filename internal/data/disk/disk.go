@@ -0,0 +1,123 @@
+package disk
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"oss/internal/control"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	// diskIDFile hold the id of the disk, a disk without it or with another id than its catalog was replaced
+	diskIDFile = ".disk"
+	probeFile  = ".probe"
+	blocksDir  = "blocks"
+)
+
+// disk is a mount point, its fields are guarded by the lock of the store
+type disk struct {
+	// checkLock serialize the health checks of the disk
+	checkLock sync.Mutex
+
+	path    string
+	weight  float64
+	catalog *catalog
+	repo    control.BlockRepo
+	state   control.DiskState
+	total   int64
+	free    int64
+	used    int64
+	blocks  int
+}
+
+func (d *disk) writable() bool {
+	return d.state == control.DiskStateOK && d.repo != nil
+}
+
+func (d *disk) readable() bool {
+	return d.state != control.DiskStateFailed && d.repo != nil
+}
+
+// health is the result of a disk check
+type health struct {
+	state control.DiskState
+	id    string
+	total int64
+	free  int64
+}
+
+// checkDisk probe the disk by writing, syncing and reading back a file
+func checkDisk(path string) health {
+	h := health{state: control.DiskStateFailed}
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		return h
+	}
+	id, err := os.ReadFile(filepath.Join(path, diskIDFile))
+	if err != nil && !os.IsNotExist(err) {
+		return h
+	}
+	h.id = strings.TrimSpace(string(id))
+
+	if err = probe(path); err != nil {
+		if !errors.Is(err, syscall.EROFS) {
+			return h
+		}
+		h.state = control.DiskStateReadOnly
+	} else {
+		h.state = control.DiskStateOK
+	}
+	h.total, h.free, _ = diskSpace(path)
+	return h
+}
+
+func probe(path string) error {
+	filename := filepath.Join(path, probeFile)
+	data := []byte("probe")
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	read, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(read, data) {
+		return errors.New("probe data mismatch")
+	}
+	return os.Remove(filename)
+}
+
+// writeDiskID give a new id to the disk
+func writeDiskID(path string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	file, err := os.Create(filepath.Join(path, diskIDFile))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err = file.WriteString(id); err != nil {
+		return "", err
+	}
+	return id, file.Sync()
+}
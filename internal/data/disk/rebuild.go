@@ -0,0 +1,106 @@
+package disk
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"oss/internal/control"
+	"time"
+)
+
+// Fetcher fetch a block from the peers holding its other replicas
+type Fetcher func(ctx context.Context, meta control.BlockMeta) (io.Reader, error)
+
+// RunHealthCheck check the disks every CheckInterval until ctx is done,
+// the blocks of a replaced disk are rebuilt with fetch
+func (s *store) RunHealthCheck(ctx context.Context, fetch Fetcher) {
+	ticker := time.NewTicker(s.opt.CheckInterval)
+	defer ticker.Stop()
+	for {
+		for _, d := range s.disks {
+			s.refresh(d)
+			s.RLock()
+			rebuilding := d.state == control.DiskStateRebuilding
+			s.RUnlock()
+			if !rebuilding || fetch == nil {
+				continue
+			}
+			if err := s.Rebuild(ctx, d.path, fetch); err != nil {
+				log.Debugf("rebuild disk %s failed: %v", d.path, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Rebuild fetch the blocks of the catalog of the disk that are missing on it,
+// the disk is back in rotation once all of them are rebuilt
+func (s *store) Rebuild(ctx context.Context, path string, fetch Fetcher) error {
+	var d *disk
+	for _, disk := range s.disks {
+		if disk.path == path {
+			d = disk
+		}
+	}
+	if d == nil || !s.readable(d) {
+		return ErrDiskUnavailable
+	}
+	blocks, err := d.catalog.load()
+	if err != nil {
+		return err
+	}
+
+	rebuilt, failed := 0, 0
+	for k, meta := range blocks {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		// the block was deleted or moved since the catalog was read
+		s.RLock()
+		loc, ok := s.blocks[k]
+		s.RUnlock()
+		if !ok || loc.disk != d {
+			continue
+		}
+		if _, err = d.repo.GetBlockMeta(ctx, k.bucketID, k.objectID, k.blockID); err == nil {
+			continue
+		} else if !errors.Is(err, control.ErrBlockNotFound) {
+			return err
+		}
+		if err = s.rebuildBlock(ctx, d, meta, fetch); err != nil {
+			log.Debugf("rebuild block %d of disk %s failed: %v", meta.ID, d.path, err)
+			failed++
+			continue
+		}
+		rebuilt++
+	}
+	log.Debugf("rebuild disk %s: %d blocks rebuilt, %d failed", d.path, rebuilt, failed)
+	if failed > 0 {
+		return errors.New("some blocks are not rebuilt")
+	}
+
+	h := checkDisk(d.path)
+	if h.state != control.DiskStateOK || h.id == "" {
+		return ErrDiskUnavailable
+	}
+	if err = d.catalog.setDiskID(h.id); err != nil {
+		return err
+	}
+	s.refresh(d)
+	return nil
+}
+
+func (s *store) rebuildBlock(ctx context.Context, d *disk, meta control.BlockMeta, fetch Fetcher) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	data, err := fetch(ctx, meta)
+	if err != nil {
+		return err
+	}
+	return d.repo.StoreBlock(ctx, meta, data)
+}
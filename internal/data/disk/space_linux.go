@@ -0,0 +1,14 @@
+//go:build linux
+
+package disk
+
+import "syscall"
+
+// diskSpace returns the total and the available bytes of the file system of path
+func diskSpace(path string) (int64, int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+	return int64(stat.Blocks) * int64(stat.Bsize), int64(stat.Bavail) * int64(stat.Bsize), nil
+}
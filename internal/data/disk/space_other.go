@@ -0,0 +1,8 @@
+//go:build !linux
+
+package disk
+
+// diskSpace is unknown on this platform, the disks are then placed by weight only
+func diskSpace(path string) (int64, int64, error) {
+	return 0, 0, nil
+}
@@ -0,0 +1,374 @@
+package disk
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math/rand"
+	"oss/internal/control"
+	"oss/internal/data/block"
+	"oss/internal/utils"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMinFree       = 1 << 30
+	defaultCheckInterval = 30 * time.Second
+)
+
+var (
+	ErrNoDiskAvailable = errors.New("no disk available")
+	ErrDiskUnavailable = errors.New("disk unavailable")
+)
+
+// Disk is a mount point managed by the store
+type Disk struct {
+	Path string
+	// Weight scale the share of the new blocks placed on the disk, 0 means 1
+	Weight float64
+}
+
+type Option struct {
+	// MinFree is the free bytes under which a disk takes no more block
+	MinFree int64
+	// CheckInterval is the interval between two health checks of the disks
+	CheckInterval time.Duration
+}
+
+func WithMinFree(minFree int64) Option {
+	return Option{MinFree: minFree}
+}
+
+func WithCheckInterval(interval time.Duration) Option {
+	return Option{CheckInterval: interval}
+}
+
+func (o Option) apply(opt *Option) {
+	if o.MinFree > 0 {
+		opt.MinFree = o.MinFree
+	}
+	if o.CheckInterval > 0 {
+		opt.CheckInterval = o.CheckInterval
+	}
+}
+
+type location struct {
+	disk *disk
+	size int64
+}
+
+// store is a BlockRepo spreading the blocks over a set of disks, every disk is a directory
+// block store. New blocks are placed by free space and weight on the healthy disks, failed
+// disks are taken out of rotation and read-only disks only serve reads.
+type store struct {
+	sync.RWMutex
+	opt    Option
+	disks  []*disk
+	blocks map[key]location
+}
+
+// NewMultiDiskStore returns a BlockRepo storing the blocks on disks,
+// the catalogs of the disks are kept in catalogDir that must not be on one of them
+func NewMultiDiskStore(catalogDir string, disks []Disk, opt ...Option) (*store, error) {
+	if err := utils.CreateDirIfNotExists(catalogDir); err != nil {
+		return nil, err
+	}
+	s := &store{
+		opt: Option{
+			MinFree:       defaultMinFree,
+			CheckInterval: defaultCheckInterval,
+		},
+		blocks: make(map[key]location),
+	}
+	for _, o := range opt {
+		o.apply(&s.opt)
+	}
+	for _, config := range disks {
+		c, blocks, err := openCatalog(catalogPath(catalogDir, config.Path))
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		d := &disk{path: config.Path, weight: config.Weight, catalog: c}
+		if d.weight <= 0 {
+			d.weight = 1
+		}
+		for k, meta := range blocks {
+			s.blocks[k] = location{disk: d, size: meta.Size}
+			d.used += meta.Size
+			d.blocks++
+		}
+		s.disks = append(s.disks, d)
+		s.refresh(d)
+	}
+	return s, nil
+}
+
+// refresh check the health of the disk and update its state
+func (s *store) refresh(d *disk) {
+	d.checkLock.Lock()
+	defer d.checkLock.Unlock()
+
+	h := checkDisk(d.path)
+	if h.state != control.DiskStateFailed && d.repo == nil {
+		repo, err := block.OpenBlockStore(filepath.Join(d.path, blocksDir))
+		if err != nil {
+			h.state = control.DiskStateFailed
+		}
+		s.Lock()
+		d.repo = repo
+		s.Unlock()
+	}
+
+	if h.state == control.DiskStateOK && h.id == "" {
+		id, err := writeDiskID(d.path)
+		if err != nil {
+			h.state = control.DiskStateFailed
+		}
+		h.id = id
+	}
+	if h.state != control.DiskStateFailed {
+		s.RLock()
+		empty := d.blocks == 0
+		s.RUnlock()
+		switch catalogID := d.catalog.getDiskID(); {
+		case catalogID == "" || (catalogID != h.id && empty):
+			if h.state == control.DiskStateOK {
+				if err := d.catalog.setDiskID(h.id); err != nil {
+					log.Debugf("update catalog of disk %s failed: %v", d.path, err)
+				}
+			}
+		case catalogID != h.id:
+			// the disk was replaced, its blocks are rebuilt from the peers
+			if h.state == control.DiskStateOK {
+				h.state = control.DiskStateRebuilding
+			} else {
+				h.state = control.DiskStateFailed
+			}
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if d.state != h.state {
+		log.Debugf("disk %s state %s -> %s", d.path, d.state, h.state)
+	}
+	d.state, d.total, d.free = h.state, h.total, h.free
+}
+
+// place pick the disk of a new block of size, weighted by free space and weight
+func (s *store) place(size int64) (*disk, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	candidates := make([]*disk, 0, len(s.disks))
+	scores := make([]float64, 0, len(s.disks))
+	total := 0.0
+	for _, d := range s.disks {
+		if !d.writable() {
+			continue
+		}
+		score := d.weight
+		// the space is unknown when total is 0
+		if d.total > 0 {
+			available := d.free - s.opt.MinFree
+			if available < size {
+				continue
+			}
+			score *= float64(available)
+		}
+		candidates = append(candidates, d)
+		scores = append(scores, score)
+		total += score
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoDiskAvailable
+	}
+	r := rand.Float64() * total
+	for i, score := range scores {
+		if r < score {
+			return candidates[i], nil
+		}
+		r -= score
+	}
+	return candidates[len(candidates)-1], nil
+}
+
+// locate returns the disk holding the block, the readable disks are searched when the catalogs miss it
+func (s *store) locate(ctx context.Context, k key) (*disk, error) {
+	s.RLock()
+	loc, ok := s.blocks[k]
+	disks := s.disks
+	s.RUnlock()
+	if ok {
+		if !s.readable(loc.disk) {
+			return nil, ErrDiskUnavailable
+		}
+		return loc.disk, nil
+	}
+	for _, d := range disks {
+		if !s.readable(d) {
+			continue
+		}
+		meta, err := d.repo.GetBlockMeta(ctx, k.bucketID, k.objectID, k.blockID)
+		if err != nil {
+			continue
+		}
+		s.Lock()
+		if _, ok = s.blocks[k]; !ok {
+			s.blocks[k] = location{disk: d, size: meta.Size}
+			d.used += meta.Size
+			d.blocks++
+		}
+		s.Unlock()
+		d.catalog.put(*meta)
+		return d, nil
+	}
+	return nil, control.ErrBlockNotFound
+}
+
+func (s *store) readable(d *disk) bool {
+	s.RLock()
+	defer s.RUnlock()
+	return d.readable()
+}
+
+// failed check the disk after an operation on it failed with err
+func (s *store) failed(ctx context.Context, d *disk, err error) {
+	if ctx.Err() != nil || errors.Is(err, control.ErrBlockNotFound) || errors.Is(err, control.ErrBlockCorrupted) {
+		return
+	}
+	s.refresh(d)
+}
+
+func (s *store) StoreBlock(ctx context.Context, meta control.BlockMeta, data io.Reader) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	d, err := s.place(meta.Size)
+	if err != nil {
+		return err
+	}
+	if err = d.repo.StoreBlock(ctx, meta, data); err != nil {
+		s.failed(ctx, d, err)
+		return err
+	}
+	if err = d.catalog.put(meta); err != nil {
+		log.Debugf("update catalog of disk %s failed: %v", d.path, err)
+	}
+
+	k := metaKey(meta)
+	s.Lock()
+	old, ok := s.blocks[k]
+	if ok {
+		old.disk.used -= old.size
+		old.disk.blocks--
+	}
+	s.blocks[k] = location{disk: d, size: meta.Size}
+	d.used += meta.Size
+	d.free -= meta.Size
+	d.blocks++
+	s.Unlock()
+
+	// a stored block replaced on another disk
+	if ok && old.disk != d {
+		if s.readable(old.disk) {
+			old.disk.repo.DeleteBlock(ctx, k.bucketID, k.objectID, k.blockID)
+		}
+		old.disk.catalog.del(k)
+	}
+	return nil
+}
+
+func (s *store) GetBlock(ctx context.Context, bucketID int64, objectID int64, blockID int64) (io.Reader, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	d, err := s.locate(ctx, key{bucketID: bucketID, objectID: objectID, blockID: blockID})
+	if err != nil {
+		return nil, err
+	}
+	data, err := d.repo.GetBlock(ctx, bucketID, objectID, blockID)
+	if err != nil {
+		s.failed(ctx, d, err)
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *store) DeleteBlock(ctx context.Context, bucketID int64, objectID int64, blockID int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	k := key{bucketID: bucketID, objectID: objectID, blockID: blockID}
+	s.Lock()
+	loc, ok := s.blocks[k]
+	if ok {
+		delete(s.blocks, k)
+		loc.disk.used -= loc.size
+		loc.disk.free += loc.size
+		loc.disk.blocks--
+	}
+	s.Unlock()
+	if !ok {
+		return nil
+	}
+	// the block of a failed disk is only removed from its catalog so that it is not rebuilt
+	if err := loc.disk.catalog.del(k); err != nil {
+		return err
+	}
+	if !s.readable(loc.disk) {
+		return nil
+	}
+	if err := loc.disk.repo.DeleteBlock(ctx, bucketID, objectID, blockID); err != nil {
+		s.failed(ctx, loc.disk, err)
+		return err
+	}
+	return nil
+}
+
+func (s *store) GetBlockMeta(ctx context.Context, bucketID int64, objectID int64, blockID int64) (*control.BlockMeta, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	d, err := s.locate(ctx, key{bucketID: bucketID, objectID: objectID, blockID: blockID})
+	if err != nil {
+		return nil, err
+	}
+	meta, err := d.repo.GetBlockMeta(ctx, bucketID, objectID, blockID)
+	if err != nil {
+		s.failed(ctx, d, err)
+		return nil, err
+	}
+	return meta, nil
+}
+
+// Usage returns the usage of every disk
+func (s *store) Usage() []control.DiskUsage {
+	s.RLock()
+	defer s.RUnlock()
+
+	usage := make([]control.DiskUsage, 0, len(s.disks))
+	for _, d := range s.disks {
+		usage = append(usage, control.DiskUsage{
+			Path:   d.path,
+			State:  d.state,
+			Weight: d.weight,
+			Total:  d.total,
+			Free:   d.free,
+			Used:   d.used,
+		})
+	}
+	return usage
+}
+
+// Close close the catalogs of the disks
+func (s *store) Close() error {
+	for _, d := range s.disks {
+		d.catalog.close()
+	}
+	return nil
+}
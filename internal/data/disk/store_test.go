@@ -0,0 +1,310 @@
+package disk_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"oss/internal/control"
+	"oss/internal/data/disk"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// diskStore is the block repo of the disks with its health checks
+type diskStore interface {
+	control.BlockRepo
+	Usage() []control.DiskUsage
+	RunHealthCheck(ctx context.Context, fetch disk.Fetcher)
+	Rebuild(ctx context.Context, path string, fetch disk.Fetcher) error
+	Close() error
+}
+
+type testDisks struct {
+	catalog string
+	disks   []disk.Disk
+}
+
+// newTestDisks returns the disks of the weights under a temp dir
+func newTestDisks(t *testing.T, weights ...float64) *testDisks {
+	root := t.TempDir()
+	td := &testDisks{catalog: filepath.Join(root, "catalog")}
+	for i, weight := range weights {
+		path := filepath.Join(root, fmt.Sprintf("disk%d", i))
+		if err := os.Mkdir(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+		td.disks = append(td.disks, disk.Disk{Path: path, Weight: weight})
+	}
+	return td
+}
+
+func (td *testDisks) open(t *testing.T, opt ...disk.Option) diskStore {
+	t.Helper()
+	s, err := disk.NewMultiDiskStore(td.catalog, td.disks, append([]disk.Option{disk.WithMinFree(1)}, opt...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// check run one health check of the disks
+func check(s diskStore, fetch disk.Fetcher) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.RunHealthCheck(ctx, fetch)
+}
+
+func usage(s diskStore, path string) control.DiskUsage {
+	for _, u := range s.Usage() {
+		if u.Path == path {
+			return u
+		}
+	}
+	return control.DiskUsage{}
+}
+
+func blockData(id int64) []byte {
+	return []byte(fmt.Sprintf("block %d", id))
+}
+
+func put(t *testing.T, s diskStore, id int64) error {
+	t.Helper()
+	data := blockData(id)
+	meta := control.BlockMeta{ID: id, BucketID: 1, ObjectID: 2, Size: int64(len(data)), Checksum: crc32.ChecksumIEEE(data)}
+	return s.StoreBlock(context.Background(), meta, bytes.NewReader(data))
+}
+
+func get(s diskStore, id int64) ([]byte, error) {
+	r, err := s.GetBlock(context.Background(), 1, 2, id)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// blocksOn returns the ids of the blocks stored on the disk
+func blocksOn(t *testing.T, d disk.Disk) map[int64]bool {
+	t.Helper()
+	dirs, err := filepath.Glob(filepath.Join(d.Path, "blocks", "1", "2", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[int64]bool)
+	for _, dir := range dirs {
+		var id int64
+		fmt.Sscan(filepath.Base(dir), &id)
+		ids[id] = true
+	}
+	return ids
+}
+
+func TestPlacementByWeight(t *testing.T) {
+	td := newTestDisks(t, 1, 3)
+	s := td.open(t)
+	defer s.Close()
+	for id := int64(1); id <= 400; id++ {
+		if err := put(t, s, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the disks share the file system, the blocks follow the weights
+	light, heavy := len(blocksOn(t, td.disks[0])), len(blocksOn(t, td.disks[1]))
+	if light+heavy != 400 || heavy < 240 || heavy > 360 {
+		t.Fatalf("%d blocks on the disk of weight 1 and %d on the disk of weight 3", light, heavy)
+	}
+
+	// no disk keeps the free space
+	full := td.open(t, disk.WithMinFree(1<<62))
+	defer full.Close()
+	if err := put(t, full, 1000); !errors.Is(err, disk.ErrNoDiskAvailable) {
+		t.Fatalf("store on full disks: %v, want ErrNoDiskAvailable", err)
+	}
+}
+
+func TestFailedDisk(t *testing.T) {
+	td := newTestDisks(t, 1, 1)
+	s := td.open(t)
+	defer s.Close()
+	for id := int64(1); id <= 20; id++ {
+		if err := put(t, s, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lost := blocksOn(t, td.disks[0])
+	if len(lost) == 0 || len(lost) == 20 {
+		t.Fatalf("%d of 20 blocks on the first disk", len(lost))
+	}
+
+	// the disk is unmounted
+	failed := td.disks[0].Path
+	if err := os.Rename(failed, failed+".gone"); err != nil {
+		t.Fatal(err)
+	}
+	check(s, nil)
+	if state := usage(s, failed).State; state != control.DiskStateFailed {
+		t.Fatalf("state %s of the unmounted disk, want failed", state)
+	}
+	for id := int64(1); id <= 20; id++ {
+		data, err := get(s, id)
+		if lost[id] {
+			if !errors.Is(err, disk.ErrDiskUnavailable) {
+				t.Fatalf("block %d of the failed disk: %v, want ErrDiskUnavailable", id, err)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(data, blockData(id)) {
+			t.Fatalf("block %d: %v", id, err)
+		}
+	}
+	// the new blocks avoid the failed disk
+	for id := int64(100); id < 120; id++ {
+		if err := put(t, s, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(blocksOn(t, td.disks[1])); n != 20-len(lost)+20 {
+		t.Fatalf("%d blocks on the healthy disk", n)
+	}
+
+	// the disk is mounted back
+	if err := os.Rename(failed+".gone", failed); err != nil {
+		t.Fatal(err)
+	}
+	check(s, nil)
+	if state := usage(s, failed).State; state != control.DiskStateOK {
+		t.Fatalf("state %s of the mounted disk, want ok", state)
+	}
+	for id := range lost {
+		if data, err := get(s, id); err != nil || !bytes.Equal(data, blockData(id)) {
+			t.Fatalf("block %d: %v", id, err)
+		}
+	}
+}
+
+func TestCatalogRewrite(t *testing.T) {
+	td := newTestDisks(t, 1)
+	s := td.open(t)
+	for id := int64(1); id <= 10; id++ {
+		if err := put(t, s, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id := int64(1); id <= 10; id += 2 {
+		if err := s.DeleteBlock(context.Background(), 1, 2, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+
+	// a record of an interrupted append ends the catalog
+	catalogs, err := filepath.Glob(filepath.Join(td.catalog, "*"))
+	if err != nil || len(catalogs) != 1 {
+		t.Fatalf("catalogs %v: %v", catalogs, err)
+	}
+	file, err := os.OpenFile(catalogs[0], os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"op":"put","meta":{"id":`)
+	file.Close()
+
+	s = td.open(t)
+	defer s.Close()
+	// the catalog is rewritten with the disk id and the live blocks
+	data, err := os.ReadFile(catalogs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 6 {
+		t.Fatalf("rewritten catalog has %d records, want 6:\n%s", len(lines), data)
+	}
+	want := int64(0)
+	for id := int64(2); id <= 10; id += 2 {
+		want += int64(len(blockData(id)))
+	}
+	if used := usage(s, td.disks[0].Path).Used; used != want {
+		t.Fatalf("used %d bytes, want %d", used, want)
+	}
+	for id := int64(1); id <= 10; id++ {
+		data, err := get(s, id)
+		if id%2 == 1 {
+			if !errors.Is(err, control.ErrBlockNotFound) {
+				t.Fatalf("deleted block %d: %v, want ErrBlockNotFound", id, err)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(data, blockData(id)) {
+			t.Fatalf("block %d: %v", id, err)
+		}
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	td := newTestDisks(t, 1, 1)
+	s := td.open(t)
+	for id := int64(1); id <= 20; id++ {
+		if err := put(t, s, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lost := blocksOn(t, td.disks[0])
+
+	// the disk is replaced by an empty one
+	replaced := td.disks[0].Path
+	if err := os.RemoveAll(replaced); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(replaced, 0755); err != nil {
+		t.Fatal(err)
+	}
+	fail := errors.New("peer unavailable")
+	fetched := 0
+	fetch := func(ctx context.Context, meta control.BlockMeta) (io.Reader, error) {
+		if fail != nil {
+			return nil, fail
+		}
+		fetched++
+		return bytes.NewReader(blockData(meta.ID)), nil
+	}
+	// the disk stays out of rotation while blocks are missing
+	check(s, fetch)
+	if state := usage(s, replaced).State; state != control.DiskStateRebuilding {
+		t.Fatalf("state %s of the replaced disk, want rebuilding", state)
+	}
+	for id := int64(100); id < 110; id++ {
+		if err := put(t, s, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(blocksOn(t, td.disks[0])); n != 0 {
+		t.Fatalf("%d new blocks placed on the rebuilding disk", n)
+	}
+
+	fail = nil
+	if err := s.Rebuild(context.Background(), replaced, fetch); err != nil {
+		t.Fatal(err)
+	}
+	if fetched != len(lost) {
+		t.Fatalf("%d blocks fetched, want %d", fetched, len(lost))
+	}
+	if state := usage(s, replaced).State; state != control.DiskStateOK {
+		t.Fatalf("state %s of the rebuilt disk, want ok", state)
+	}
+	for id := range lost {
+		if data, err := get(s, id); err != nil || !bytes.Equal(data, blockData(id)) {
+			t.Fatalf("rebuilt block %d: %v", id, err)
+		}
+	}
+	// the rebuilt disk is kept once the store is reopened
+	s.Close()
+	reopened := td.open(t)
+	defer reopened.Close()
+	if state := usage(reopened, replaced).State; state != control.DiskStateOK {
+		t.Fatalf("state %s of the reopened disk, want ok", state)
+	}
+}
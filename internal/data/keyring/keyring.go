@@ -0,0 +1,110 @@
+package keyring
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"oss/internal/control"
+	"oss/internal/utils"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrEmptyKeyRing = errors.New("key ring has no master key")
+)
+
+// ringFile is the keyring file, the master keys are never removed so that old data keys can still be unwrapped
+type ringFile struct {
+	Current string            `json:"current"`
+	Keys    map[string][]byte `json:"keys"`
+}
+
+type keyRing struct {
+	sync.RWMutex
+	path string
+	file ringFile
+}
+
+// NewFileKeyRing open the keyring file at path, a keyring with one master key is created when it does not exist
+func NewFileKeyRing(path string) (*keyRing, error) {
+	r := &keyRing{path: path}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err = json.Unmarshal(data, &r.file); err != nil {
+			return nil, err
+		}
+		if _, ok := r.file.Keys[r.file.Current]; !ok {
+			return nil, ErrEmptyKeyRing
+		}
+		return r, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err = utils.CreateDirIfNotExists(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	if _, err = r.Rotate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *keyRing) CurrentKeyID() string {
+	r.RLock()
+	defer r.RUnlock()
+	return r.file.Current
+}
+
+func (r *keyRing) WrapKey(dataKey []byte) (string, []byte, error) {
+	r.RLock()
+	keyID, key := r.file.Current, r.file.Keys[r.file.Current]
+	r.RUnlock()
+	wrapped, err := utils.Seal(key, dataKey, []byte(keyID))
+	if err != nil {
+		return "", nil, err
+	}
+	return keyID, wrapped, nil
+}
+
+func (r *keyRing) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	r.RLock()
+	key, ok := r.file.Keys[keyID]
+	r.RUnlock()
+	if !ok {
+		return nil, control.ErrKeyNotFound
+	}
+	return utils.Open(key, wrapped, []byte(keyID))
+}
+
+// Rotate add a new master key and make it the current one, the data keys are re-wrapped by the ctrl
+func (r *keyRing) Rotate() (string, error) {
+	key, err := utils.RandomKey()
+	if err != nil {
+		return "", err
+	}
+	r.Lock()
+	defer r.Unlock()
+	keyID := strconv.FormatInt(time.Now().UnixNano(), 36)
+	f := ringFile{Current: keyID, Keys: map[string][]byte{keyID: key}}
+	for id, k := range r.file.Keys {
+		f.Keys[id] = k
+	}
+	if err = r.write(&f); err != nil {
+		return "", err
+	}
+	r.file = f
+	return keyID, nil
+}
+
+// write replace the keyring file atomically, it is only readable by its owner
+func (r *keyRing) write(f *ringFile) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(r.path, data, 0600)
+}
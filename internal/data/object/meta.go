@@ -1,6 +1,8 @@
 package object
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"os"
@@ -8,14 +10,18 @@ import (
 	"oss/internal/utils"
 	"path/filepath"
 	"strconv"
+	"sync"
 )
 
+// namesDir hold the name files of a bucket
+const namesDir = "names"
+
 var (
 	ErrMetaAlreadyExists = errors.New("object already exists")
-	ErrMetaNotFound      = errors.New("object not found")
+	ErrMetaNotFound      = control.ErrObjectNotFound
 )
 
-func NewObjectMetaStore(baseDir string) control.MetaStore {
+func NewObjectMetaStore(baseDir string) control.ObjectMetaRepo {
 	err := utils.CreateDirIfNotExists(baseDir)
 	if err != nil {
 		panic(err)
@@ -24,8 +30,11 @@ func NewObjectMetaStore(baseDir string) control.MetaStore {
 	return &store{baseDir: baseDir}
 }
 
+// store keep a json file per object, and a name file per object name holding the id of the latest object of the name
 type store struct {
-	baseDir string
+	// nameLock serialize the updates of the name files
+	nameLock sync.Mutex
+	baseDir  string
 }
 
 func (o *store) GetMetaList(bucketID int64) ([]*control.ObjectMeta, error) {
@@ -38,17 +47,23 @@ func (o *store) GetMetaList(bucketID int64) ([]*control.ObjectMeta, error) {
 			if info.IsDir() || filepath.Ext(path) != ".json" {
 				return nil
 			}
-			f, err := os.Open(info.Name())
+			f, err := os.Open(path)
 			if err != nil {
 				return err
 			}
+			defer f.Close()
 			meta := &control.ObjectMeta{}
-			err = json.NewDecoder(f).Decode(meta)
+			if err = json.NewDecoder(f).Decode(meta); err != nil {
+				return err
+			}
 			list = append(list, meta)
 			return nil
 		}
 	)
 	bucketDir := filepath.Join(o.baseDir, strconv.FormatInt(bucketID, 10))
+	if _, err := os.Stat(bucketDir); os.IsNotExist(err) {
+		return list, nil
+	}
 	if err := filepath.Walk(bucketDir, walkFn); err != nil {
 		return nil, err
 	}
@@ -70,9 +85,13 @@ func (o *store) StoreMeta(meta *control.ObjectMeta) error {
 	}
 	err = json.NewEncoder(f).Encode(meta)
 	if err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
 		return err
 	}
-	return nil
+	return o.setName(meta.BucketID, meta.Name, meta.ID)
 }
 
 func (o *store) GetMeta(bucketID int64, objectID int64) (*control.ObjectMeta, error) {
@@ -88,6 +107,7 @@ func (o *store) GetMeta(bucketID int64, objectID int64) (*control.ObjectMeta, er
 		}
 		return nil, err
 	}
+	defer f.Close()
 	meta := &control.ObjectMeta{}
 	err = json.NewDecoder(f).Decode(meta)
 	if err != nil {
@@ -95,3 +115,80 @@ func (o *store) GetMeta(bucketID int64, objectID int64) (*control.ObjectMeta, er
 	}
 	return meta, nil
 }
+
+func (o *store) GetMetaByName(bucketID int64, name string) (*control.ObjectMeta, error) {
+	data, err := os.ReadFile(o.namePath(bucketID, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrMetaNotFound
+		}
+		return nil, err
+	}
+	objectID, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return o.GetMeta(bucketID, objectID)
+}
+
+func (o *store) DeleteMeta(bucketID int64, objectID int64) error {
+	meta, err := o.GetMeta(bucketID, objectID)
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(o.baseDir, strconv.FormatInt(bucketID, 10), strconv.FormatInt(objectID, 10)+".json")
+	if err = os.Remove(filename); err != nil {
+		if os.IsNotExist(err) {
+			return ErrMetaNotFound
+		}
+		return err
+	}
+	return o.unsetName(bucketID, meta.Name, objectID)
+}
+
+func (o *store) UpdateMeta(meta *control.ObjectMeta) error {
+	if _, err := o.GetMeta(meta.BucketID, meta.ID); err != nil {
+		return err
+	}
+	filename := filepath.Join(o.baseDir, strconv.FormatInt(meta.BucketID, 10), strconv.FormatInt(meta.ID, 10)+".json")
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	// the meta is replaced atomically, a crash keeps the old one
+	return utils.WriteFileAtomic(filename, data, 0644)
+}
+
+// namePath returns the name file of the object name, the name is hashed as it may be longer than a file name
+func (o *store) namePath(bucketID int64, name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return filepath.Join(o.baseDir, strconv.FormatInt(bucketID, 10), namesDir, hex.EncodeToString(sum[:]))
+}
+
+func (o *store) setName(bucketID int64, name string, objectID int64) error {
+	o.nameLock.Lock()
+	defer o.nameLock.Unlock()
+	filename := o.namePath(bucketID, name)
+	if err := utils.CreateDirIfNotExists(filepath.Dir(filename)); err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(filename, []byte(strconv.FormatInt(objectID, 10)), 0644)
+}
+
+// unsetName remove the name file when it still holds the object
+func (o *store) unsetName(bucketID int64, name string, objectID int64) error {
+	o.nameLock.Lock()
+	defer o.nameLock.Unlock()
+	filename := o.namePath(bucketID, name)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if string(data) != strconv.FormatInt(objectID, 10) {
+		return nil
+	}
+	return os.Remove(filename)
+}
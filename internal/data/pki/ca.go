@@ -0,0 +1,224 @@
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"oss/internal/control"
+	"oss/internal/utils"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CACertFile = "ca.crt"
+	CAKeyFile  = "ca.key"
+
+	defaultCAValidity   = 10 * 365 * 24 * time.Hour
+	defaultNodeValidity = 365 * 24 * time.Hour
+	// clockSkew backdate the certificates so that a peer with a slow clock accept them
+	clockSkew = 5 * time.Minute
+
+	// nodeURIScheme and nodeURIHost make the uri SAN oss://node/<nid> naming the node of a certificate
+	nodeURIScheme = "oss"
+	nodeURIHost   = "node"
+)
+
+var (
+	ErrNotCA      = errors.New("certificate is not a CA")
+	ErrInvalidPEM = errors.New("no pem block found")
+)
+
+// CA issue the node certificates of the cluster, its certificate and key are PEM files in a local dir
+type CA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// NewFileCA open the CA in dir, a self signed CA is created when dir has none
+func NewFileCA(dir string, name string) (*CA, error) {
+	certFile, keyFile := filepath.Join(dir, CACertFile), filepath.Join(dir, CAKeyFile)
+	if _, err := os.Stat(certFile); err == nil {
+		return LoadCA(certFile, keyFile)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := utils.CreateDirIfNotExists(dir); err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             now.Add(-clockSkew),
+		NotAfter:              now.Add(defaultCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	// the key is written first, a cert without its key is never left
+	if err = writeKey(keyFile, key); err != nil {
+		return nil, err
+	}
+	if err = writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return nil, err
+	}
+	return &CA{cert: cert, key: key}, nil
+}
+
+// LoadCA read the CA from its PEM files
+func LoadCA(certFile string, keyFile string) (*CA, error) {
+	cert, err := readCert(certFile)
+	if err != nil {
+		return nil, err
+	}
+	if !cert.IsCA {
+		return nil, ErrNotCA
+	}
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrInvalidPEM
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, ErrNotCA
+	}
+	return &CA{cert: cert, key: signer}, nil
+}
+
+// Certificate returns the certificate of the CA
+func (ca *CA) Certificate() *x509.Certificate {
+	return ca.cert
+}
+
+// IssueNode issue the certificate of the node nid, valid for the hosts and for validity, 0 is a year. The cert and
+// the key are written to certFile and keyFile, a running node reloads them.
+func (ca *CA) IssueNode(nid int64, hosts []string, validity time.Duration, certFile string, keyFile string) error {
+	if validity <= 0 {
+		validity = defaultNodeValidity
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "node-" + strconv.FormatInt(nid, 10)},
+		NotBefore:    now.Add(-clockSkew),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		// a node is both the server and the client of its peers
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		URIs:        []*url.URL{nodeURI(nid)},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return err
+	}
+	if err = utils.CreateDirIfNotExists(filepath.Dir(certFile)); err != nil {
+		return err
+	}
+	if err = utils.CreateDirIfNotExists(filepath.Dir(keyFile)); err != nil {
+		return err
+	}
+	if err = writeKey(keyFile, key); err != nil {
+		return err
+	}
+	return writePEM(certFile, "CERTIFICATE", der, 0644)
+}
+
+// NodeID returns the NID of the uri SAN of the certificate
+func NodeID(cert *x509.Certificate) (int64, error) {
+	for _, uri := range cert.URIs {
+		if uri.Scheme != nodeURIScheme || uri.Host != nodeURIHost {
+			continue
+		}
+		nid, err := strconv.ParseInt(strings.TrimPrefix(uri.Path, "/"), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return nid, nil
+	}
+	return 0, control.ErrNoNodeID
+}
+
+func nodeURI(nid int64) *url.URL {
+	return &url.URL{Scheme: nodeURIScheme, Host: nodeURIHost, Path: "/" + strconv.FormatInt(nid, 10)}
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func readCert(certFile string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrInvalidPEM
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func writeKey(keyFile string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writePEM(keyFile, "PRIVATE KEY", der, 0600)
+}
+
+// writePEM replace the file atomically with the PEM block of der
+func writePEM(filename string, blockType string, der []byte, perm os.FileMode) error {
+	return utils.WriteFileAtomic(filename, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), perm)
+}
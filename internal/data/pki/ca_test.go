@@ -0,0 +1,90 @@
+package pki_test
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"oss/internal/control"
+	"oss/internal/data/pki"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// nodeFiles returns the cert and the key files of the node in dir
+func nodeFiles(dir string, nid int64) (string, string) {
+	name := strconv.FormatInt(nid, 10)
+	return filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+}
+
+func readCert(t *testing.T, certFile string) *x509.Certificate {
+	t.Helper()
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatalf("no pem block in %s", certFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestCA(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := pki.NewFileCA(filepath.Join(dir, "ca"), "test ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca.Certificate().IsCA || ca.Certificate().Subject.CommonName != "test ca" {
+		t.Fatalf("CA certificate %s is not a CA", ca.Certificate().Subject)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "ca", pki.CAKeyFile)); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("CA key file: %v", err)
+	}
+	// the CA of the dir is opened again
+	reopened, err := pki.NewFileCA(filepath.Join(dir, "ca"), "other name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reopened.Certificate().Equal(ca.Certificate()) {
+		t.Fatal("a new CA is created over the CA of the dir")
+	}
+
+	certFile, keyFile := nodeFiles(filepath.Join(dir, "node"), 7)
+	if err = ca.IssueNode(7, []string{"127.0.0.1", "node7.local"}, time.Hour, certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	cert := readCert(t, certFile)
+	if nid, err := pki.NodeID(cert); err != nil || nid != 7 {
+		t.Fatalf("node id %d: %v, want 7", nid, err)
+	}
+	if len(cert.IPAddresses) != 1 || !cert.IPAddresses[0].Equal([]byte{127, 0, 0, 1}) || len(cert.DNSNames) != 1 || cert.DNSNames[0] != "node7.local" {
+		t.Fatalf("hosts %v %v", cert.IPAddresses, cert.DNSNames)
+	}
+	if cert.NotAfter.After(time.Now().Add(time.Hour)) {
+		t.Fatalf("certificate valid until %s, want an hour", cert.NotAfter)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Certificate())
+	if _, err = cert.Verify(x509.VerifyOptions{Roots: pool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Fatalf("node certificate not verified by the CA: %v", err)
+	}
+	if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("node key file: %v", err)
+	}
+
+	// a node certificate is not a CA and the CA certificate has no node
+	if _, err = pki.LoadCA(certFile, keyFile); !errors.Is(err, pki.ErrNotCA) {
+		t.Fatalf("load of a node certificate as CA: %v, want ErrNotCA", err)
+	}
+	if _, err = pki.NodeID(ca.Certificate()); !errors.Is(err, control.ErrNoNodeID) {
+		t.Fatalf("node id of the CA: %v, want ErrNoNodeID", err)
+	}
+}
@@ -0,0 +1,185 @@
+package pki
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"oss/internal/control"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrNoCACert = errors.New("no CA certificate found")
+)
+
+// credentials is a loaded version of the files of the identity
+type credentials struct {
+	cert  *tls.Certificate
+	pool  *x509.CertPool
+	stamp []fileStamp
+}
+
+// fileStamp is the size and the modification time of a file when it is loaded
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+type identity struct {
+	caFile   string
+	certFile string
+	keyFile  string
+	// reloadLock serialize the reloads, the handshakes read current without lock
+	reloadLock sync.Mutex
+	current    atomic.Pointer[credentials]
+}
+
+// NewFileIdentity load the node certificate of certFile and keyFile, and the CA certificates of caFile. The files are
+// reloaded at the next handshake once they change, a reload failure keeps the loaded ones.
+func NewFileIdentity(caFile string, certFile string, keyFile string) (*identity, error) {
+	id := &identity{caFile: caFile, certFile: certFile, keyFile: keyFile}
+	if err := id.Reload(); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// Reload read the files again
+func (id *identity) Reload() error {
+	id.reloadLock.Lock()
+	defer id.reloadLock.Unlock()
+	return id.reload()
+}
+
+func (id *identity) reload() error {
+	// stamped before reading, a file changed while being read is read again next time
+	stamp, err := id.stamp()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(id.caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return ErrNoCACert
+	}
+	cert, err := tls.LoadX509KeyPair(id.certFile, id.keyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	// a cert half replaced with a new CA is not taken
+	if _, err = verifyNode(cert.Leaf, nil, pool, x509.ExtKeyUsageAny); err != nil {
+		return err
+	}
+	id.current.Store(&credentials{cert: &cert, pool: pool, stamp: stamp})
+	return nil
+}
+
+func (id *identity) stamp() ([]fileStamp, error) {
+	files := []string{id.caFile, id.certFile, id.keyFile}
+	stamp := make([]fileStamp, len(files))
+	for i, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		stamp[i] = fileStamp{size: info.Size(), modTime: info.ModTime()}
+	}
+	return stamp, nil
+}
+
+// credentials returns the loaded credentials, they are reloaded first when the files changed
+func (id *identity) credentials() *credentials {
+	current := id.current.Load()
+	stamp, err := id.stamp()
+	if err != nil || slices.Equal(stamp, current.stamp) {
+		return current
+	}
+	id.reloadLock.Lock()
+	defer id.reloadLock.Unlock()
+	if current = id.current.Load(); slices.Equal(stamp, current.stamp) {
+		return current
+	}
+	if err = id.reload(); err != nil {
+		log.Debugf("reload node certificate %s failed: %v", id.certFile, err)
+	}
+	return id.current.Load()
+}
+
+func (id *identity) ServerTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		// the config of every handshake is made of the current credentials
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			current := id.credentials()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS13,
+				NextProtos:   []string{"h2"},
+				Certificates: []tls.Certificate{*current.cert},
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				ClientCAs:    current.pool,
+				VerifyPeerCertificate: func(_ [][]byte, chains [][]*x509.Certificate) error {
+					if len(chains) == 0 || len(chains[0]) == 0 {
+						return control.ErrNoNodeID
+					}
+					_, err := NodeID(chains[0][0])
+					return err
+				},
+			}, nil
+		},
+	}
+}
+
+func (id *identity) ClientTLSConfig(nid int64) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return id.credentials().cert, nil
+		},
+		// the server is verified by its NID rather than by its host, against the current CA
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return control.ErrNoNodeID
+			}
+			got, err := verifyNode(state.PeerCertificates[0], state.PeerCertificates[1:], id.credentials().pool, x509.ExtKeyUsageServerAuth)
+			if err != nil {
+				return err
+			}
+			if got != nid {
+				return control.ErrNodeIDInvalid
+			}
+			return nil
+		},
+	}
+}
+
+func (id *identity) NodeID(cert *x509.Certificate) (int64, error) {
+	return NodeID(cert)
+}
+
+// verifyNode verify the certificate is issued by the CA of pool and returns its NID
+func verifyNode(cert *x509.Certificate, intermediates []*x509.Certificate, pool *x509.CertPool, usage x509.ExtKeyUsage) (int64, error) {
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}
+	for _, c := range intermediates {
+		opts.Intermediates.AddCert(c)
+	}
+	if _, err := cert.Verify(opts); err != nil {
+		return 0, err
+	}
+	return NodeID(cert)
+}
@@ -0,0 +1,174 @@
+package pki_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"oss/internal/control"
+	"oss/internal/data/pki"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	*pki.CA
+	dir    string
+	caFile string
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), name)
+	ca, err := pki.NewFileCA(dir, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{CA: ca, dir: dir, caFile: filepath.Join(dir, pki.CACertFile)}
+}
+
+// identity issue the certificate of the node and returns its identity
+func (ca *testCA) identity(t *testing.T, nid int64) control.NodeIdentity {
+	t.Helper()
+	certFile, keyFile := nodeFiles(ca.dir, nid)
+	if err := ca.IssueNode(nid, []string{"127.0.0.1"}, 0, certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	id, err := pki.NewFileIdentity(ca.caFile, certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// handshake run a TLS handshake over a loopback connection and returns the errors of the server and of the client
+func handshake(t *testing.T, server *tls.Config, client *tls.Config) (error, error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		serverErr <- tls.Server(conn, server).Handshake()
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// a TLS 1.3 client is done before the server verified its certificate, the server reports the rejection
+	clientErr := tls.Client(conn, client).Handshake()
+	conn.Close()
+	return <-serverErr, clientErr
+}
+
+func TestHandshake(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	server, client := ca.identity(t, 1), ca.identity(t, 2)
+	foreign := newTestCA(t, "foreign")
+	// the foreign server has the NID of the server
+	rogueServer := foreign.identity(t, 1)
+	// the foreign client trusts both CAs, its certificate is issued by the foreign one
+	both := filepath.Join(t.TempDir(), "both.crt")
+	caCert, err := os.ReadFile(ca.caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreignCert, err := os.ReadFile(foreign.caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(both, append(caCert, foreignCert...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := nodeFiles(foreign.dir, 3)
+	if err = foreign.IssueNode(3, nil, 0, certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	rogueClient, err := pki.NewFileIdentity(both, certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unknownAuthority := func(err error) bool {
+		return errors.As(err, &x509.UnknownAuthorityError{})
+	}
+	cases := []struct {
+		name      string
+		server    control.NodeIdentity
+		client    control.NodeIdentity
+		nid       int64
+		serverErr func(error) bool
+		clientErr func(error) bool
+	}{
+		{name: "same CA", server: server, client: client, nid: 1},
+		{name: "server of another NID", server: server, client: client, nid: 3,
+			clientErr: func(err error) bool { return errors.Is(err, control.ErrNodeIDInvalid) }},
+		{name: "server of a foreign CA", server: rogueServer, client: client, nid: 1, clientErr: unknownAuthority},
+		{name: "client of a foreign CA", server: server, client: rogueClient, nid: 1, serverErr: unknownAuthority},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			serverErr, clientErr := handshake(t, tc.server.ServerTLSConfig(), tc.client.ClientTLSConfig(tc.nid))
+			switch {
+			case tc.clientErr != nil:
+				if !tc.clientErr(clientErr) {
+					t.Fatalf("client error %v", clientErr)
+				}
+			case tc.serverErr != nil:
+				if !tc.serverErr(serverErr) {
+					t.Fatalf("server error %v", serverErr)
+				}
+			default:
+				if serverErr != nil || clientErr != nil {
+					t.Fatalf("server error %v, client error %v", serverErr, clientErr)
+				}
+			}
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	client := ca.identity(t, 2)
+	certFile, keyFile := nodeFiles(ca.dir, 1)
+	server := ca.identity(t, 1)
+	if serverErr, clientErr := handshake(t, server.ServerTLSConfig(), client.ClientTLSConfig(1)); serverErr != nil || clientErr != nil {
+		t.Fatalf("server error %v, client error %v", serverErr, clientErr)
+	}
+
+	// the files of the server are replaced with the certificate of another NID, the next handshake takes it
+	if err := ca.IssueNode(4, []string{"127.0.0.1"}, 0, certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handshake(t, server.ServerTLSConfig(), client.ClientTLSConfig(1)); !errors.Is(err, control.ErrNodeIDInvalid) {
+		t.Fatalf("client error %v with the old NID, want ErrNodeIDInvalid", err)
+	}
+	if serverErr, clientErr := handshake(t, server.ServerTLSConfig(), client.ClientTLSConfig(4)); serverErr != nil || clientErr != nil {
+		t.Fatalf("server error %v, client error %v with the reloaded certificate", serverErr, clientErr)
+	}
+
+	// a certificate of a foreign CA is not taken, the loaded one is kept
+	foreign := newTestCA(t, "foreign")
+	if err := foreign.IssueNode(5, []string{"127.0.0.1"}, 0, certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if serverErr, clientErr := handshake(t, server.ServerTLSConfig(), client.ClientTLSConfig(4)); serverErr != nil || clientErr != nil {
+		t.Fatalf("server error %v, client error %v after a failed reload", serverErr, clientErr)
+	}
+	if err := server.(interface{ Reload() error }).Reload(); err == nil {
+		t.Fatal("certificate of a foreign CA reloaded")
+	}
+}
@@ -0,0 +1,155 @@
+package volume
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"time"
+)
+
+// RunCompactor compact the volumes every CompactInterval until ctx is done
+func (s *store) RunCompactor(ctx context.Context) {
+	ticker := time.NewTicker(s.opt.CompactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.Compact(); err != nil {
+			log.Debugf("compact volumes failed: %v", err)
+		}
+	}
+}
+
+// Compact rewrite the sealed volumes whose garbage ratio reached GarbageRatio
+func (s *store) Compact() error {
+	s.compactLock.Lock()
+	defer s.compactLock.Unlock()
+
+	s.Lock()
+	candidates := make([]*volume, 0)
+	for _, v := range s.volumes {
+		if v != s.active && v.size > 0 && float64(v.garbage) >= float64(v.size)*s.opt.GarbageRatio {
+			candidates = append(candidates, v)
+		}
+	}
+	s.Unlock()
+
+	for _, v := range candidates {
+		if err := s.compactVolume(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compactVolume copy the live needles of v to a new volume and remove v.
+// A tombstone is kept as long as another volume may hold an older needle of its key.
+func (s *store) compactVolume(v *volume) error {
+	s.Lock()
+	live := make([]entry, 0)
+	for _, e := range s.entries {
+		if e.vol == v {
+			live = append(live, *e)
+		}
+	}
+	dropped := make([]entry, 0)
+	for _, e := range s.tombstones {
+		if e.vol != v {
+			continue
+		}
+		if s.shadows(v, e.n.seq) {
+			live = append(live, *e)
+		} else {
+			dropped = append(dropped, *e)
+		}
+	}
+	var nv *volume
+	if len(live) > 0 {
+		var err error
+		if nv, _, err = openVolume(s.dir, s.nextID); err != nil {
+			s.Unlock()
+			return err
+		}
+		s.nextID++
+	}
+	v.refs++
+	s.Unlock()
+	defer s.release(v)
+
+	// copy the live needles, their sequence numbers are kept
+	moved := make([]entry, 0, len(live))
+	for _, e := range live {
+		meta, err := v.readMeta(e.n)
+		if err != nil {
+			s.discard(nv)
+			return err
+		}
+		n := e.n
+		data := io.NewSectionReader(v.file, e.n.dataOffset(), e.n.size)
+		if err = nv.append(&n, data, func() ([]byte, error) { return meta, nil }); err != nil {
+			s.discard(nv)
+			return err
+		}
+		nv.commit(n)
+		moved = append(moved, entry{vol: nv, n: n})
+	}
+	if nv != nil {
+		if err := nv.sync(); err != nil {
+			s.discard(nv)
+			return err
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	for i := range moved {
+		e := &moved[i]
+		index := s.entries
+		if e.n.tombstone() {
+			index = s.tombstones
+		}
+		// the needle may have been replaced or deleted during the copy
+		if cur, ok := index[e.n.key]; ok && cur.vol == v && cur.n.seq == e.n.seq {
+			index[e.n.key] = e
+		} else {
+			nv.garbage += e.n.length()
+		}
+	}
+	for _, e := range dropped {
+		if cur, ok := s.tombstones[e.n.key]; ok && cur.vol == v && cur.n.seq == e.n.seq {
+			delete(s.tombstones, e.n.key)
+		}
+	}
+	if nv != nil {
+		s.volumes[nv.id] = nv
+	}
+	delete(s.volumes, v.id)
+	v.retired = true
+	log.Debugf("compact volume %d: %d bytes to %d bytes", v.id, v.size, v.size-v.garbage)
+	return v.remove()
+}
+
+// shadows reports whether a volume other than v may hold a needle older than seq,
+// must be called with lock held
+func (s *store) shadows(v *volume, seq uint64) bool {
+	for _, other := range s.volumes {
+		if other != v && other.size > 0 && other.minSeq < seq {
+			return true
+		}
+	}
+	return false
+}
+
+// discard remove a volume that failed to be written by a compaction
+func (s *store) discard(v *volume) {
+	if v == nil {
+		return
+	}
+	v.close()
+	os.Remove(v.file.Name())
+	os.Remove(v.index.Name())
+}
@@ -0,0 +1,119 @@
+package volume
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	needleMagic      uint32 = 0x4e45444c
+	needleHeaderSize        = 4 + 1 + 8 + 8*3 + 4 + 8
+	needleFooterSize        = 4
+	indexRecordSize         = 1 + 8 + 8*3 + 8 + 4 + 8
+
+	flagTombstone byte = 1
+)
+
+var (
+	ErrCorruptedNeedle = errors.New("corrupted needle")
+)
+
+type key struct {
+	bucketID int64
+	objectID int64
+	blockID  int64
+}
+
+// needle is a block appended to a volume:
+// header | data | meta json | crc32 of data, meta and header.
+// The meta follows the data so that the digest computed while the data streams can be recorded in it.
+// A tombstone is a needle without meta and data that delete the block of its key.
+type needle struct {
+	flags   byte
+	seq     uint64
+	key     key
+	metaLen uint32
+	size    int64
+	offset  int64
+}
+
+func (n *needle) tombstone() bool {
+	return n.flags&flagTombstone != 0
+}
+
+// length returns the bytes the needle takes in the volume
+func (n *needle) length() int64 {
+	return needleHeaderSize + int64(n.metaLen) + n.size + needleFooterSize
+}
+
+func (n *needle) dataOffset() int64 {
+	return n.offset + needleHeaderSize
+}
+
+func (n *needle) metaOffset() int64 {
+	return n.dataOffset() + n.size
+}
+
+func (n *needle) header() []byte {
+	b := make([]byte, needleHeaderSize)
+	binary.LittleEndian.PutUint32(b[0:], needleMagic)
+	b[4] = n.flags
+	binary.LittleEndian.PutUint64(b[5:], n.seq)
+	binary.LittleEndian.PutUint64(b[13:], uint64(n.key.bucketID))
+	binary.LittleEndian.PutUint64(b[21:], uint64(n.key.objectID))
+	binary.LittleEndian.PutUint64(b[29:], uint64(n.key.blockID))
+	binary.LittleEndian.PutUint32(b[37:], n.metaLen)
+	binary.LittleEndian.PutUint64(b[41:], uint64(n.size))
+	return b
+}
+
+func decodeHeader(b []byte, offset int64) (needle, error) {
+	if binary.LittleEndian.Uint32(b[0:]) != needleMagic {
+		return needle{}, ErrCorruptedNeedle
+	}
+	n := needle{
+		flags: b[4],
+		seq:   binary.LittleEndian.Uint64(b[5:]),
+		key: key{
+			bucketID: int64(binary.LittleEndian.Uint64(b[13:])),
+			objectID: int64(binary.LittleEndian.Uint64(b[21:])),
+			blockID:  int64(binary.LittleEndian.Uint64(b[29:])),
+		},
+		metaLen: binary.LittleEndian.Uint32(b[37:]),
+		size:    int64(binary.LittleEndian.Uint64(b[41:])),
+		offset:  offset,
+	}
+	if n.size < 0 {
+		return needle{}, ErrCorruptedNeedle
+	}
+	return n, nil
+}
+
+// record returns the index record of the needle
+func (n *needle) record() []byte {
+	b := make([]byte, indexRecordSize)
+	b[0] = n.flags
+	binary.LittleEndian.PutUint64(b[1:], n.seq)
+	binary.LittleEndian.PutUint64(b[9:], uint64(n.key.bucketID))
+	binary.LittleEndian.PutUint64(b[17:], uint64(n.key.objectID))
+	binary.LittleEndian.PutUint64(b[25:], uint64(n.key.blockID))
+	binary.LittleEndian.PutUint64(b[33:], uint64(n.offset))
+	binary.LittleEndian.PutUint32(b[41:], n.metaLen)
+	binary.LittleEndian.PutUint64(b[45:], uint64(n.size))
+	return b
+}
+
+func decodeRecord(b []byte) needle {
+	return needle{
+		flags: b[0],
+		seq:   binary.LittleEndian.Uint64(b[1:]),
+		key: key{
+			bucketID: int64(binary.LittleEndian.Uint64(b[9:])),
+			objectID: int64(binary.LittleEndian.Uint64(b[17:])),
+			blockID:  int64(binary.LittleEndian.Uint64(b[25:])),
+		},
+		offset:  int64(binary.LittleEndian.Uint64(b[33:])),
+		metaLen: binary.LittleEndian.Uint32(b[41:]),
+		size:    int64(binary.LittleEndian.Uint64(b[45:])),
+	}
+}
@@ -0,0 +1,395 @@
+package volume
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"oss/internal/control"
+	"oss/internal/utils"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxVolumeSize   = 1 << 30
+	defaultGarbageRatio    = 0.5
+	defaultCompactInterval = 10 * time.Minute
+)
+
+type Option struct {
+	// MaxVolumeSize is the size after which the blocks are appended to a new volume
+	MaxVolumeSize int64
+	// GarbageRatio is the ratio of deleted bytes after which a volume is compacted
+	GarbageRatio float64
+	// CompactInterval is the interval between two compactions
+	CompactInterval time.Duration
+}
+
+func WithMaxVolumeSize(size int64) Option {
+	return Option{MaxVolumeSize: size}
+}
+
+func WithCompaction(interval time.Duration, garbageRatio float64) Option {
+	return Option{CompactInterval: interval, GarbageRatio: garbageRatio}
+}
+
+func (o Option) apply(opt *Option) {
+	if o.MaxVolumeSize > 0 {
+		opt.MaxVolumeSize = o.MaxVolumeSize
+	}
+	if o.GarbageRatio > 0 && o.GarbageRatio <= 1 {
+		opt.GarbageRatio = o.GarbageRatio
+	}
+	if o.CompactInterval > 0 {
+		opt.CompactInterval = o.CompactInterval
+	}
+}
+
+type entry struct {
+	vol *volume
+	n   needle
+}
+
+// store is a BlockRepo appending the blocks to large volume files instead of
+// one directory per block. The location of every block is kept in memory and
+// in the index file of its volume, a deleted block is marked by a tombstone
+// and its bytes are reclaimed by the compaction.
+// Every needle has a sequence number, the needle with the highest one wins
+// when the volumes are loaded, so a compaction may move needles to a new volume.
+type store struct {
+	// writeLock serialize the appends to the active volume
+	writeLock sync.Mutex
+	// compactLock serialize the compactions
+	compactLock sync.Mutex
+
+	sync.Mutex
+	dir        string
+	opt        Option
+	volumes    map[int64]*volume
+	active     *volume
+	nextID     int64
+	seq        uint64
+	entries    map[key]*entry
+	tombstones map[key]*entry
+}
+
+// NewVolumeStore returns a BlockRepo appending the blocks to the volumes under baseDir
+func NewVolumeStore(baseDir string, opt ...Option) (*store, error) {
+	if err := utils.CreateDirIfNotExists(baseDir); err != nil {
+		return nil, err
+	}
+	s := &store{
+		dir: baseDir,
+		opt: Option{
+			MaxVolumeSize:   defaultMaxVolumeSize,
+			GarbageRatio:    defaultGarbageRatio,
+			CompactInterval: defaultCompactInterval,
+		},
+		volumes:    make(map[int64]*volume),
+		nextID:     1,
+		seq:        1,
+		entries:    make(map[key]*entry),
+		tombstones: make(map[key]*entry),
+	}
+	for _, o := range opt {
+		o.apply(&s.opt)
+	}
+	if err := s.load(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load open the volumes and replay their needles in sequence order
+func (s *store) load() error {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	entries := make([]entry, 0)
+	for _, file := range files {
+		name := file.Name()
+		id, err := strconv.ParseInt(strings.TrimSuffix(name, filepath.Ext(name)), 10, 64)
+		if err != nil {
+			continue
+		}
+		if filepath.Ext(name) == indexExt {
+			// the index left by a volume removed by a compaction
+			if _, err = os.Stat(volumePath(s.dir, id, volumeExt)); os.IsNotExist(err) {
+				os.Remove(filepath.Join(s.dir, name))
+			}
+			continue
+		}
+		if filepath.Ext(name) != volumeExt {
+			continue
+		}
+		v, needles, err := openVolume(s.dir, id)
+		if err != nil {
+			return err
+		}
+		s.volumes[id] = v
+		if id >= s.nextID {
+			s.nextID = id + 1
+		}
+		if s.active == nil || id > s.active.id {
+			s.active = v
+		}
+		for _, n := range needles {
+			entries = append(entries, entry{vol: v, n: n})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].n.seq < entries[j].n.seq
+	})
+	for i := range entries {
+		e := &entries[i]
+		if e.n.seq >= s.seq {
+			s.seq = e.n.seq + 1
+		}
+		if e.n.tombstone() {
+			s.applyTombstone(e)
+			continue
+		}
+		if cur, ok := s.entries[e.n.key]; ok && cur.n.seq >= e.n.seq {
+			// the copy of a needle left by an interrupted compaction
+			e.vol.garbage += e.n.length()
+			continue
+		}
+		s.applyBlock(e)
+	}
+
+	if s.active == nil {
+		return s.roll()
+	}
+	return nil
+}
+
+// applyBlock make e the block of its key, must be called with lock held
+func (s *store) applyBlock(e *entry) {
+	if cur, ok := s.entries[e.n.key]; ok {
+		cur.vol.garbage += cur.n.length()
+	}
+	if cur, ok := s.tombstones[e.n.key]; ok {
+		cur.vol.garbage += cur.n.length()
+		delete(s.tombstones, e.n.key)
+	}
+	s.entries[e.n.key] = e
+}
+
+// applyTombstone delete the block of the key of e, must be called with lock held
+func (s *store) applyTombstone(e *entry) {
+	if cur, ok := s.entries[e.n.key]; ok {
+		cur.vol.garbage += cur.n.length()
+		delete(s.entries, e.n.key)
+	}
+	if cur, ok := s.tombstones[e.n.key]; ok {
+		cur.vol.garbage += cur.n.length()
+	}
+	s.tombstones[e.n.key] = e
+}
+
+// roll create a new active volume, must be called with lock held
+func (s *store) roll() error {
+	v, _, err := openVolume(s.dir, s.nextID)
+	if err != nil {
+		return err
+	}
+	s.nextID++
+	s.volumes[v.id] = v
+	s.active = v
+	return nil
+}
+
+// write append a needle to the active volume, must be called with writeLock held
+func (s *store) write(n needle, data io.Reader, meta func() ([]byte, error)) (*entry, error) {
+	s.Lock()
+	if s.active.size >= s.opt.MaxVolumeSize {
+		if err := s.roll(); err != nil {
+			s.Unlock()
+			return nil, err
+		}
+	}
+	v := s.active
+	n.seq = s.seq
+	s.seq++
+	s.Unlock()
+
+	if err := v.append(&n, data, meta); err != nil {
+		return nil, err
+	}
+	if err := v.file.Sync(); err != nil {
+		v.rollback()
+		return nil, err
+	}
+	s.Lock()
+	v.commit(n)
+	s.Unlock()
+	return &entry{vol: v, n: n}, nil
+}
+
+// StoreBlock append the block to the active volume, the checksum is verified as the data streams
+// and the digest is computed when the meta has an algorithm but no digest
+func (s *store) StoreBlock(ctx context.Context, meta control.BlockMeta, data io.Reader) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	reader, err := control.NewBlockChecksumReader(utils.NewContextReader(ctx, data), meta)
+	if err != nil {
+		return err
+	}
+	n := needle{
+		key:  key{bucketID: meta.BucketID, objectID: meta.ObjectID, blockID: meta.ID},
+		size: meta.Size,
+	}
+	metaData := func() ([]byte, error) {
+		if meta.ChecksumAlgorithm != "" && meta.Digest == nil {
+			meta.Digest = reader.Sum()
+		}
+		return json.Marshal(meta)
+	}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	e, err := s.write(n, reader, metaData)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	s.applyBlock(e)
+	s.Unlock()
+	return nil
+}
+
+func (s *store) GetBlock(ctx context.Context, bucketID int64, objectID int64, blockID int64) (io.Reader, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	e, err := s.acquire(key{bucketID: bucketID, objectID: objectID, blockID: blockID})
+	if err != nil {
+		return nil, err
+	}
+	meta, err := e.readMeta()
+	if err != nil {
+		s.release(e.vol)
+		return nil, err
+	}
+	// the data is verified as it is read
+	reader, err := control.NewBlockChecksumReader(&blockReader{
+		SectionReader: io.NewSectionReader(e.vol.file, e.n.dataOffset(), e.n.size),
+		release:       func() { s.release(e.vol) },
+	}, *meta)
+	if err != nil {
+		s.release(e.vol)
+		return nil, err
+	}
+	return reader, nil
+}
+
+func (s *store) DeleteBlock(ctx context.Context, bucketID int64, objectID int64, blockID int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	k := key{bucketID: bucketID, objectID: objectID, blockID: blockID}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.Lock()
+	_, ok := s.entries[k]
+	s.Unlock()
+	if !ok {
+		return nil
+	}
+	e, err := s.write(needle{flags: flagTombstone, key: k}, strings.NewReader(""), func() ([]byte, error) { return nil, nil })
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	s.applyTombstone(e)
+	s.Unlock()
+	return nil
+}
+
+func (s *store) GetBlockMeta(ctx context.Context, bucketID int64, objectID int64, blockID int64) (*control.BlockMeta, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	e, err := s.acquire(key{bucketID: bucketID, objectID: objectID, blockID: blockID})
+	if err != nil {
+		return nil, err
+	}
+	defer s.release(e.vol)
+	return e.readMeta()
+}
+
+func (e entry) readMeta() (*control.BlockMeta, error) {
+	data, err := e.vol.readMeta(e.n)
+	if err != nil {
+		return nil, err
+	}
+	meta := &control.BlockMeta{}
+	err = json.Unmarshal(data, meta)
+	return meta, err
+}
+
+// acquire returns the entry of the key and hold its volume until it is released
+func (s *store) acquire(k key) (entry, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	e, ok := s.entries[k]
+	if !ok {
+		return entry{}, control.ErrBlockNotFound
+	}
+	e.vol.refs++
+	return *e, nil
+}
+
+func (s *store) release(v *volume) {
+	s.Lock()
+	defer s.Unlock()
+
+	v.refs--
+	if v.retired && v.refs == 0 {
+		v.close()
+	}
+}
+
+// Close close all the volumes
+func (s *store) Close() error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.Lock()
+	defer s.Unlock()
+
+	for _, v := range s.volumes {
+		v.close()
+	}
+	return nil
+}
+
+// blockReader read the data of a needle and release its volume at EOF or Close
+type blockReader struct {
+	*io.SectionReader
+	release func()
+	once    sync.Once
+}
+
+func (r *blockReader) Read(p []byte) (int, error) {
+	n, err := r.SectionReader.Read(p)
+	if err == io.EOF {
+		r.Close()
+	}
+	return n, err
+}
+
+func (r *blockReader) Close() error {
+	r.once.Do(r.release)
+	return nil
+}
@@ -0,0 +1,249 @@
+package volume_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"oss/internal/control"
+	"oss/internal/data/volume"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// volumeStore is the block repo of the volumes with its compaction
+type volumeStore interface {
+	control.BlockRepo
+	Compact() error
+	Close() error
+}
+
+func openStore(t *testing.T, dir string, opt ...volume.Option) volumeStore {
+	t.Helper()
+	s, err := volume.NewVolumeStore(dir, opt...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// blockData returns the data of the block id, the same for a size
+func blockData(id int64, size int) []byte {
+	return bytes.Repeat([]byte{byte(id)}, size)
+}
+
+func put(t *testing.T, s volumeStore, id int64, data []byte) {
+	t.Helper()
+	meta := control.BlockMeta{ID: id, BucketID: 1, ObjectID: 2, Size: int64(len(data)), Checksum: crc32.ChecksumIEEE(data)}
+	if err := s.StoreBlock(context.Background(), meta, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func remove(t *testing.T, s volumeStore, id int64) {
+	t.Helper()
+	if err := s.DeleteBlock(context.Background(), 1, 2, id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// check verify the store holds the blocks of want and no other block of ids
+func check(t *testing.T, s volumeStore, want map[int64][]byte, ids ...int64) {
+	t.Helper()
+	for _, id := range ids {
+		data, err := func() ([]byte, error) {
+			r, err := s.GetBlock(context.Background(), 1, 2, id)
+			if err != nil {
+				return nil, err
+			}
+			return io.ReadAll(r)
+		}()
+		if _, ok := want[id]; !ok {
+			if !errors.Is(err, control.ErrBlockNotFound) {
+				t.Fatalf("block %d: %v, want ErrBlockNotFound", id, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("block %d: %v", id, err)
+		}
+		if !bytes.Equal(data, want[id]) {
+			t.Fatalf("block %d holds other data", id)
+		}
+		meta, err := s.GetBlockMeta(context.Background(), 1, 2, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.ID != id || meta.Size != int64(len(want[id])) {
+			t.Fatalf("block %d has the meta of block %d of %d bytes", id, meta.ID, meta.Size)
+		}
+	}
+}
+
+func volumeFiles(t *testing.T, dir string, ext string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+ext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, volume.WithMaxVolumeSize(4096))
+	want := make(map[int64][]byte)
+	for id := int64(1); id <= 10; id++ {
+		want[id] = blockData(id, 1000)
+		put(t, s, id, want[id])
+	}
+	// the blocks are replaced and deleted in the later volumes
+	for id := int64(1); id <= 10; id += 3 {
+		want[id] = blockData(id+100, 500)
+		put(t, s, id, want[id])
+	}
+	for id := int64(2); id <= 10; id += 2 {
+		remove(t, s, id)
+		delete(want, id)
+	}
+	// a failed write leaves nothing
+	bad := control.BlockMeta{ID: 20, BucketID: 1, ObjectID: 2, Size: 10, Checksum: 1}
+	if err := s.StoreBlock(context.Background(), bad, bytes.NewReader(make([]byte, 10))); !errors.Is(err, control.ErrBlockCorrupted) {
+		t.Fatalf("store of a corrupted block: %v, want ErrBlockCorrupted", err)
+	}
+	check(t, s, want, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 20)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openStore(t, dir, volume.WithMaxVolumeSize(4096))
+	defer s.Close()
+	check(t, s, want, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 20)
+}
+
+func TestStoreCrashTail(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir)
+	want := map[int64][]byte{1: blockData(1, 1000), 2: blockData(2, 1000)}
+	put(t, s, 1, want[1])
+	put(t, s, 2, want[2])
+	s.Close()
+
+	// the index lost the last needle and the volume ends with a partial needle
+	vol := volumeFiles(t, dir, ".vol")[0]
+	stat, err := os.Stat(vol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := volumeFiles(t, dir, ".idx")[0]
+	records, err := os.ReadFile(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(index, records[:len(records)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(vol, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("partial needle"))
+	file.Close()
+
+	s = openStore(t, dir)
+	check(t, s, want, 1, 2)
+	if got, err := os.Stat(vol); err != nil || got.Size() != stat.Size() {
+		t.Fatalf("partial needle not dropped: %v", err)
+	}
+	if got, err := os.ReadFile(index); err != nil || !bytes.Equal(got, records) {
+		t.Fatalf("index not rebuilt: %v", err)
+	}
+	put(t, s, 3, blockData(3, 1000))
+	want[3] = blockData(3, 1000)
+	s.Close()
+
+	s = openStore(t, dir)
+	defer s.Close()
+	check(t, s, want, 1, 2, 3)
+}
+
+func TestStoreStaleIndexRecord(t *testing.T) {
+	// the record of block 1 whose volume write was rolled back after the index was written
+	stale := t.TempDir()
+	s := openStore(t, stale)
+	put(t, s, 1, blockData(1, 100))
+	s.Close()
+	record, err := os.ReadFile(volumeFiles(t, stale, ".idx")[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// block 2 is written at the offset of the rolled back block
+	dir := t.TempDir()
+	s = openStore(t, dir)
+	put(t, s, 2, blockData(2, 200))
+	s.Close()
+	index := volumeFiles(t, dir, ".idx")[0]
+	records, err := os.ReadFile(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(index, append(record, records...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openStore(t, dir)
+	defer s.Close()
+	check(t, s, map[int64][]byte{2: blockData(2, 200)}, 1, 2)
+}
+
+func TestStoreCompaction(t *testing.T) {
+	dir := t.TempDir()
+	opt := []volume.Option{volume.WithMaxVolumeSize(4096), volume.WithCompaction(time.Hour, 0.5)}
+	s := openStore(t, dir, opt...)
+	want := make(map[int64][]byte)
+	for id := int64(1); id <= 12; id++ {
+		want[id] = blockData(id, 1000)
+		put(t, s, id, want[id])
+	}
+	// the first volumes become garbage, the tombstones stay in the last ones
+	for id := int64(1); id <= 8; id++ {
+		if id%2 == 0 {
+			remove(t, s, id)
+			delete(want, id)
+		} else {
+			want[id] = blockData(id+100, 1000)
+			put(t, s, id, want[id])
+		}
+	}
+
+	// a reader holds its volume while it is compacted
+	r, err := s.GetBlock(context.Background(), 1, 2, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumes := len(volumeFiles(t, dir, ".vol"))
+	if err = s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(volumeFiles(t, dir, ".vol")); n >= volumes {
+		t.Fatalf("%d volumes after the compaction, %d before", n, volumes)
+	}
+	if n := len(volumeFiles(t, dir, ".idx")); n != len(volumeFiles(t, dir, ".vol")) {
+		t.Fatalf("%d index files left for the volumes", n)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(data, want[9]) {
+		t.Fatalf("reader of a compacted volume: %v", err)
+	}
+	check(t, s, want, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12)
+	s.Close()
+
+	// the deleted blocks stay deleted once the volumes are replayed
+	s = openStore(t, dir, opt...)
+	defer s.Close()
+	check(t, s, want, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12)
+}
@@ -0,0 +1,229 @@
+package volume
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	volumeExt = ".vol"
+	indexExt  = ".idx"
+)
+
+// volume is an append-only data file of needles and its index file.
+// The index is rebuilt from the data file when the tail of it was not indexed.
+type volume struct {
+	id    int64
+	file  *os.File
+	index *os.File
+	size  int64
+	// indexSize is the size of the index records of the committed needles
+	indexSize int64
+	garbage   int64
+	minSeq    uint64
+	refs      int
+	retired   bool
+}
+
+func volumePath(dir string, id int64, ext string) string {
+	return filepath.Join(dir, fmt.Sprintf("%08d%s", id, ext))
+}
+
+// openVolume open or create the volume id and returns the needles it holds
+func openVolume(dir string, id int64) (*volume, []needle, error) {
+	file, err := os.OpenFile(volumePath(dir, id, volumeExt), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	index, err := os.OpenFile(volumePath(dir, id, indexExt), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	v := &volume{id: id, file: file, index: index}
+	needles, err := v.load()
+	if err != nil {
+		v.close()
+		return nil, nil, err
+	}
+	return v, needles, nil
+}
+
+func (v *volume) load() ([]needle, error) {
+	stat, err := v.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	records, err := io.ReadAll(v.index)
+	if err != nil {
+		return nil, err
+	}
+
+	// read the index, the records of needles that are not fully in the volume are dropped
+	needles := make([]needle, 0, len(records)/indexRecordSize)
+	for i := 0; i+indexRecordSize <= len(records); i += indexRecordSize {
+		n := decodeRecord(records[i : i+indexRecordSize])
+		if n.offset != v.size || n.offset+n.length() > stat.Size() {
+			break
+		}
+		// the record of a needle whose write failed may point at the needle written after it
+		if stored, err := v.readNeedle(n.offset); err != nil || stored != n {
+			break
+		}
+		needles = append(needles, n)
+		v.size += n.length()
+	}
+	v.indexSize = int64(len(needles)) * indexRecordSize
+	if err = v.index.Truncate(v.indexSize); err != nil {
+		return nil, err
+	}
+
+	// scan the needles appended after the last indexed one
+	for v.size < stat.Size() {
+		n, err := v.readNeedle(v.size)
+		if err != nil {
+			break
+		}
+		if _, err = v.index.Write(n.record()); err != nil {
+			return nil, err
+		}
+		v.indexSize += indexRecordSize
+		needles = append(needles, n)
+		v.size += n.length()
+	}
+	// drop the partial needle of an interrupted write
+	if v.size < stat.Size() {
+		if err = v.file.Truncate(v.size); err != nil {
+			return nil, err
+		}
+	}
+	for _, n := range needles {
+		v.track(n)
+	}
+	return needles, nil
+}
+
+// readNeedle read the needle at offset and verify its checksum
+func (v *volume) readNeedle(offset int64) (needle, error) {
+	header := make([]byte, needleHeaderSize)
+	if _, err := v.file.ReadAt(header, offset); err != nil {
+		return needle{}, err
+	}
+	n, err := decodeHeader(header, offset)
+	if err != nil {
+		return needle{}, err
+	}
+	hash := crc32.NewIEEE()
+	body := io.NewSectionReader(v.file, n.dataOffset(), n.size+int64(n.metaLen))
+	if _, err = io.Copy(hash, body); err != nil {
+		return needle{}, err
+	}
+	hash.Write(header)
+	footer := make([]byte, needleFooterSize)
+	if _, err = v.file.ReadAt(footer, offset+n.length()-needleFooterSize); err != nil {
+		return needle{}, err
+	}
+	if binary.LittleEndian.Uint32(footer) != hash.Sum32() {
+		return needle{}, ErrCorruptedNeedle
+	}
+	return n, nil
+}
+
+// append write the needle with size bytes of data and the meta returned once the data is written
+// at the end of the volume, nothing is left in the volume when it fails.
+// The needle is part of the volume once committed.
+func (v *volume) append(n *needle, data io.Reader, meta func() ([]byte, error)) error {
+	n.offset = v.size
+	hash := crc32.NewIEEE()
+	err := func() error {
+		w := io.MultiWriter(io.NewOffsetWriter(v.file, n.dataOffset()), hash)
+		written, err := io.CopyN(w, data, n.size)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		extra, err := io.ReadFull(data, make([]byte, 1))
+		if written != n.size || extra > 0 {
+			return fmt.Errorf("write size not match, expect %d, got %d", n.size, written+int64(extra))
+		}
+		if err != io.EOF {
+			return err
+		}
+		metaData, err := meta()
+		if err != nil {
+			return err
+		}
+		n.metaLen = uint32(len(metaData))
+		if _, err = v.file.WriteAt(metaData, n.metaOffset()); err != nil {
+			return err
+		}
+		hash.Write(metaData)
+		header := n.header()
+		if _, err = v.file.WriteAt(header, n.offset); err != nil {
+			return err
+		}
+		hash.Write(header)
+		footer := make([]byte, needleFooterSize)
+		binary.LittleEndian.PutUint32(footer, hash.Sum32())
+		_, err = v.file.WriteAt(footer, n.offset+n.length()-needleFooterSize)
+		return err
+	}()
+	if err != nil {
+		v.rollback()
+		return err
+	}
+	if _, err = v.index.Write(n.record()); err != nil {
+		v.rollback()
+		return err
+	}
+	return nil
+}
+
+// rollback drop the needle appended after the committed ones from the volume and the index
+func (v *volume) rollback() {
+	v.file.Truncate(v.size)
+	v.index.Truncate(v.indexSize)
+}
+
+func (v *volume) commit(n needle) {
+	v.size += n.length()
+	v.indexSize += indexRecordSize
+	v.track(n)
+}
+
+func (v *volume) track(n needle) {
+	if v.minSeq == 0 || n.seq < v.minSeq {
+		v.minSeq = n.seq
+	}
+}
+
+func (v *volume) readMeta(n needle) ([]byte, error) {
+	meta := make([]byte, n.metaLen)
+	if _, err := v.file.ReadAt(meta, n.metaOffset()); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func (v *volume) sync() error {
+	if err := v.file.Sync(); err != nil {
+		return err
+	}
+	return v.index.Sync()
+}
+
+func (v *volume) close() {
+	v.file.Close()
+	v.index.Close()
+}
+
+// remove unlink the files of the volume, the readers still holding it can read it until it is closed
+func (v *volume) remove() error {
+	if err := os.Remove(v.file.Name()); err != nil {
+		return err
+	}
+	return os.Remove(v.index.Name())
+}
@@ -2,35 +2,112 @@ package divider
 
 import (
 	"errors"
+	"oss/internal/control"
 )
 
 var (
 	ErrInvalidShardNumber    = errors.New("invalid shard number")
 	ErrResetFileOffsetFailed = errors.New("reset file offset failed")
+	ErrCodecMismatch         = errors.New("erasure profile codec mismatch")
+	ErrUnknownCodec          = errors.New("unknown erasure codec")
+	ErrTooFewShards          = errors.New("too few shards to reconstruct")
+	ErrInvalidShardSize      = errors.New("shards are not of the same size")
 )
 
 const (
 	MaxSize = 1024 * 1024 * 1
+
+	defaultDataShards   = 8
+	defaultParityShards = 4
+	defaultCopies       = 3
+	defaultLocalGroups  = 2
+	defaultGlobalParity = 2
 )
 
 type Option struct {
-	Strategy func(size int64) (int, int)
+	// DataShards, ParityShards and ShardSize are the geometry of a stripe,
+	// an object is coded as a sequence of stripes of DataShards * ShardSize bytes
+	DataShards   int
+	ParityShards int
+	ShardSize    int64
+
+	// DefaultCodec is the codec used when no codec is given
+	DefaultCodec string
+	// Codecs are registered in addition to the builtin codecs, replacing a builtin codec of the same name
+	Codecs []Codec
+	// Copies is the number of copies kept by the replication codec
+	Copies int
+	// LocalGroups is the number of local groups of the lrc codec
+	LocalGroups int
+	// GlobalParity is the number of global parity shards of the lrc codec
+	GlobalParity int
+}
+
+func WithGeometry(dataShards int, parityShards int, shardSize int64) Option {
+	return Option{DataShards: dataShards, ParityShards: parityShards, ShardSize: shardSize}
+}
+
+func WithDefaultCodec(codec string) Option {
+	return Option{DefaultCodec: codec}
+}
+
+func WithCodec(codec ...Codec) Option {
+	return Option{Codecs: codec}
+}
+
+func WithCopies(copies int) Option {
+	return Option{Copies: copies}
 }
 
-func WithStrategy(strategy func(size int64) (int, int)) Option {
-	return Option{Strategy: strategy}
+func WithLocalGroups(localGroups int, globalParity int) Option {
+	return Option{LocalGroups: localGroups, GlobalParity: globalParity}
 }
 
 func (o Option) apply(opt *Option) {
-	if o.Strategy != nil {
-		opt.Strategy = o.Strategy
+	if o.DataShards > 0 {
+		opt.DataShards = o.DataShards
+	}
+	if o.ParityShards > 0 {
+		opt.ParityShards = o.ParityShards
+	}
+	if o.ShardSize > 0 {
+		opt.ShardSize = o.ShardSize
+	}
+	if o.DefaultCodec != "" {
+		opt.DefaultCodec = o.DefaultCodec
+	}
+	opt.Codecs = append(opt.Codecs, o.Codecs...)
+	if o.Copies > 0 {
+		opt.Copies = o.Copies
+	}
+	if o.LocalGroups > 0 {
+		opt.LocalGroups = o.LocalGroups
+	}
+	if o.GlobalParity > 0 {
+		opt.GlobalParity = o.GlobalParity
 	}
 }
 
-func defaultStrategy(size int64) (int, int) {
-	dataShard := int(size / MaxSize)
-	if size%MaxSize != 0 {
-		dataShard++
+func defaultOption() Option {
+	return Option{
+		DataShards:   defaultDataShards,
+		ParityShards: defaultParityShards,
+		ShardSize:    MaxSize,
+		DefaultCodec: control.CodecReedSolomon,
+		Copies:       defaultCopies,
+		LocalGroups:  defaultLocalGroups,
+		GlobalParity: defaultGlobalParity,
+	}
+}
+
+// checkProfile check the profile is written by codec and matches the given shards
+func checkProfile(profile control.ErasureProfile, codec string, dataShards int, parityShards int) error {
+	if profile.Codec != codec {
+		return ErrCodecMismatch
+	}
+	if profile.DataShards <= 0 || profile.ParityShards < 0 ||
+		profile.DataShards != dataShards || profile.ParityShards != parityShards {
+		return ErrInvalidShardNumber
 	}
-	return dataShard, dataShard / 2
+	return nil
 }
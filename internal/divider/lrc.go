@@ -0,0 +1,323 @@
+package divider
+
+import (
+	"bytes"
+	"github.com/klauspost/reedsolomon"
+	"io"
+	"os"
+	"oss/internal/control"
+	"path/filepath"
+)
+
+// lrcVersion is the version of the shard layout written by lrc,
+// version 2 spread the data shards over the local groups so that no group is empty
+const lrcVersion = 2
+
+// lrc is a locally repairable code. The data shards are split into local groups,
+// every group has a xor local parity, and Reed-Solomon global parities cover all the data shards.
+// The parity shards are the local parities followed by the global parities.
+// A single lost shard of a group is repaired from the group alone, more losses fall back to the global parities.
+type lrc struct {
+	opt Option
+}
+
+func NewLRC(opt ...Option) Codec {
+	c := &lrc{
+		opt: defaultOption(),
+	}
+	for _, o := range opt {
+		o.apply(&c.opt)
+	}
+	return c
+}
+
+func (c *lrc) Name() string {
+	return control.CodecLRC
+}
+
+// Profile returns the erasure profile of a stripe
+func (c *lrc) Profile() control.ErasureProfile {
+	localGroups := c.opt.LocalGroups
+	if localGroups > c.opt.DataShards {
+		localGroups = c.opt.DataShards
+	}
+	return control.ErasureProfile{
+		Codec:        control.CodecLRC,
+		Version:      lrcVersion,
+		DataShards:   c.opt.DataShards,
+		ParityShards: localGroups + c.opt.GlobalParity,
+		ShardSize:    c.opt.ShardSize,
+		LocalGroups:  localGroups,
+	}
+}
+
+// Encode the data to dataShards, local parities and global parities
+func (c *lrc) Encode(profile control.ErasureProfile, data []io.Reader, size int64, dataShards []*os.File, parityShards []*os.File) error {
+	if err := checkLRCProfile(profile, len(dataShards), len(parityShards)); err != nil {
+		return err
+	}
+	enc, err := reedsolomon.NewStream(profile.DataShards, profile.ParityShards-profile.LocalGroups)
+	if err != nil {
+		return err
+	}
+	// Split the data into dataShard
+	if err = enc.Split(io.MultiReader(data...), convertFilesToWriters(dataShards), size); err != nil {
+		return err
+	}
+	if err = filesSeek(dataShards, 0, 0); err != nil {
+		return ErrResetFileOffsetFailed
+	}
+	// Encode global parity
+	global := parityShards[profile.LocalGroups:]
+	if err = enc.Encode(convertFilesToReaders(dataShards), convertFilesToWriters(global)); err != nil {
+		return err
+	}
+	// Encode local parity
+	for g := 0; g < profile.LocalGroups; g++ {
+		if err = filesSeek(dataShards, 0, 0); err != nil {
+			return ErrResetFileOffsetFailed
+		}
+		if err = xorShards(groupShards(profile, dataShards, g), parityShards[g]); err != nil {
+			return err
+		}
+	}
+	// Reset the file offset to 0
+	if err = filesSeek(parityShards, 0, 0); err != nil {
+		return ErrResetFileOffsetFailed
+	}
+	if err = filesSeek(dataShards, 0, 0); err != nil {
+		return ErrResetFileOffsetFailed
+	}
+	return nil
+}
+
+// Verify the global parities and every local parity
+func (c *lrc) Verify(profile control.ErasureProfile, dataShards []*os.File, parityShards []*os.File) (bool, error) {
+	if err := checkLRCProfile(profile, len(dataShards), len(parityShards)); err != nil {
+		return false, err
+	}
+	enc, err := reedsolomon.NewStream(profile.DataShards, profile.ParityShards-profile.LocalGroups)
+	if err != nil {
+		return false, err
+	}
+	res, err := enc.Verify(convertFilesToReaders(dataShards, parityShards[profile.LocalGroups:]))
+	if err != nil {
+		return false, err
+	}
+	for g := 0; g < profile.LocalGroups && res; g++ {
+		if err = filesSeek(dataShards, 0, 0); err != nil {
+			return false, ErrResetFileOffsetFailed
+		}
+		if _, err = parityShards[g].Seek(0, 0); err != nil {
+			return false, ErrResetFileOffsetFailed
+		}
+		files := append(groupShards(profile, dataShards, g), parityShards[g])
+		err = readChunks(files, func(chunks [][]byte) error {
+			res = res && bytes.Equal(xorChunks(chunks[:len(chunks)-1]), chunks[len(chunks)-1])
+			return nil
+		})
+		if err != nil {
+			return false, err
+		}
+	}
+	// Reset the file offset to 0
+	if err = filesSeek(dataShards, 0, 0); err != nil {
+		return false, ErrResetFileOffsetFailed
+	}
+	if err = filesSeek(parityShards, 0, 0); err != nil {
+		return false, ErrResetFileOffsetFailed
+	}
+	return res, nil
+}
+
+// Reconstruct the data from dataShards and parityShards to fill,
+// groups missing a single shard are repaired locally before the global parities are read
+func (c *lrc) Reconstruct(profile control.ErasureProfile, dataShards []*os.File, parityShards []*os.File, fill []*os.File) error {
+	if err := checkLRCProfile(profile, len(dataShards), len(parityShards)); err != nil {
+		return err
+	}
+	k, l := profile.DataShards, profile.LocalGroups
+	shards := append(append([]*os.File{}, dataShards...), parityShards...)
+	// repair fill from the other shards
+	repair := func(i int, src []*os.File) error {
+		if err := filesSeek(src, 0, 0); err != nil {
+			return ErrResetFileOffsetFailed
+		}
+		if err := xorShards(src, fill[i]); err != nil {
+			return err
+		}
+		shards[i] = fill[i]
+		return nil
+	}
+
+	// Repair locally the groups missing a single shard
+	for g := 0; g < l; g++ {
+		members := append(groupMembers(profile, g), k+g)
+		missing, src := -1, make([]*os.File, 0, len(members))
+		for _, i := range members {
+			if shards[i] == nil {
+				if missing != -1 {
+					missing = -2
+					break
+				}
+				missing = i
+				continue
+			}
+			src = append(src, shards[i])
+		}
+		if missing < 0 || fill[missing] == nil {
+			continue
+		}
+		if err := repair(missing, src); err != nil {
+			return err
+		}
+	}
+
+	// Reconstruct the rest from the global parities
+	readers := append(append([]*os.File{}, shards[:k]...), shards[k+l:]...)
+	writers := make([]*os.File, 0, len(readers))
+	present, need := 0, false
+	for i, shard := range readers {
+		idx := i
+		if i >= k {
+			idx = i + l
+		}
+		if shard != nil {
+			present++
+			writers = append(writers, nil)
+			continue
+		}
+		// the data shards are needed to repair the local parities
+		if fill[idx] != nil || (idx < k && fill[k+profile.LocalGroup(idx)] != nil) {
+			need = true
+		}
+		writers = append(writers, fill[idx])
+	}
+	if need {
+		if present < k {
+			return ErrTooFewShards
+		}
+		for i := 0; i < k; i++ {
+			local := fill[k+profile.LocalGroup(i)]
+			if readers[i] != nil || writers[i] != nil || local == nil {
+				continue
+			}
+			// reconstruct the data shard next to the local parity to repair it
+			f, err := os.CreateTemp(filepath.Dir(local.Name()), "lrc")
+			if err != nil {
+				return err
+			}
+			defer os.Remove(f.Name())
+			defer f.Close()
+			writers[i] = f
+		}
+		if err := filesSeek(readers, 0, 0); err != nil {
+			return ErrResetFileOffsetFailed
+		}
+		enc, err := reedsolomon.NewStream(k, profile.ParityShards-l)
+		if err != nil {
+			return err
+		}
+		if err = enc.Reconstruct(convertFilesToReaders(readers), convertFilesToWriters(writers)); err != nil {
+			return err
+		}
+		for i := 0; i < k; i++ {
+			if shards[i] == nil {
+				shards[i] = writers[i]
+			}
+		}
+	}
+
+	// Repair the local parities
+	for g := 0; g < l; g++ {
+		if shards[k+g] != nil || fill[k+g] == nil {
+			continue
+		}
+		if err := repair(k+g, groupShards(profile, shards[:k], g)); err != nil {
+			return err
+		}
+	}
+
+	// Reset the file offset to 0
+	if err := filesSeek(fill, 0, 0); err != nil {
+		return ErrResetFileOffsetFailed
+	}
+	if err := filesSeek(dataShards, 0, 0); err != nil {
+		return ErrResetFileOffsetFailed
+	}
+	if err := filesSeek(parityShards, 0, 0); err != nil {
+		return ErrResetFileOffsetFailed
+	}
+	return nil
+}
+
+// Join the dataShards of a stripe and write size bytes of it to dst
+func (c *lrc) Join(profile control.ErasureProfile, dst io.Writer, dataShards []*os.File, size int64) error {
+	if err := checkLRCProfile(profile, len(dataShards), profile.ParityShards); err != nil {
+		return err
+	}
+	enc, err := reedsolomon.NewStream(profile.DataShards, profile.ParityShards-profile.LocalGroups)
+	if err != nil {
+		return err
+	}
+	if err = enc.Join(dst, convertFilesToReaders(dataShards), size); err != nil {
+		return err
+	}
+	if err = filesSeek(dataShards, 0, 0); err != nil {
+		return ErrResetFileOffsetFailed
+	}
+	return nil
+}
+
+func checkLRCProfile(profile control.ErasureProfile, dataShards int, parityShards int) error {
+	if err := checkProfile(profile, control.CodecLRC, dataShards, parityShards); err != nil {
+		return err
+	}
+	if profile.LocalGroups <= 0 || profile.LocalGroups > profile.DataShards || profile.LocalGroups > profile.ParityShards {
+		return ErrInvalidShardNumber
+	}
+	// the version 1 layout leaves the last groups empty when the shards do not fill them
+	if profile.LocalGroup(profile.DataShards-1) != profile.LocalGroups-1 {
+		return ErrInvalidShardNumber
+	}
+	return nil
+}
+
+// groupMembers returns the data shards of the local group g
+func groupMembers(profile control.ErasureProfile, g int) []int {
+	members := make([]int, 0)
+	for i := 0; i < profile.DataShards; i++ {
+		if profile.LocalGroup(i) == g {
+			members = append(members, i)
+		}
+	}
+	return members
+}
+
+func groupShards(profile control.ErasureProfile, dataShards []*os.File, g int) []*os.File {
+	members := groupMembers(profile, g)
+	files := make([]*os.File, len(members))
+	for i, m := range members {
+		files[i] = dataShards[m]
+	}
+	return files
+}
+
+// xorShards write the xor of src to dst
+func xorShards(src []*os.File, dst io.Writer) error {
+	return readChunks(src, func(chunks [][]byte) error {
+		_, err := dst.Write(xorChunks(chunks))
+		return err
+	})
+}
+
+func xorChunks(chunks [][]byte) []byte {
+	out := make([]byte, len(chunks[0]))
+	copy(out, chunks[0])
+	for _, chunk := range chunks[1:] {
+		for i := range chunk {
+			out[i] ^= chunk[i]
+		}
+	}
+	return out
+}
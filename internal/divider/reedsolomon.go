@@ -7,15 +7,16 @@ import (
 	"oss/internal/control"
 )
 
+// reedSolomonVersion is the version of the shard layout written by reedSolomon
+const reedSolomonVersion = 1
+
 type reedSolomon struct {
 	opt Option
 }
 
-func NewReedSolomon(opt ...Option) control.Divider {
+func NewReedSolomon(opt ...Option) Codec {
 	c := &reedSolomon{
-		opt: Option{
-			Strategy: defaultStrategy,
-		},
+		opt: defaultOption(),
 	}
 	for _, o := range opt {
 		o.apply(&c.opt)
@@ -23,18 +24,28 @@ func NewReedSolomon(opt ...Option) control.Divider {
 	return c
 }
 
-// CalcShardsNum Calculate the number of dataShards and parityShards
-func (c *reedSolomon) CalcShardsNum(size int64) (dataShard int, parityShard int) {
-	return c.opt.Strategy(size)
+func (c *reedSolomon) Name() string {
+	return control.CodecReedSolomon
+}
+
+// Profile returns the erasure profile of a stripe
+func (c *reedSolomon) Profile() control.ErasureProfile {
+	return control.ErasureProfile{
+		Codec:        control.CodecReedSolomon,
+		Version:      reedSolomonVersion,
+		DataShards:   c.opt.DataShards,
+		ParityShards: c.opt.ParityShards,
+		ShardSize:    c.opt.ShardSize,
+	}
 }
 
 // Encode the data to dataShards and parityShards
-func (c *reedSolomon) Encode(data []io.Reader, size int64, dataShards []*os.File, parityShards []*os.File) error {
-	dataShard, parityShard := c.opt.Strategy(size)
-	if len(dataShards) != dataShard || len(parityShards) != parityShard {
-		return ErrInvalidShardNumber
+func (c *reedSolomon) Encode(profile control.ErasureProfile, data []io.Reader, size int64, dataShards []*os.File, parityShards []*os.File) error {
+	if err := checkProfile(profile, control.CodecReedSolomon, len(dataShards), len(parityShards)); err != nil {
+		return err
 	}
-	enc, err := reedsolomon.NewStream(dataShard, parityShard)
+	dataShard := profile.DataShards
+	enc, err := reedsolomon.NewStream(dataShard, profile.ParityShards)
 	if err != nil {
 		return err
 	}
@@ -74,12 +85,11 @@ func (c *reedSolomon) Encode(data []io.Reader, size int64, dataShards []*os.File
 }
 
 // Verify the dataShards and parityShards
-func (c *reedSolomon) Verify(dataShards []*os.File, parityShards []*os.File) (bool, error) {
-	dataShard, parityShard := c.opt.Strategy(0)
-	if len(dataShards) != dataShard || len(parityShards) != parityShard {
-		return false, ErrInvalidShardNumber
+func (c *reedSolomon) Verify(profile control.ErasureProfile, dataShards []*os.File, parityShards []*os.File) (bool, error) {
+	if err := checkProfile(profile, control.CodecReedSolomon, len(dataShards), len(parityShards)); err != nil {
+		return false, err
 	}
-	enc, err := reedsolomon.NewStream(dataShard, parityShard)
+	enc, err := reedsolomon.NewStream(profile.DataShards, profile.ParityShards)
 	if err != nil {
 		return false, err
 	}
@@ -99,12 +109,11 @@ func (c *reedSolomon) Verify(dataShards []*os.File, parityShards []*os.File) (bo
 }
 
 // Reconstruct the data from dataShards and parityShards to fill
-func (c *reedSolomon) Reconstruct(dataShards []*os.File, parityShards []*os.File, fill []*os.File) error {
-	dataShard, parityShard := c.opt.Strategy(0)
-	if len(dataShards) != dataShard || len(parityShards) != parityShard {
-		return ErrInvalidShardNumber
+func (c *reedSolomon) Reconstruct(profile control.ErasureProfile, dataShards []*os.File, parityShards []*os.File, fill []*os.File) error {
+	if err := checkProfile(profile, control.CodecReedSolomon, len(dataShards), len(parityShards)); err != nil {
+		return err
 	}
-	enc, err := reedsolomon.NewStream(dataShard, parityShard)
+	enc, err := reedsolomon.NewStream(profile.DataShards, profile.ParityShards)
 	if err != nil {
 		return err
 	}
@@ -130,6 +139,24 @@ func (c *reedSolomon) Reconstruct(dataShards []*os.File, parityShards []*os.File
 	return nil
 }
 
+// Join the dataShards of a stripe and write size bytes of it to dst
+func (c *reedSolomon) Join(profile control.ErasureProfile, dst io.Writer, dataShards []*os.File, size int64) error {
+	if err := checkProfile(profile, control.CodecReedSolomon, len(dataShards), profile.ParityShards); err != nil {
+		return err
+	}
+	enc, err := reedsolomon.NewStream(profile.DataShards, profile.ParityShards)
+	if err != nil {
+		return err
+	}
+	if err = enc.Join(dst, convertFilesToReaders(dataShards), size); err != nil {
+		return err
+	}
+	if err = filesSeek(dataShards, 0, 0); err != nil {
+		return ErrResetFileOffsetFailed
+	}
+	return nil
+}
+
 func filesSeek(files []*os.File, offset int64, whence int) error {
 	for _, f := range files {
 		if f == nil {
@@ -178,3 +205,41 @@ func convertFilesToWriters(files ...[]*os.File) []io.Writer {
 	}
 	return writers
 }
+
+// chunkSize is the size of the chunks read by readChunks
+const chunkSize = 64 * 1024
+
+// readChunks read the files chunk by chunk in lockstep and call fn with the chunks of every file,
+// all the files must be of the same size
+func readChunks(files []*os.File, fn func(chunks [][]byte) error) error {
+	bufs := make([][]byte, len(files))
+	chunks := make([][]byte, len(files))
+	for i := range bufs {
+		bufs[i] = make([]byte, chunkSize)
+	}
+	for {
+		n := -1
+		eof := false
+		for i, f := range files {
+			m, err := io.ReadFull(f, bufs[i])
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+			if n != -1 && m != n {
+				return ErrInvalidShardSize
+			}
+			n = m
+			chunks[i] = bufs[i][:m]
+		}
+		if n > 0 {
+			if err := fn(chunks); err != nil {
+				return err
+			}
+		}
+		if eof {
+			return nil
+		}
+	}
+}
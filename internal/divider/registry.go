@@ -0,0 +1,105 @@
+package divider
+
+import (
+	"io"
+	"os"
+	"oss/internal/control"
+	"sync"
+)
+
+// Codec is an erasure code selectable by name through the divider
+type Codec interface {
+	Name() string
+	Profile() control.ErasureProfile
+	Encode(profile control.ErasureProfile, data []io.Reader, size int64, dataShards []*os.File, parityShards []*os.File) error
+	Verify(profile control.ErasureProfile, dataShards []*os.File, parityShards []*os.File) (bool, error)
+	Reconstruct(profile control.ErasureProfile, dataShards []*os.File, parityShards []*os.File, fill []*os.File) error
+	Join(profile control.ErasureProfile, dst io.Writer, dataShards []*os.File, size int64) error
+}
+
+// registry dispatch to the codec named by the erasure profile
+type registry struct {
+	sync.RWMutex
+	opt    Option
+	codecs map[string]Codec
+}
+
+// NewDivider returns a divider with the replication, reedsolomon and lrc codecs registered
+func NewDivider(opt ...Option) control.Divider {
+	r := &registry{
+		opt:    defaultOption(),
+		codecs: make(map[string]Codec),
+	}
+	for _, o := range opt {
+		o.apply(&r.opt)
+	}
+	geometry := WithGeometry(r.opt.DataShards, r.opt.ParityShards, r.opt.ShardSize)
+	r.Register(
+		NewReplication(geometry, WithCopies(r.opt.Copies)),
+		NewReedSolomon(geometry),
+		NewLRC(geometry, WithLocalGroups(r.opt.LocalGroups, r.opt.GlobalParity)),
+	)
+	r.Register(r.opt.Codecs...)
+	return r
+}
+
+func (r *registry) Register(codecs ...Codec) {
+	r.Lock()
+	defer r.Unlock()
+	for _, c := range codecs {
+		r.codecs[c.Name()] = c
+	}
+}
+
+func (r *registry) codec(name string) (Codec, error) {
+	r.RLock()
+	defer r.RUnlock()
+	c, ok := r.codecs[name]
+	if !ok {
+		return nil, ErrUnknownCodec
+	}
+	return c, nil
+}
+
+func (r *registry) Profile(codec string) (control.ErasureProfile, error) {
+	if codec == "" {
+		codec = r.opt.DefaultCodec
+	}
+	c, err := r.codec(codec)
+	if err != nil {
+		return control.ErasureProfile{}, err
+	}
+	return c.Profile(), nil
+}
+
+func (r *registry) Encode(profile control.ErasureProfile, data []io.Reader, size int64, dataShards []*os.File, parityShards []*os.File) error {
+	c, err := r.codec(profile.Codec)
+	if err != nil {
+		return err
+	}
+	return c.Encode(profile, data, size, dataShards, parityShards)
+}
+
+func (r *registry) Verify(profile control.ErasureProfile, dataShards []*os.File, parityShards []*os.File) (bool, error) {
+	c, err := r.codec(profile.Codec)
+	if err != nil {
+		return false, err
+	}
+	return c.Verify(profile, dataShards, parityShards)
+}
+
+func (r *registry) Reconstruct(profile control.ErasureProfile, dataShards []*os.File, parityShards []*os.File, fill []*os.File) error {
+	c, err := r.codec(profile.Codec)
+	if err != nil {
+		return err
+	}
+	return c.Reconstruct(profile, dataShards, parityShards, fill)
+}
+
+func (r *registry) Join(profile control.ErasureProfile, dst io.Writer, dataShards []*os.File, size int64) error {
+	c, err := r.codec(profile.Codec)
+	if err != nil {
+		return err
+	}
+	return c.Join(profile, dst, dataShards, size)
+}
@@ -0,0 +1,149 @@
+package divider
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"oss/internal/control"
+)
+
+// replicationVersion is the version of the shard layout written by replication
+const replicationVersion = 1
+
+// replication keep full copies of the object, the data shard is the object and every parity shard a copy of it
+type replication struct {
+	opt Option
+}
+
+func NewReplication(opt ...Option) Codec {
+	c := &replication{
+		opt: defaultOption(),
+	}
+	for _, o := range opt {
+		o.apply(&c.opt)
+	}
+	return c
+}
+
+func (c *replication) Name() string {
+	return control.CodecReplication
+}
+
+// Profile returns the erasure profile of a stripe
+func (c *replication) Profile() control.ErasureProfile {
+	return control.ErasureProfile{
+		Codec:        control.CodecReplication,
+		Version:      replicationVersion,
+		DataShards:   1,
+		ParityShards: c.opt.Copies - 1,
+		ShardSize:    c.opt.ShardSize,
+	}
+}
+
+// Encode copy the data to the dataShard and every parityShard
+func (c *replication) Encode(profile control.ErasureProfile, data []io.Reader, size int64, dataShards []*os.File, parityShards []*os.File) error {
+	if err := checkProfile(profile, control.CodecReplication, len(dataShards), len(parityShards)); err != nil {
+		return err
+	}
+	n, err := io.Copy(dataShards[0], io.LimitReader(io.MultiReader(data...), size))
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return io.ErrUnexpectedEOF
+	}
+	for i := range parityShards {
+		if _, err = dataShards[0].Seek(0, 0); err != nil {
+			return ErrResetFileOffsetFailed
+		}
+		if _, err = io.Copy(parityShards[i], dataShards[0]); err != nil {
+			return err
+		}
+	}
+	if err = filesSeek(parityShards, 0, 0); err != nil {
+		return ErrResetFileOffsetFailed
+	}
+	if err = filesSeek(dataShards, 0, 0); err != nil {
+		return ErrResetFileOffsetFailed
+	}
+	return nil
+}
+
+// Verify every copy is the same
+func (c *replication) Verify(profile control.ErasureProfile, dataShards []*os.File, parityShards []*os.File) (bool, error) {
+	if err := checkProfile(profile, control.CodecReplication, len(dataShards), len(parityShards)); err != nil {
+		return false, err
+	}
+	shards := append(append([]*os.File{}, dataShards...), parityShards...)
+	for _, shard := range shards {
+		if shard == nil {
+			return false, ErrTooFewShards
+		}
+	}
+	ok := true
+	err := readChunks(shards, func(chunks [][]byte) error {
+		for i := 1; i < len(chunks) && ok; i++ {
+			ok = bytes.Equal(chunks[0], chunks[i])
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if err = filesSeek(shards, 0, 0); err != nil {
+		return false, ErrResetFileOffsetFailed
+	}
+	return ok, nil
+}
+
+// Reconstruct copy any present shard to fill
+func (c *replication) Reconstruct(profile control.ErasureProfile, dataShards []*os.File, parityShards []*os.File, fill []*os.File) error {
+	if err := checkProfile(profile, control.CodecReplication, len(dataShards), len(parityShards)); err != nil {
+		return err
+	}
+	var src *os.File
+	for _, shard := range append(append([]*os.File{}, dataShards...), parityShards...) {
+		if shard != nil {
+			src = shard
+			break
+		}
+	}
+	if src == nil {
+		return ErrTooFewShards
+	}
+	for i := range fill {
+		if fill[i] == nil || fill[i] == src {
+			continue
+		}
+		if _, err := src.Seek(0, 0); err != nil {
+			return ErrResetFileOffsetFailed
+		}
+		if _, err := io.Copy(fill[i], src); err != nil {
+			return err
+		}
+	}
+	if err := filesSeek(fill, 0, 0); err != nil {
+		return ErrResetFileOffsetFailed
+	}
+	if _, err := src.Seek(0, 0); err != nil {
+		return ErrResetFileOffsetFailed
+	}
+	return nil
+}
+
+// Join write size bytes of the dataShard to dst
+func (c *replication) Join(profile control.ErasureProfile, dst io.Writer, dataShards []*os.File, size int64) error {
+	if err := checkProfile(profile, control.CodecReplication, len(dataShards), profile.ParityShards); err != nil {
+		return err
+	}
+	if dataShards[0] == nil {
+		return ErrTooFewShards
+	}
+	if _, err := io.CopyN(dst, dataShards[0], size); err != nil {
+		return err
+	}
+	if _, err := dataShards[0].Seek(0, 0); err != nil {
+		return ErrResetFileOffsetFailed
+	}
+	return nil
+}
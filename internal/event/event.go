@@ -2,6 +2,7 @@ package event
 
 import "oss/pkg/event_bus"
 
+// the event types are the patterns of the event names, s3:ObjectCreated:* matches s3:ObjectCreated:Put
 const (
 	EventTypeObjectCreated  = "s3:ObjectCreated:*"
 	EventTypeObjectRemoved  = "s3:ObjectRemoved:*"
@@ -11,6 +12,12 @@ const (
 	EventTypeBucketCreated  = "s3:BucketCreated:*"
 	EventTypeBucketRemoved  = "s3:BucketRemoved:*"
 	EventTypeBucketAccessed = "s3:BucketAccessed:*"
+
+	// the names of the events published by the ctrl
+	EventObjectCreatedPut    = "s3:ObjectCreated:Put"
+	EventObjectRemovedDelete = "s3:ObjectRemoved:Delete"
+	EventBucketCreatedPut    = "s3:BucketCreated:Put"
+	EventBucketRemovedDelete = "s3:BucketRemoved:Delete"
 )
 
 var Bus *event_bus.EventBus
@@ -18,3 +25,14 @@ var Bus *event_bus.EventBus
 func init() {
 	Bus = event_bus.NewEventBus(1024)
 }
+
+// OpenDurable replace the bus by a durable one logging the events in dir, it is called before the ctrl is created
+func OpenDurable(dir string, opt ...event_bus.BusOption) error {
+	bus, err := event_bus.NewDurableEventBus(dir, 1024, opt...)
+	if err != nil {
+		return err
+	}
+	Bus.Close()
+	Bus = bus
+	return nil
+}
@@ -0,0 +1,170 @@
+package gateway
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"oss/internal/control"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxClockSkew is the max difference between the date of a signed request and the time it is received
+	maxClockSkew = 15 * time.Minute
+	// maxPresignExpires is the max validity of a presigned request
+	maxPresignExpires = 7 * 24 * time.Hour
+
+	signedStreamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	headerAmzDate          = "x-amz-date"
+)
+
+// requestAuth is the resolved signature of a request, the signed streaming payloads are checked with it
+type requestAuth struct {
+	principal *control.Principal
+	// key is the signing key of the scope, nil for an anonymous request
+	key       []byte
+	amzDate   string
+	scope     string
+	signature string
+}
+
+type authKey struct{}
+
+func authFromContext(ctx context.Context) *requestAuth {
+	auth, _ := ctx.Value(authKey{}).(*requestAuth)
+	return auth
+}
+
+// authenticate check the SigV4 signature of the request, in the Authorization header or in the query of a
+// presigned request. A request without signature is anonymous.
+func (g *Gateway) authenticate(r *http.Request) (*requestAuth, error) {
+	header := r.Header.Get("Authorization")
+	switch {
+	case strings.HasPrefix(header, signV4Algorithm+" "):
+		return g.authenticateHeader(r, strings.TrimPrefix(header, signV4Algorithm+" "))
+	case header != "":
+		return nil, ErrSignatureVersionNotSupported
+	case r.URL.Query().Has("X-Amz-Algorithm"):
+		return g.authenticatePresigned(r)
+	}
+	return &requestAuth{principal: &control.Principal{Anonymous: true}}, nil
+}
+
+func (g *Gateway) authenticateHeader(r *http.Request, header string) (*requestAuth, error) {
+	fields := make(map[string]string, 3)
+	for _, field := range strings.Split(header, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return nil, ErrAuthorizationHeaderMalformed
+		}
+		fields[name] = value
+	}
+	credential, signedHeaders, sig := fields["Credential"], fields["SignedHeaders"], fields["Signature"]
+	if credential == "" || signedHeaders == "" || sig == "" {
+		return nil, ErrAuthorizationHeaderMalformed
+	}
+	amzDate := r.Header.Get(headerAmzDate)
+	if amzDate == "" {
+		// the Date header is used when there is no x-amz-date
+		date, err := http.ParseTime(r.Header.Get("Date"))
+		if err != nil {
+			return nil, ErrMissingSecurityHeader
+		}
+		amzDate = date.UTC().Format(timeFormatAmz)
+	}
+	date, err := time.Parse(timeFormatAmz, amzDate)
+	if err != nil {
+		return nil, ErrMissingSecurityHeader
+	}
+	if skew := time.Since(date); skew > maxClockSkew || skew < -maxClockSkew {
+		return nil, ErrRequestTimeTooSkewed
+	}
+	payloadHash := r.Header.Get(headerContentSHA256)
+	if payloadHash == "" {
+		return nil, ErrMissingContentSHA256
+	}
+	return g.verify(r, credential, signedHeaders, sig, amzDate, payloadHash)
+}
+
+func (g *Gateway) authenticatePresigned(r *http.Request) (*requestAuth, error) {
+	query := r.URL.Query()
+	if query.Get("X-Amz-Algorithm") != signV4Algorithm {
+		return nil, ErrSignatureVersionNotSupported
+	}
+	credential, signedHeaders, sig := query.Get("X-Amz-Credential"), query.Get("X-Amz-SignedHeaders"), query.Get("X-Amz-Signature")
+	if credential == "" || signedHeaders == "" || sig == "" {
+		return nil, ErrAuthorizationQueryParametersError
+	}
+	amzDate := query.Get("X-Amz-Date")
+	date, err := time.Parse(timeFormatAmz, amzDate)
+	if err != nil {
+		return nil, ErrAuthorizationQueryParametersError
+	}
+	expires, err := strconv.ParseInt(query.Get("X-Amz-Expires"), 10, 64)
+	if err != nil || expires < 1 || time.Duration(expires)*time.Second > maxPresignExpires {
+		return nil, ErrAuthorizationQueryParametersError
+	}
+	if time.Until(date) > maxClockSkew {
+		return nil, ErrRequestNotYetValid
+	}
+	if time.Since(date) > time.Duration(expires)*time.Second {
+		return nil, ErrRequestExpired
+	}
+	// the payload of a presigned request is not signed unless the client sent its hash
+	payloadHash := r.Header.Get(headerContentSHA256)
+	if payloadHash == "" {
+		payloadHash = unsignedPayload
+	}
+	return g.verify(r, credential, signedHeaders, sig, amzDate, payloadHash)
+}
+
+// verify check the signature of the request is the one of the access key of the credential
+func (g *Gateway) verify(r *http.Request, credential string, signedHeaders string, sig string, amzDate string, payloadHash string) (*requestAuth, error) {
+	// the credential is <access key id>/<date>/<region>/<service>/aws4_request
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[3] != serviceS3 || parts[4] != scopeTerminator || parts[1] != amzDate[:len(timeFormatScope)] {
+		return nil, ErrAuthorizationHeaderMalformed
+	}
+	headers := strings.Split(signedHeaders, ";")
+	if !sort.StringsAreSorted(headers) || !slices.Contains(headers, "host") {
+		return nil, ErrAuthorizationHeaderMalformed
+	}
+	// the x-amz headers change the operation, a request can not add one that is not signed.
+	// The payload hash and the date do not have to be, they are checked through the string to sign.
+	for name := range r.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") && name != headerContentSHA256 && name != headerAmzDate && !slices.Contains(headers, name) {
+			return nil, ErrHeadersNotSigned
+		}
+	}
+	accessKey, err := g.credentials.GetAccessKey(parts[0])
+	if errors.Is(err, control.ErrAccessKeyNotFound) || err == nil && accessKey.Disabled {
+		return nil, ErrInvalidAccessKeyID
+	}
+	if err != nil {
+		return nil, err
+	}
+	scope := strings.Join(parts[1:], "/")
+	key := signingKey(accessKey.SecretKey, parts[1], parts[2], parts[3])
+	expected := signature(key, stringToSign(amzDate, scope, canonicalRequest(r, headers, payloadHash)))
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(sig)) != 1 {
+		return nil, ErrSignatureDoesNotMatch
+	}
+	return &requestAuth{
+		principal: &control.Principal{UserID: accessKey.UserID, AccessKeyID: accessKey.AccessKeyID},
+		key:       key,
+		amzDate:   amzDate,
+		scope:     scope,
+		signature: sig,
+	}, nil
+}
+
+// principal returns the principal of the request
+func principal(r *http.Request) *control.Principal {
+	return control.PrincipalFromContext(r.Context())
+}
@@ -0,0 +1,327 @@
+package gateway
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/url"
+	"oss/internal/control"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Namespace     = "http://s3.amazonaws.com/doc/2006-03-01/"
+	defaultMaxKeys  = 1000
+	maxKeyLength    = 1024
+	timeFormatISO   = "2006-01-02T15:04:05.000Z"
+	storageStandard = "STANDARD"
+)
+
+var bucketNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+type bucketEntry struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type listBucketsResponse struct {
+	XMLName xml.Name      `xml:"ListAllMyBucketsResult"`
+	Xmlns   string        `xml:"xmlns,attr"`
+	Owner   owner         `xml:"Owner"`
+	Buckets []bucketEntry `xml:"Buckets>Bucket"`
+}
+
+type owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type objectEntry struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type listObjectsResponse struct {
+	XMLName        xml.Name       `xml:"ListBucketResult"`
+	Xmlns          string         `xml:"xmlns,attr"`
+	Name           string         `xml:"Name"`
+	Prefix         string         `xml:"Prefix"`
+	Delimiter      string         `xml:"Delimiter,omitempty"`
+	MaxKeys        int            `xml:"MaxKeys"`
+	EncodingType   string         `xml:"EncodingType,omitempty"`
+	IsTruncated    bool           `xml:"IsTruncated"`
+	Contents       []objectEntry  `xml:"Contents"`
+	CommonPrefixes []commonPrefix `xml:"CommonPrefixes"`
+
+	// ListObjects
+	Marker     *string `xml:"Marker"`
+	NextMarker string  `xml:"NextMarker,omitempty"`
+
+	// ListObjectsV2
+	KeyCount              *int   `xml:"KeyCount"`
+	ContinuationToken     string `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string `xml:"StartAfter,omitempty"`
+}
+
+type locationResponse struct {
+	XMLName  xml.Name `xml:"LocationConstraint"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:",chardata"`
+}
+
+func (g *Gateway) listBuckets(w http.ResponseWriter, r *http.Request) {
+	if principal(r).Anonymous {
+		writeError(w, r, ErrAccessDenied)
+		return
+	}
+	ownerID := principal(r).UserID
+	buckets, err := g.buckets.GetBucketByOwnerID(ownerID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	response := &listBucketsResponse{
+		Xmlns:   s3Namespace,
+		Owner:   owner{ID: strconv.FormatInt(ownerID, 10), DisplayName: strconv.FormatInt(ownerID, 10)},
+		Buckets: make([]bucketEntry, 0, len(buckets)),
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Name < buckets[j].Name })
+	for _, bucket := range buckets {
+		response.Buckets = append(response.Buckets, bucketEntry{Name: bucket.Name, CreationDate: isoTime(bucket.CreatedAt)})
+	}
+	writeXML(w, http.StatusOK, response)
+}
+
+func (g *Gateway) createBucket(w http.ResponseWriter, r *http.Request, name string) {
+	if principal(r).Anonymous {
+		writeError(w, r, ErrAccessDenied)
+		return
+	}
+	if !bucketNamePattern.MatchString(name) || strings.Contains(name, "..") {
+		writeError(w, r, ErrInvalidBucketName)
+		return
+	}
+	acl := r.Header.Get(headerACL)
+	if acl != "" && !control.ValidACL(acl) {
+		writeError(w, r, control.ErrInvalidACL)
+		return
+	}
+	if bucket, err := g.bucket(name); err == nil {
+		if bucket.OwnerID == principal(r).UserID {
+			writeError(w, r, ErrBucketAlreadyOwnedByYou)
+		} else {
+			writeError(w, r, ErrBucketAlreadyExists)
+		}
+		return
+	} else if !errors.Is(err, control.ErrBucketNotFound) {
+		writeError(w, r, err)
+		return
+	}
+	bucket, err := g.ctrl.CreateBucket(r.Context(), name)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if acl != "" && acl != control.ACLPrivate {
+		bucket.ACL = acl
+		if err = g.buckets.UpdateBucket(bucket); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	w.Header().Set("Location", "/"+name)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (g *Gateway) headBucket(w http.ResponseWriter, r *http.Request, name string) {
+	if _, err := g.authorizedBucket(r, name, control.AccessRequest{Action: control.ActionListBucket}); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("x-amz-bucket-region", g.opt.Region)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (g *Gateway) getBucketLocation(w http.ResponseWriter, r *http.Request, name string) {
+	if _, err := g.authorizedBucket(r, name, control.AccessRequest{Action: control.ActionGetBucketLocation}); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	response := &locationResponse{Xmlns: s3Namespace}
+	// us-east-1 is reported as an empty location by S3
+	if g.opt.Region != defaultRegion {
+		response.Location = g.opt.Region
+	}
+	writeXML(w, http.StatusOK, response)
+}
+
+func (g *Gateway) deleteBucket(w http.ResponseWriter, r *http.Request, name string) {
+	bucket, err := g.authorizedBucket(r, name, control.AccessRequest{Action: control.ActionDeleteBucket})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err = g.ctrl.DeleteBucket(r.Context(), bucket.ID); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listObjects serve ListObjects, and ListObjectsV2 when list-type is 2
+func (g *Gateway) listObjects(w http.ResponseWriter, r *http.Request, name string) {
+	bucket, err := g.authorizedBucket(r, name, control.AccessRequest{Action: control.ActionListBucket, Prefix: r.URL.Query().Get("prefix")})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	query := r.URL.Query()
+	v2 := query.Get("list-type") == "2"
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	encodingType := query.Get("encoding-type")
+	if encodingType != "" && encodingType != "url" {
+		writeError(w, r, ErrInvalidArgument)
+		return
+	}
+	maxKeys := defaultMaxKeys
+	if s := query.Get("max-keys"); s != "" {
+		if maxKeys, err = strconv.Atoi(s); err != nil || maxKeys < 0 {
+			writeError(w, r, ErrInvalidArgument)
+			return
+		}
+		maxKeys = min(maxKeys, defaultMaxKeys)
+	}
+
+	response := &listObjectsResponse{
+		Xmlns:        s3Namespace,
+		Name:         name,
+		Prefix:       prefix,
+		Delimiter:    delimiter,
+		MaxKeys:      maxKeys,
+		EncodingType: encodingType,
+	}
+	// the listing starts after marker
+	var marker string
+	if v2 {
+		response.ContinuationToken = query.Get("continuation-token")
+		response.StartAfter = query.Get("start-after")
+		marker = response.StartAfter
+		if response.ContinuationToken != "" {
+			token, err := base64.RawURLEncoding.DecodeString(response.ContinuationToken)
+			if err != nil {
+				writeError(w, r, ErrInvalidArgument)
+				return
+			}
+			marker = string(token)
+		}
+	} else {
+		marker = query.Get("marker")
+		response.Marker = &marker
+	}
+
+	metas, err := g.latestObjects(bucket.ID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	encode := func(s string) string {
+		if encodingType == "url" {
+			return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+		}
+		return s
+	}
+	last := ""
+	for _, meta := range metas {
+		if !strings.HasPrefix(meta.Name, prefix) || meta.Name <= marker {
+			continue
+		}
+		// the keys sharing a prefix up to the delimiter are rolled up in a common prefix
+		common := ""
+		if delimiter != "" {
+			if i := strings.Index(meta.Name[len(prefix):], delimiter); i >= 0 {
+				common = meta.Name[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if common != "" && common <= marker {
+			continue
+		}
+		if len(response.Contents)+len(response.CommonPrefixes) >= maxKeys {
+			response.IsTruncated = true
+			break
+		}
+		if common != "" {
+			response.CommonPrefixes = append(response.CommonPrefixes, commonPrefix{Prefix: encode(common)})
+			// the next keys of the common prefix are after it
+			marker, last = common+"\U0010ffff", common
+			continue
+		}
+		response.Contents = append(response.Contents, objectEntry{
+			Key:          encode(meta.Name),
+			LastModified: isoTime(meta.UpdatedAt),
+			ETag:         quoteETag(meta.ETag),
+			Size:         meta.Size,
+			StorageClass: storageStandard,
+		})
+		last = meta.Name
+	}
+	if response.IsTruncated {
+		if v2 {
+			response.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+		} else if delimiter != "" {
+			response.NextMarker = last
+		}
+	}
+	if v2 {
+		keyCount := len(response.Contents) + len(response.CommonPrefixes)
+		response.KeyCount = &keyCount
+		response.Prefix = encode(prefix)
+		response.StartAfter = encode(response.StartAfter)
+	}
+	writeXML(w, http.StatusOK, response)
+}
+
+// latestObjects returns the latest object of every name of the bucket sorted by name,
+// an overwritten object whose delete failed is hidden by the object replacing it
+func (g *Gateway) latestObjects(bucketID int64) ([]*control.ObjectMeta, error) {
+	metas, err := g.objects.GetMetaList(bucketID)
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[string]*control.ObjectMeta, len(metas))
+	for _, meta := range metas {
+		if m, ok := latest[meta.Name]; !ok || meta.ID > m.ID {
+			latest[meta.Name] = meta
+		}
+	}
+	list := make([]*control.ObjectMeta, 0, len(latest))
+	for _, meta := range latest {
+		list = append(list, meta)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+func isoTime(ms int64) string {
+	return time.UnixMilli(ms).UTC().Format(timeFormatISO)
+}
+
+func httpTime(ms int64) string {
+	return time.UnixMilli(ms).UTC().Format(http.TimeFormat)
+}
+
+func quoteETag(etag string) string {
+	return `"` + etag + `"`
+}
@@ -0,0 +1,143 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxChunkLineSize is the max size of a chunk header line and of a trailer line
+const maxChunkLineSize = 4096
+
+// chunkedReader decode an aws-chunked payload, every chunk is
+// "<hex size>[;chunk-signature=<signature>]\r\n<data>\r\n", the last chunk is empty and is followed by the trailers
+type chunkedReader struct {
+	r       *bufio.Reader
+	n       int64
+	started bool
+	done    bool
+
+	// signer check the signature of every chunk of a signed payload, nil for an unsigned one
+	signer    *chunkSigner
+	signature string
+	hash      hash.Hash
+}
+
+// chunkSigner chain the signatures of the chunks to the seed signature of the request
+type chunkSigner struct {
+	key      []byte
+	amzDate  string
+	scope    string
+	previous string
+}
+
+// verify check the signature of a chunk of the hash, the chunk signature is the previous one of the next chunk
+func (s *chunkSigner) verify(sig string, chunkHash []byte) error {
+	expected := signature(s.key, chunkStringToSign(s.amzDate, s.scope, s.previous, hex.EncodeToString(chunkHash)))
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(sig)) != 1 {
+		return ErrSignatureDoesNotMatch
+	}
+	s.previous = sig
+	return nil
+}
+
+func newChunkedReader(r io.Reader) *chunkedReader {
+	return &chunkedReader{r: bufio.NewReaderSize(r, maxChunkLineSize)}
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for c.n == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > c.n {
+		p = p[:c.n]
+	}
+	n, err := c.r.Read(p)
+	c.n -= int64(n)
+	if c.hash != nil {
+		c.hash.Write(p[:n])
+	}
+	if err == io.EOF {
+		err = ErrIncompleteBody
+	}
+	return n, err
+}
+
+// next read the header of the next chunk, and the trailers after the last chunk
+func (c *chunkedReader) next() error {
+	if c.started {
+		// the data of a chunk ends with CRLF
+		line, err := c.line()
+		if err != nil {
+			return err
+		}
+		if len(line) != 0 {
+			return ErrIncompleteBody
+		}
+		if c.signer != nil {
+			if err = c.signer.verify(c.signature, c.hash.Sum(nil)); err != nil {
+				return err
+			}
+		}
+	}
+	c.started = true
+	c.signature = ""
+	line, err := c.line()
+	if err != nil {
+		return err
+	}
+	if i := bytes.IndexByte(line, ';'); i >= 0 {
+		c.signature = strings.TrimPrefix(string(line[i+1:]), "chunk-signature=")
+		line = line[:i]
+	}
+	size, err := strconv.ParseInt(string(bytes.TrimSpace(line)), 16, 64)
+	if err != nil || size < 0 {
+		return ErrIncompleteBody
+	}
+	if c.signer != nil {
+		c.hash = sha256.New()
+	}
+	if size > 0 {
+		c.n = size
+		return nil
+	}
+	if c.signer != nil {
+		if err = c.signer.verify(c.signature, c.hash.Sum(nil)); err != nil {
+			return err
+		}
+	}
+	// the trailers end with an empty line, a payload without trailers may end right after the last chunk
+	c.done = true
+	for {
+		line, err = c.line()
+		if err == ErrIncompleteBody || err == nil && len(line) == 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// line returns the next line without its CRLF
+func (c *chunkedReader) line() ([]byte, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err == io.EOF || err == bufio.ErrBufferFull {
+		return nil, ErrIncompleteBody
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,143 @@
+package gateway
+
+import (
+	"encoding/xml"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"oss/internal/control"
+	"oss/internal/utils"
+)
+
+// apiError is an S3 error response
+type apiError struct {
+	Code    string
+	Message string
+	Status  int
+}
+
+func (e *apiError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	ErrAccessDenied                      = &apiError{"AccessDenied", "Access Denied.", http.StatusForbidden}
+	ErrAuthorizationHeaderMalformed      = &apiError{"AuthorizationHeaderMalformed", "The authorization header is malformed.", http.StatusBadRequest}
+	ErrAuthorizationQueryParametersError = &apiError{"AuthorizationQueryParametersError", "The authorization query parameters are malformed.", http.StatusBadRequest}
+	ErrBadDigest                         = &apiError{"BadDigest", "The Content-MD5 or checksum value that you specified did not match what the server received.", http.StatusBadRequest}
+	ErrBucketAlreadyExists               = &apiError{"BucketAlreadyExists", "The requested bucket name is not available.", http.StatusConflict}
+	ErrBucketAlreadyOwnedByYou           = &apiError{"BucketAlreadyOwnedByYou", "The bucket that you tried to create already exists, and you own it.", http.StatusConflict}
+	ErrBucketNotEmpty                    = &apiError{"BucketNotEmpty", "The bucket that you tried to delete is not empty.", http.StatusConflict}
+	ErrContentSHA256Mismatch             = &apiError{"XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed.", http.StatusBadRequest}
+	ErrEntityTooLarge                    = &apiError{"EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size.", http.StatusBadRequest}
+	ErrEntityTooSmall                    = &apiError{"EntityTooSmall", "Your proposed upload is smaller than the minimum allowed object size.", http.StatusBadRequest}
+	ErrHeadersNotSigned                  = &apiError{"AccessDenied", "There were headers present in the request which were not signed.", http.StatusForbidden}
+	ErrIncompleteBody                    = &apiError{"IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header.", http.StatusBadRequest}
+	ErrInternalError                     = &apiError{"InternalError", "We encountered an internal error. Please try again.", http.StatusInternalServerError}
+	ErrInvalidAccessKeyID                = &apiError{"InvalidAccessKeyId", "The access key ID you provided does not exist in our records.", http.StatusForbidden}
+	ErrInvalidArgument                   = &apiError{"InvalidArgument", "Invalid Argument.", http.StatusBadRequest}
+	ErrInvalidBucketName                 = &apiError{"InvalidBucketName", "The specified bucket is not valid.", http.StatusBadRequest}
+	ErrInvalidDigest                     = &apiError{"InvalidDigest", "The Content-MD5 or checksum value that you specified is not valid.", http.StatusBadRequest}
+	ErrInvalidPart                       = &apiError{"InvalidPart", "One or more of the specified parts could not be found.", http.StatusBadRequest}
+	ErrInvalidPartOrder                  = &apiError{"InvalidPartOrder", "The list of parts was not in ascending order.", http.StatusBadRequest}
+	ErrInvalidRange                      = &apiError{"InvalidRange", "The requested range is not satisfiable.", http.StatusRequestedRangeNotSatisfiable}
+	ErrInvalidRequest                    = &apiError{"InvalidRequest", "Invalid Request.", http.StatusBadRequest}
+	ErrKeyTooLong                        = &apiError{"KeyTooLongError", "Your key is too long.", http.StatusBadRequest}
+	ErrMalformedPolicy                   = &apiError{"MalformedPolicy", "The policy is not valid.", http.StatusBadRequest}
+	ErrMalformedXML                      = &apiError{"MalformedXML", "The XML that you provided was not well formed or did not validate against our published schema.", http.StatusBadRequest}
+	ErrMethodNotAllowed                  = &apiError{"MethodNotAllowed", "The specified method is not allowed against this resource.", http.StatusMethodNotAllowed}
+	ErrMissingContentLength              = &apiError{"MissingContentLength", "You must provide the Content-Length HTTP header.", http.StatusLengthRequired}
+	ErrMissingContentSHA256              = &apiError{"InvalidRequest", "Missing required header for this request: x-amz-content-sha256.", http.StatusBadRequest}
+	ErrMissingSecurityHeader             = &apiError{"MissingSecurityHeader", "Your request is missing a required header.", http.StatusBadRequest}
+	ErrNoSuchBucket                      = &apiError{"NoSuchBucket", "The specified bucket does not exist.", http.StatusNotFound}
+	ErrNoSuchBucketPolicy                = &apiError{"NoSuchBucketPolicy", "The bucket policy does not exist.", http.StatusNotFound}
+	ErrNoSuchKey                         = &apiError{"NoSuchKey", "The specified key does not exist.", http.StatusNotFound}
+	ErrNoSuchUpload                      = &apiError{"NoSuchUpload", "The specified multipart upload does not exist.", http.StatusNotFound}
+	ErrNotImplemented                    = &apiError{"NotImplemented", "A header or query you provided implies functionality that is not implemented.", http.StatusNotImplemented}
+	ErrPolicyTooLarge                    = &apiError{"PolicyTooLarge", "The policy exceeds the maximum allowed size.", http.StatusBadRequest}
+	ErrRequestExpired                    = &apiError{"AccessDenied", "Request has expired.", http.StatusForbidden}
+	ErrRequestNotYetValid                = &apiError{"AccessDenied", "Request is not valid yet.", http.StatusForbidden}
+	ErrRequestTimeTooSkewed              = &apiError{"RequestTimeTooSkewed", "The difference between the request time and the server's time is too large.", http.StatusForbidden}
+	ErrSignatureDoesNotMatch             = &apiError{"SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided.", http.StatusForbidden}
+	ErrSignatureVersionNotSupported      = &apiError{"InvalidRequest", "The authorization mechanism you have provided is not supported. Please use AWS4-HMAC-SHA256.", http.StatusBadRequest}
+)
+
+// toAPIError map an error of ctrl or of the meta repos to its S3 error
+func toAPIError(err error) *apiError {
+	var e *apiError
+	switch {
+	case errors.As(err, &e):
+		return e
+	case errors.Is(err, control.ErrAccessDenied):
+		return ErrAccessDenied
+	case errors.Is(err, control.ErrMalformedPolicy):
+		return ErrMalformedPolicy
+	case errors.Is(err, control.ErrInvalidACL):
+		return &apiError{"InvalidArgument", "The canned ACL is not supported.", http.StatusBadRequest}
+	case errors.Is(err, control.ErrObjectNotFound):
+		return ErrNoSuchKey
+	case errors.Is(err, control.ErrBucketNotFound):
+		return ErrNoSuchBucket
+	case errors.Is(err, control.ErrBucketExists):
+		return ErrBucketAlreadyOwnedByYou
+	case errors.Is(err, control.ErrBucketNotEmpty):
+		return ErrBucketNotEmpty
+	case errors.Is(err, control.ErrInvalidNotification):
+		return &apiError{"InvalidArgument", "The notification configuration is not valid.", http.StatusBadRequest}
+	case errors.Is(err, control.ErrBadDigest):
+		return ErrBadDigest
+	case errors.Is(err, control.ErrInvalidRange):
+		return ErrInvalidRange
+	case errors.Is(err, control.ErrCustomerKeyRequired):
+		return &apiError{"InvalidRequest", "The object was stored using a form of Server Side Encryption. The correct parameters must be provided to retrieve the object.", http.StatusBadRequest}
+	case errors.Is(err, control.ErrCustomerKeyMismatch):
+		return &apiError{"AccessDenied", "The provided customer key does not match the key the object was encrypted with.", http.StatusForbidden}
+	case errors.Is(err, utils.ErrInvalidKey):
+		return &apiError{"InvalidArgument", "The secret key was invalid for the specified algorithm.", http.StatusBadRequest}
+	case errors.Is(err, utils.ErrUnknownCompression):
+		return &apiError{"InvalidArgument", "The compression algorithm is not supported.", http.StatusBadRequest}
+	}
+	return ErrInternalError
+}
+
+type errorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource,omitempty"`
+	RequestID string   `xml:"RequestId"`
+}
+
+// writeError write the S3 error response of err
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	if aw, ok := w.(*auditWriter); ok {
+		aw.err = err
+	}
+	e := toAPIError(err)
+	if e == ErrInternalError {
+		log.Debugf("%s %s failed: %v", r.Method, r.URL.Path, err)
+	}
+	// a HEAD response has no body
+	if r.Method == http.MethodHead {
+		w.WriteHeader(e.Status)
+		return
+	}
+	writeXML(w, e.Status, &errorResponse{
+		Code:      e.Code,
+		Message:   e.Message,
+		Resource:  r.URL.Path,
+		RequestID: w.Header().Get(headerRequestID),
+	})
+}
+
+func writeXML(w http.ResponseWriter, status int, v any) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
@@ -0,0 +1,358 @@
+package gateway
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"oss/internal/control"
+	"oss/internal/utils"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRegion                = "us-east-1"
+	defaultMaxObjectSize         = 5 << 40
+	defaultUploadJanitorInterval = time.Hour
+	defaultUploadMaxAge          = 7 * 24 * time.Hour
+
+	headerRequestID = "x-amz-request-id"
+)
+
+// Ctrl is the part of the ctrl the gateway maps the S3 operations onto
+type Ctrl interface {
+	UploadObject(ctx context.Context, data []*os.File, name string, size int64, bucketID int64, objType control.ObjectType, opt ...control.UploadOption) (*control.Object, error)
+	DownloadObject(ctx context.Context, bucketID int64, objectID int64, opt ...control.DownloadOption) (*control.Object, error)
+	DeleteObject(ctx context.Context, bucketID int64, objectID int64) error
+	CreateBucket(ctx context.Context, name string) (*control.BucketMeta, error)
+	DeleteBucket(ctx context.Context, bucketID int64) error
+	Authorize(ctx context.Context, bucket *control.BucketMeta, request control.AccessRequest) error
+	SimulateAccess(ctx context.Context, bucketID int64, request control.AccessRequest) (*control.AccessDecision, error)
+	AuditRequest(ctx context.Context, operation string) (context.Context, func(err error))
+}
+
+type Option struct {
+	// Domain enables the virtual hosted style requests, the bucket is the subdomain of the host
+	Domain string
+	// Region is the region reported to the clients
+	Region string
+	// MaxObjectSize is the max size of an object
+	MaxObjectSize int64
+	// KeyRing wrap the keys the parts of the multipart uploads are staged with, the parts of an SSE upload
+	// can not be staged without it
+	KeyRing control.KeyRing
+	// UploadJanitorInterval is the interval between two sweeps of the abandoned multipart uploads
+	UploadJanitorInterval time.Duration
+	// UploadMaxAge is the age a multipart upload not completed nor aborted is removed at
+	UploadMaxAge time.Duration
+}
+
+func WithDomain(domain string) Option {
+	return Option{Domain: domain}
+}
+
+func WithRegion(region string) Option {
+	return Option{Region: region}
+}
+
+func WithMaxObjectSize(size int64) Option {
+	return Option{MaxObjectSize: size}
+}
+
+func WithKeyRing(ring control.KeyRing) Option {
+	return Option{KeyRing: ring}
+}
+
+func WithUploadJanitor(interval time.Duration, maxAge time.Duration) Option {
+	return Option{UploadJanitorInterval: interval, UploadMaxAge: maxAge}
+}
+
+func (o Option) apply(opt *Option) {
+	if o.Domain != "" {
+		opt.Domain = o.Domain
+	}
+	if o.Region != "" {
+		opt.Region = o.Region
+	}
+	if o.MaxObjectSize > 0 {
+		opt.MaxObjectSize = o.MaxObjectSize
+	}
+	if o.KeyRing != nil {
+		opt.KeyRing = o.KeyRing
+	}
+	if o.UploadJanitorInterval > 0 {
+		opt.UploadJanitorInterval = o.UploadJanitorInterval
+	}
+	if o.UploadMaxAge > 0 {
+		opt.UploadMaxAge = o.UploadMaxAge
+	}
+}
+
+// Gateway serve the S3 REST API over the ctrl and the meta repos, the requests are signed with the access keys
+// of the credentials. The request bodies and the multipart upload parts are spooled in tmpDir, sealed
+// when the object is encrypted.
+type Gateway struct {
+	ctrl        Ctrl
+	buckets     control.BucketMetaRepo
+	objects     control.ObjectMetaRepo
+	credentials control.CredentialRepo
+	tmpDir      string
+	uploads     *multipartStore
+	keys        *keyLocks
+	opt         Option
+}
+
+func NewGateway(ctrl Ctrl, buckets control.BucketMetaRepo, objects control.ObjectMetaRepo, credentials control.CredentialRepo, tmpDir string, opt ...Option) (*Gateway, error) {
+	if err := utils.CreateDirIfNotExists(tmpDir); err != nil {
+		return nil, err
+	}
+	uploads, err := newMultipartStore(filepath.Join(tmpDir, multipartDir))
+	if err != nil {
+		return nil, err
+	}
+	g := &Gateway{
+		ctrl:        ctrl,
+		buckets:     buckets,
+		objects:     objects,
+		credentials: credentials,
+		tmpDir:      tmpDir,
+		uploads:     uploads,
+		keys:        newKeyLocks(),
+		opt: Option{
+			Region:                defaultRegion,
+			MaxObjectSize:         defaultMaxObjectSize,
+			UploadJanitorInterval: defaultUploadJanitorInterval,
+			UploadMaxAge:          defaultUploadMaxAge,
+		},
+	}
+	for _, o := range opt {
+		o.apply(&g.opt)
+	}
+	return g, nil
+}
+
+// RunUploadJanitor remove the multipart uploads older than UploadMaxAge at startup and every UploadJanitorInterval until ctx is done
+func (g *Gateway) RunUploadJanitor(ctx context.Context) {
+	ticker := time.NewTicker(g.opt.UploadJanitorInterval)
+	defer ticker.Stop()
+	for {
+		if err := g.uploads.expire(g.opt.UploadMaxAge); err != nil {
+			log.Debugf("expire multipart uploads failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ListenAndServe serve the gateway on addr
+func (g *Gateway) ListenAndServe(addr string) error {
+	return http.ListenAndServe(addr, g)
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := requestID()
+	w.Header().Set(headerRequestID, id)
+	w.Header().Set("Server", "oss")
+	// the principal and the request id are passed down to the ctrl with the context,
+	// the ctrl audits the request once with what it is made on, a failed authentication included
+	principal := &control.Principal{SourceIP: sourceIP(r)}
+	ctx, end := g.ctrl.AuditRequest(control.WithRequestID(control.WithPrincipal(r.Context(), principal), id), r.Method)
+	aw := &auditWriter{ResponseWriter: w}
+	defer func() { end(aw.err) }()
+	w = aw
+	auth, err := g.authenticate(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	auth.principal.SourceIP = principal.SourceIP
+	*principal = *auth.principal
+	auth.principal = principal
+	r = r.WithContext(context.WithValue(ctx, authKey{}, auth))
+	bucket, key := g.route(r)
+	query := r.URL.Query()
+
+	switch {
+	case bucket == "":
+		if r.Method != http.MethodGet {
+			writeError(w, r, ErrMethodNotAllowed)
+			return
+		}
+		g.listBuckets(w, r)
+	case key == "":
+		g.serveBucket(w, r, bucket, query)
+	case query.Has("uploads"):
+		if r.Method != http.MethodPost {
+			writeError(w, r, ErrMethodNotAllowed)
+			return
+		}
+		g.createMultipartUpload(w, r, bucket, key)
+	case query.Has("uploadId"):
+		g.serveMultipart(w, r, bucket, key, query.Get("uploadId"))
+	default:
+		g.serveObject(w, r, bucket, key)
+	}
+}
+
+func (g *Gateway) serveBucket(w http.ResponseWriter, r *http.Request, bucket string, query url.Values) {
+	switch {
+	case query.Has("policy"):
+		g.serveBucketPolicy(w, r, bucket)
+		return
+	case query.Has("acl"):
+		g.serveBucketACL(w, r, bucket)
+		return
+	case query.Has("notification"):
+		g.serveBucketNotification(w, r, bucket)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		g.createBucket(w, r, bucket)
+	case http.MethodHead:
+		g.headBucket(w, r, bucket)
+	case http.MethodDelete:
+		g.deleteBucket(w, r, bucket)
+	case http.MethodGet:
+		switch {
+		case query.Has("location"):
+			g.getBucketLocation(w, r, bucket)
+		case query.Has("simulate"):
+			g.simulateAccess(w, r, bucket)
+		case query.Has("uploads"):
+			writeError(w, r, ErrNotImplemented)
+		default:
+			g.listObjects(w, r, bucket)
+		}
+	default:
+		writeError(w, r, ErrMethodNotAllowed)
+	}
+}
+
+func (g *Gateway) serveBucketPolicy(w http.ResponseWriter, r *http.Request, bucket string) {
+	switch r.Method {
+	case http.MethodGet:
+		g.getBucketPolicy(w, r, bucket)
+	case http.MethodPut:
+		g.putBucketPolicy(w, r, bucket)
+	case http.MethodDelete:
+		g.deleteBucketPolicy(w, r, bucket)
+	default:
+		writeError(w, r, ErrMethodNotAllowed)
+	}
+}
+
+func (g *Gateway) serveBucketACL(w http.ResponseWriter, r *http.Request, bucket string) {
+	switch r.Method {
+	case http.MethodGet:
+		g.getBucketACL(w, r, bucket)
+	case http.MethodPut:
+		g.putBucketACL(w, r, bucket)
+	default:
+		writeError(w, r, ErrMethodNotAllowed)
+	}
+}
+
+func (g *Gateway) serveObject(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	switch r.Method {
+	case http.MethodPut:
+		if r.Header.Get("x-amz-copy-source") != "" {
+			writeError(w, r, ErrNotImplemented)
+			return
+		}
+		g.putObject(w, r, bucket, key)
+	case http.MethodGet:
+		g.getObject(w, r, bucket, key)
+	case http.MethodHead:
+		g.headObject(w, r, bucket, key)
+	case http.MethodDelete:
+		g.deleteObject(w, r, bucket, key)
+	default:
+		writeError(w, r, ErrMethodNotAllowed)
+	}
+}
+
+func (g *Gateway) serveMultipart(w http.ResponseWriter, r *http.Request, bucket string, key string, uploadID string) {
+	switch r.Method {
+	case http.MethodPut:
+		g.uploadPart(w, r, bucket, key, uploadID)
+	case http.MethodPost:
+		g.completeMultipartUpload(w, r, bucket, key, uploadID)
+	case http.MethodDelete:
+		g.abortMultipartUpload(w, r, bucket, key, uploadID)
+	case http.MethodGet:
+		g.listParts(w, r, bucket, key, uploadID)
+	default:
+		writeError(w, r, ErrMethodNotAllowed)
+	}
+}
+
+// auditWriter keep the error the request failed with for the audit of the request
+type auditWriter struct {
+	http.ResponseWriter
+	err error
+}
+
+// route returns the bucket and the key of the request, from the host for a virtual hosted style request
+func (g *Gateway) route(r *http.Request) (bucket string, key string) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if g.opt.Domain != "" {
+		host := r.Host
+		if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.Contains(host[i:], "]") {
+			host = host[:i]
+		}
+		if strings.HasSuffix(host, "."+g.opt.Domain) {
+			return strings.TrimSuffix(host, "."+g.opt.Domain), path
+		}
+	}
+	bucket, key, _ = strings.Cut(path, "/")
+	return bucket, key
+}
+
+// bucket returns the meta of the bucket of name
+func (g *Gateway) bucket(name string) (*control.BucketMeta, error) {
+	bucket, err := g.buckets.GetBucketByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if bucket == nil {
+		return nil, control.ErrBucketNotFound
+	}
+	return bucket, nil
+}
+
+// authorizedBucket returns the meta of the bucket of name once the principal of the request is allowed to make the request on it
+func (g *Gateway) authorizedBucket(r *http.Request, name string, request control.AccessRequest) (*control.BucketMeta, error) {
+	bucket, err := g.bucket(name)
+	if err != nil {
+		return nil, err
+	}
+	if err = g.ctrl.Authorize(r.Context(), bucket, request); err != nil {
+		return nil, err
+	}
+	return bucket, nil
+}
+
+// sourceIP returns the address of the client of the request
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func requestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return strings.ToUpper(hex.EncodeToString(b))
+}
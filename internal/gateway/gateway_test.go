@@ -0,0 +1,449 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"oss/internal/control"
+	"oss/internal/data/bucket"
+	"oss/internal/data/credential"
+	"oss/internal/data/object"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testBucket = "bucket"
+
+type testIDGenerator struct {
+	n atomic.Int64
+}
+
+func (g *testIDGenerator) GenerateID() int64 {
+	return g.n.Add(1)
+}
+
+// memCtrl keep the content of the objects in memory and their meta in the object repo
+type memCtrl struct {
+	sync.Mutex
+	objects control.ObjectMetaRepo
+	ids     testIDGenerator
+	data    map[int64][]byte
+	// delay is the time an upload takes once its content is read
+	delay time.Duration
+	// audits receives the audited requests
+	audits chan auditRecord
+}
+
+// auditRecord is a request audited by the ctrl
+type auditRecord struct {
+	operation string
+	requestID string
+	principal control.Principal
+	err       error
+}
+
+func (c *memCtrl) UploadObject(ctx context.Context, data []*os.File, name string, size int64, bucketID int64, objType control.ObjectType, opt ...control.UploadOption) (*control.Object, error) {
+	readers := make([]io.Reader, len(data))
+	for i := range data {
+		readers[i] = data[i]
+	}
+	content, err := io.ReadAll(io.LimitReader(io.MultiReader(readers...), size))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) != size {
+		return nil, control.ErrContentTooShort
+	}
+	time.Sleep(c.delay)
+	meta := &control.ObjectMeta{ID: c.ids.GenerateID(), Name: name, Size: size, BucketID: bucketID, Type: objType, ETag: md5Hex(content)}
+	if err = c.objects.StoreMeta(meta); err != nil {
+		return nil, err
+	}
+	c.Lock()
+	c.data[meta.ID] = content
+	c.Unlock()
+	return &control.Object{ID: meta.ID, Name: name, Size: size, BucketID: bucketID, ETag: meta.ETag}, nil
+}
+
+// DownloadObject returns the object in a removed temp file, a range is not supported
+func (c *memCtrl) DownloadObject(ctx context.Context, bucketID int64, objectID int64, opt ...control.DownloadOption) (*control.Object, error) {
+	c.Lock()
+	content, ok := c.data[objectID]
+	c.Unlock()
+	if !ok {
+		return nil, control.ErrObjectNotFound
+	}
+	file, err := os.CreateTemp("", "object-*")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(file.Name())
+	if _, err = file.Write(content); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &control.Object{ID: objectID, BucketID: bucketID, Size: int64(len(content)), Files: []*os.File{file}}, nil
+}
+
+func (c *memCtrl) DeleteObject(ctx context.Context, bucketID int64, objectID int64) error {
+	c.Lock()
+	delete(c.data, objectID)
+	c.Unlock()
+	return c.objects.DeleteMeta(bucketID, objectID)
+}
+
+func (c *memCtrl) CreateBucket(ctx context.Context, name string) (*control.BucketMeta, error) {
+	return nil, ErrNotImplemented
+}
+
+func (c *memCtrl) DeleteBucket(ctx context.Context, bucketID int64) error {
+	return ErrNotImplemented
+}
+
+func (c *memCtrl) Authorize(ctx context.Context, bucket *control.BucketMeta, request control.AccessRequest) error {
+	return nil
+}
+
+func (c *memCtrl) SimulateAccess(ctx context.Context, bucketID int64, request control.AccessRequest) (*control.AccessDecision, error) {
+	return nil, ErrNotImplemented
+}
+
+func (c *memCtrl) AuditRequest(ctx context.Context, operation string) (context.Context, func(err error)) {
+	return ctx, func(err error) {
+		record := auditRecord{operation: operation, requestID: control.RequestIDFromContext(ctx), err: err}
+		if principal := control.PrincipalFromContext(ctx); principal != nil {
+			record.principal = *principal
+		}
+		select {
+		case c.audits <- record:
+		default:
+		}
+	}
+}
+
+// audited returns the next audited request, it is recorded once the response is sent
+func (c *memCtrl) audited(t *testing.T) auditRecord {
+	t.Helper()
+	select {
+	case record := <-c.audits:
+		return record
+	case <-time.After(5 * time.Second):
+		t.Fatal("request not audited")
+	}
+	return auditRecord{}
+}
+
+// content returns the content of the latest object of the key
+func (c *memCtrl) content(t *testing.T, bucketID int64, key string) []byte {
+	t.Helper()
+	meta, err := c.objects.GetMetaByName(bucketID, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.data[meta.ID]
+}
+
+type testGateway struct {
+	*Gateway
+	ctrl      *memCtrl
+	bucket    *control.BucketMeta
+	accessKey *control.AccessKey
+	url       string
+}
+
+func newTestGateway(t *testing.T, opt ...Option) *testGateway {
+	dir := t.TempDir()
+	objects := object.NewObjectMetaStore(filepath.Join(dir, "objects"))
+	buckets := bucket.NewBucketMetaStore(filepath.Join(dir, "buckets"), &testIDGenerator{})
+	credentials, err := credential.NewFileCredentialStore(filepath.Join(dir, "credentials.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := credentials.CreateUser("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessKey, err := credentials.CreateAccessKey(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := buckets.CreateBucket(testBucket, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrl := &memCtrl{objects: objects, data: make(map[int64][]byte), audits: make(chan auditRecord, 100)}
+	g, err := NewGateway(ctrl, buckets, objects, credentials, filepath.Join(dir, "tmp"), opt...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(g)
+	t.Cleanup(server.Close)
+	return &testGateway{Gateway: g, ctrl: ctrl, bucket: b, accessKey: accessKey, url: server.URL}
+}
+
+// do send the request signed in the Authorization header, with the x-amz headers and the host signed,
+// a Host header replaces the host of the request
+func (g *testGateway) do(t *testing.T, method string, path string, body []byte, header map[string]string) (*http.Response, []byte) {
+	t.Helper()
+	r, err := http.NewRequest(method, g.url+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range header {
+		if name == "Host" {
+			r.Host = value
+			continue
+		}
+		r.Header.Set(name, value)
+	}
+	if r.Header.Get(headerContentSHA256) == "" {
+		sum := sha256.Sum256(body)
+		r.Header.Set(headerContentSHA256, hex.EncodeToString(sum[:]))
+	}
+	signHeader(r, g.accessKey, time.Now())
+	response, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response, data
+}
+
+// expect send the request and fail the test when the response is not of the status
+func (g *testGateway) expect(t *testing.T, status int, method string, path string, body []byte, header map[string]string) (*http.Response, []byte) {
+	t.Helper()
+	response, data := g.do(t, method, path, body, header)
+	if response.StatusCode != status {
+		t.Fatalf("%s %s: status %d, want %d: %s", method, path, response.StatusCode, status, data)
+	}
+	return response, data
+}
+
+// signHeader sign the request in its Authorization header, the headers set after are not signed
+func signHeader(r *http.Request, accessKey *control.AccessKey, now time.Time) {
+	amzDate := now.UTC().Format(timeFormatAmz)
+	r.Header.Set("x-amz-date", amzDate)
+	headers := []string{"host"}
+	for name := range r.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-amz-") || name == "content-md5" {
+			headers = append(headers, name)
+		}
+	}
+	sort.Strings(headers)
+	headers = slices.Compact(headers)
+	scope := amzDate[:len(timeFormatScope)] + "/" + defaultRegion + "/" + serviceS3 + "/" + scopeTerminator
+	key := signingKey(accessKey.SecretKey, amzDate[:len(timeFormatScope)], defaultRegion, serviceS3)
+	sig := signature(key, stringToSign(amzDate, scope, canonicalRequest(r, headers, r.Header.Get(headerContentSHA256))))
+	r.Header.Set("Authorization", signV4Algorithm+" Credential="+accessKey.AccessKeyID+"/"+scope+
+		", SignedHeaders="+strings.Join(headers, ";")+", Signature="+sig)
+}
+
+// errorCode returns the code of the S3 error response
+func errorCode(t *testing.T, response *http.Response, data []byte) string {
+	t.Helper()
+	e := &errorResponse{}
+	if err := xml.Unmarshal(data, e); err != nil {
+		t.Fatalf("error response %q: %v", data, err)
+	}
+	if id := response.Header.Get(headerRequestID); id == "" || e.RequestID != id {
+		t.Fatalf("error response of request %q has the request id %q", id, e.RequestID)
+	}
+	return e.Code
+}
+
+func TestObjectRequests(t *testing.T) {
+	g := newTestGateway(t)
+	data := testData(1000, 1)
+	key := "/" + testBucket + "/dir/object"
+
+	response, _ := g.expect(t, http.StatusOK, http.MethodPut, key, data, nil)
+	if etag := response.Header.Get("ETag"); etag != `"`+md5Hex(data)+`"` {
+		t.Fatalf("etag %s, want the md5 of the content", etag)
+	}
+	if _, got := g.expect(t, http.StatusOK, http.MethodGet, key, nil, nil); !bytes.Equal(got, data) {
+		t.Fatal("got object differs from the put one")
+	}
+	response, _ = g.expect(t, http.StatusOK, http.MethodHead, key, nil, nil)
+	if response.ContentLength != int64(len(data)) {
+		t.Fatalf("head content length %d, want %d", response.ContentLength, len(data))
+	}
+	_, list := g.expect(t, http.StatusOK, http.MethodGet, "/"+testBucket+"?list-type=2&prefix=dir/", nil, nil)
+	result := &listObjectsResponse{}
+	if err := xml.Unmarshal(list, result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Contents) != 1 || result.Contents[0].Key != "dir/object" || result.Contents[0].Size != int64(len(data)) {
+		t.Fatalf("listed %+v", result.Contents)
+	}
+	_, list = g.expect(t, http.StatusOK, http.MethodGet, "/", nil, nil)
+	if !strings.Contains(string(list), "<Name>"+testBucket+"</Name>") {
+		t.Fatalf("bucket not listed: %s", list)
+	}
+	g.expect(t, http.StatusNoContent, http.MethodDelete, key, nil, nil)
+	g.expect(t, http.StatusNotFound, http.MethodGet, key, nil, nil)
+}
+
+func TestVirtualHostedStyle(t *testing.T) {
+	g := newTestGateway(t, WithDomain("oss.test"))
+	data := testData(1000, 1)
+	host := testBucket + ".oss.test"
+
+	g.expect(t, http.StatusOK, http.MethodPut, "/dir/object", data, map[string]string{"Host": host + ":9000"})
+	if got := g.ctrl.content(t, g.bucket.ID, "dir/object"); !bytes.Equal(got, data) {
+		t.Fatal("object not stored under the key of the path")
+	}
+	// the path style requests are still served
+	if _, got := g.expect(t, http.StatusOK, http.MethodGet, "/"+testBucket+"/dir/object", nil, nil); !bytes.Equal(got, data) {
+		t.Fatal("path style get differs")
+	}
+	if _, got := g.expect(t, http.StatusOK, http.MethodGet, "/dir/object", nil, map[string]string{"Host": host}); !bytes.Equal(got, data) {
+		t.Fatal("virtual hosted style get differs")
+	}
+	_, list := g.expect(t, http.StatusOK, http.MethodGet, "/", nil, map[string]string{"Host": host})
+	if !strings.Contains(string(list), "<Key>dir/object</Key>") {
+		t.Fatalf("the root of the bucket host does not list the bucket: %s", list)
+	}
+	response, data := g.expect(t, http.StatusNotFound, http.MethodGet, "/object", nil, map[string]string{"Host": "missing.oss.test"})
+	if code := errorCode(t, response, data); code != "NoSuchBucket" {
+		t.Fatalf("error %s, want NoSuchBucket", code)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	g := newTestGateway(t)
+	g.expect(t, http.StatusOK, http.MethodPut, "/"+testBucket+"/object", []byte("data"), nil)
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		header map[string]string
+		status int
+		code   string
+	}{
+		{name: "missing key", method: http.MethodGet, path: "/" + testBucket + "/missing", status: http.StatusNotFound, code: "NoSuchKey"},
+		{name: "missing bucket", method: http.MethodGet, path: "/missing/object", status: http.StatusNotFound, code: "NoSuchBucket"},
+		{name: "method of an object", method: http.MethodPost, path: "/" + testBucket + "/object", status: http.StatusMethodNotAllowed, code: "MethodNotAllowed"},
+		{name: "method of the service", method: http.MethodPut, path: "/", status: http.StatusMethodNotAllowed, code: "MethodNotAllowed"},
+		{name: "copy", method: http.MethodPut, path: "/" + testBucket + "/copy", header: map[string]string{"x-amz-copy-source": testBucket + "/object"}, status: http.StatusNotImplemented, code: "NotImplemented"},
+		{name: "invalid bucket name", method: http.MethodPut, path: "/Invalid_Bucket", status: http.StatusBadRequest, code: "InvalidBucketName"},
+		{name: "invalid range", method: http.MethodGet, path: "/" + testBucket + "/object", header: map[string]string{"Range": "bytes=100-200"}, status: http.StatusRequestedRangeNotSatisfiable, code: "InvalidRange"},
+		{name: "key too long", method: http.MethodPut, path: "/" + testBucket + "/" + strings.Repeat("k", 1025), status: http.StatusBadRequest, code: "KeyTooLongError"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			response, data := g.expect(t, tc.status, tc.method, tc.path, nil, tc.header)
+			if code := errorCode(t, response, data); code != tc.code {
+				t.Fatalf("error %s, want %s", code, tc.code)
+			}
+		})
+	}
+
+	// a HEAD error has no body
+	response, data := g.expect(t, http.StatusNotFound, http.MethodHead, "/"+testBucket+"/missing", nil, nil)
+	if len(data) != 0 || response.Header.Get(headerRequestID) == "" {
+		t.Fatalf("head error has %d bytes of body and the request id %q", len(data), response.Header.Get(headerRequestID))
+	}
+
+	// the signature errors
+	r, err := http.NewRequest(http.MethodGet, g.url+"/"+testBucket+"/object", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set(headerContentSHA256, unsignedPayload)
+	signHeader(r, &control.AccessKey{AccessKeyID: g.accessKey.AccessKeyID, SecretKey: "wrong"}, time.Now())
+	if code := sendError(t, r, http.StatusForbidden); code != "SignatureDoesNotMatch" {
+		t.Fatalf("error %s, want SignatureDoesNotMatch", code)
+	}
+	signHeader(r, &control.AccessKey{AccessKeyID: "unknown", SecretKey: g.accessKey.SecretKey}, time.Now())
+	if code := sendError(t, r, http.StatusForbidden); code != "InvalidAccessKeyId" {
+		t.Fatalf("error %s, want InvalidAccessKeyId", code)
+	}
+	signHeader(r, g.accessKey, time.Now().Add(-time.Hour))
+	if code := sendError(t, r, http.StatusForbidden); code != "RequestTimeTooSkewed" {
+		t.Fatalf("error %s, want RequestTimeTooSkewed", code)
+	}
+}
+
+func TestAuditRequest(t *testing.T) {
+	g := newTestGateway(t)
+	response, _ := g.expect(t, http.StatusOK, http.MethodPut, "/"+testBucket+"/object", []byte("data"), nil)
+	record := g.ctrl.audited(t)
+	if record.operation != http.MethodPut || record.err != nil || record.requestID != response.Header.Get(headerRequestID) {
+		t.Fatalf("audited %+v of request %s", record, response.Header.Get(headerRequestID))
+	}
+	if record.principal.UserID != g.accessKey.UserID || record.principal.AccessKeyID != g.accessKey.AccessKeyID || record.principal.SourceIP != "127.0.0.1" {
+		t.Fatalf("audited principal %+v", record.principal)
+	}
+
+	// a request failing its authentication is audited with its error
+	r, err := http.NewRequest(http.MethodGet, g.url+"/"+testBucket+"/object", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set(headerContentSHA256, unsignedPayload)
+	signHeader(r, &control.AccessKey{AccessKeyID: g.accessKey.AccessKeyID, SecretKey: "wrong"}, time.Now())
+	sendError(t, r, http.StatusForbidden)
+	record = g.ctrl.audited(t)
+	if record.operation != http.MethodGet || !errors.Is(record.err, ErrSignatureDoesNotMatch) || record.requestID == "" {
+		t.Fatalf("audited %+v of the request of a wrong signature", record)
+	}
+	if record.principal != (control.Principal{SourceIP: "127.0.0.1"}) {
+		t.Fatalf("audited principal %+v of the request of a wrong signature", record.principal)
+	}
+}
+
+// sendError send the request and returns the code of its error response of the status
+func sendError(t *testing.T, r *http.Request, status int) string {
+	t.Helper()
+	response, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != status {
+		t.Fatalf("status %d, want %d: %s", response.StatusCode, status, data)
+	}
+	return errorCode(t, response, data)
+}
+
+// testData returns size bytes of random data, the same for a seed
+func testData(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func md5Hex(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,47 @@
+package gateway
+
+import (
+	"strconv"
+	"sync"
+)
+
+// keyLocks serialize the uploads of a key, an upload replaces the object it found under the key
+// and no other upload can replace it in between
+type keyLocks struct {
+	sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	// holders is the number of uploads holding or waiting for the lock, the lock is dropped with the last one
+	holders int
+}
+
+func newKeyLocks() *keyLocks {
+	return &keyLocks{locks: make(map[string]*keyLock)}
+}
+
+// lock the key of the bucket, it returns the unlock func
+func (l *keyLocks) lock(bucketID int64, key string) func() {
+	name := strconv.FormatInt(bucketID, 10) + "/" + key
+	l.Lock()
+	lock, ok := l.locks[name]
+	if !ok {
+		lock = &keyLock{}
+		l.locks[name] = lock
+	}
+	lock.holders++
+	l.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.Lock()
+		lock.holders--
+		if lock.holders == 0 {
+			delete(l.locks, name)
+		}
+		l.Unlock()
+	}
+}
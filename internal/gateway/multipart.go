@@ -0,0 +1,608 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"os"
+	"oss/internal/control"
+	"oss/internal/utils"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// multipartDir hold the multipart uploads in the tmp dir of the gateway
+	multipartDir   = "multipart"
+	uploadFile     = "upload.json"
+	minPartSize    = 5 << 20
+	maxPartNumber  = 10000
+	defaultMaxPart = 1000
+	// maxCompleteBodySize is the max size of the part list completing an upload
+	maxCompleteBodySize = 1 << 20
+	// stagingKeyLabel derive the staging key of an SSE-C upload from the key of the customer
+	stagingKeyLabel = "multipart-staging:"
+)
+
+// multipartUpload is an initiated multipart upload
+type multipartUpload struct {
+	Bucket     string             `json:"bucket"`
+	BucketID   int64              `json:"bucket_id"`
+	Key        string             `json:"key"`
+	Type       control.ObjectType `json:"type"`
+	Initiated  int64              `json:"initiated"`
+	Encryption bool               `json:"encryption,omitempty"`
+	// CustomerKeyMD5 is the md5 of the SSE-C key, the key itself is only kept in memory
+	CustomerKeyMD5 string `json:"customer_key_md5,omitempty"`
+	// StagingKeyID and StagingKey are the key the parts are sealed with in the tmp dir, wrapped by the key ring.
+	// The parts of an SSE-C upload are sealed with a key derived from the key of the customer instead.
+	StagingKeyID string `json:"staging_key_id,omitempty"`
+	StagingKey   []byte `json:"staging_key,omitempty"`
+}
+
+// uploadedPart is a part of a multipart upload
+type uploadedPart struct {
+	Number       int    `json:"number"`
+	ETag         string `json:"etag"`
+	Size         int64  `json:"size"`
+	LastModified int64  `json:"last_modified"`
+}
+
+// multipartStore keep a dir per multipart upload holding the upload, a file per part and a json file per part.
+// The uploads not completed nor aborted are removed once they expire.
+type multipartStore struct {
+	sync.Mutex
+	dir string
+	// customerKeys hold the SSE-C keys of the uploads, the parts are encrypted with them once the upload completes
+	customerKeys map[string][]byte
+}
+
+func newMultipartStore(dir string) (*multipartStore, error) {
+	if err := utils.CreateDirIfNotExists(dir); err != nil {
+		return nil, err
+	}
+	return &multipartStore{dir: dir, customerKeys: make(map[string][]byte)}, nil
+}
+
+func (s *multipartStore) create(upload *multipartUpload, customerKey []byte) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	uploadID := hex.EncodeToString(b)
+	if err := os.Mkdir(filepath.Join(s.dir, uploadID), 0755); err != nil {
+		return "", err
+	}
+	if err := writeJSON(filepath.Join(s.dir, uploadID, uploadFile), upload); err != nil {
+		os.RemoveAll(filepath.Join(s.dir, uploadID))
+		return "", err
+	}
+	if customerKey != nil {
+		s.Lock()
+		s.customerKeys[uploadID] = customerKey
+		s.Unlock()
+	}
+	return uploadID, nil
+}
+
+// get returns the upload of the bucket and the key
+func (s *multipartStore) get(uploadID string, bucket string, key string) (*multipartUpload, error) {
+	if !validUploadID(uploadID) {
+		return nil, ErrNoSuchUpload
+	}
+	upload := &multipartUpload{}
+	if err := readJSON(filepath.Join(s.dir, uploadID, uploadFile), upload); err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNoSuchUpload
+		}
+		return nil, err
+	}
+	if upload.Bucket != bucket || upload.Key != key {
+		return nil, ErrNoSuchUpload
+	}
+	return upload, nil
+}
+
+// putPart move the spooled file in the upload, a part uploaded again replaces the previous one
+func (s *multipartStore) putPart(uploadID string, part *uploadedPart, file string) error {
+	s.Lock()
+	defer s.Unlock()
+	dir := filepath.Join(s.dir, uploadID)
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return ErrNoSuchUpload
+		}
+		return err
+	}
+	name := filepath.Join(dir, strconv.Itoa(part.Number))
+	if err := os.Rename(file, name); err != nil {
+		return err
+	}
+	return writeJSON(name+".json", part)
+}
+
+// parts returns the parts of the upload sorted by number
+func (s *multipartStore) parts(uploadID string) ([]*uploadedPart, error) {
+	matches, err := filepath.Glob(filepath.Join(s.dir, uploadID, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	parts := make([]*uploadedPart, 0, len(matches))
+	for _, match := range matches {
+		if filepath.Base(match) == uploadFile {
+			continue
+		}
+		part := &uploadedPart{}
+		if err = readJSON(match, part); err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+	return parts, nil
+}
+
+func (s *multipartStore) partFile(uploadID string, number int) string {
+	return filepath.Join(s.dir, uploadID, strconv.Itoa(number))
+}
+
+func (s *multipartStore) customerKey(uploadID string) []byte {
+	s.Lock()
+	defer s.Unlock()
+	return s.customerKeys[uploadID]
+}
+
+// expire remove the uploads initiated more than maxAge ago, an upload without a readable
+// upload file is aged by the mod time of its dir
+func (s *multipartStore) expire(maxAge time.Duration) error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(-maxAge)
+	for _, entry := range entries {
+		if !entry.IsDir() || !validUploadID(entry.Name()) {
+			continue
+		}
+		initiated, err := s.initiated(entry)
+		if err != nil {
+			return err
+		}
+		if initiated.After(deadline) {
+			continue
+		}
+		if err = s.remove(entry.Name()); err != nil && !errors.Is(err, ErrNoSuchUpload) {
+			return err
+		}
+		log.Debugf("expire multipart upload %s initiated at %s", entry.Name(), initiated)
+	}
+	return nil
+}
+
+func (s *multipartStore) initiated(entry os.DirEntry) (time.Time, error) {
+	upload := &multipartUpload{}
+	if err := readJSON(filepath.Join(s.dir, entry.Name(), uploadFile), upload); err == nil {
+		return time.UnixMilli(upload.Initiated), nil
+	}
+	info, err := entry.Info()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+func (s *multipartStore) remove(uploadID string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.customerKeys, uploadID)
+	dir := filepath.Join(s.dir, uploadID)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return ErrNoSuchUpload
+	}
+	return os.RemoveAll(dir)
+}
+
+// authorizedUpload returns the upload once the principal of the request is allowed to make the action on its key
+func (g *Gateway) authorizedUpload(r *http.Request, uploadID string, bucket string, key string, action control.Action) (*multipartUpload, error) {
+	if _, err := g.authorizedBucket(r, bucket, control.AccessRequest{Action: action, Key: key}); err != nil {
+		return nil, err
+	}
+	return g.uploads.get(uploadID, bucket, key)
+}
+
+// stagingKey returns the key the parts of the upload are sealed with, nil when they are not sealed
+func (g *Gateway) stagingKey(uploadID string, upload *multipartUpload, customerKey []byte) ([]byte, error) {
+	switch {
+	case upload.CustomerKeyMD5 != "":
+		mac := hmac.New(sha256.New, customerKey)
+		mac.Write([]byte(stagingKeyLabel + uploadID))
+		return mac.Sum(nil), nil
+	case upload.StagingKey != nil:
+		if g.opt.KeyRing == nil {
+			return nil, control.ErrNoKeyRing
+		}
+		return g.opt.KeyRing.UnwrapKey(upload.StagingKeyID, upload.StagingKey)
+	}
+	return nil, nil
+}
+
+func validUploadID(uploadID string) bool {
+	b, err := hex.DecodeString(uploadID)
+	return err == nil && len(b) == 16
+}
+
+type initiateMultipartUploadResponse struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+type completeMultipartUploadRequest struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type completeMultipartUploadResponse struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+type partEntry struct {
+	PartNumber   int    `xml:"PartNumber"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+}
+
+type listPartsResponse struct {
+	XMLName              xml.Name    `xml:"ListPartsResult"`
+	Xmlns                string      `xml:"xmlns,attr"`
+	Bucket               string      `xml:"Bucket"`
+	Key                  string      `xml:"Key"`
+	UploadID             string      `xml:"UploadId"`
+	StorageClass         string      `xml:"StorageClass"`
+	PartNumberMarker     int         `xml:"PartNumberMarker"`
+	NextPartNumberMarker int         `xml:"NextPartNumberMarker"`
+	MaxParts             int         `xml:"MaxParts"`
+	IsTruncated          bool        `xml:"IsTruncated"`
+	Parts                []partEntry `xml:"Part"`
+}
+
+func (g *Gateway) createMultipartUpload(w http.ResponseWriter, r *http.Request, bucketName string, key string) {
+	if len(key) > maxKeyLength {
+		writeError(w, r, ErrKeyTooLong)
+		return
+	}
+	bucket, err := g.authorizedBucket(r, bucketName, control.AccessRequest{Action: control.ActionPutObject, Key: key})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	upload := &multipartUpload{
+		Bucket:    bucketName,
+		BucketID:  bucket.ID,
+		Key:       key,
+		Type:      objectType(r),
+		Initiated: time.Now().UnixMilli(),
+	}
+	switch sse := r.Header.Get(headerSSE); sse {
+	case "":
+	case sseAES256:
+		upload.Encryption = true
+	default:
+		writeError(w, r, ErrInvalidArgument)
+		return
+	}
+	sseKey, err := customerKey(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if sseKey != nil {
+		upload.CustomerKeyMD5 = keyMD5(sseKey)
+	} else if g.opt.KeyRing != nil {
+		// the parts are sealed when the key ring is configured, they have to be for an SSE upload
+		key, err := utils.RandomKey()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if upload.StagingKeyID, upload.StagingKey, err = g.opt.KeyRing.WrapKey(key); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	} else if upload.Encryption {
+		writeError(w, r, control.ErrNoKeyRing)
+		return
+	}
+	uploadID, err := g.uploads.create(upload, sseKey)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeSSEHeaders(w, r)
+	writeXML(w, http.StatusOK, &initiateMultipartUploadResponse{
+		Xmlns:    s3Namespace,
+		Bucket:   bucketName,
+		Key:      key,
+		UploadID: uploadID,
+	})
+}
+
+func (g *Gateway) uploadPart(w http.ResponseWriter, r *http.Request, bucket string, key string, uploadID string) {
+	number, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || number < 1 || number > maxPartNumber {
+		writeError(w, r, ErrInvalidArgument)
+		return
+	}
+	upload, err := g.authorizedUpload(r, uploadID, bucket, key, control.ActionPutObject)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	// the parts of an SSE-C upload are sent with the key of the upload
+	sseKey, err := customerKey(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if upload.CustomerKeyMD5 != "" && (sseKey == nil || keyMD5(sseKey) != upload.CustomerKeyMD5) {
+		writeError(w, r, control.ErrCustomerKeyMismatch)
+		return
+	}
+	expected, err := contentMD5(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	stagingKey, err := g.stagingKey(uploadID, upload, sseKey)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	file, size, digest, err := g.spool(r, stagingKey)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer discard(file)
+	if expected != nil && !bytes.Equal(expected, digest) {
+		writeError(w, r, ErrBadDigest)
+		return
+	}
+	part := &uploadedPart{
+		Number:       number,
+		ETag:         hex.EncodeToString(digest),
+		Size:         size,
+		LastModified: time.Now().UnixMilli(),
+	}
+	if err = g.uploads.putPart(uploadID, part, file.Name()); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", quoteETag(part.ETag))
+	writeSSEHeaders(w, r)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (g *Gateway) completeMultipartUpload(w http.ResponseWriter, r *http.Request, bucket string, key string, uploadID string) {
+	upload, err := g.authorizedUpload(r, uploadID, bucket, key, control.ActionPutObject)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	body, _, err := requestBody(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(body, maxCompleteBodySize))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	request := &completeMultipartUploadRequest{}
+	if err = xml.Unmarshal(data, request); err != nil || len(request.Parts) == 0 {
+		writeError(w, r, ErrMalformedXML)
+		return
+	}
+	parts, err := g.uploads.parts(uploadID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	uploaded := make(map[int]*uploadedPart, len(parts))
+	for _, part := range parts {
+		uploaded[part.Number] = part
+	}
+
+	// the object is the listed parts in order, every part but the last is at least minPartSize
+	var size int64
+	files := make([]*os.File, 0, len(request.Parts))
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for i, p := range request.Parts {
+		if i > 0 && p.PartNumber <= request.Parts[i-1].PartNumber {
+			writeError(w, r, ErrInvalidPartOrder)
+			return
+		}
+		part, ok := uploaded[p.PartNumber]
+		if !ok || strings.Trim(p.ETag, `"`) != part.ETag {
+			writeError(w, r, ErrInvalidPart)
+			return
+		}
+		if part.Size < minPartSize && i < len(request.Parts)-1 {
+			writeError(w, r, ErrEntityTooSmall)
+			return
+		}
+		file, err := os.Open(g.uploads.partFile(uploadID, p.PartNumber))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		files = append(files, file)
+		size += part.Size
+	}
+	if size > g.opt.MaxObjectSize {
+		writeError(w, r, ErrEntityTooLarge)
+		return
+	}
+
+	var opt []control.UploadOption
+	if upload.Encryption {
+		opt = append(opt, control.WithEncryption())
+	}
+	var sseKey []byte
+	if upload.CustomerKeyMD5 != "" {
+		// the key given on completion is used when the gateway restarted since the upload was initiated
+		if sseKey, err = customerKey(r); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if sseKey == nil {
+			sseKey = g.uploads.customerKey(uploadID)
+		}
+		if sseKey == nil {
+			writeError(w, r, control.ErrCustomerKeyRequired)
+			return
+		}
+		if keyMD5(sseKey) != upload.CustomerKeyMD5 {
+			writeError(w, r, control.ErrCustomerKeyMismatch)
+			return
+		}
+		opt = append(opt, control.WithCustomerKey(sseKey))
+	}
+	stagingKey, err := g.stagingKey(uploadID, upload, sseKey)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	obj, err := g.uploadSealed(r, upload.BucketID, key, files, stagingKey, size, upload.Type, opt...)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err = g.uploads.remove(uploadID); err != nil && !errors.Is(err, ErrNoSuchUpload) {
+		writeError(w, r, err)
+		return
+	}
+	writeXML(w, http.StatusOK, &completeMultipartUploadResponse{
+		Xmlns:    s3Namespace,
+		Location: "/" + bucket + "/" + key,
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     quoteETag(obj.ETag),
+	})
+}
+
+func (g *Gateway) abortMultipartUpload(w http.ResponseWriter, r *http.Request, bucket string, key string, uploadID string) {
+	if _, err := g.authorizedUpload(r, uploadID, bucket, key, control.ActionAbortMultipartUpload); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := g.uploads.remove(uploadID); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (g *Gateway) listParts(w http.ResponseWriter, r *http.Request, bucket string, key string, uploadID string) {
+	if _, err := g.authorizedUpload(r, uploadID, bucket, key, control.ActionListMultipartUploadParts); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	query := r.URL.Query()
+	response := &listPartsResponse{
+		Xmlns:        s3Namespace,
+		Bucket:       bucket,
+		Key:          key,
+		UploadID:     uploadID,
+		StorageClass: storageStandard,
+		MaxParts:     defaultMaxPart,
+	}
+	var err error
+	if s := query.Get("max-parts"); s != "" {
+		if response.MaxParts, err = strconv.Atoi(s); err != nil || response.MaxParts < 0 {
+			writeError(w, r, ErrInvalidArgument)
+			return
+		}
+		response.MaxParts = min(response.MaxParts, defaultMaxPart)
+	}
+	if s := query.Get("part-number-marker"); s != "" {
+		if response.PartNumberMarker, err = strconv.Atoi(s); err != nil {
+			writeError(w, r, ErrInvalidArgument)
+			return
+		}
+	}
+	parts, err := g.uploads.parts(uploadID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	for _, part := range parts {
+		if part.Number <= response.PartNumberMarker {
+			continue
+		}
+		if len(response.Parts) >= response.MaxParts {
+			response.IsTruncated = true
+			break
+		}
+		response.Parts = append(response.Parts, partEntry{
+			PartNumber:   part.Number,
+			LastModified: isoTime(part.LastModified),
+			ETag:         quoteETag(part.ETag),
+			Size:         part.Size,
+		})
+		response.NextPartNumberMarker = part.Number
+	}
+	writeXML(w, http.StatusOK, response)
+}
+
+// keyMD5 returns the base64 md5 of an SSE-C key
+func keyMD5(key []byte) string {
+	sum := md5.Sum(key)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func writeJSON(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(path, data, 0644)
+}
+
+func readJSON(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
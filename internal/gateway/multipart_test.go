@@ -0,0 +1,179 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"net/http"
+	"os"
+	"oss/internal/data/keyring"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sseCHeaders returns the SSE-C headers of the customer key
+func sseCHeaders(key []byte) map[string]string {
+	return map[string]string{
+		headerSSECAlgorithm: sseAES256,
+		headerSSECKey:       base64.StdEncoding.EncodeToString(key),
+		headerSSECKeyMD5:    keyMD5(key),
+	}
+}
+
+// createUpload initiate a multipart upload of the key, it returns the upload id
+func (g *testGateway) createUpload(t *testing.T, key string, header map[string]string) string {
+	t.Helper()
+	_, data := g.expect(t, http.StatusOK, http.MethodPost, "/"+testBucket+"/"+key+"?uploads", nil, header)
+	response := &initiateMultipartUploadResponse{}
+	if err := xml.Unmarshal(data, response); err != nil {
+		t.Fatal(err)
+	}
+	return response.UploadID
+}
+
+func TestMultipartStagedParts(t *testing.T) {
+	customerKey := bytes.Repeat([]byte{7}, 32)
+	parts := [][]byte{testData(minPartSize, 1), testData(1000, 2)}
+
+	cases := []struct {
+		name    string
+		keyRing bool
+		header  map[string]string
+		sealed  bool
+	}{
+		{name: "plain"},
+		{name: "plain with key ring", keyRing: true, sealed: true},
+		{name: "sse", keyRing: true, header: map[string]string{headerSSE: sseAES256}, sealed: true},
+		{name: "sse-c", header: sseCHeaders(customerKey), sealed: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var opt []Option
+			if tc.keyRing {
+				ring, err := keyring.NewFileKeyRing(filepath.Join(t.TempDir(), "keyring.json"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				opt = append(opt, WithKeyRing(ring))
+			}
+			g := newTestGateway(t, opt...)
+			uploadID := g.createUpload(t, "object", tc.header)
+			complete := &completeMultipartUploadRequest{}
+			for i, part := range parts {
+				response, _ := g.expect(t, http.StatusOK, http.MethodPut, "/"+testBucket+"/object?partNumber="+strconv.Itoa(i+1)+"&uploadId="+uploadID, part, tc.header)
+				complete.Parts = append(complete.Parts, struct {
+					PartNumber int    `xml:"PartNumber"`
+					ETag       string `xml:"ETag"`
+				}{PartNumber: i + 1, ETag: response.Header.Get("ETag")})
+			}
+
+			// the staged parts hold the plaintext only when they are not sealed
+			for i, part := range parts {
+				staged, err := os.ReadFile(g.uploads.partFile(uploadID, i+1))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if bytes.Contains(staged, part[:64]) == tc.sealed {
+					t.Fatalf("part %d staged sealed %v, want %v", i+1, !tc.sealed, tc.sealed)
+				}
+			}
+
+			body, err := xml.Marshal(complete)
+			if err != nil {
+				t.Fatal(err)
+			}
+			g.expect(t, http.StatusOK, http.MethodPost, "/"+testBucket+"/object?uploadId="+uploadID, body, tc.header)
+			if got := g.ctrl.content(t, g.bucket.ID, "object"); !bytes.Equal(got, bytes.Join(parts, nil)) {
+				t.Fatal("uploaded object does not match the parts")
+			}
+		})
+	}
+}
+
+func TestMultipartSSERequiresKeyRing(t *testing.T) {
+	g := newTestGateway(t)
+	g.expect(t, http.StatusInternalServerError, http.MethodPost, "/"+testBucket+"/object?uploads", nil, map[string]string{headerSSE: sseAES256})
+}
+
+func TestMultipartTamperedPart(t *testing.T) {
+	customerKey := bytes.Repeat([]byte{7}, 32)
+	g := newTestGateway(t)
+	uploadID := g.createUpload(t, "object", sseCHeaders(customerKey))
+	response, _ := g.expect(t, http.StatusOK, http.MethodPut, "/"+testBucket+"/object?partNumber=1&uploadId="+uploadID, testData(1000, 1), sseCHeaders(customerKey))
+
+	staged, err := os.ReadFile(g.uploads.partFile(uploadID, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	staged[len(staged)/2] ^= 1
+	if err = os.WriteFile(g.uploads.partFile(uploadID, 1), staged, 0644); err != nil {
+		t.Fatal(err)
+	}
+	body := `<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>` + response.Header.Get("ETag") + `</ETag></Part></CompleteMultipartUpload>`
+	g.expect(t, http.StatusInternalServerError, http.MethodPost, "/"+testBucket+"/object?uploadId="+uploadID, []byte(body), sseCHeaders(customerKey))
+	if _, err = g.objects.GetMetaByName(g.bucket.ID, "object"); err == nil {
+		t.Fatal("tampered part uploaded")
+	}
+}
+
+func TestMultipartExpire(t *testing.T) {
+	g := newTestGateway(t)
+	expired := g.createUpload(t, "expired", nil)
+	active := g.createUpload(t, "active", nil)
+	// the upload file of the expired upload is rewritten as initiated 2 days ago
+	upload, err := g.uploads.get(expired, testBucket, "expired")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload.Initiated = time.Now().Add(-48 * time.Hour).UnixMilli()
+	if err = writeJSON(filepath.Join(g.uploads.dir, expired, uploadFile), upload); err != nil {
+		t.Fatal(err)
+	}
+	// a dir left without its upload file is aged by its mod time
+	orphan := strings.Repeat("ab", 16)
+	if err = os.Mkdir(filepath.Join(g.uploads.dir, orphan), 0755); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	if err = os.Chtimes(filepath.Join(g.uploads.dir, orphan), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = g.uploads.expire(24 * time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	g.expect(t, http.StatusNotFound, http.MethodGet, "/"+testBucket+"/expired?uploadId="+expired, nil, nil)
+	g.expect(t, http.StatusOK, http.MethodGet, "/"+testBucket+"/active?uploadId="+active, nil, nil)
+	if _, err = os.Stat(filepath.Join(g.uploads.dir, orphan)); !os.IsNotExist(err) {
+		t.Fatalf("orphan upload dir not removed: %v", err)
+	}
+}
+
+func TestConcurrentPutsReplaceObject(t *testing.T) {
+	g := newTestGateway(t)
+	// the uploads overlap without the key lock
+	g.ctrl.delay = 20 * time.Millisecond
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if response, data := g.do(t, http.MethodPut, "/"+testBucket+"/object", testData(1000, int64(i)), nil); response.StatusCode != http.StatusOK {
+				t.Errorf("put %d: status %d: %s", i, response.StatusCode, data)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	list, err := g.objects.GetMetaList(g.bucket.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("%d objects of the key, want 1", len(list))
+	}
+}
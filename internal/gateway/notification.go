@@ -0,0 +1,160 @@
+package gateway
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"oss/internal/control"
+	"strings"
+)
+
+// maxNotificationSize is the max size of a notification configuration
+const maxNotificationSize = 64 << 10
+
+type filterRule struct {
+	Name  string `xml:"Name"`
+	Value string `xml:"Value"`
+}
+
+type notificationFilter struct {
+	Rules []filterRule `xml:"S3Key>FilterRule"`
+}
+
+// targetConfiguration is a QueueConfiguration, a TopicConfiguration or a CloudFunctionConfiguration, the target
+// is the ARN of its Queue, Topic or CloudFunction element
+type targetConfiguration struct {
+	ID            string              `xml:"Id,omitempty"`
+	Queue         string              `xml:"Queue,omitempty"`
+	Topic         string              `xml:"Topic,omitempty"`
+	CloudFunction string              `xml:"CloudFunction,omitempty"`
+	Events        []string            `xml:"Event"`
+	Filter        *notificationFilter `xml:"Filter,omitempty"`
+}
+
+type notificationConfiguration struct {
+	XMLName        xml.Name              `xml:"NotificationConfiguration"`
+	Xmlns          string                `xml:"xmlns,attr,omitempty"`
+	Queues         []targetConfiguration `xml:"QueueConfiguration"`
+	Topics         []targetConfiguration `xml:"TopicConfiguration"`
+	CloudFunctions []targetConfiguration `xml:"CloudFunctionConfiguration"`
+}
+
+func (g *Gateway) serveBucketNotification(w http.ResponseWriter, r *http.Request, bucket string) {
+	switch r.Method {
+	case http.MethodGet:
+		g.getBucketNotification(w, r, bucket)
+	case http.MethodPut:
+		g.putBucketNotification(w, r, bucket)
+	default:
+		writeError(w, r, ErrMethodNotAllowed)
+	}
+}
+
+// getBucketNotification returns the rules of the queue targets as QueueConfiguration and the ones of the webhooks as TopicConfiguration
+func (g *Gateway) getBucketNotification(w http.ResponseWriter, r *http.Request, name string) {
+	bucket, err := g.authorizedBucket(r, name, control.AccessRequest{Action: control.ActionGetBucketNotification})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	response := &notificationConfiguration{Xmlns: s3Namespace}
+	if bucket.Notification != nil {
+		for _, rule := range bucket.Notification.Rules {
+			config := targetConfiguration{ID: rule.ID, Events: rule.Events}
+			if rule.Prefix != "" || rule.Suffix != "" {
+				config.Filter = &notificationFilter{}
+				if rule.Prefix != "" {
+					config.Filter.Rules = append(config.Filter.Rules, filterRule{Name: "prefix", Value: rule.Prefix})
+				}
+				if rule.Suffix != "" {
+					config.Filter.Rules = append(config.Filter.Rules, filterRule{Name: "suffix", Value: rule.Suffix})
+				}
+			}
+			if kind, _, _ := control.ParseTargetARN(rule.Target); kind == control.TargetQueue {
+				config.Queue = rule.Target
+				response.Queues = append(response.Queues, config)
+			} else {
+				config.Topic = rule.Target
+				response.Topics = append(response.Topics, config)
+			}
+		}
+	}
+	writeXML(w, http.StatusOK, response)
+}
+
+// putBucketNotification replace the notification config of the bucket, an empty config removes it
+func (g *Gateway) putBucketNotification(w http.ResponseWriter, r *http.Request, name string) {
+	bucket, err := g.authorizedBucket(r, name, control.AccessRequest{Action: control.ActionPutBucketNotification})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	body, _, err := requestBody(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(body, maxNotificationSize+1))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	request := &notificationConfiguration{}
+	if len(data) > maxNotificationSize || xml.Unmarshal(data, request) != nil {
+		writeError(w, r, ErrMalformedXML)
+		return
+	}
+	config := &control.NotificationConfig{}
+	for _, c := range request.Queues {
+		if config.Rules, err = appendRule(config.Rules, c, c.Queue, control.TargetQueue); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	for _, c := range append(request.Topics, request.CloudFunctions...) {
+		if config.Rules, err = appendRule(config.Rules, c, c.Topic+c.CloudFunction, control.TargetWebhook); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	if err = control.ValidateNotification(config); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	bucket.Notification = config
+	if len(config.Rules) == 0 {
+		bucket.Notification = nil
+	}
+	if err = g.buckets.UpdateBucket(bucket); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// appendRule append the rule of the configuration, its target must be of the kind
+func appendRule(rules []control.NotificationRule, c targetConfiguration, target string, kind string) ([]control.NotificationRule, error) {
+	if got, _, err := control.ParseTargetARN(target); err != nil || got != kind {
+		return nil, control.ErrInvalidNotification
+	}
+	rule := control.NotificationRule{ID: c.ID, Events: c.Events, Target: target}
+	if c.Filter != nil {
+		for _, f := range c.Filter.Rules {
+			switch strings.ToLower(f.Name) {
+			case "prefix":
+				if rule.Prefix != "" {
+					return nil, control.ErrInvalidNotification
+				}
+				rule.Prefix = f.Value
+			case "suffix":
+				if rule.Suffix != "" {
+					return nil, control.ErrInvalidNotification
+				}
+				rule.Suffix = f.Value
+			default:
+				return nil, control.ErrInvalidNotification
+			}
+		}
+	}
+	return append(rules, rule), nil
+}
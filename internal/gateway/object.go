@@ -0,0 +1,460 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"oss/internal/control"
+	"oss/internal/utils"
+	"strconv"
+	"strings"
+)
+
+const (
+	headerContentSHA256 = "x-amz-content-sha256"
+	headerDecodedLength = "x-amz-decoded-content-length"
+	headerSSE           = "x-amz-server-side-encryption"
+	headerSSECAlgorithm = "x-amz-server-side-encryption-customer-algorithm"
+	headerSSECKey       = "x-amz-server-side-encryption-customer-key"
+	headerSSECKeyMD5    = "x-amz-server-side-encryption-customer-key-md5"
+
+	sseAES256            = "AES256"
+	contentTypeOctet     = "application/octet-stream"
+	unsignedPayload      = "UNSIGNED-PAYLOAD"
+	streamingPayloadPref = "STREAMING-"
+)
+
+func (g *Gateway) putObject(w http.ResponseWriter, r *http.Request, bucketName string, key string) {
+	if len(key) > maxKeyLength {
+		writeError(w, r, ErrKeyTooLong)
+		return
+	}
+	bucket, err := g.authorizedBucket(r, bucketName, control.AccessRequest{Action: control.ActionPutObject, Key: key})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	opt, err := uploadOptions(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	// the body of an encrypted object is spooled with a key of the request only
+	var sealKey []byte
+	if r.Header.Get(headerSSE) != "" || r.Header.Get(headerSSECAlgorithm) != "" {
+		if sealKey, err = utils.RandomKey(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	file, size, _, err := g.spool(r, sealKey)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer discard(file)
+
+	obj, err := g.uploadSealed(r, bucket.ID, key, []*os.File{file}, sealKey, size, objectType(r), opt...)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", quoteETag(obj.ETag))
+	writeSSEHeaders(w, r)
+	w.WriteHeader(http.StatusOK)
+}
+
+// uploadSealed upload the files sealed with sealKey, they are opened through a pipe as the ctrl reads them.
+// The files are uploaded as they are when sealKey is nil.
+func (g *Gateway) uploadSealed(r *http.Request, bucketID int64, key string, files []*os.File, sealKey []byte, size int64, objType control.ObjectType, opt ...control.UploadOption) (*control.Object, error) {
+	if sealKey == nil {
+		return g.upload(r, bucketID, key, files, size, objType, opt...)
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer pr.Close()
+	opened := make(chan error, 1)
+	go func() {
+		opened <- openSealed(pw, files, sealKey)
+		pw.Close()
+	}()
+	obj, err := g.upload(r, bucketID, key, []*os.File{pr}, size, objType, opt...)
+	// closing the reader stop the opening when the upload failed before reading all of it
+	pr.Close()
+	if openErr := <-opened; err != nil && errors.Is(openErr, utils.ErrDecryptFailed) {
+		return nil, openErr
+	}
+	return obj, err
+}
+
+// openSealed write the plaintext of the sealed files to w in order
+func openSealed(w io.Writer, files []*os.File, key []byte) error {
+	for _, file := range files {
+		reader, err := utils.NewOpenReader(file, key)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(w, reader); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upload store the object and delete the object it replaces, the key is locked in between
+// so that the replaced object is the one the new object displaced
+func (g *Gateway) upload(r *http.Request, bucketID int64, key string, files []*os.File, size int64, objType control.ObjectType, opt ...control.UploadOption) (*control.Object, error) {
+	unlock := g.keys.lock(bucketID, key)
+	defer unlock()
+	old, err := g.objects.GetMetaByName(bucketID, key)
+	if err != nil && !errors.Is(err, control.ErrObjectNotFound) {
+		return nil, err
+	}
+	obj, err := g.ctrl.UploadObject(r.Context(), files, key, size, bucketID, objType, opt...)
+	if err != nil {
+		return nil, err
+	}
+	if old != nil {
+		// the new object is already the latest of the key, the old one is only leaked on failure.
+		// Overwriting only needs the right to put, the old object is deleted as an internal call.
+		ctx := control.WithPrincipal(r.Context(), nil)
+		if err = g.ctrl.DeleteObject(ctx, bucketID, old.ID); err != nil && !errors.Is(err, control.ErrObjectNotFound) {
+			return nil, err
+		}
+	}
+	return obj, nil
+}
+
+func (g *Gateway) getObject(w http.ResponseWriter, r *http.Request, bucketName string, key string) {
+	meta, err := g.objectMeta(r, bucketName, key, control.ActionGetObject)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	opt, err := downloadOptions(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	status := http.StatusOK
+	length := meta.Size
+	if header := r.Header.Get("Range"); header != "" {
+		start, end, ok, err := parseRange(header, meta.Size)
+		if err != nil {
+			w.Header().Set("Content-Range", "bytes */"+strconv.FormatInt(meta.Size, 10))
+			writeError(w, r, err)
+			return
+		}
+		if ok {
+			status, length = http.StatusPartialContent, end-start
+			opt = append(opt, control.WithRange(start, length))
+			w.Header().Set("Content-Range", "bytes "+strconv.FormatInt(start, 10)+"-"+strconv.FormatInt(end-1, 10)+"/"+strconv.FormatInt(meta.Size, 10))
+		}
+	}
+	obj, err := g.ctrl.DownloadObject(r.Context(), meta.BucketID, meta.ID, opt...)
+	if err != nil {
+		w.Header().Del("Content-Range")
+		writeError(w, r, err)
+		return
+	}
+	defer obj.Close()
+
+	writeObjectHeaders(w, meta)
+	writeSSEHeaders(w, r)
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(status)
+	readers := make([]io.Reader, len(obj.Files))
+	for i := range obj.Files {
+		readers[i] = obj.Files[i]
+	}
+	io.Copy(w, io.MultiReader(readers...))
+}
+
+func (g *Gateway) headObject(w http.ResponseWriter, r *http.Request, bucketName string, key string) {
+	meta, err := g.objectMeta(r, bucketName, key, control.ActionGetObject)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeObjectHeaders(w, meta)
+	writeSSEHeaders(w, r)
+	w.Header().Set("Content-Length", strconv.FormatInt(meta.Size, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (g *Gateway) deleteObject(w http.ResponseWriter, r *http.Request, bucketName string, key string) {
+	meta, err := g.objectMeta(r, bucketName, key, control.ActionDeleteObject)
+	if errors.Is(err, control.ErrObjectNotFound) {
+		// deleting a missing key succeeds
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err = g.ctrl.DeleteObject(r.Context(), meta.BucketID, meta.ID); err != nil && !errors.Is(err, control.ErrObjectNotFound) {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// objectMeta returns the meta of the latest object of the key once the principal of the request is allowed to make the action on it
+func (g *Gateway) objectMeta(r *http.Request, bucketName string, key string, action control.Action) (*control.ObjectMeta, error) {
+	bucket, err := g.authorizedBucket(r, bucketName, control.AccessRequest{Action: action, Key: key})
+	if err != nil {
+		return nil, err
+	}
+	return g.objects.GetMetaByName(bucket.ID, key)
+}
+
+// spool write the body of the request to a temp file, sealed with key when it is not nil.
+// It returns the file at offset 0, the size and the md5 of the body.
+func (g *Gateway) spool(r *http.Request, key []byte) (*os.File, int64, []byte, error) {
+	body, size, err := requestBody(r)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if size > g.opt.MaxObjectSize {
+		return nil, 0, nil, ErrEntityTooLarge
+	}
+	file, err := os.CreateTemp(g.tmpDir, "put-*")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	writer := io.WriteCloser(file)
+	if key != nil {
+		if writer, err = utils.NewSealWriter(file, key); err != nil {
+			discard(file)
+			return nil, 0, nil, err
+		}
+	}
+	digest := md5.New()
+	n, err := io.Copy(io.MultiWriter(writer, digest), io.LimitReader(body, size+1))
+	if err != nil {
+		discard(file)
+		return nil, 0, nil, err
+	}
+	if n != size {
+		discard(file)
+		return nil, 0, nil, ErrIncompleteBody
+	}
+	if key != nil {
+		if err = writer.Close(); err != nil {
+			discard(file)
+			return nil, 0, nil, err
+		}
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		discard(file)
+		return nil, 0, nil, err
+	}
+	return file, size, digest.Sum(nil), nil
+}
+
+// requestBody returns the payload of the request and its size, the aws-chunked payload is decoded.
+// The payload is checked against its signed hash, or the signatures of its chunks, as it is read.
+func requestBody(r *http.Request) (io.Reader, int64, error) {
+	payloadHash := r.Header.Get(headerContentSHA256)
+	if strings.HasPrefix(payloadHash, streamingPayloadPref) || strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		size, err := strconv.ParseInt(r.Header.Get(headerDecodedLength), 10, 64)
+		if err != nil || size < 0 {
+			return nil, 0, ErrMissingContentLength
+		}
+		reader := newChunkedReader(r.Body)
+		if strings.HasPrefix(payloadHash, signedStreamingPayload) {
+			auth := authFromContext(r.Context())
+			if auth == nil || auth.key == nil {
+				return nil, 0, ErrAccessDenied
+			}
+			reader.signer = &chunkSigner{key: auth.key, amzDate: auth.amzDate, scope: auth.scope, previous: auth.signature}
+		}
+		return reader, size, nil
+	}
+	if r.ContentLength < 0 {
+		return nil, 0, ErrMissingContentLength
+	}
+	if payloadHash == "" || payloadHash == unsignedPayload {
+		return r.Body, r.ContentLength, nil
+	}
+	expected, err := hex.DecodeString(payloadHash)
+	if err != nil || len(expected) != sha256.Size {
+		return nil, 0, ErrInvalidDigest
+	}
+	return &hashReader{r: r.Body, hash: sha256.New(), expected: expected}, r.ContentLength, nil
+}
+
+// uploadOptions returns the digest and the encryption asked by the headers of the request,
+// the signed hash of the payload is checked as the body is spooled
+func uploadOptions(r *http.Request) ([]control.UploadOption, error) {
+	var opt []control.UploadOption
+	digest, err := contentMD5(r)
+	if err != nil {
+		return nil, err
+	}
+	if digest != nil {
+		opt = append(opt, control.WithContentMD5(digest))
+	}
+	switch sse := r.Header.Get(headerSSE); sse {
+	case "":
+	case sseAES256:
+		opt = append(opt, control.WithEncryption())
+	default:
+		return nil, ErrInvalidArgument
+	}
+	key, err := customerKey(r)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		opt = append(opt, control.WithCustomerKey(key))
+	}
+	return opt, nil
+}
+
+// contentMD5 returns the Content-MD5 of the request, nil when there is none
+func contentMD5(r *http.Request) ([]byte, error) {
+	s := r.Header.Get("Content-MD5")
+	if s == "" {
+		return nil, nil
+	}
+	digest, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(digest) != md5.Size {
+		return nil, ErrInvalidDigest
+	}
+	return digest, nil
+}
+
+func downloadOptions(r *http.Request) ([]control.DownloadOption, error) {
+	key, err := customerKey(r)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, nil
+	}
+	return []control.DownloadOption{control.WithDownloadCustomerKey(key)}, nil
+}
+
+// customerKey returns the SSE-C key of the request, nil when there is none
+func customerKey(r *http.Request) ([]byte, error) {
+	algorithm := r.Header.Get(headerSSECAlgorithm)
+	if algorithm == "" && r.Header.Get(headerSSECKey) == "" {
+		return nil, nil
+	}
+	if algorithm != sseAES256 {
+		return nil, ErrInvalidArgument
+	}
+	key, err := base64.StdEncoding.DecodeString(r.Header.Get(headerSSECKey))
+	if err != nil || len(key) != 32 {
+		return nil, ErrInvalidArgument
+	}
+	if s := r.Header.Get(headerSSECKeyMD5); s != "" && s != keyMD5(key) {
+		return nil, ErrInvalidDigest
+	}
+	return key, nil
+}
+
+// objectType returns the type of the uploaded object
+func objectType(r *http.Request) control.ObjectType {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" || contentType == contentTypeOctet {
+		return control.ObjectTypeStreamOctet
+	}
+	return control.ObjectType(contentType)
+}
+
+func writeObjectHeaders(w http.ResponseWriter, meta *control.ObjectMeta) {
+	contentType := string(meta.Type)
+	if meta.Type == control.ObjectTypeStreamOctet || contentType == "" {
+		contentType = contentTypeOctet
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", quoteETag(meta.ETag))
+	w.Header().Set("Last-Modified", httpTime(meta.UpdatedAt))
+	w.Header().Set("Accept-Ranges", "bytes")
+	if meta.Encryption != nil && meta.Encryption.CustomerKeyMD5 == nil {
+		w.Header().Set(headerSSE, sseAES256)
+	}
+}
+
+// writeSSEHeaders echo the SSE-C headers of the request
+func writeSSEHeaders(w http.ResponseWriter, r *http.Request) {
+	if algorithm := r.Header.Get(headerSSECAlgorithm); algorithm != "" {
+		w.Header().Set(headerSSECAlgorithm, algorithm)
+		w.Header().Set(headerSSECKeyMD5, r.Header.Get(headerSSECKeyMD5))
+	} else if sse := r.Header.Get(headerSSE); sse != "" {
+		w.Header().Set(headerSSE, sse)
+	}
+}
+
+// parseRange parse a single byte range of an object of size, ok is false when the range is ignored
+func parseRange(header string, size int64) (start int64, end int64, ok bool, err error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	// multiple ranges are not supported, the whole object is returned like S3 does
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, nil
+	}
+	if first == "" {
+		// the suffix range is the last bytes of the object
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, false, nil
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, false, ErrInvalidRange
+		}
+		return max(size-n, 0), size, true, nil
+	}
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false, nil
+	}
+	end = size
+	if last != "" {
+		e, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || e < start {
+			return 0, 0, false, nil
+		}
+		end = min(e+1, size)
+	}
+	if start >= size {
+		return 0, 0, false, ErrInvalidRange
+	}
+	return start, end, true, nil
+}
+
+// hashReader check the content read is the expected one at the end of the content
+type hashReader struct {
+	r        io.Reader
+	hash     hash.Hash
+	expected []byte
+}
+
+func (h *hashReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(h.hash.Sum(nil), h.expected) {
+		return n, ErrContentSHA256Mismatch
+	}
+	return n, err
+}
+
+func discard(file *os.File) {
+	file.Close()
+	os.Remove(file.Name())
+}
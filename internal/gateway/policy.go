@@ -0,0 +1,200 @@
+package gateway
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"oss/internal/control"
+	"strconv"
+)
+
+const (
+	headerACL = "x-amz-acl"
+	// maxPolicySize is the max size of a bucket policy
+	maxPolicySize = 20 << 10
+
+	groupAllUsers = "http://acs.amazonaws.com/groups/global/AllUsers"
+	xmlnsXSI      = "http://www.w3.org/2001/XMLSchema-instance"
+)
+
+type grantee struct {
+	XMLNS       string `xml:"xmlns:xsi,attr"`
+	Type        string `xml:"xsi:type,attr"`
+	ID          string `xml:"ID,omitempty"`
+	DisplayName string `xml:"DisplayName,omitempty"`
+	URI         string `xml:"URI,omitempty"`
+}
+
+type grant struct {
+	Grantee    grantee `xml:"Grantee"`
+	Permission string  `xml:"Permission"`
+}
+
+type accessControlPolicy struct {
+	XMLName xml.Name `xml:"AccessControlPolicy"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Owner   owner    `xml:"Owner"`
+	Grants  []grant  `xml:"AccessControlList>Grant"`
+}
+
+type simulationResponse struct {
+	XMLName   xml.Name `xml:"SimulationResult"`
+	Xmlns     string   `xml:"xmlns,attr"`
+	Allowed   bool     `xml:"Allowed"`
+	Reason    string   `xml:"Reason"`
+	Statement string   `xml:"Statement,omitempty"`
+}
+
+func (g *Gateway) getBucketPolicy(w http.ResponseWriter, r *http.Request, name string) {
+	bucket, err := g.authorizedBucket(r, name, control.AccessRequest{Action: control.ActionGetBucketPolicy})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if bucket.Policy == nil {
+		writeError(w, r, ErrNoSuchBucketPolicy)
+		return
+	}
+	data, err := json.Marshal(bucket.Policy)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func (g *Gateway) putBucketPolicy(w http.ResponseWriter, r *http.Request, name string) {
+	bucket, err := g.authorizedBucket(r, name, control.AccessRequest{Action: control.ActionPutBucketPolicy})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	body, _, err := requestBody(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(body, maxPolicySize+1))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if len(data) > maxPolicySize {
+		writeError(w, r, ErrPolicyTooLarge)
+		return
+	}
+	if bucket.Policy, err = control.ParseBucketPolicy(data, bucket.Name); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err = g.buckets.UpdateBucket(bucket); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (g *Gateway) deleteBucketPolicy(w http.ResponseWriter, r *http.Request, name string) {
+	bucket, err := g.authorizedBucket(r, name, control.AccessRequest{Action: control.ActionDeleteBucketPolicy})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	bucket.Policy = nil
+	if err = g.buckets.UpdateBucket(bucket); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (g *Gateway) getBucketACL(w http.ResponseWriter, r *http.Request, name string) {
+	bucket, err := g.authorizedBucket(r, name, control.AccessRequest{Action: control.ActionGetBucketAcl})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	ownerID := strconv.FormatInt(bucket.OwnerID, 10)
+	response := &accessControlPolicy{
+		Xmlns: s3Namespace,
+		Owner: owner{ID: ownerID, DisplayName: ownerID},
+		Grants: []grant{{
+			Grantee:    grantee{XMLNS: xmlnsXSI, Type: "CanonicalUser", ID: ownerID, DisplayName: ownerID},
+			Permission: "FULL_CONTROL",
+		}},
+	}
+	if bucket.ACL == control.ACLPublicRead {
+		response.Grants = append(response.Grants, grant{
+			Grantee:    grantee{XMLNS: xmlnsXSI, Type: "Group", URI: groupAllUsers},
+			Permission: "READ",
+		})
+	}
+	writeXML(w, http.StatusOK, response)
+}
+
+// putBucketACL set the canned ACL of the x-amz-acl header, the ACLs given as XML grants are not supported
+func (g *Gateway) putBucketACL(w http.ResponseWriter, r *http.Request, name string) {
+	acl := r.Header.Get(headerACL)
+	if acl == "" {
+		writeError(w, r, ErrNotImplemented)
+		return
+	}
+	if !control.ValidACL(acl) {
+		writeError(w, r, control.ErrInvalidACL)
+		return
+	}
+	bucket, err := g.authorizedBucket(r, name, control.AccessRequest{Action: control.ActionPutBucketAcl})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	bucket.ACL = acl
+	if err = g.buckets.UpdateBucket(bucket); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// simulateAccess returns the decision of the policy and of the ACL of the bucket on the request described by
+// the query: action, key, prefix, user (anonymous without it) and source-ip
+func (g *Gateway) simulateAccess(w http.ResponseWriter, r *http.Request, name string) {
+	bucket, err := g.bucket(name)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	query := r.URL.Query()
+	request := control.AccessRequest{
+		Principal: &control.Principal{Anonymous: true, SourceIP: query.Get("source-ip")},
+		Action:    control.Action(query.Get("action")),
+		Key:       query.Get("key"),
+		Prefix:    query.Get("prefix"),
+	}
+	if request.Action == "" {
+		writeError(w, r, ErrInvalidArgument)
+		return
+	}
+	if s := query.Get("user"); s != "" {
+		userID, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			writeError(w, r, ErrInvalidArgument)
+			return
+		}
+		request.Principal.Anonymous, request.Principal.UserID = false, userID
+	}
+	decision, err := g.ctrl.SimulateAccess(r.Context(), bucket.ID, request)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeXML(w, http.StatusOK, &simulationResponse{
+		Xmlns:     s3Namespace,
+		Allowed:   decision.Allowed,
+		Reason:    decision.Reason,
+		Statement: decision.Statement,
+	})
+}
@@ -0,0 +1,83 @@
+package gateway
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"oss/internal/control"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrPresignMethod  = errors.New("presigned url only grants GET or PUT")
+	ErrPresignExpires = errors.New("presigned url expires out of range")
+	ErrPresignKey     = errors.New("presigned url needs a bucket and a key")
+)
+
+// PresignRequest is the operation a presigned url grants
+type PresignRequest struct {
+	// Method is GET to download the object or PUT to upload it
+	Method string
+	Bucket string
+	Key    string
+	// Expires is how long the url is valid, at most 7 days
+	Expires time.Duration
+	// ContentType is signed when not empty, a presigned PUT must then be sent with it
+	ContentType string
+}
+
+// Presign returns the url at endpoint granting the request until it expires, signed with the secret of the
+// access key. The url is path style, endpoint is the scheme and the host the clients reach the gateway at.
+func (g *Gateway) Presign(endpoint string, accessKeyID string, request PresignRequest) (string, error) {
+	accessKey, err := g.credentials.GetAccessKey(accessKeyID)
+	if err != nil {
+		return "", err
+	}
+	if accessKey.Disabled {
+		return "", control.ErrAccessKeyNotFound
+	}
+	return PresignURL(endpoint, g.opt.Region, accessKey, request, time.Now())
+}
+
+// PresignURL returns the url at endpoint granting the request from now until it expires, the url is the
+// query signed SigV4 request of the access key
+func PresignURL(endpoint string, region string, accessKey *control.AccessKey, request PresignRequest, now time.Time) (string, error) {
+	if request.Method != http.MethodGet && request.Method != http.MethodPut {
+		return "", ErrPresignMethod
+	}
+	if request.Expires < time.Second || request.Expires > maxPresignExpires {
+		return "", ErrPresignExpires
+	}
+	if request.Bucket == "" || request.Key == "" {
+		return "", ErrPresignKey
+	}
+	base, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return "", err
+	}
+	r, err := http.NewRequest(request.Method, base.String()+uriEncode("/"+request.Bucket+"/"+request.Key, false), nil)
+	if err != nil {
+		return "", err
+	}
+	headers := []string{"host"}
+	if request.ContentType != "" {
+		r.Header.Set("Content-Type", request.ContentType)
+		headers = []string{"content-type", "host"}
+	}
+
+	amzDate := now.UTC().Format(timeFormatAmz)
+	scope := amzDate[:len(timeFormatScope)] + "/" + region + "/" + serviceS3 + "/" + scopeTerminator
+	query := r.URL.Query()
+	query.Set("X-Amz-Algorithm", signV4Algorithm)
+	query.Set("X-Amz-Credential", accessKey.AccessKeyID+"/"+scope)
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", strconv.FormatInt(int64(request.Expires/time.Second), 10))
+	query.Set("X-Amz-SignedHeaders", strings.Join(headers, ";"))
+	r.URL.RawQuery = canonicalQuery(query)
+
+	key := signingKey(accessKey.SecretKey, amzDate[:len(timeFormatScope)], region, serviceS3)
+	sig := signature(key, stringToSign(amzDate, scope, canonicalRequest(r, headers, unsignedPayload)))
+	return r.URL.String() + "&X-Amz-Signature=" + sig, nil
+}
@@ -0,0 +1,131 @@
+package gateway
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// send make the request to the url and returns its status and its body
+func send(t *testing.T, method string, url string, body []byte, header map[string]string) (int, []byte) {
+	t.Helper()
+	r, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range header {
+		r.Header.Set(name, value)
+	}
+	response, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response.StatusCode, data
+}
+
+func TestPresignRoundTrip(t *testing.T) {
+	g := newTestGateway(t)
+	data := testData(1000, 1)
+
+	put, err := g.Presign(g.url, g.accessKey.AccessKeyID, PresignRequest{Method: http.MethodPut, Bucket: testBucket, Key: "dir/object name", Expires: time.Hour, ContentType: "text/plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, body := send(t, http.MethodPut, put, data, map[string]string{"Content-Type": "text/plain"}); status != http.StatusOK {
+		t.Fatalf("presigned put: status %d: %s", status, body)
+	}
+	get, err := g.Presign(g.url, g.accessKey.AccessKeyID, PresignRequest{Method: http.MethodGet, Bucket: testBucket, Key: "dir/object name", Expires: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, body := send(t, http.MethodGet, get, nil, nil)
+	if status != http.StatusOK {
+		t.Fatalf("presigned get: status %d: %s", status, body)
+	}
+	if !bytes.Equal(body, data) {
+		t.Fatal("downloaded object does not match")
+	}
+}
+
+func TestPresignedRequestRejected(t *testing.T) {
+	g := newTestGateway(t)
+	presign := func(method string, now time.Time, expires time.Duration, contentType string) string {
+		u, err := PresignURL(g.url, defaultRegion, g.accessKey, PresignRequest{Method: method, Bucket: testBucket, Key: "object", Expires: expires, ContentType: contentType}, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	cases := []struct {
+		name   string
+		method string
+		url    string
+		header map[string]string
+		err    *apiError
+	}{
+		{name: "valid", method: http.MethodPut, url: presign(http.MethodPut, time.Now(), time.Hour, "")},
+		{name: "expired", method: http.MethodGet, url: presign(http.MethodGet, time.Now().Add(-2*time.Hour), time.Hour, ""), err: ErrRequestExpired},
+		{name: "expired by a second", method: http.MethodGet, url: presign(http.MethodGet, time.Now().Add(-time.Minute-time.Second), time.Minute, ""), err: ErrRequestExpired},
+		{name: "not yet valid", method: http.MethodGet, url: presign(http.MethodGet, time.Now().Add(time.Hour), time.Hour, ""), err: ErrRequestNotYetValid},
+		{name: "other method", method: http.MethodPut, url: presign(http.MethodGet, time.Now(), time.Hour, ""), err: ErrSignatureDoesNotMatch},
+		{name: "other key", method: http.MethodGet, url: strings.Replace(presign(http.MethodGet, time.Now(), time.Hour, ""), "/object?", "/other?", 1), err: ErrSignatureDoesNotMatch},
+		{name: "longer expiry", method: http.MethodGet, url: strings.Replace(presign(http.MethodGet, time.Now(), time.Hour, ""), "X-Amz-Expires=3600", "X-Amz-Expires=7200", 1), err: ErrSignatureDoesNotMatch},
+		{name: "expiry above 7 days", method: http.MethodGet, url: strings.Replace(presign(http.MethodGet, time.Now(), time.Hour, ""), "X-Amz-Expires=3600", "X-Amz-Expires=604801", 1), err: ErrAuthorizationQueryParametersError},
+		{name: "content type not sent", method: http.MethodPut, url: presign(http.MethodPut, time.Now(), time.Hour, "text/plain"), err: ErrSignatureDoesNotMatch},
+		{name: "other content type", method: http.MethodPut, url: presign(http.MethodPut, time.Now(), time.Hour, "text/plain"), header: map[string]string{"Content-Type": "text/html"}, err: ErrSignatureDoesNotMatch},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			status, body := send(t, tc.method, tc.url, []byte("data"), tc.header)
+			if tc.err == nil {
+				if status != http.StatusOK {
+					t.Fatalf("status %d: %s", status, body)
+				}
+				return
+			}
+			if status != tc.err.Status || !bytes.Contains(body, []byte(tc.err.Message)) {
+				t.Fatalf("status %d %s, want %s", status, body, tc.err.Message)
+			}
+		})
+	}
+}
+
+func TestPresignRequestValidation(t *testing.T) {
+	g := newTestGateway(t)
+	cases := []struct {
+		name    string
+		request PresignRequest
+		err     error
+	}{
+		{name: "delete", request: PresignRequest{Method: http.MethodDelete, Bucket: testBucket, Key: "object", Expires: time.Hour}, err: ErrPresignMethod},
+		{name: "below a second", request: PresignRequest{Method: http.MethodGet, Bucket: testBucket, Key: "object", Expires: time.Millisecond}, err: ErrPresignExpires},
+		{name: "above 7 days", request: PresignRequest{Method: http.MethodGet, Bucket: testBucket, Key: "object", Expires: maxPresignExpires + time.Second}, err: ErrPresignExpires},
+		{name: "no key", request: PresignRequest{Method: http.MethodGet, Bucket: testBucket, Expires: time.Hour}, err: ErrPresignKey},
+		{name: "7 days", request: PresignRequest{Method: http.MethodGet, Bucket: testBucket, Key: "object", Expires: maxPresignExpires}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := g.Presign(g.url, g.accessKey.AccessKeyID, tc.request); !errors.Is(err, tc.err) {
+				t.Fatalf("presign error %v, want %v", err, tc.err)
+			}
+		})
+	}
+
+	// a disabled key can not presign
+	if err := g.credentials.SetAccessKeyStatus(g.accessKey.AccessKeyID, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Presign(g.url, g.accessKey.AccessKeyID, cases[len(cases)-1].request); err == nil {
+		t.Fatal("disabled key presigned a url")
+	}
+}
@@ -0,0 +1,235 @@
+package gateway
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the requests of the AWS SigV4 test suite are signed with this key for the date, the region and the service
+const (
+	suiteSecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	suiteAmzDate   = "20150830T123600Z"
+	suiteScope     = "20150830/us-east-1/service/aws4_request"
+)
+
+func TestSignatureTestSuite(t *testing.T) {
+	cases := []struct {
+		name      string
+		method    string
+		url       string
+		header    [][2]string
+		body      string
+		canonical string
+		signature string
+	}{
+		{name: "get-vanilla", method: http.MethodGet, url: "/",
+			canonical: "GET\n/\n\nhost:example.amazonaws.com\nx-amz-date:20150830T123600Z\n\nhost;x-amz-date\n" + emptySHA256,
+			signature: "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+		{name: "get-vanilla-empty-query-key", method: http.MethodGet, url: "/?Param1=value1",
+			canonical: "GET\n/\nParam1=value1\nhost:example.amazonaws.com\nx-amz-date:20150830T123600Z\n\nhost;x-amz-date\n" + emptySHA256,
+			signature: "a67d582fa61cc504c4bae71f336f98b97f1ea3c7a6bfe1b6e45aec72011b9aeb"},
+		{name: "get-vanilla-query-order-key-case", method: http.MethodGet, url: "/?Param2=value2&Param1=value1",
+			canonical: "GET\n/\nParam1=value1&Param2=value2\nhost:example.amazonaws.com\nx-amz-date:20150830T123600Z\n\nhost;x-amz-date\n" + emptySHA256,
+			signature: "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+		{name: "get-vanilla-utf8-query", method: http.MethodGet, url: "/?ሴ=bar",
+			canonical: "GET\n/\n%E1%88%B4=bar\nhost:example.amazonaws.com\nx-amz-date:20150830T123600Z\n\nhost;x-amz-date\n" + emptySHA256,
+			signature: "2cdec8eed098649ff3a119c94853b13c643bcf08f8b0a1d91e12c9027818dd04"},
+		{name: "get-unreserved", method: http.MethodGet, url: "/-._~0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz",
+			canonical: "GET\n/-._~0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz\n\nhost:example.amazonaws.com\nx-amz-date:20150830T123600Z\n\nhost;x-amz-date\n" + emptySHA256,
+			signature: "07ef7494c76fa4850883e2b006601f940f8a34d404d0cfa977f52a65bbf5f24f"},
+		{name: "get-utf8", method: http.MethodGet, url: "/ሴ",
+			canonical: "GET\n/%E1%88%B4\n\nhost:example.amazonaws.com\nx-amz-date:20150830T123600Z\n\nhost;x-amz-date\n" + emptySHA256,
+			signature: "8318018e0b0f223aa2bbf98705b62bb787dc9c0e678f255a891fd03141be5d85"},
+		{name: "get-space", method: http.MethodGet, url: "/example%20space/",
+			canonical: "GET\n/example%20space/\n\nhost:example.amazonaws.com\nx-amz-date:20150830T123600Z\n\nhost;x-amz-date\n" + emptySHA256,
+			signature: "652487583200325589f1fba4c7e578f72c47cb61beeca81406b39ddec1366741"},
+		{name: "get-header-key-duplicate", method: http.MethodGet, url: "/",
+			header:    [][2]string{{"My-Header1", "value2"}, {"My-Header1", "value2"}, {"My-Header1", "value1"}},
+			canonical: "GET\n/\n\nhost:example.amazonaws.com\nmy-header1:value2,value2,value1\nx-amz-date:20150830T123600Z\n\nhost;my-header1;x-amz-date\n" + emptySHA256,
+			signature: "c9d5ea9f3f72853aea855b47ea873832890dbdd183b4468f858259531a5138ea"},
+		{name: "get-header-value-order", method: http.MethodGet, url: "/",
+			header:    [][2]string{{"My-Header1", "value4"}, {"My-Header1", "value1"}, {"My-Header1", "value3"}, {"My-Header1", "value2"}},
+			canonical: "GET\n/\n\nhost:example.amazonaws.com\nmy-header1:value4,value1,value3,value2\nx-amz-date:20150830T123600Z\n\nhost;my-header1;x-amz-date\n" + emptySHA256,
+			signature: "08c7e5a9acfcfeb3ab6b2185e75ce8b1deb5e634ec47601a50643f830c755c01"},
+		{name: "get-header-value-trim", method: http.MethodGet, url: "/",
+			header:    [][2]string{{"My-Header1", " value1"}, {"My-Header2", ` "a   b   c"`}},
+			canonical: "GET\n/\n\nhost:example.amazonaws.com\nmy-header1:value1\nmy-header2:\"a b c\"\nx-amz-date:20150830T123600Z\n\nhost;my-header1;my-header2;x-amz-date\n" + emptySHA256,
+			signature: "acc3ed3afb60bb290fc8d2dd0098b9911fcaa05412b367055dee359757a9c736"},
+		{name: "post-vanilla", method: http.MethodPost, url: "/",
+			canonical: "POST\n/\n\nhost:example.amazonaws.com\nx-amz-date:20150830T123600Z\n\nhost;x-amz-date\n" + emptySHA256,
+			signature: "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b"},
+		{name: "post-x-www-form-urlencoded", method: http.MethodPost, url: "/",
+			header: [][2]string{{"Content-Type", "application/x-www-form-urlencoded"}}, body: "Param1=value1",
+			canonical: "POST\n/\n\ncontent-type:application/x-www-form-urlencoded\nhost:example.amazonaws.com\nx-amz-date:20150830T123600Z\n\ncontent-type;host;x-amz-date\n" + sha256Hex("Param1=value1"),
+			signature: "ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a"},
+	}
+	key := signingKey(suiteSecretKey, "20150830", "us-east-1", "service")
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := http.NewRequest(tc.method, "http://example.amazonaws.com"+tc.url, strings.NewReader(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			headers := []string{"host", "x-amz-date"}
+			for _, h := range tc.header {
+				r.Header.Add(h[0], h[1])
+				if name := strings.ToLower(h[0]); !slices.Contains(headers, name) {
+					headers = append(headers, name)
+				}
+			}
+			r.Header.Set(headerAmzDate, suiteAmzDate)
+			sort.Strings(headers)
+
+			canonical := canonicalRequest(r, headers, sha256Hex(tc.body))
+			if canonical != tc.canonical {
+				t.Fatalf("canonical request\n%s\nwant\n%s", canonical, tc.canonical)
+			}
+			if sig := signature(key, stringToSign(suiteAmzDate, suiteScope, canonical)); sig != tc.signature {
+				t.Fatalf("signature %s, want %s", sig, tc.signature)
+			}
+		})
+	}
+}
+
+// the streaming PUT example of the S3 docs, 66560 bytes of 'a' in chunks of 64KB
+const (
+	exampleSecretKey = "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY"
+	exampleAmzDate   = "20130524T000000Z"
+	exampleScope     = "20130524/us-east-1/s3/aws4_request"
+	exampleSeed      = "4f232c4386841ef735655705268965c44a0e4690baa4adea153f7db9fa80a0a9"
+)
+
+var exampleChunkSignatures = []string{
+	"ad80c730a21e5b8d04586a2213dd63b9a0e99e0e2307b0ade35a65485a288648",
+	"0055627c9e194cb4542bae2aa5492e3c1575bbb81b612b7d234b86a503ef5497",
+	"b6c6ea8a5354eaf15b3cb7646744f4275b71ea724fed81ceb9323e279d449df9",
+}
+
+func TestStreamingSeedSignature(t *testing.T) {
+	r, err := http.NewRequest(http.MethodPut, "https://s3.amazonaws.com/examplebucket/chunkObject.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.ContentLength = 66824
+	r.Header.Set("Content-Encoding", "aws-chunked")
+	r.Header.Set(headerContentSHA256, signedStreamingPayload)
+	r.Header.Set(headerAmzDate, exampleAmzDate)
+	r.Header.Set(headerDecodedLength, "66560")
+	r.Header.Set("x-amz-storage-class", "REDUCED_REDUNDANCY")
+	headers := []string{"content-encoding", "content-length", "host", "x-amz-content-sha256", "x-amz-date", "x-amz-decoded-content-length", "x-amz-storage-class"}
+
+	key := signingKey(exampleSecretKey, "20130524", "us-east-1", serviceS3)
+	sig := signature(key, stringToSign(exampleAmzDate, exampleScope, canonicalRequest(r, headers, signedStreamingPayload)))
+	if sig != exampleSeed {
+		t.Fatalf("seed signature %s, want %s", sig, exampleSeed)
+	}
+}
+
+// examplePayload returns the chunks of the example payload with their signatures
+func examplePayload(signatures []string) string {
+	var b strings.Builder
+	b.WriteString("10000;chunk-signature=" + signatures[0] + "\r\n" + strings.Repeat("a", 65536) + "\r\n")
+	b.WriteString("400;chunk-signature=" + signatures[1] + "\r\n" + strings.Repeat("a", 1024) + "\r\n")
+	b.WriteString("0;chunk-signature=" + signatures[2] + "\r\n\r\n")
+	return b.String()
+}
+
+func TestChunkSignatures(t *testing.T) {
+	payload := examplePayload(exampleChunkSignatures)
+	cases := []struct {
+		name    string
+		payload string
+		err     error
+	}{
+		{name: "signed", payload: payload},
+		{name: "data changed", payload: strings.Replace(payload, "aaaa", "aaab", 1), err: ErrSignatureDoesNotMatch},
+		{name: "signature changed", payload: examplePayload([]string{exampleChunkSignatures[0], exampleChunkSignatures[2], exampleChunkSignatures[2]}),
+			err: ErrSignatureDoesNotMatch},
+		{name: "chunks swapped", payload: examplePayload([]string{exampleChunkSignatures[1], exampleChunkSignatures[0], exampleChunkSignatures[2]}),
+			err: ErrSignatureDoesNotMatch},
+		{name: "last chunk dropped", payload: payload[:strings.LastIndex(payload, "0;chunk-signature")], err: ErrIncompleteBody},
+		{name: "truncated", payload: payload[:1000], err: ErrIncompleteBody},
+	}
+	key := signingKey(exampleSecretKey, "20130524", "us-east-1", serviceS3)
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			reader := newChunkedReader(strings.NewReader(tc.payload))
+			reader.signer = &chunkSigner{key: key, amzDate: exampleAmzDate, scope: exampleScope, previous: exampleSeed}
+			data, err := io.ReadAll(reader)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("read error %v, want %v", err, tc.err)
+			}
+			if err == nil && !bytes.Equal(data, bytes.Repeat([]byte{'a'}, 66560)) {
+				t.Fatal("decoded payload does not match")
+			}
+		})
+	}
+}
+
+func TestUnsignedAmzHeaders(t *testing.T) {
+	g := newTestGateway(t)
+	presigned := func(header map[string]string) *http.Request {
+		u, err := PresignURL(g.url, defaultRegion, g.accessKey, PresignRequest{Method: http.MethodGet, Bucket: testBucket, Key: "object", Expires: time.Hour}, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, value := range header {
+			r.Header.Set(name, value)
+		}
+		return r
+	}
+	signed := func(header map[string]string) *http.Request {
+		r, err := http.NewRequest(http.MethodGet, g.url+"/"+testBucket+"/object", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set(headerContentSHA256, emptySHA256)
+		signHeader(r, g.accessKey, time.Now())
+		// the headers set once the request is signed are not signed
+		for name, value := range header {
+			r.Header.Set(name, value)
+		}
+		return r
+	}
+
+	cases := []struct {
+		name    string
+		request *http.Request
+		err     *apiError
+	}{
+		{name: "header signed", request: signed(nil), err: ErrNoSuchKey},
+		{name: "header unsigned x-amz header", request: signed(map[string]string{"x-amz-server-side-encryption-customer-algorithm": sseAES256}), err: ErrHeadersNotSigned},
+		{name: "header unsigned other header", request: signed(map[string]string{"X-Forwarded-For": "10.0.0.1"}), err: ErrNoSuchKey},
+		{name: "presigned", request: presigned(nil), err: ErrNoSuchKey},
+		{name: "presigned unsigned x-amz header", request: presigned(map[string]string{"x-amz-server-side-encryption-customer-algorithm": sseAES256}), err: ErrHeadersNotSigned},
+		{name: "presigned unsigned payload hash", request: presigned(map[string]string{headerContentSHA256: unsignedPayload}), err: ErrNoSuchKey},
+		{name: "presigned unsigned date", request: presigned(map[string]string{headerAmzDate: "20150830T123600Z"}), err: ErrNoSuchKey},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			response, err := http.DefaultClient.Do(tc.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+			data, err := io.ReadAll(response.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != tc.err.Status || !bytes.Contains(data, []byte(tc.err.Message)) {
+				t.Fatalf("status %d %s, want %s", response.StatusCode, data, tc.err.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"oss/internal/control"
+	"oss/pkg/event_bus"
+	"time"
+)
+
+const (
+	// Path is the path the metrics are served on
+	Path = "/metrics"
+
+	defaultNamespace = "oss"
+)
+
+var defaultLatencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+type Option struct {
+	// Namespace prefix the names of the metrics
+	Namespace string
+	// LatencyBuckets are the buckets in seconds of the latency histograms
+	LatencyBuckets []float64
+}
+
+func WithNamespace(namespace string) Option {
+	return Option{Namespace: namespace}
+}
+
+func WithLatencyBuckets(buckets ...float64) Option {
+	return Option{LatencyBuckets: buckets}
+}
+
+func (o Option) apply(opt *Option) {
+	if o.Namespace != "" {
+		opt.Namespace = o.Namespace
+	}
+	if len(o.LatencyBuckets) > 0 {
+		opt.LatencyBuckets = o.LatencyBuckets
+	}
+}
+
+// Metrics is the control.Metrics exported to prometheus, the usages of the BlockRepo, of the temp dir and of the
+// event bus are read at every scrape
+type Metrics struct {
+	opt      Option
+	registry *prometheus.Registry
+
+	operations        *prometheus.CounterVec
+	operationLatency  *prometheus.HistogramVec
+	receivedBytes     *prometheus.CounterVec
+	sentBytes         *prometheus.CounterVec
+	shardFetches      *prometheus.CounterVec
+	shardFetchErrors  *prometheus.CounterVec
+	shardFetchLatency *prometheus.HistogramVec
+	reconstructions   *prometheus.CounterVec
+	reconstructed     *prometheus.CounterVec
+	codingBytes       *prometheus.CounterVec
+	codingSeconds     *prometheus.CounterVec
+}
+
+func NewMetrics(opt ...Option) *Metrics {
+	m := &Metrics{
+		opt: Option{
+			Namespace:      defaultNamespace,
+			LatencyBuckets: defaultLatencyBuckets,
+		},
+		registry: prometheus.NewRegistry(),
+	}
+	for _, o := range opt {
+		o.apply(&m.opt)
+	}
+	ns := m.opt.Namespace
+	m.operations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns, Name: "operations_total",
+		Help: "Number of the ctrl entry points and of the peer rpcs by result.",
+	}, []string{"operation", "result"})
+	m.operationLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns, Name: "operation_duration_seconds",
+		Help:    "Latency of the ctrl entry points and of the peer rpcs.",
+		Buckets: m.opt.LatencyBuckets,
+	}, []string{"operation"})
+	m.receivedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns, Name: "received_bytes_total",
+		Help: "Bytes of the content uploaded by the operations.",
+	}, []string{"operation"})
+	m.sentBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns, Name: "sent_bytes_total",
+		Help: "Bytes of the content downloaded by the operations.",
+	}, []string{"operation"})
+	m.shardFetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns, Name: "shard_fetches_total",
+		Help: "Number of the shards fetched from a peer.",
+	}, []string{"peer"})
+	m.shardFetchErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns, Name: "shard_fetch_failures_total",
+		Help: "Number of the shard fetches failed by a peer.",
+	}, []string{"peer"})
+	m.shardFetchLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns, Name: "shard_fetch_duration_seconds",
+		Help:    "Latency of the shard fetches from a peer.",
+		Buckets: m.opt.LatencyBuckets,
+	}, []string{"peer"})
+	m.reconstructions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns, Name: "reconstructions_total",
+		Help: "Number of the stripes whose missing data shards were reconstructed, by result.",
+	}, []string{"codec", "result"})
+	m.reconstructed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns, Name: "reconstructed_shards_total",
+		Help: "Number of the data shards reconstructed.",
+	}, []string{"codec"})
+	m.codingBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns, Name: "erasure_coded_bytes_total",
+		Help: "Bytes of the stripes erasure encoded or decoded.",
+	}, []string{"codec", "op"})
+	m.codingSeconds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns, Name: "erasure_coding_seconds_total",
+		Help: "Time spent erasure encoding or decoding (reconstructing and joining) the stripes.",
+	}, []string{"codec", "op"})
+	m.registry.MustRegister(
+		m.operations, m.operationLatency, m.receivedBytes, m.sentBytes,
+		m.shardFetches, m.shardFetchErrors, m.shardFetchLatency,
+		m.reconstructions, m.reconstructed, m.codingBytes, m.codingSeconds,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+func (m *Metrics) ObserveOperation(operation string, result string, latency time.Duration, received int64, sent int64) {
+	m.operations.WithLabelValues(operation, result).Inc()
+	m.operationLatency.WithLabelValues(operation).Observe(latency.Seconds())
+	if received > 0 {
+		m.receivedBytes.WithLabelValues(operation).Add(float64(received))
+	}
+	if sent > 0 {
+		m.sentBytes.WithLabelValues(operation).Add(float64(sent))
+	}
+}
+
+func (m *Metrics) ObserveShardFetch(peer string, latency time.Duration, err error) {
+	m.shardFetches.WithLabelValues(peer).Inc()
+	if err != nil {
+		m.shardFetchErrors.WithLabelValues(peer).Inc()
+		return
+	}
+	m.shardFetchLatency.WithLabelValues(peer).Observe(latency.Seconds())
+}
+
+func (m *Metrics) ObserveReconstruction(codec string, shards int, err error) {
+	if err != nil {
+		m.reconstructions.WithLabelValues(codec, control.AuditFailure).Inc()
+		return
+	}
+	m.reconstructions.WithLabelValues(codec, control.AuditSuccess).Inc()
+	m.reconstructed.WithLabelValues(codec).Add(float64(shards))
+}
+
+func (m *Metrics) ObserveCoding(codec string, encode bool, size int64, cost time.Duration) {
+	op := "decode"
+	if encode {
+		op = "encode"
+	}
+	m.codingBytes.WithLabelValues(codec, op).Add(float64(size))
+	m.codingSeconds.WithLabelValues(codec, op).Add(cost.Seconds())
+}
+
+// WatchBlockRepo export the usage of the disks of the BlockRepo, a BlockRepo not reporting its capacity is ignored
+func (m *Metrics) WatchBlockRepo(repo control.BlockRepo) {
+	reporter, ok := repo.(control.CapacityReporter)
+	if !ok {
+		return
+	}
+	labels := []string{"path", "state"}
+	total := m.desc("block_repo_disk_total_bytes", "Size of a disk of the BlockRepo.", labels)
+	free := m.desc("block_repo_disk_free_bytes", "Free bytes of a disk of the BlockRepo.", labels)
+	used := m.desc("block_repo_disk_used_bytes", "Bytes of the blocks on a disk of the BlockRepo.", labels)
+	m.registry.MustRegister(&collector{
+		descs: []*prometheus.Desc{total, free, used},
+		collect: func(ch chan<- prometheus.Metric) {
+			for _, disk := range reporter.Usage() {
+				state := string(disk.State)
+				ch <- prometheus.MustNewConstMetric(total, prometheus.GaugeValue, float64(disk.Total), disk.Path, state)
+				ch <- prometheus.MustNewConstMetric(free, prometheus.GaugeValue, float64(disk.Free), disk.Path, state)
+				ch <- prometheus.MustNewConstMetric(used, prometheus.GaugeValue, float64(disk.Used), disk.Path, state)
+			}
+		},
+	})
+}
+
+// WatchTemp export the usage of the temp dir of the ctrl
+func (m *Metrics) WatchTemp(reporter control.TempReporter) {
+	used := m.desc("temp_used_bytes", "Bytes of the temp dir reserved by the running operations.", nil)
+	orphan := m.desc("temp_orphan_bytes", "Bytes of the temp dirs left by the crashed operations.", nil)
+	quota := m.desc("temp_quota_bytes", "Max bytes of the temp dir, 0 is unlimited.", nil)
+	m.registry.MustRegister(&collector{
+		descs: []*prometheus.Desc{used, orphan, quota},
+		collect: func(ch chan<- prometheus.Metric) {
+			usage := reporter.TempUsage()
+			ch <- prometheus.MustNewConstMetric(used, prometheus.GaugeValue, float64(usage.Used))
+			ch <- prometheus.MustNewConstMetric(orphan, prometheus.GaugeValue, float64(usage.Orphan))
+			ch <- prometheus.MustNewConstMetric(quota, prometheus.GaugeValue, float64(usage.Quota))
+		},
+	})
+}
+
+// WatchEventBus export the queue depths of the subscriptions of the bus, the memory subscriptions of a pattern
+// are summed up and a durable one is labeled with its name
+func (m *Metrics) WatchEventBus(bus *event_bus.EventBus) {
+	labels := []string{"pattern", "subscription"}
+	pending := m.desc("event_bus_pending_events", "Events waiting for the handler of a subscription.", labels)
+	dropped := m.desc("event_bus_dropped_events_total", "Events dropped by the overflow policy of a subscription.", labels)
+	m.registry.MustRegister(&collector{
+		descs: []*prometheus.Desc{pending, dropped},
+		collect: func(ch chan<- prometheus.Metric) {
+			type key struct{ pattern, name string }
+			sums := make(map[key]*event_bus.SubscriptionStats)
+			var keys []key
+			for _, stats := range bus.Stats() {
+				k := key{stats.Pattern, stats.Name}
+				sum, ok := sums[k]
+				if !ok {
+					sum = &event_bus.SubscriptionStats{}
+					sums[k] = sum
+					keys = append(keys, k)
+				}
+				sum.Pending += stats.Pending
+				sum.Dropped += stats.Dropped
+			}
+			for _, k := range keys {
+				ch <- prometheus.MustNewConstMetric(pending, prometheus.GaugeValue, float64(sums[k].Pending), k.pattern, k.name)
+				ch <- prometheus.MustNewConstMetric(dropped, prometheus.CounterValue, float64(sums[k].Dropped), k.pattern, k.name)
+			}
+		},
+	})
+}
+
+func (m *Metrics) desc(name string, help string, labels []string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(m.opt.Namespace, "", name), help, labels, nil)
+}
+
+// Handler serve the metrics in the prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// ListenAndServe serve the metrics on the Path of addr
+func (m *Metrics) ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle(Path, m.Handler())
+	return http.ListenAndServe(addr, mux)
+}
+
+// collector collect the metrics read at every scrape
+type collector struct {
+	descs   []*prometheus.Desc
+	collect func(ch chan<- prometheus.Metric)
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range c.descs {
+		ch <- desc
+	}
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	c.collect(ch)
+}
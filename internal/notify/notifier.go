@@ -0,0 +1,288 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"oss/internal/control"
+	"oss/internal/event"
+	"oss/pkg/event_bus"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRetries    = 5
+	defaultBackoff    = time.Second
+	defaultMaxBackoff = time.Minute
+	defaultTimeout    = 10 * time.Second
+	// defaultBacklog is the max number of the messages waiting for a webhook
+	defaultBacklog = 1024
+)
+
+type Option struct {
+	// Webhooks are the urls of the webhook targets by name
+	Webhooks map[string]string
+	// Retries is the number of the retries of a failed webhook delivery
+	Retries int
+	// Backoff is the delay before the first retry, it doubles at every retry
+	Backoff time.Duration
+	// Timeout is the timeout of a webhook request
+	Timeout time.Duration
+}
+
+func WithWebhook(name string, url string) Option {
+	return Option{Webhooks: map[string]string{name: url}}
+}
+
+func WithRetry(retries int, backoff time.Duration) Option {
+	return Option{Retries: retries, Backoff: backoff}
+}
+
+func WithTimeout(timeout time.Duration) Option {
+	return Option{Timeout: timeout}
+}
+
+func (o Option) apply(opt *Option) {
+	for name, url := range o.Webhooks {
+		opt.Webhooks[name] = url
+	}
+	if o.Retries > 0 {
+		opt.Retries = o.Retries
+	}
+	if o.Backoff > 0 {
+		opt.Backoff = o.Backoff
+	}
+	if o.Timeout > 0 {
+		opt.Timeout = o.Timeout
+	}
+}
+
+// Notifier deliver the events of the buckets to the targets of their notification configs. The webhooks are
+// registered by the operator, the queues are the dirs of queueDir named after them.
+type Notifier struct {
+	buckets  control.BucketMetaRepo
+	queueDir string
+	opt      Option
+	client   *http.Client
+
+	webhooks map[string]*webhook
+	queues   sync.Map
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewNotifier(buckets control.BucketMetaRepo, queueDir string, opt ...Option) *Notifier {
+	n := &Notifier{
+		buckets:  buckets,
+		queueDir: queueDir,
+		opt: Option{
+			Webhooks: make(map[string]string),
+			Retries:  defaultRetries,
+			Backoff:  defaultBackoff,
+			Timeout:  defaultTimeout,
+		},
+		webhooks: make(map[string]*webhook),
+	}
+	for _, o := range opt {
+		o.apply(&n.opt)
+	}
+	n.client = &http.Client{Timeout: n.opt.Timeout}
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	for name, url := range n.opt.Webhooks {
+		w := &webhook{name: name, url: url, ch: make(chan []byte, defaultBacklog)}
+		n.webhooks[name] = w
+		n.wg.Add(1)
+		go n.runWebhook(w)
+	}
+	return n
+}
+
+// Subscribe deliver the object and the bucket events published on the bus. On a durable bus the
+// subscriptions are durable, an event whose delivery failed is retried and is delivered again after a restart.
+func (n *Notifier) Subscribe(bus *event_bus.EventBus) error {
+	for _, topic := range []string{event.EventTypeObjectCreated, event.EventTypeObjectRemoved, event.EventTypeBucketCreated, event.EventTypeBucketRemoved} {
+		if !bus.Durable() {
+			bus.Subscribe(topic, func(e event_bus.Event) {
+				if record, ok := eventRecord(e); ok {
+					n.Notify(record)
+				}
+			})
+			continue
+		}
+		name := "notifier-" + strings.TrimSuffix(strings.TrimPrefix(topic, "s3:"), ":*")
+		_, err := bus.SubscribeDurable(name, topic, func(e event_bus.Event) error {
+			record, ok := eventRecord(e)
+			if !ok {
+				return nil
+			}
+			return n.notify(record, true)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eventRecord returns the record of the event, the data of a logged event is its JSON
+func eventRecord(e event_bus.Event) (control.EventRecord, bool) {
+	switch data := e.Data.(type) {
+	case control.EventRecord:
+		return data, true
+	case json.RawMessage:
+		record := control.EventRecord{}
+		if err := json.Unmarshal(data, &record); err != nil {
+			log.Debugf("decode event %d of %s failed: %v", e.Offset, e.EventName, err)
+			return record, false
+		}
+		return record, true
+	}
+	return control.EventRecord{}, false
+}
+
+// Notify deliver the record to the targets of the rules of its bucket matching it. The events of a removed
+// bucket are not delivered as its config is removed with it.
+func (n *Notifier) Notify(record control.EventRecord) {
+	n.notify(record, false)
+}
+
+// notify returns the last error of the deliveries of the record. With wait the webhooks are posted before it
+// returns, so a durable event is acked only once the webhooks accepted it.
+func (n *Notifier) notify(record control.EventRecord, wait bool) error {
+	bucket, err := n.buckets.GetBucketByID(record.S3.Bucket.ID)
+	if err != nil || bucket.Notification == nil {
+		return nil
+	}
+	name, key := record.Name(), record.Key()
+	var last error
+	for _, rule := range bucket.Notification.Rules {
+		if !rule.Match(name, key) {
+			continue
+		}
+		record.S3.ConfigurationID = rule.ID
+		if err = n.deliver(rule.Target, &control.EventMessage{Records: []control.EventRecord{record}}, wait); err != nil {
+			log.Debugf("deliver %s of bucket %s to %s failed: %v", name, bucket.Name, rule.Target, err)
+			last = err
+		}
+	}
+	return last
+}
+
+// Close stop the webhook deliveries, the messages waiting for a webhook are dropped
+func (n *Notifier) Close() {
+	n.cancel()
+	n.wg.Wait()
+}
+
+func (n *Notifier) deliver(target string, message *control.EventMessage, wait bool) error {
+	kind, name, err := control.ParseTargetARN(target)
+	if err != nil {
+		return err
+	}
+	if kind == control.TargetQueue {
+		queue, err := n.Queue(name)
+		if err != nil {
+			return err
+		}
+		return queue.Push(message)
+	}
+	w, ok := n.webhooks[name]
+	if !ok {
+		return fmt.Errorf("webhook %s is not registered", name)
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	if wait {
+		return n.post(w, data)
+	}
+	// the event bus is not blocked by a slow webhook
+	select {
+	case w.ch <- data:
+		return nil
+	default:
+		return fmt.Errorf("webhook %s backlog is full", name)
+	}
+}
+
+// Queue returns the queue target of name, the consumers read the events from it
+func (n *Notifier) Queue(name string) (*Queue, error) {
+	if q, ok := n.queues.Load(name); ok {
+		return q.(*Queue), nil
+	}
+	if _, _, err := control.ParseTargetARN(control.TargetARN(control.TargetQueue, name)); err != nil {
+		return nil, err
+	}
+	queue, err := OpenQueue(filepath.Join(n.queueDir, name))
+	if err != nil {
+		return nil, err
+	}
+	q, _ := n.queues.LoadOrStore(name, queue)
+	return q.(*Queue), nil
+}
+
+type webhook struct {
+	name string
+	url  string
+	ch   chan []byte
+}
+
+func (n *Notifier) runWebhook(w *webhook) {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case data := <-w.ch:
+			if err := n.post(w, data); err != nil {
+				log.Debugf("webhook %s dropped an event: %v", w.name, err)
+			}
+		}
+	}
+}
+
+// post send the message to the webhook, it is retried with an exponential backoff until it is accepted with a 2xx
+func (n *Notifier) post(w *webhook, data []byte) error {
+	backoff := n.opt.Backoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = n.postOnce(w, data); err == nil {
+			return nil
+		}
+		if attempt >= n.opt.Retries {
+			return err
+		}
+		select {
+		case <-n.ctx.Done():
+			return n.ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, defaultMaxBackoff)
+	}
+}
+
+func (n *Notifier) postOnce(w *webhook, data []byte) error {
+	request, err := http.NewRequestWithContext(n.ctx, http.MethodPost, w.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := n.client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook %s responded %s", w.name, response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package notify_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"oss/internal/control"
+	"oss/internal/data/bucket"
+	"oss/internal/event"
+	"oss/internal/notify"
+	"oss/pkg/event_bus"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testIDGenerator struct {
+	n atomic.Int64
+}
+
+func (g *testIDGenerator) GenerateID() int64 {
+	return g.n.Add(1)
+}
+
+// lag returns the number of the events not acked by the durable subscription of the notifier
+func lag(bus *event_bus.EventBus, topic string) uint64 {
+	for _, stats := range bus.Stats() {
+		if stats.Name == "notifier-"+topic {
+			return stats.Pending
+		}
+	}
+	return 0
+}
+
+// waitFor fail the test when cond is not true within a second
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+	}
+}
+
+func TestDurableWebhookAckedAfterPost(t *testing.T) {
+	dir := t.TempDir()
+	release := make(chan struct{})
+	var posts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first post fails, the retry is held until released
+		if posts.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		<-release
+	}))
+	defer server.Close()
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	defer unblock()
+
+	buckets := bucket.NewBucketMetaStore(filepath.Join(dir, "buckets"), &testIDGenerator{})
+	b, err := buckets.CreateBucket("bucket", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Notification = &control.NotificationConfig{Rules: []control.NotificationRule{
+		{Events: []string{event.EventTypeObjectCreated}, Target: control.TargetARN(control.TargetWebhook, "hook")},
+	}}
+	if err = buckets.UpdateBucket(b); err != nil {
+		t.Fatal(err)
+	}
+	bus, err := event_bus.NewDurableEventBus(filepath.Join(dir, "bus"), 16, event_bus.WithoutSync())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.Close()
+	n := notify.NewNotifier(buckets, filepath.Join(dir, "queues"), notify.WithWebhook("hook", server.URL), notify.WithRetry(1, time.Millisecond))
+	defer n.Close()
+	if err = n.Subscribe(bus); err != nil {
+		t.Fatal(err)
+	}
+
+	record := control.EventRecord{EventName: strings.TrimPrefix(event.EventObjectCreatedPut, "s3:")}
+	record.S3.Bucket.ID = b.ID
+	record.S3.Object.Key = "object"
+	if err = bus.Publish(event.EventObjectCreatedPut, record); err != nil {
+		t.Fatal(err)
+	}
+	topic := "ObjectCreated"
+	waitFor(t, "the retry of the webhook", func() bool { return posts.Load() == 2 })
+	// the event is not acked while the webhook has not accepted it
+	time.Sleep(20 * time.Millisecond)
+	if got := lag(bus, topic); got != 1 {
+		t.Fatalf("lag %d before the webhook accepted the event, want 1", got)
+	}
+	unblock()
+	waitFor(t, "the event to be acked", func() bool { return lag(bus, topic) == 0 })
+}
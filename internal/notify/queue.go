@@ -0,0 +1,111 @@
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"oss/internal/utils"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	messageExt = ".json"
+)
+
+var (
+	ErrInvalidMessageID = errors.New("invalid queue message id")
+)
+
+// QueueMessage is a message of a queue, it stays in the queue until it is acked
+type QueueMessage struct {
+	ID   string
+	Data []byte
+}
+
+// Queue is a durable queue in a local dir, a message is a file named after the time it is pushed.
+// The consumers read the oldest messages and ack them once handled, a message not acked is read again.
+type Queue struct {
+	dir string
+	seq atomic.Uint64
+}
+
+func OpenQueue(dir string) (*Queue, error) {
+	if err := utils.CreateDirIfNotExists(dir); err != nil {
+		return nil, err
+	}
+	return &Queue{dir: dir}, nil
+}
+
+// Push append the JSON of v to the queue, it is on disk once Push returns
+func (q *Queue) Push(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	// the sequence keep the order of the messages pushed in the same nanosecond
+	id := fmt.Sprintf("%020d-%010d", time.Now().UnixNano(), q.seq.Add(1)%1e10)
+	return utils.WriteFileAtomic(filepath.Join(q.dir, id+messageExt), data, 0644)
+}
+
+// Read returns up to max of the oldest messages
+func (q *Queue) Read(max int) ([]QueueMessage, error) {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if name := entry.Name(); !entry.IsDir() && strings.HasSuffix(name, messageExt) {
+			ids = append(ids, strings.TrimSuffix(name, messageExt))
+		}
+	}
+	sort.Strings(ids)
+	messages := make([]QueueMessage, 0, min(max, len(ids)))
+	for _, id := range ids {
+		if len(messages) >= max {
+			break
+		}
+		data, err := os.ReadFile(filepath.Join(q.dir, id+messageExt))
+		if err != nil {
+			// acked by another consumer
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		messages = append(messages, QueueMessage{ID: id, Data: data})
+	}
+	return messages, nil
+}
+
+// Ack remove the message from the queue
+func (q *Queue) Ack(id string) error {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return ErrInvalidMessageID
+	}
+	err := os.Remove(filepath.Join(q.dir, id+messageExt))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Len returns the number of the messages in the queue
+func (q *Queue) Len() (int, error) {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), messageExt) {
+			n++
+		}
+	}
+	return n, nil
+}
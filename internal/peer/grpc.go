@@ -1 +1,19 @@
 package peer
+
+import (
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"oss/internal/control"
+)
+
+// Dial create a client connection to the peer server of the node nid at addr,
+// the connection is secured with mTLS by the identity and is insecure without identity
+func Dial(addr string, nid int64, identity control.NodeIdentity, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	creds := insecure.NewCredentials()
+	if identity != nil {
+		creds = credentials.NewTLS(identity.ClientTLSConfig(nid))
+	}
+	opts = append([]grpc.DialOption{grpc.WithTransportCredentials(creds)}, opts...)
+	return grpc.NewClient(addr, opts...)
+}
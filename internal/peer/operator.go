@@ -1 +1,172 @@
 package peer
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/grpc"
+	"io"
+	"oss/internal/control"
+	"oss/internal/proto"
+)
+
+// chunkSize is the size of the block chunk carried by one stream message
+const chunkSize = 64 * 1024
+
+type operator struct {
+	client proto.OperatorClient
+	addr   string
+	nid    int64
+}
+
+func NewOperator(conn grpc.ClientConnInterface, addr string, nid int64) control.Operator {
+	return &operator{
+		client: proto.NewOperatorClient(conn),
+		addr:   addr,
+		nid:    nid,
+	}
+}
+
+// UploadBlock stream the block to the peer, ctx deadline and cancellation apply to the whole call
+func (o *operator) UploadBlock(ctx context.Context, meta *control.BlockMeta, data io.Reader) error {
+	stream, err := o.client.UploadBlock(ctx)
+	if err != nil {
+		return err
+	}
+	request := &proto.UploadBlockRequest{BlockMeta: toProtoBlockMeta(meta)}
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(data, buf)
+		if n > 0 || request.BlockMeta != nil {
+			request.Block = buf[:n]
+			if err := stream.Send(request); err != nil {
+				return err
+			}
+			request = &proto.UploadBlockRequest{}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			stream.CloseSend()
+			return err
+		}
+	}
+	response, err := stream.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+	if !response.Success {
+		return responseError(response.Message)
+	}
+	return nil
+}
+
+// DownloadBlock return a reader of the block streamed from the peer, reading fails once ctx is done
+func (o *operator) DownloadBlock(ctx context.Context, meta control.BlockMeta) (io.Reader, error) {
+	stream, err := o.client.DownloadBlock(ctx, &proto.DownloadBlockRequest{
+		BucketID: meta.BucketID,
+		ObjectID: meta.ObjectID,
+		BlockID:  meta.ID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &downloadStreamReader{stream: stream}, nil
+}
+
+func (o *operator) DeleteBlock(ctx context.Context, meta control.BlockMeta) error {
+	response, err := o.client.DeleteBlock(ctx, &proto.DeleteBlockRequest{
+		BucketID: meta.BucketID,
+		ObjectID: meta.ObjectID,
+		BlockID:  meta.ID,
+	})
+	if err != nil {
+		return err
+	}
+	if !response.Success {
+		return responseError(response.Message)
+	}
+	return nil
+}
+
+func (o *operator) Capacity(ctx context.Context) ([]control.DiskUsage, error) {
+	response, err := o.client.Capacity(ctx, &proto.CapacityRequest{})
+	if err != nil {
+		return nil, err
+	}
+	if !response.Success {
+		return nil, responseError(response.Message)
+	}
+	disks := make([]control.DiskUsage, 0, len(response.Disks))
+	for _, disk := range response.Disks {
+		disks = append(disks, control.DiskUsage{
+			Path:   disk.Path,
+			State:  control.DiskState(disk.State),
+			Weight: disk.Weight,
+			Total:  disk.Total,
+			Free:   disk.Free,
+			Used:   disk.Used,
+		})
+	}
+	return disks, nil
+}
+
+func (o *operator) Addr() string {
+	return o.addr
+}
+
+func (o *operator) NID() int64 {
+	return o.nid
+}
+
+// downloadStreamReader read the block chunks of a download stream
+type downloadStreamReader struct {
+	stream proto.Operator_DownloadBlockClient
+	buf    []byte
+}
+
+func (r *downloadStreamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		response, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		if !response.Success {
+			return 0, responseError(response.Message)
+		}
+		r.buf = response.Block
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// responseError returns the error of a failed response, the block errors are mapped back so that errors.Is
+// detects them across the rpc
+func responseError(message string) error {
+	for _, err := range []error{control.ErrBlockNotFound, control.ErrBlockCorrupted} {
+		if message == err.Error() {
+			return err
+		}
+	}
+	return errors.New(message)
+}
+
+func toProtoBlockMeta(meta *control.BlockMeta) *proto.BlockMeta {
+	m := &proto.BlockMeta{
+		BlockID:           meta.ID,
+		BucketID:          meta.BucketID,
+		ObjectID:          meta.ObjectID,
+		Size:              meta.Size,
+		Checksum:          meta.Checksum,
+		ChecksumAlgorithm: meta.ChecksumAlgorithm,
+		Digest:            meta.Digest,
+		CreatedAt:         meta.CreatedAt,
+		UpdatedAt:         meta.UpdatedAt,
+		Path:              meta.Path,
+	}
+	for _, location := range meta.Locations {
+		m.Locations = append(m.Locations, &proto.Location{NID: location.NID, Addr: location.Location})
+	}
+	return m
+}
@@ -0,0 +1,250 @@
+package peer_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"net"
+	"oss/internal/control"
+	"oss/internal/peer"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// memRepo keep the blocks in memory, the reader of a held block blocks until the rpc is done
+type memRepo struct {
+	sync.Mutex
+	blocks map[int64][]byte
+	// held are the blocks whose reader waits for the rpc context once the block is read
+	held map[int64]bool
+	// corrupted are the blocks whose reader fails with ErrBlockCorrupted
+	corrupted map[int64]bool
+	// reading is closed once a held block is being read, done receive the error of its context
+	reading chan struct{}
+	done    chan error
+	// open is the number of the read blocks whose reader is not closed
+	open atomic.Int32
+}
+
+func newMemRepo() *memRepo {
+	return &memRepo{
+		blocks:    make(map[int64][]byte),
+		held:      make(map[int64]bool),
+		corrupted: make(map[int64]bool),
+		reading:   make(chan struct{}),
+		done:      make(chan error, 1),
+	}
+}
+
+func (r *memRepo) StoreBlock(ctx context.Context, meta control.BlockMeta, data io.Reader) error {
+	block, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.blocks[meta.ID] = block
+	return nil
+}
+
+func (r *memRepo) GetBlock(ctx context.Context, bucketID int64, objectID int64, blockID int64) (io.Reader, error) {
+	r.Lock()
+	defer r.Unlock()
+	block, ok := r.blocks[blockID]
+	if !ok {
+		return nil, control.ErrBlockNotFound
+	}
+	if r.corrupted[blockID] {
+		return r.reader(io.MultiReader(bytes.NewReader(block), &failReader{err: control.ErrBlockCorrupted})), nil
+	}
+	if r.held[blockID] {
+		return r.reader(io.MultiReader(bytes.NewReader(block), &heldReader{ctx: ctx, reading: r.reading, done: r.done})), nil
+	}
+	return r.reader(bytes.NewReader(block)), nil
+}
+
+// reader returns a reader of data that is open until closed
+func (r *memRepo) reader(data io.Reader) io.Reader {
+	r.open.Add(1)
+	return &closeReader{Reader: data, open: &r.open}
+}
+
+type closeReader struct {
+	io.Reader
+	open *atomic.Int32
+	once sync.Once
+}
+
+func (r *closeReader) Close() error {
+	r.once.Do(func() { r.open.Add(-1) })
+	return nil
+}
+
+func (r *memRepo) DeleteBlock(ctx context.Context, bucketID int64, objectID int64, blockID int64) error {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.blocks[blockID]; !ok {
+		return control.ErrBlockNotFound
+	}
+	delete(r.blocks, blockID)
+	return nil
+}
+
+func (r *memRepo) GetBlockMeta(ctx context.Context, bucketID int64, objectID int64, blockID int64) (*control.BlockMeta, error) {
+	return nil, control.ErrBlockNotFound
+}
+
+type failReader struct {
+	err error
+}
+
+func (r *failReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+type heldReader struct {
+	ctx     context.Context
+	reading chan struct{}
+	done    chan<- error
+}
+
+func (r *heldReader) Read(p []byte) (int, error) {
+	close(r.reading)
+	<-r.ctx.Done()
+	r.done <- r.ctx.Err()
+	return 0, r.ctx.Err()
+}
+
+// newTestOperator returns an operator of a peer server storing the blocks in repo
+func newTestOperator(t *testing.T, repo *memRepo) control.Operator {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	go control.RunServer(control.NewPeerServer(addr, 1, control.NewCtrl(t.TempDir(), nil, nil, repo, nil, nil, nil, nil)))
+	conn, err := peer.Dial(addr, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	// the server is listening once a call does not fail to connect
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err = peer.NewOperator(conn, addr, 1).Capacity(ctx)
+		cancel()
+		if status.Code(err) != codes.Unavailable {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("peer server not listening: %v", err)
+		}
+	}
+	return peer.NewOperator(conn, addr, 1)
+}
+
+func TestOperatorBlockErrors(t *testing.T) {
+	repo := newMemRepo()
+	repo.blocks[2] = []byte("corrupted")
+	repo.corrupted[2] = true
+	op := newTestOperator(t, repo)
+
+	download := func(id int64) error {
+		r, err := op.DownloadBlock(context.Background(), control.BlockMeta{ID: id})
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadAll(r)
+		return err
+	}
+	if err := download(1); !errors.Is(err, control.ErrBlockNotFound) {
+		t.Fatalf("download of a missing block: %v, want ErrBlockNotFound", err)
+	}
+	if err := download(2); !errors.Is(err, control.ErrBlockCorrupted) {
+		t.Fatalf("download of a corrupted block: %v, want ErrBlockCorrupted", err)
+	}
+	if err := op.DeleteBlock(context.Background(), control.BlockMeta{ID: 1}); !errors.Is(err, control.ErrBlockNotFound) {
+		t.Fatalf("delete of a missing block: %v, want ErrBlockNotFound", err)
+	}
+	// the server closes the readers of the blocks it sent, the failed ones too
+	repo.Lock()
+	repo.blocks[3] = []byte("block")
+	repo.Unlock()
+	if err := download(3); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); repo.open.Load() != 0; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d block readers not closed", repo.open.Load())
+		}
+	}
+}
+
+func TestOperatorDownloadCanceled(t *testing.T) {
+	repo := newMemRepo()
+	repo.blocks[1] = bytes.Repeat([]byte{1}, 1000)
+	repo.held[1] = true
+	op := newTestOperator(t, repo)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r, err := op.DownloadBlock(ctx, control.BlockMeta{ID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-repo.reading:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the block is not read")
+	}
+	// the block repo sees the cancel of the client
+	cancel()
+	if _, err = r.Read(make([]byte, 1)); status.Code(err) != codes.Canceled {
+		t.Fatalf("read after cancel: %v, want canceled", err)
+	}
+	select {
+	case err = <-repo.done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("block read ended with %v, want context canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the block read was not canceled")
+	}
+}
+
+func TestOperatorUploadCanceled(t *testing.T) {
+	repo := newMemRepo()
+	op := newTestOperator(t, repo)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	// the upload is canceled after its first chunk was sent
+	data := io.MultiReader(bytes.NewReader(make([]byte, 64*1024)), &cancelReader{cancel: cancel})
+	err := op.UploadBlock(ctx, &control.BlockMeta{ID: 1, Size: 128 * 1024}, data)
+	if !errors.Is(err, context.Canceled) && status.Code(err) != codes.Canceled {
+		t.Fatalf("upload error %v, want canceled", err)
+	}
+	repo.Lock()
+	defer repo.Unlock()
+	if _, ok := repo.blocks[1]; ok {
+		t.Fatal("the canceled upload was stored")
+	}
+}
+
+// cancelReader cancel the context of the call and fail the read
+type cancelReader struct {
+	cancel context.CancelFunc
+}
+
+func (r *cancelReader) Read(p []byte) (int, error) {
+	r.cancel()
+	return 0, context.Canceled
+}
@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"io"
+	"math/bits"
+)
+
+// gear is the random table of the rolling hash, it must never change as it decides the chunk boundaries
+var gear = func() [256]uint64 {
+	var table [256]uint64
+	// splitmix64 with a fixed seed
+	seed := uint64(0x6f73732d63646321)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// Chunker cut a stream into content defined chunks with FastCDC, the same content gives the same
+// chunks wherever it is in the stream. Chunks are between min and max bytes, avg bytes on average.
+type Chunker struct {
+	r     io.Reader
+	min   int
+	avg   int
+	max   int
+	maskS uint64
+	maskL uint64
+	buf   []byte
+	eof   bool
+}
+
+func NewChunker(r io.Reader, min int, avg int, max int) *Chunker {
+	// normalized chunking, the cut is harder before avg and easier after
+	b := bits.Len(uint(avg)) - 1
+	return &Chunker{
+		r:     r,
+		min:   min,
+		avg:   avg,
+		max:   max,
+		maskS: ^uint64(0) << (64 - (b + 1)),
+		maskL: ^uint64(0) << (64 - (b - 1)),
+		buf:   make([]byte, 0, max),
+	}
+}
+
+// Next returns the next chunk, io.EOF when the stream is consumed
+func (c *Chunker) Next() ([]byte, error) {
+	if !c.eof && len(c.buf) < c.max {
+		n, err := io.ReadFull(c.r, c.buf[len(c.buf):c.max])
+		c.buf = c.buf[:len(c.buf)+n]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+	cut := c.cutPoint(c.buf)
+	chunk := make([]byte, cut)
+	copy(chunk, c.buf)
+	c.buf = c.buf[:copy(c.buf, c.buf[cut:])]
+	return chunk, nil
+}
+
+func (c *Chunker) cutPoint(data []byte) int {
+	n := len(data)
+	if n <= c.min {
+		return n
+	}
+	if n > c.max {
+		n = c.max
+	}
+	normal := min(c.avg, n)
+	fp := uint64(0)
+	i := c.min
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
@@ -0,0 +1,116 @@
+package utils_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"oss/internal/utils"
+	"testing"
+)
+
+const (
+	testChunkMin = 2 * 1024
+	testChunkAvg = 8 * 1024
+	testChunkMax = 32 * 1024
+)
+
+// chunks cut data into content defined chunks
+func chunks(t *testing.T, data []byte) [][]byte {
+	chunker := utils.NewChunker(bytes.NewReader(data), testChunkMin, testChunkAvg, testChunkMax)
+	out := make([][]byte, 0)
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return out
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, chunk)
+	}
+}
+
+func randomData(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestChunkerBoundaries(t *testing.T) {
+	cases := []struct {
+		name   string
+		data   []byte
+		chunks int
+	}{
+		{name: "empty", data: nil, chunks: 0},
+		{name: "below min", data: randomData(testChunkMin-1, 1), chunks: 1},
+		{name: "min", data: randomData(testChunkMin, 1), chunks: 1},
+		{name: "zeros are cut at max", data: make([]byte, 3*testChunkMax+100), chunks: 4},
+		{name: "random", data: randomData(1024*1024, 1), chunks: -1},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := chunks(t, tc.data)
+			if tc.chunks >= 0 && len(got) != tc.chunks {
+				t.Fatalf("%d chunks, want %d", len(got), tc.chunks)
+			}
+			for i, chunk := range got {
+				if len(chunk) > testChunkMax {
+					t.Fatalf("chunk %d of %d bytes is above max", i, len(chunk))
+				}
+				if i < len(got)-1 && len(chunk) < testChunkMin {
+					t.Fatalf("chunk %d of %d bytes is below min", i, len(chunk))
+				}
+			}
+			if joined := bytes.Join(got, nil); !bytes.Equal(joined, tc.data) {
+				t.Fatal("chunks do not join to the data")
+			}
+		})
+	}
+}
+
+func TestChunkerAverageSize(t *testing.T) {
+	data := randomData(4*1024*1024, 1)
+	got := chunks(t, data)
+	avg := len(data) / len(got)
+	if avg < testChunkAvg/2 || avg > testChunkAvg*2 {
+		t.Fatalf("average chunk size %d, want about %d", avg, testChunkAvg)
+	}
+}
+
+func TestChunkerContentDefined(t *testing.T) {
+	data := randomData(1024*1024, 1)
+	original := make(map[string]bool)
+	for _, chunk := range chunks(t, data) {
+		original[string(chunk)] = true
+	}
+
+	cases := []struct {
+		name string
+		data []byte
+	}{
+		{name: "same data", data: data},
+		{name: "prefix inserted", data: append(randomData(100, 2), data...)},
+		{name: "bytes changed in the middle", data: func() []byte {
+			changed := append([]byte{}, data...)
+			copy(changed[len(changed)/2:], randomData(10, 3))
+			return changed
+		}()},
+		{name: "suffix appended", data: append(append([]byte{}, data...), randomData(5000, 4)...)},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := chunks(t, tc.data)
+			shared := 0
+			for _, chunk := range got {
+				if original[string(chunk)] {
+					shared++
+				}
+			}
+			// an edit only changes the chunks around it
+			if len(got)-shared > 3 {
+				t.Fatalf("%d of %d chunks changed", len(got)-shared, len(got))
+			}
+		})
+	}
+}
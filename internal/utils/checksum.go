@@ -1,28 +1,67 @@
 package utils
 
 import (
+	"crypto/sha256"
+	"errors"
+	"github.com/cespare/xxhash/v2"
+	"github.com/zeebo/blake3"
+	"hash"
 	"hash/crc32"
 	"io"
 	"os"
 )
 
-func ChecksumByFile(f *os.File) (uint32, error) {
-	hash := crc32.NewIEEE()
+const (
+	ChecksumCRC32    = "crc32"
+	ChecksumCRC32C   = "crc32c"
+	ChecksumXXHash64 = "xxhash64"
+	ChecksumSHA256   = "sha256"
+	ChecksumBLAKE3   = "blake3"
+)
+
+var (
+	ErrUnknownChecksum = errors.New("unknown checksum algorithm")
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// NewHash returns the hash of the checksum algorithm
+func NewHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case ChecksumCRC32:
+		return crc32.NewIEEE(), nil
+	case ChecksumCRC32C:
+		return crc32.New(castagnoliTable), nil
+	case ChecksumXXHash64:
+		return xxhash.New(), nil
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	case ChecksumBLAKE3:
+		return blake3.New(), nil
+	}
+	return nil, ErrUnknownChecksum
+}
+
+// SumByFile returns the checksum of the file and reset its offset to 0
+func SumByFile(f *os.File, algorithm string) ([]byte, error) {
+	h, err := NewHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
 	stat, err := f.Stat()
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	n, err := io.Copy(hash, f)
+	n, err := io.Copy(h, f)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	if n != stat.Size() {
-		return 0, io.ErrShortWrite
+		return nil, io.ErrShortWrite
 	}
-	sum := hash.Sum32()
 	_, err = f.Seek(0, 0)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	return sum, nil
+	return h.Sum(nil), nil
 }
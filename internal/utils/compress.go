@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"io"
+)
+
+const (
+	CompressionZstd = "zstd"
+	CompressionLZ4  = "lz4"
+	CompressionGzip = "gzip"
+)
+
+var (
+	ErrUnknownCompression = errors.New("unknown compression algorithm")
+)
+
+// zstd encoder and decoder are safe for concurrent use through EncodeAll and DecodeAll
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// ValidCompression reports whether the compression algorithm is known, empty means no compression
+func ValidCompression(algorithm string) bool {
+	switch algorithm {
+	case "", CompressionZstd, CompressionLZ4, CompressionGzip:
+		return true
+	}
+	return false
+}
+
+// Compress returns data compressed with the algorithm
+func Compress(algorithm string, data []byte) ([]byte, error) {
+	switch algorithm {
+	case CompressionZstd:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	case CompressionLZ4:
+		buf := make([]byte, lz4.CompressBlockBound(len(data)))
+		n, err := lz4.CompressBlock(data, buf, nil)
+		if err != nil {
+			return nil, err
+		}
+		// lz4 returns 0 for incompressible data, it is kept as is by the caller
+		if n == 0 {
+			return data, nil
+		}
+		return buf[:n], nil
+	case CompressionGzip:
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, ErrUnknownCompression
+}
+
+// Decompress returns data decompressed with the algorithm, size is the size of the uncompressed data
+func Decompress(algorithm string, data []byte, size int64) ([]byte, error) {
+	switch algorithm {
+	case CompressionZstd:
+		return zstdDecoder.DecodeAll(data, make([]byte, 0, size))
+	case CompressionLZ4:
+		buf := make([]byte, size)
+		n, err := lz4.UncompressBlock(data, buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		buf := bytes.NewBuffer(make([]byte, 0, size))
+		if _, err = io.Copy(buf, r); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, ErrUnknownCompression
+}
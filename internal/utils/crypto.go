@@ -0,0 +1,226 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	// StreamFrameSize is the size of the plaintext of a frame of a sealed stream
+	StreamFrameSize = 64 * 1024
+	// streamNonceSize is the random prefix of the frame nonces of a stream, the frame index completes it
+	streamNonceSize = 8
+)
+
+var (
+	ErrInvalidKey    = errors.New("invalid key, a 32 bytes key is required")
+	ErrDecryptFailed = errors.New("decrypt failed")
+)
+
+// NewGCM returns the AES-256-GCM cipher of the key
+func NewGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, ErrInvalidKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypt the plaintext with AES-256-GCM, the random nonce is prepended to the ciphertext
+func Seal(key []byte, plaintext []byte, aad []byte) ([]byte, error) {
+	gcm, err := NewGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// Open decrypt a ciphertext returned by Seal
+func Open(key []byte, sealed []byte, aad []byte) ([]byte, error) {
+	gcm, err := NewGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, ErrDecryptFailed
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], aad)
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+	return plaintext, nil
+}
+
+// RandomKey returns a random 32 bytes key
+func RandomKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// SealWriter encrypt the data written to it with AES-256-GCM in frames of StreamFrameSize bytes.
+// The random nonce prefix is written first, every frame is authenticated with its index and whether
+// it is the last one so that frames can not be reordered, dropped or truncated.
+type SealWriter struct {
+	w      io.Writer
+	gcm    cipher.AEAD
+	prefix []byte
+	buf    []byte
+	index  uint32
+	closed bool
+}
+
+func NewSealWriter(w io.Writer, key []byte) (*SealWriter, error) {
+	gcm, err := NewGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, streamNonceSize)
+	if _, err = rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(prefix); err != nil {
+		return nil, err
+	}
+	return &SealWriter{w: w, gcm: gcm, prefix: prefix, buf: make([]byte, 0, StreamFrameSize)}, nil
+}
+
+func (s *SealWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		// a full frame is sealed once more data comes, the last frame is sealed by Close
+		if len(s.buf) == cap(s.buf) {
+			if err := s.seal(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(s.buf[len(s.buf):cap(s.buf)], p)
+		s.buf = s.buf[:len(s.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+// Close seal the last frame, it does not close the underlying writer
+func (s *SealWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.seal(true)
+}
+
+func (s *SealWriter) seal(last bool) error {
+	sealed := s.gcm.Seal(nil, streamNonce(s.prefix, s.index), s.buf, streamAAD(last))
+	if _, err := s.w.Write(sealed); err != nil {
+		return err
+	}
+	s.buf = s.buf[:0]
+	s.index++
+	return nil
+}
+
+// OpenReader decrypt a stream written by SealWriter, ErrDecryptFailed is returned when a frame
+// does not authenticate or the stream ends before its last frame
+type OpenReader struct {
+	r      *bufio.Reader
+	gcm    cipher.AEAD
+	prefix []byte
+	sealed []byte
+	buf    []byte
+	index  uint32
+	done   bool
+}
+
+func NewOpenReader(r io.Reader, key []byte) (*OpenReader, error) {
+	gcm, err := NewGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &OpenReader{
+		r:      bufio.NewReader(r),
+		gcm:    gcm,
+		sealed: make([]byte, StreamFrameSize+gcm.Overhead()),
+	}, nil
+}
+
+func (o *OpenReader) Read(p []byte) (int, error) {
+	for len(o.buf) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		if err := o.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, o.buf)
+	o.buf = o.buf[n:]
+	return n, nil
+}
+
+// open read and decrypt the next frame
+func (o *OpenReader) open() error {
+	if o.prefix == nil {
+		o.prefix = make([]byte, streamNonceSize)
+		if _, err := io.ReadFull(o.r, o.prefix); err != nil {
+			return readError(err)
+		}
+	}
+	n, err := io.ReadFull(o.r, o.sealed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return readError(err)
+	}
+	// a frame shorter than a full frame is the last one, a full frame is when nothing follows it
+	last := err == io.ErrUnexpectedEOF
+	if !last {
+		if _, err = o.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	o.buf, err = o.gcm.Open(o.sealed[:0], streamNonce(o.prefix, o.index), o.sealed[:n], streamAAD(last))
+	if err != nil {
+		return ErrDecryptFailed
+	}
+	o.index++
+	o.done = last
+	return nil
+}
+
+// readError returns ErrDecryptFailed for a stream ending early
+func readError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrDecryptFailed
+	}
+	return err
+}
+
+func streamNonce(prefix []byte, index uint32) []byte {
+	nonce := make([]byte, streamNonceSize+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[streamNonceSize:], index)
+	return nonce
+}
+
+func streamAAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
@@ -0,0 +1,118 @@
+package utils_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"oss/internal/utils"
+	"testing"
+)
+
+// sealStream returns data sealed by a SealWriter written in writes of step bytes
+func sealStream(t *testing.T, key []byte, data []byte, step int) []byte {
+	sealed := &bytes.Buffer{}
+	w, err := utils.NewSealWriter(sealed, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(data) > 0 {
+		n := min(step, len(data))
+		if _, err = w.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return sealed.Bytes()
+}
+
+func openStream(key []byte, sealed []byte) ([]byte, error) {
+	r, err := utils.NewOpenReader(bytes.NewReader(sealed), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestSealStreamRoundTrip(t *testing.T) {
+	key, err := utils.RandomKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name string
+		size int
+		step int
+	}{
+		{name: "empty", size: 0, step: 1},
+		{name: "one byte", size: 1, step: 1},
+		{name: "below a frame", size: utils.StreamFrameSize - 1, step: 1000},
+		{name: "a frame", size: utils.StreamFrameSize, step: utils.StreamFrameSize},
+		{name: "above a frame", size: utils.StreamFrameSize + 1, step: 7},
+		{name: "frames", size: 3 * utils.StreamFrameSize, step: 100000},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			data := randomData(tc.size, 1)
+			sealed := sealStream(t, key, data, tc.step)
+			// a few bytes can be found in the ciphertext by chance
+			if tc.size >= 16 && bytes.Contains(sealed, data[:min(tc.size, 64)]) {
+				t.Fatal("sealed stream holds the plaintext")
+			}
+			got, err := openStream(key, sealed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("opened data does not match")
+			}
+		})
+	}
+}
+
+func TestOpenStreamTampered(t *testing.T) {
+	key, err := utils.RandomKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := utils.RandomKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := randomData(2*utils.StreamFrameSize+100, 1)
+	sealed := sealStream(t, key, data, len(data))
+	// the prefix is followed by the sealed frames
+	frame := 8 + utils.StreamFrameSize + 16
+
+	cases := []struct {
+		name   string
+		key    []byte
+		sealed []byte
+	}{
+		{name: "wrong key", key: other, sealed: sealed},
+		{name: "flipped byte", key: key, sealed: func() []byte {
+			b := bytes.Clone(sealed)
+			b[len(b)/2] ^= 1
+			return b
+		}()},
+		{name: "truncated last frame", key: key, sealed: sealed[:len(sealed)-1]},
+		{name: "dropped last frame", key: key, sealed: sealed[:8+2*(utils.StreamFrameSize+16)]},
+		{name: "prefix only", key: key, sealed: sealed[:8]},
+		{name: "short prefix", key: key, sealed: sealed[:3]},
+		{name: "swapped frames", key: key, sealed: func() []byte {
+			b := bytes.Clone(sealed[:8])
+			b = append(b, sealed[frame:frame+utils.StreamFrameSize+16]...)
+			b = append(b, sealed[8:frame]...)
+			return append(b, sealed[8+2*(utils.StreamFrameSize+16):]...)
+		}()},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := openStream(tc.key, tc.sealed); !errors.Is(err, utils.ErrDecryptFailed) {
+				t.Fatalf("open error %v, want %v", err, utils.ErrDecryptFailed)
+			}
+		})
+	}
+}
@@ -17,3 +17,13 @@ func CreateDirIfNotExists(dir string) error {
 	}
 	return nil
 }
+
+// SyncDir fsync the dir so that the entries created or renamed in it are durable
+func SyncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,55 @@
+package utils_test
+
+import (
+	"os"
+	"oss/internal/utils"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	cases := []struct {
+		name string
+		old  []byte
+		data []byte
+		perm os.FileMode
+	}{
+		{name: "new file", data: []byte("new"), perm: 0644},
+		{name: "replace", old: []byte("the old content is longer"), data: []byte("new"), perm: 0644},
+		{name: "empty", old: []byte("old"), data: []byte{}, perm: 0644},
+		{name: "owner only", data: []byte("secret"), perm: 0600},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			filename := filepath.Join(dir, "file")
+			if tc.old != nil {
+				if err := os.WriteFile(filename, tc.old, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := utils.WriteFileAtomic(filename, tc.data, tc.perm); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(tc.data) {
+				t.Fatalf("content %q, want %q", got, tc.data)
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Fatalf("%d files left in the dir, want 1", len(entries))
+			}
+			if tc.old == nil {
+				if stat, err := os.Stat(filename); err != nil || stat.Mode().Perm() != tc.perm {
+					t.Fatalf("mode %v, want %v", stat.Mode().Perm(), tc.perm)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,464 @@
+package event_bus
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"oss/internal/utils"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	logDir    = "log"
+	cursorDir = "cursors"
+	deadDir   = "dead"
+
+	cursorExt = ".json"
+
+	maxRetryBackoff = time.Minute
+)
+
+var durableNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]{0,127}$`)
+
+// NewDurableEventBus returns an event bus whose events are appended to a log in dir before they are delivered.
+// The durable subscriptions read the log from their cursors, so an event not acked is delivered again after a restart.
+func NewDurableEventBus(dir string, size int, opt ...BusOption) (*EventBus, error) {
+	busOpt := BusOption{SegmentSize: defaultSegmentSize, MaxLogSize: defaultMaxLogSize}
+	for _, o := range opt {
+		o.apply(&busOpt)
+	}
+	l, err := openLog(filepath.Join(dir, logDir), busOpt)
+	if err != nil {
+		return nil, err
+	}
+	cursors, err := openCursors(filepath.Join(dir, cursorDir))
+	if err != nil {
+		l.close()
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Join(dir, deadDir), 0755); err != nil {
+		l.close()
+		return nil, err
+	}
+	eb := NewEventBus(size)
+	eb.dir = dir
+	eb.log = l
+	eb.durable = make(map[string]*DurableSubscription)
+	eb.cursors = cursors
+	if acked, ok := cursors.min(); ok {
+		l.trim(acked)
+	}
+	return eb, nil
+}
+
+// cursorStore keep the acked offset of every durable subscription, the ones of the stopped subscriptions too
+type cursorStore struct {
+	dir     string
+	mu      sync.Mutex
+	offsets map[string]uint64
+}
+
+type cursor struct {
+	Acked uint64 `json:"acked"`
+}
+
+func openCursors(dir string) (*cursorStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &cursorStore{dir: dir, offsets: make(map[string]uint64)}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), cursorExt)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		c := &cursor{}
+		if err = json.Unmarshal(data, c); err != nil {
+			return nil, fmt.Errorf("cursor %s: %w", name, err)
+		}
+		s.offsets[name] = c.Acked
+	}
+	return s, nil
+}
+
+func (s *cursorStore) get(name string) (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	acked, ok := s.offsets[name]
+	return acked, ok
+}
+
+func (s *cursorStore) save(name string, acked uint64) error {
+	data, _ := json.Marshal(&cursor{Acked: acked})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := utils.WriteFileAtomic(filepath.Join(s.dir, name+cursorExt), data, 0644); err != nil {
+		return err
+	}
+	s.offsets[name] = acked
+	return nil
+}
+
+func (s *cursorStore) remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := os.Remove(filepath.Join(s.dir, name+cursorExt))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(s.offsets, name)
+	return nil
+}
+
+// min returns the lowest acked offset of the cursors, the log is trimmed up to it
+func (s *cursorStore) min() (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var acked uint64
+	ok := false
+	for _, offset := range s.offsets {
+		if !ok || offset < acked {
+			acked, ok = offset, true
+		}
+	}
+	return acked, ok
+}
+
+// DeadLetter is an event whose handler failed MaxAttempts times
+type DeadLetter struct {
+	Offset   uint64          `json:"offset"`
+	Name     string          `json:"name"`
+	Time     time.Time       `json:"time"`
+	Data     json.RawMessage `json:"data"`
+	Error    string          `json:"error"`
+	Attempts int             `json:"attempts"`
+}
+
+// DurableSubscription deliver the logged events matching its pattern to its handler from its cursor, an event is acked
+// once the handler returns nil. The cursor is kept when the subscription is stopped.
+type DurableSubscription struct {
+	bus     *EventBus
+	name    string
+	pattern string
+	handler func(Event) error
+	opt     SubscribeOption
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	acked   uint64
+	saved   uint64
+	stopped bool
+	dropped atomic.Uint64
+
+	stopCh chan struct{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+// SubscribeDurable deliver the events matching the pattern to the handler of the durable subscription name. The
+// subscription resumes from its cursor, a new one starts from the oldest event of the log. The data of
+// the events is the json.RawMessage of the published data. A handler returning an error or panicking is
+// retried, the event is dead lettered after MaxAttempts.
+func (eb *EventBus) SubscribeDurable(name string, pattern string, handler func(Event) error, opt ...SubscribeOption) (*DurableSubscription, error) {
+	if eb.log == nil {
+		return nil, ErrNotDurable
+	}
+	if !durableNamePattern.MatchString(name) {
+		return nil, ErrInvalidName
+	}
+	sub := &DurableSubscription{
+		bus:     eb,
+		name:    name,
+		pattern: pattern,
+		handler: handler,
+		opt: SubscribeOption{
+			Overflow:     OverflowSpill,
+			Buffer:       eb.chanSize,
+			MaxAttempts:  defaultMaxAttempts,
+			RetryBackoff: defaultRetryBackoff,
+		},
+		stopCh: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	for _, o := range opt {
+		o.apply(&sub.opt)
+	}
+	sub.opt.Buffer = max(sub.opt.Buffer, 1)
+	sub.cond = sync.NewCond(&sub.mu)
+
+	eb.Lock()
+	defer eb.Unlock()
+	if eb.closed {
+		return nil, ErrClosed
+	}
+	if _, ok := eb.durable[name]; ok {
+		return nil, ErrSubscriptionExists
+	}
+	acked, ok := eb.cursors.get(name)
+	if !ok {
+		acked = eb.log.oldest() - 1
+		if err := eb.cursors.save(name, acked); err != nil {
+			return nil, err
+		}
+	}
+	sub.acked, sub.saved = acked, acked
+	eb.durable[name] = sub
+	go sub.run(eb.log.reader(acked + 1))
+	return sub, nil
+}
+
+// RemoveDurable stop the durable subscription name and remove its cursor, the log is no longer kept for it
+func (eb *EventBus) RemoveDurable(name string) error {
+	if eb.log == nil {
+		return ErrNotDurable
+	}
+	eb.Lock()
+	sub := eb.durable[name]
+	delete(eb.durable, name)
+	eb.Unlock()
+	if sub != nil {
+		sub.stop()
+	}
+	if err := eb.cursors.remove(name); err != nil {
+		return err
+	}
+	if acked, ok := eb.cursors.min(); ok {
+		eb.log.trim(acked)
+	}
+	return nil
+}
+
+// DeadLetters returns the dead letters of the durable subscription name
+func (eb *EventBus) DeadLetters(name string) ([]DeadLetter, error) {
+	if eb.log == nil {
+		return nil, ErrNotDurable
+	}
+	if !durableNamePattern.MatchString(name) {
+		return nil, ErrInvalidName
+	}
+	file, err := os.Open(filepath.Join(eb.dir, deadDir, name+segmentExt))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	var letters []DeadLetter
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<30)
+	for scanner.Scan() {
+		letter := DeadLetter{}
+		// a partial line is left by a crash
+		if json.Unmarshal(scanner.Bytes(), &letter) == nil {
+			letters = append(letters, letter)
+		}
+	}
+	return letters, scanner.Err()
+}
+
+// backpressure block the publisher while a durable subscription matching the event with the block policy lags
+// by its buffer. A handler must not publish an event it subscribes with the block policy.
+func (eb *EventBus) backpressure(event Event) error {
+	if eb.log == nil {
+		return nil
+	}
+	eb.RLock()
+	var subs []*DurableSubscription
+	for _, sub := range eb.durable {
+		if sub.opt.Overflow == OverflowBlock && Match(sub.pattern, event.EventName) {
+			subs = append(subs, sub)
+		}
+	}
+	eb.RUnlock()
+	for _, sub := range subs {
+		sub.wait(event.Offset)
+	}
+	return nil
+}
+
+func (s *DurableSubscription) wait(offset uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !s.stopped && offset > s.acked+uint64(s.opt.Buffer) {
+		s.cond.Wait()
+	}
+}
+
+func (s *DurableSubscription) run(reader *logReader) {
+	defer close(s.done)
+	defer reader.close()
+	for {
+		record, err := reader.next(s.stopCh, s.persist)
+		if err != nil {
+			return
+		}
+		if skipped := reader.skipped; skipped > 0 {
+			s.dropped.Add(skipped)
+			reader.skipped = 0
+		}
+		event := Event{EventName: record.Name, Data: record.Data, Offset: record.Offset}
+		if Match(s.pattern, record.Name) && s.opt.accept(event) {
+			if s.opt.Overflow == OverflowDrop && s.bus.log.last()-record.Offset >= uint64(s.opt.Buffer) {
+				s.dropped.Add(1)
+			} else if !s.deliver(record, event) {
+				return
+			}
+			s.ack(record.Offset)
+			s.persist()
+			continue
+		}
+		// the records not matching are acked in memory, the cursor is saved once idle
+		s.ack(record.Offset)
+	}
+}
+
+// deliver call the handler until it succeeds or the event is dead lettered after MaxAttempts, it returns false
+// when stopped before. An event whose dead letter failed to be written is not acked, it is retried after the backoff.
+func (s *DurableSubscription) deliver(record *logRecord, event Event) bool {
+	backoff := s.opt.RetryBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = s.call(event); err == nil {
+			return true
+		}
+		if attempt >= s.opt.MaxAttempts {
+			if err = s.deadLetter(record, err, attempt); err == nil {
+				return true
+			}
+		}
+		select {
+		case <-s.stopCh:
+			return false
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxRetryBackoff)
+	}
+}
+
+func (s *DurableSubscription) call(event Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panic: %v", r)
+		}
+	}()
+	return s.handler(event)
+}
+
+// deadLetter append the event to the dead letters of the subscription
+func (s *DurableSubscription) deadLetter(record *logRecord, err error, attempts int) error {
+	letter := &DeadLetter{
+		Offset:   record.Offset,
+		Name:     record.Name,
+		Time:     record.Time,
+		Data:     record.Data,
+		Error:    err.Error(),
+		Attempts: attempts,
+	}
+	line, _ := json.Marshal(letter)
+	file, err := os.OpenFile(filepath.Join(s.bus.dir, deadDir, s.name+segmentExt), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err == nil {
+		// a partial line is removed, so that the retry does not append to it
+		if _, err = file.Write(append(line, '\n')); err != nil {
+			file.Truncate(info.Size())
+		} else if !s.bus.log.opt.NoSync {
+			err = file.Sync()
+		}
+	}
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+func (s *DurableSubscription) ack(offset uint64) {
+	s.mu.Lock()
+	s.acked = offset
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// persist save the cursor when it moved, and trim the log acked by every cursor
+func (s *DurableSubscription) persist() {
+	s.mu.Lock()
+	acked := s.acked
+	s.mu.Unlock()
+	if acked == s.saved {
+		return
+	}
+	if err := s.bus.cursors.save(s.name, acked); err != nil {
+		return
+	}
+	s.saved = acked
+	if min, ok := s.bus.cursors.min(); ok {
+		s.bus.log.trim(min)
+	}
+}
+
+// stop stop the delivery and save the cursor, an event being retried is delivered again by the next subscription
+func (s *DurableSubscription) stop() {
+	s.once.Do(func() {
+		close(s.stopCh)
+		<-s.done
+		s.persist()
+		s.mu.Lock()
+		s.stopped = true
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	})
+}
+
+// Unsubscribe stop the subscription, its cursor is kept so that subscribing the name again resumes from it
+func (s *DurableSubscription) Unsubscribe() {
+	s.bus.Lock()
+	if s.bus.durable[s.name] == s {
+		delete(s.bus.durable, s.name)
+	}
+	s.bus.Unlock()
+	s.stop()
+}
+
+// Name returns the name of the subscription
+func (s *DurableSubscription) Name() string {
+	return s.name
+}
+
+// Acked returns the offset of the last acked event
+func (s *DurableSubscription) Acked() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.acked
+}
+
+// Lag returns the number of the logged events after the cursor of the subscription
+func (s *DurableSubscription) Lag() uint64 {
+	last := s.bus.log.last()
+	acked := s.Acked()
+	if acked >= last {
+		return 0
+	}
+	return last - acked
+}
+
+// Dropped returns the number of the events dropped by the overflow policy or removed by the retention before they were read
+func (s *DurableSubscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
@@ -0,0 +1,184 @@
+package event_bus_test
+
+import (
+	"errors"
+	"os"
+	"oss/pkg/event_bus"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitFor fail the test when cond is not true within a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+	}
+}
+
+func openBus(t *testing.T, dir string) *event_bus.EventBus {
+	t.Helper()
+	eb, err := event_bus.NewDurableEventBus(dir, 16, event_bus.WithoutSync())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return eb
+}
+
+func publish(t *testing.T, eb *event_bus.EventBus, name string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := eb.Publish(name, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// offsets record the offsets of the events delivered to a handler
+type offsets struct {
+	sync.Mutex
+	got []uint64
+}
+
+func (o *offsets) handler(e event_bus.Event) error {
+	o.Lock()
+	defer o.Unlock()
+	o.got = append(o.got, e.Offset)
+	return nil
+}
+
+func (o *offsets) list() []uint64 {
+	o.Lock()
+	defer o.Unlock()
+	return append([]uint64{}, o.got...)
+}
+
+func TestDurableResumeFromCursor(t *testing.T) {
+	dir := t.TempDir()
+	eb := openBus(t, dir)
+	publish(t, eb, "a", 3)
+	first := &offsets{}
+	sub, err := eb.SubscribeDurable("sub", "a", first.handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the events to be acked", func() bool { return sub.Acked() == 3 })
+	sub.Unsubscribe()
+	// the events published while the subscription is stopped are delivered once it resumes
+	publish(t, eb, "a", 2)
+	eb.Close()
+
+	eb = openBus(t, dir)
+	defer eb.Close()
+	second := &offsets{}
+	sub, err = eb.SubscribeDurable("sub", "a", second.handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the events to be acked", func() bool { return sub.Acked() == 5 })
+	if got := first.list(); len(got) != 3 || got[0] != 1 || got[2] != 3 {
+		t.Fatalf("delivered %v, want 1-3", got)
+	}
+	if got := second.list(); len(got) != 2 || got[0] != 4 || got[1] != 5 {
+		t.Fatalf("delivered %v after the restart, want 4-5", got)
+	}
+}
+
+func TestDurableAckAfterHandler(t *testing.T) {
+	eb := openBus(t, t.TempDir())
+	defer eb.Close()
+	release := make(chan struct{})
+	var calls atomic.Int32
+	sub, err := eb.SubscribeDurable("sub", "a", func(e event_bus.Event) error {
+		// the first attempt fails, the retry is held until released
+		if calls.Add(1) == 1 {
+			return errors.New("failed")
+		}
+		<-release
+		return nil
+	}, event_bus.WithRetry(3, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish(t, eb, "a", 1)
+	waitFor(t, "the retry", func() bool { return calls.Load() == 2 })
+	if sub.Acked() != 0 || sub.Lag() != 1 {
+		t.Fatalf("acked %d lag %d while the handler runs, want 0 and 1", sub.Acked(), sub.Lag())
+	}
+	close(release)
+	waitFor(t, "the event to be acked", func() bool { return sub.Acked() == 1 })
+	letters, err := eb.DeadLetters("sub")
+	if err != nil || len(letters) != 0 {
+		t.Fatalf("dead letters %v %v, want none", letters, err)
+	}
+}
+
+func TestDurableDeadLetter(t *testing.T) {
+	eb := openBus(t, t.TempDir())
+	defer eb.Close()
+	var calls atomic.Int32
+	sub, err := eb.SubscribeDurable("sub", "a", func(e event_bus.Event) error {
+		if calls.Add(1)%2 == 0 {
+			panic("handler panic")
+		}
+		return errors.New("failed")
+	}, event_bus.WithRetry(3, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish(t, eb, "a", 2)
+	waitFor(t, "the events to be acked", func() bool { return sub.Acked() == 2 })
+	letters, err := eb.DeadLetters("sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 2 || calls.Load() != 6 {
+		t.Fatalf("%d dead letters after %d calls, want 2 after 6", len(letters), calls.Load())
+	}
+	for i, letter := range letters {
+		if letter.Offset != uint64(i+1) || letter.Name != "a" || letter.Attempts != 3 || letter.Error == "" {
+			t.Fatalf("dead letter %+v", letter)
+		}
+	}
+}
+
+func TestDurableDeadLetterWriteFailed(t *testing.T) {
+	dir := t.TempDir()
+	eb := openBus(t, dir)
+	defer eb.Close()
+	// the dead letters can not be written while a dir is in the place of their file
+	deadFile := filepath.Join(dir, "dead", "sub.log")
+	if err := os.Mkdir(deadFile, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var calls atomic.Int32
+	sub, err := eb.SubscribeDurable("sub", "a", func(e event_bus.Event) error {
+		calls.Add(1)
+		return errors.New("failed")
+	}, event_bus.WithRetry(2, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish(t, eb, "a", 1)
+	waitFor(t, "the dead letter to be retried", func() bool { return calls.Load() > 4 })
+	if sub.Acked() != 0 {
+		t.Fatalf("acked %d without a dead letter, want 0", sub.Acked())
+	}
+
+	if err = os.Remove(deadFile); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the event to be acked", func() bool { return sub.Acked() == 1 })
+	letters, err := eb.DeadLetters("sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].Offset != 1 {
+		t.Fatalf("dead letters %+v, want the event", letters)
+	}
+}
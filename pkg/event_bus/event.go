@@ -1,106 +1,369 @@
 package event_bus
 
 import (
-	"fmt"
+	"errors"
 	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy is what happens to an event published to a subscriber with a full buffer
+type OverflowPolicy int
+
+const (
+	// OverflowBlock block the publisher until the subscriber has room
+	OverflowBlock OverflowPolicy = iota + 1
+	// OverflowDrop drop the event for the subscriber
+	OverflowDrop
+	// OverflowSpill queue the event beyond the buffer, in memory for a subscription and in the log for a durable one
+	OverflowSpill
+)
+
+const (
+	defaultMaxAttempts  = 5
+	defaultRetryBackoff = 100 * time.Millisecond
+)
+
+var (
+	ErrClosed             = errors.New("event bus is closed")
+	ErrNotDurable         = errors.New("event bus is not durable")
+	ErrSubscriptionExists = errors.New("durable subscription already exists")
+	ErrInvalidName        = errors.New("invalid durable subscription name")
 )
 
 type Event struct {
 	EventName string
 	Data      any
+	// Offset is the position of the event in the log of a durable bus, 0 when it is not logged
+	Offset uint64
 }
 
-type innerEvent struct {
-	ch      chan Event
-	handler func(Event)
+type SubscribeOption struct {
+	// Overflow is the policy once the buffer is full, a subscription blocks and a durable one spills by default
+	Overflow OverflowPolicy
+	// Buffer is the max pending events of a subscription, or the max lag of a durable one
+	Buffer int
+	// MaxAttempts is the number of the attempts of a durable handler before its event is dead lettered
+	MaxAttempts int
+	// RetryBackoff is the delay before the first retry of a durable handler, it doubles at every retry
+	RetryBackoff time.Duration
+	// Filter skip the events it does not accept, a skipped event of a durable subscription is acked
+	Filter func(Event) bool
 }
 
-func (s *innerEvent) publish(event Event) {
-	s.ch <- event
+func WithOverflow(policy OverflowPolicy) SubscribeOption {
+	return SubscribeOption{Overflow: policy}
 }
 
-func (s *innerEvent) close() {
-	close(s.ch)
+func WithBuffer(size int) SubscribeOption {
+	return SubscribeOption{Buffer: size}
 }
 
-func (s *innerEvent) apply() {
-	go func() {
-		for {
-			select {
-			case event, ok := <-s.ch:
-				if !ok {
-					return
-				}
-				s.handler(event)
-			}
+func WithRetry(maxAttempts int, backoff time.Duration) SubscribeOption {
+	return SubscribeOption{MaxAttempts: maxAttempts, RetryBackoff: backoff}
+}
+
+func (o SubscribeOption) apply(opt *SubscribeOption) {
+	if o.Overflow != 0 {
+		opt.Overflow = o.Overflow
+	}
+	if o.Buffer > 0 {
+		opt.Buffer = o.Buffer
+	}
+	if o.MaxAttempts > 0 {
+		opt.MaxAttempts = o.MaxAttempts
+	}
+	if o.RetryBackoff > 0 {
+		opt.RetryBackoff = o.RetryBackoff
+	}
+	if o.Filter != nil {
+		if prev := opt.Filter; prev != nil {
+			opt.Filter = func(e Event) bool { return prev(e) && o.Filter(e) }
+		} else {
+			opt.Filter = o.Filter
 		}
-	}()
+	}
+}
+
+func (o *SubscribeOption) accept(event Event) bool {
+	return o.Filter == nil || o.Filter(event)
+}
+
+// Subscription deliver the events matching its pattern to its handler in a goroutine, in the order they are published
+type Subscription struct {
+	bus     *EventBus
+	pattern string
+	handler func(Event)
+	opt     SubscribeOption
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []Event
+	closed  bool
+	dropped atomic.Uint64
+}
+
+func (s *Subscription) publish(event Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !s.closed && len(s.queue) >= s.opt.Buffer && s.opt.Overflow != OverflowSpill {
+		if s.opt.Overflow == OverflowDrop {
+			s.dropped.Add(1)
+			return
+		}
+		s.cond.Wait()
+	}
+	if s.closed {
+		return
+	}
+	s.queue = append(s.queue, event)
+	s.cond.Broadcast()
+}
+
+func (s *Subscription) run() {
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		// the events pending when the bus is closed are still delivered
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			return
+		}
+		event := s.queue[0]
+		s.queue[0] = Event{}
+		s.queue = s.queue[1:]
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		s.handler(event)
+	}
+}
+
+// close stop the subscription once its pending events are delivered, or right away when drop is set
+func (s *Subscription) close(drop bool) {
+	s.mu.Lock()
+	s.closed = true
+	if drop {
+		s.queue = nil
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// Unsubscribe stop the subscription, its pending events are dropped
+func (s *Subscription) Unsubscribe() {
+	s.bus.unsubscribe(s)
+	s.close(true)
+}
+
+// Pending returns the number of the events waiting for the handler
+func (s *Subscription) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queue)
+}
+
+// Dropped returns the number of the events dropped by the overflow policy
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
 }
 
 type EventBus struct {
-	subscribers map[string][]innerEvent
+	// subscribers are the subscriptions by pattern
+	subscribers map[string][]*Subscription
 	chanSize    int
+	closed      bool
 	sync.RWMutex
+
+	// dir, log, durable and cursors are set on a durable bus
+	dir     string
+	log     *eventLog
+	durable map[string]*DurableSubscription
+	cursors *cursorStore
 }
 
 func NewEventBus(size int) *EventBus {
 	return &EventBus{
-		subscribers: make(map[string][]innerEvent),
+		subscribers: make(map[string][]*Subscription),
 		chanSize:    size,
 	}
 }
 
-func (eb *EventBus) Subscribe(eventName string, handler func(Event)) {
-	ch := make(chan Event, eb.chanSize)
-	sub := innerEvent{ch: ch, handler: handler}
+// Subscribe deliver the events whose name matches the pattern to the handler, the events are not persisted
+func (eb *EventBus) Subscribe(pattern string, handler func(Event), opt ...SubscribeOption) *Subscription {
+	sub := &Subscription{
+		bus:     eb,
+		pattern: pattern,
+		handler: handler,
+		opt:     SubscribeOption{Overflow: OverflowBlock, Buffer: eb.chanSize},
+	}
+	for _, o := range opt {
+		o.apply(&sub.opt)
+	}
+	sub.opt.Buffer = max(sub.opt.Buffer, 1)
+	sub.cond = sync.NewCond(&sub.mu)
 	eb.Lock()
-	eb.subscribers[eventName] = append(eb.subscribers[eventName], sub)
+	if eb.closed {
+		sub.closed = true
+	} else {
+		eb.subscribers[pattern] = append(eb.subscribers[pattern], sub)
+	}
 	eb.Unlock()
-	sub.apply()
+	go sub.run()
+	return sub
 }
 
+func (eb *EventBus) unsubscribe(sub *Subscription) {
+	eb.Lock()
+	defer eb.Unlock()
+	subs := eb.subscribers[sub.pattern]
+	for i := range subs {
+		if subs[i] == sub {
+			eb.subscribers[sub.pattern] = append(subs[:i:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(eb.subscribers[sub.pattern]) == 0 {
+		delete(eb.subscribers, sub.pattern)
+	}
+}
+
+// Publish deliver the event to the subscribers whose pattern matches its name, it is appended to the log first
+// on a durable bus. An event without subscriber is dropped, unless it is logged.
 func (eb *EventBus) Publish(eventName string, data any) error {
-	eb.RLock()
-	defer eb.RUnlock()
-	events, ok := eb.subscribers[eventName]
-	if !ok {
-		return fmt.Errorf("event %s not found", eventName)
+	event, subs, err := eb.prepare(eventName, data)
+	if err != nil {
+		return err
+	}
+	// the lock is not held while a subscriber blocks the publisher
+	for _, sub := range subs {
+		if sub.opt.accept(event) {
+			sub.publish(event)
+		}
+	}
+	return eb.backpressure(event)
+}
+
+// PublishSync call the handlers of the subscribers matching the name in the caller goroutine, the durable
+// subscriptions still get the event from the log
+func (eb *EventBus) PublishSync(eventName string, data any) error {
+	event, subs, err := eb.prepare(eventName, data)
+	if err != nil {
+		return err
 	}
-	for _, e := range events {
-		e.publish(Event{EventName: eventName, Data: data})
+	for _, sub := range subs {
+		if sub.opt.accept(event) {
+			sub.handler(event)
+		}
 	}
 	return nil
 }
 
-func (eb *EventBus) PublishSync(eventName string, data any) error {
+// prepare log the event on a durable bus, and returns it with the subscribers matching its name
+func (eb *EventBus) prepare(eventName string, data any) (Event, []*Subscription, error) {
+	event := Event{EventName: eventName, Data: data}
 	eb.RLock()
 	defer eb.RUnlock()
-	events, ok := eb.subscribers[eventName]
-	if !ok {
-		return fmt.Errorf("event %s not found", eventName)
+	if eb.closed {
+		return event, nil, ErrClosed
 	}
-	for _, e := range events {
-		e.handler(Event{EventName: eventName, Data: data})
+	if eb.log != nil {
+		offset, err := eb.log.append(eventName, data)
+		if err != nil {
+			return event, nil, err
+		}
+		event.Offset = offset
 	}
-	return nil
+	var subs []*Subscription
+	for pattern, s := range eb.subscribers {
+		if Match(pattern, eventName) {
+			subs = append(subs, s...)
+		}
+	}
+	return event, subs, nil
 }
 
-func (eb *EventBus) CloseEvent(eventName string) {
+// CloseEvent stop the subscriptions of the pattern once their pending events are delivered
+func (eb *EventBus) CloseEvent(pattern string) {
 	eb.Lock()
-	defer eb.Unlock()
-	for _, sub := range eb.subscribers[eventName] {
-		sub.close()
+	subs := eb.subscribers[pattern]
+	delete(eb.subscribers, pattern)
+	var durable []*DurableSubscription
+	for name, sub := range eb.durable {
+		if sub.pattern == pattern {
+			durable = append(durable, sub)
+			delete(eb.durable, name)
+		}
+	}
+	eb.Unlock()
+	for _, sub := range subs {
+		sub.close(false)
+	}
+	for _, sub := range durable {
+		sub.stop()
 	}
-	delete(eb.subscribers, eventName)
 }
 
+// Close stop every subscription, the log of a durable bus is closed once the durable subscriptions are stopped
 func (eb *EventBus) Close() {
 	eb.Lock()
-	defer eb.Unlock()
-	for _, subs := range eb.subscribers {
+	if eb.closed {
+		eb.Unlock()
+		return
+	}
+	eb.closed = true
+	subscribers, durable := eb.subscribers, eb.durable
+	eb.subscribers = make(map[string][]*Subscription)
+	eb.durable = make(map[string]*DurableSubscription)
+	eb.Unlock()
+	for _, subs := range subscribers {
 		for _, sub := range subs {
-			sub.close()
+			sub.close(false)
 		}
 	}
-	eb.subscribers = make(map[string][]innerEvent)
+	for _, sub := range durable {
+		sub.stop()
+	}
+	if eb.log != nil {
+		eb.log.close()
+	}
+}
+
+// Durable reports whether the events are logged before they are delivered
+func (eb *EventBus) Durable() bool {
+	return eb.log != nil
+}
+
+// SubscriptionStats is the state of a subscription, Name is set for a durable one
+type SubscriptionStats struct {
+	Pattern string
+	Name    string
+	// Pending is the number of the events queued for a memory subscription, the lag of a durable one
+	Pending uint64
+	Dropped uint64
+}
+
+// Stats returns the state of the subscriptions, the memory ones first
+func (eb *EventBus) Stats() []SubscriptionStats {
+	eb.RLock()
+	var (
+		subs    []*Subscription
+		durable []*DurableSubscription
+	)
+	for _, s := range eb.subscribers {
+		subs = append(subs, s...)
+	}
+	for _, s := range eb.durable {
+		durable = append(durable, s)
+	}
+	eb.RUnlock()
+	stats := make([]SubscriptionStats, 0, len(subs)+len(durable))
+	for _, s := range subs {
+		stats = append(stats, SubscriptionStats{Pattern: s.pattern, Pending: uint64(s.Pending()), Dropped: s.Dropped()})
+	}
+	for _, s := range durable {
+		stats = append(stats, SubscriptionStats{Pattern: s.pattern, Name: s.name, Pending: s.Lag(), Dropped: s.Dropped()})
+	}
+	return stats
 }
@@ -0,0 +1,395 @@
+package event_bus
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentExt = ".log"
+
+	defaultSegmentSize = 64 << 20
+	defaultMaxLogSize  = 1 << 30
+
+	// readChunk is the size of a read of a log reader
+	readChunk = 64 << 10
+)
+
+type BusOption struct {
+	// SegmentSize is the size a segment of the log is rolled at
+	SegmentSize int64
+	// MaxLogSize is the max size of the log, the oldest segments are removed beyond it even when not acked
+	MaxLogSize int64
+	// NoSync skip the fsync of every published event and dead letter, a crash may lose the last events
+	NoSync bool
+}
+
+func WithSegmentSize(size int64) BusOption {
+	return BusOption{SegmentSize: size}
+}
+
+func WithMaxLogSize(size int64) BusOption {
+	return BusOption{MaxLogSize: size}
+}
+
+func WithoutSync() BusOption {
+	return BusOption{NoSync: true}
+}
+
+func (o BusOption) apply(opt *BusOption) {
+	if o.SegmentSize > 0 {
+		opt.SegmentSize = o.SegmentSize
+	}
+	if o.MaxLogSize > 0 {
+		opt.MaxLogSize = o.MaxLogSize
+	}
+	if o.NoSync {
+		opt.NoSync = true
+	}
+}
+
+// logRecord is a line of a segment
+type logRecord struct {
+	Offset uint64          `json:"offset"`
+	Name   string          `json:"name"`
+	Time   time.Time       `json:"time"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// segment is a file of the log named after the offset of its first record
+type segment struct {
+	first uint64
+	size  int64
+}
+
+// eventLog is an append only log of the events in segments, the offsets start at 1
+type eventLog struct {
+	dir string
+	opt BusOption
+
+	mu       sync.Mutex
+	segments []*segment
+	file     *os.File
+	next     uint64
+	size     int64
+	closed   bool
+	// notify is closed and replaced at every append
+	notify chan struct{}
+}
+
+func segmentPath(dir string, first uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", first, segmentExt))
+}
+
+func openLog(dir string, opt BusOption) (*eventLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	l := &eventLog{dir: dir, opt: opt, next: 1, notify: make(chan struct{})}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		l.segments = append(l.segments, &segment{first: first, size: info.Size()})
+		l.size += info.Size()
+	}
+	sort.Slice(l.segments, func(i, j int) bool { return l.segments[i].first < l.segments[j].first })
+	if len(l.segments) == 0 {
+		l.segments = append(l.segments, &segment{first: 1})
+	}
+	if err = l.recover(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// recover truncate the partial record a crash left at the end of the last segment, and open it to append
+func (l *eventLog) recover() error {
+	last := l.segments[len(l.segments)-1]
+	file, err := os.OpenFile(segmentPath(l.dir, last.first), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	l.next = last.first
+	var valid int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		record := &logRecord{}
+		if json.Unmarshal(line, record) != nil || record.Offset < l.next {
+			break
+		}
+		valid += int64(len(line))
+		l.next = record.Offset + 1
+	}
+	if valid != last.size {
+		if err = file.Truncate(valid); err != nil {
+			file.Close()
+			return err
+		}
+		l.size -= last.size - valid
+		last.size = valid
+	}
+	if _, err = file.Seek(valid, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	return nil
+}
+
+// append write the record of the event, it is on disk when append returns unless NoSync is set
+func (l *eventLog) append(name string, data any) (uint64, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return 0, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return 0, ErrClosed
+	}
+	record := &logRecord{Offset: l.next, Name: name, Time: time.Now().UTC(), Data: raw}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+	line = append(line, '\n')
+	last := l.segments[len(l.segments)-1]
+	if n, err := l.file.Write(line); err != nil {
+		// drop what was written of the record
+		if n > 0 {
+			l.file.Truncate(last.size)
+			l.file.Seek(last.size, io.SeekStart)
+		}
+		return 0, err
+	}
+	if !l.opt.NoSync {
+		if err = l.file.Sync(); err != nil {
+			return 0, err
+		}
+	}
+	last.size += int64(len(line))
+	l.size += int64(len(line))
+	l.next++
+	if last.size >= l.opt.SegmentSize {
+		if err = l.roll(); err != nil {
+			return 0, err
+		}
+	}
+	l.retain()
+	close(l.notify)
+	l.notify = make(chan struct{})
+	return record.Offset, nil
+}
+
+// roll start a new segment at the next offset
+func (l *eventLog) roll() error {
+	file, err := os.OpenFile(segmentPath(l.dir, l.next), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	l.file.Close()
+	l.file = file
+	l.segments = append(l.segments, &segment{first: l.next})
+	return nil
+}
+
+// retain remove the oldest segments beyond the max size of the log, the last segment is never removed
+func (l *eventLog) retain() {
+	for len(l.segments) > 1 && l.size > l.opt.MaxLogSize {
+		l.removeOldest()
+	}
+}
+
+// trim remove the segments every record of which is acked
+func (l *eventLog) trim(acked uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for len(l.segments) > 1 && l.segments[1].first <= acked+1 {
+		l.removeOldest()
+	}
+}
+
+func (l *eventLog) removeOldest() {
+	oldest := l.segments[0]
+	if err := os.Remove(segmentPath(l.dir, oldest.first)); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	l.size -= oldest.size
+	l.segments = l.segments[1:]
+}
+
+// last returns the offset of the last record, 0 when nothing was appended
+func (l *eventLog) last() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.next - 1
+}
+
+// oldest returns the offset of the oldest record retained
+func (l *eventLog) oldest() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.segments[0].first
+}
+
+func (l *eventLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	l.file.Close()
+	close(l.notify)
+}
+
+// logReader read the records of the log from an offset, it only reads the complete records of a segment
+type logReader struct {
+	log     *eventLog
+	offset  uint64
+	segment *segment
+	file    *os.File
+	pos     int64
+	buf     []byte
+	// skipped is the number of the records removed by the retention before they were read
+	skipped uint64
+}
+
+func (l *eventLog) reader(offset uint64) *logReader {
+	return &logReader{log: l, offset: max(offset, 1)}
+}
+
+// next returns the next record, it waits for one until stop is closed. idle is called before it waits.
+func (r *logReader) next(stop <-chan struct{}, idle func()) (*logRecord, error) {
+	for {
+		if i := bytes.IndexByte(r.buf, '\n'); i >= 0 {
+			line := r.buf[:i+1]
+			r.buf = r.buf[i+1:]
+			record := &logRecord{}
+			if err := json.Unmarshal(line, record); err != nil {
+				return nil, err
+			}
+			if record.Offset < r.offset {
+				continue
+			}
+			r.offset = record.Offset + 1
+			return record, nil
+		}
+		notify, err := r.fill()
+		if err != nil {
+			return nil, err
+		}
+		if notify == nil {
+			continue
+		}
+		if idle != nil {
+			idle()
+		}
+		select {
+		case <-stop:
+			return nil, ErrClosed
+		case <-notify:
+		}
+	}
+}
+
+// fill read the next chunk of the log, it returns the channel to wait on when the log is read to its end
+func (r *logReader) fill() (<-chan struct{}, error) {
+	l := r.log
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, ErrClosed
+	}
+	index := -1
+	for i, s := range l.segments {
+		if s == r.segment {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		// the segment was removed, or nothing was read yet
+		index = 0
+		for i, s := range l.segments {
+			if s.first <= r.offset {
+				index = i
+			}
+		}
+		if first := l.segments[index].first; first > r.offset {
+			r.skipped += first - r.offset
+			r.offset = first
+		}
+		l.mu.Unlock()
+		return nil, r.open(l.segments[index])
+	}
+	if r.pos < r.segment.size {
+		n := min(r.segment.size-r.pos, readChunk)
+		l.mu.Unlock()
+		chunk := make([]byte, n)
+		if _, err := r.file.ReadAt(chunk, r.pos); err != nil {
+			return nil, err
+		}
+		r.pos += n
+		r.buf = append(r.buf, chunk...)
+		return nil, nil
+	}
+	if index < len(l.segments)-1 {
+		next := l.segments[index+1]
+		l.mu.Unlock()
+		return nil, r.open(next)
+	}
+	notify := l.notify
+	l.mu.Unlock()
+	return notify, nil
+}
+
+func (r *logReader) open(s *segment) error {
+	r.close()
+	file, err := os.Open(segmentPath(r.log.dir, s.first))
+	if err != nil {
+		// removed since, the next fill finds the oldest segment
+		if os.IsNotExist(err) {
+			r.segment = nil
+			return nil
+		}
+		return err
+	}
+	r.segment, r.file, r.pos, r.buf = s, file, 0, nil
+	return nil
+}
+
+func (r *logReader) close() {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+}
@@ -0,0 +1,96 @@
+package event_bus
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+const (
+	// TopicSeparator separate the segments of an event name, s3:ObjectCreated:Put has 3 segments
+	TopicSeparator = ":"
+	// WildcardOne matches a non empty segment of an event name
+	WildcardOne = "*"
+	// WildcardMany matches zero or more segments of an event name
+	WildcardMany = "#"
+)
+
+// Match reports whether the event name matches the pattern. A segment of the pattern is a name, * matching
+// one segment or # matching any number of segments, s3:ObjectCreated:* matches s3:ObjectCreated:Put and
+// s3:# matches every s3 event.
+func Match(pattern string, eventName string) bool {
+	if pattern == eventName {
+		return true
+	}
+	if !strings.Contains(pattern, WildcardOne) && !strings.Contains(pattern, WildcardMany) {
+		return false
+	}
+	return matchSegments(strings.Split(pattern, TopicSeparator), strings.Split(eventName, TopicSeparator))
+}
+
+func matchSegments(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case WildcardMany:
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		case WildcardOne:
+			if len(name) == 0 || name[0] == "" {
+				return false
+			}
+		default:
+			if len(name) == 0 || name[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// WithFilter deliver only the events accepted by the filter, the filters of several options must all accept
+func WithFilter(filter func(Event) bool) SubscribeOption {
+	return SubscribeOption{Filter: filter}
+}
+
+// WithField deliver only the events whose data has the value at the path of its JSON, the path is the dot
+// separated JSON names of the fields, s3.bucket.id of a control.EventRecord is the id of the bucket
+func WithField(path string, value any) SubscribeOption {
+	want, err := json.Marshal(value)
+	return WithFilter(func(e Event) bool {
+		if err != nil {
+			return false
+		}
+		got, ok := field(e.Data, path)
+		return ok && bytes.Equal(got, want)
+	})
+}
+
+// field returns the compacted JSON of the field at the path of the JSON of data
+func field(data any, path string) ([]byte, bool) {
+	raw, ok := data.(json.RawMessage)
+	if !ok {
+		var err error
+		if raw, err = json.Marshal(data); err != nil {
+			return nil, false
+		}
+	}
+	for _, name := range strings.Split(path, ".") {
+		fields := map[string]json.RawMessage{}
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return nil, false
+		}
+		if raw, ok = fields[name]; !ok {
+			return nil, false
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := json.Compact(buf, raw); err != nil {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
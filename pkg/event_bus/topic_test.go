@@ -0,0 +1,100 @@
+package event_bus_test
+
+import (
+	"encoding/json"
+	"oss/pkg/event_bus"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{pattern: "s3:ObjectCreated:Put", name: "s3:ObjectCreated:Put", want: true},
+		{pattern: "s3:ObjectCreated:Put", name: "s3:ObjectCreated:Copy"},
+		{pattern: "s3:ObjectCreated", name: "s3:ObjectCreated:Put"},
+		{pattern: "s3:ObjectCreated:*", name: "s3:ObjectCreated:Put", want: true},
+		{pattern: "s3:ObjectCreated:*", name: "s3:ObjectCreated"},
+		{pattern: "s3:ObjectCreated:*", name: "s3:ObjectCreated:Put:Part"},
+		{pattern: "s3:*:Put", name: "s3:ObjectCreated:Put", want: true},
+		{pattern: "*", name: "s3", want: true},
+		{pattern: "*", name: "s3:ObjectCreated"},
+		{pattern: "s3:#", name: "s3", want: true},
+		{pattern: "s3:#", name: "s3:ObjectCreated:Put", want: true},
+		{pattern: "s3:#", name: "s4:ObjectCreated:Put"},
+		{pattern: "#", name: "s3:ObjectCreated:Put", want: true},
+		{pattern: "#", name: "", want: true},
+		{pattern: "s3:#:Put", name: "s3:Put", want: true},
+		{pattern: "s3:#:Put", name: "s3:ObjectCreated:Multipart:Put", want: true},
+		{pattern: "s3:#:Put", name: "s3:ObjectCreated:Copy"},
+		{pattern: "#:*", name: "s3", want: true},
+		{pattern: "#:*", name: ""},
+		// an empty segment is only matched by itself or by #
+		{pattern: "s3:ObjectCreated:*", name: "s3:ObjectCreated:"},
+		{pattern: "s3:ObjectCreated:#", name: "s3:ObjectCreated:", want: true},
+		{pattern: "s3:ObjectCreated:", name: "s3:ObjectCreated:", want: true},
+		{pattern: "s3:ObjectCreated:", name: "s3:ObjectCreated"},
+		{pattern: "s3::*", name: "s3::Put", want: true},
+		{pattern: "s3:*:Put", name: "s3::Put"},
+		{pattern: "*", name: ""},
+	}
+	for _, tc := range cases {
+		if got := event_bus.Match(tc.pattern, tc.name); got != tc.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tc.pattern, tc.name, got, tc.want)
+		}
+	}
+}
+
+type record struct {
+	S3 struct {
+		Bucket struct {
+			ID   int64  `json:"id"`
+			Name string `json:"name"`
+		} `json:"bucket"`
+		Tags []string `json:"tags"`
+	} `json:"s3"`
+}
+
+func TestWithField(t *testing.T) {
+	r := record{}
+	r.S3.Bucket.ID = 7
+	r.S3.Bucket.Name = "bucket"
+	r.S3.Tags = []string{"a", "b"}
+	// a durable bus replays the events as their JSON
+	raw := json.RawMessage(`{"s3": {"bucket": {"id": 7, "name": "bucket"}, "tags": ["a", "b"]}}`)
+
+	cases := []struct {
+		name  string
+		path  string
+		value any
+		data  any
+		want  bool
+	}{
+		{name: "number", path: "s3.bucket.id", value: 7, data: r, want: true},
+		{name: "number of the JSON", path: "s3.bucket.id", value: int64(7), data: raw, want: true},
+		{name: "other number", path: "s3.bucket.id", value: 8, data: r},
+		{name: "string", path: "s3.bucket.name", value: "bucket", data: raw, want: true},
+		{name: "string of a number", path: "s3.bucket.id", value: "7", data: r},
+		{name: "array", path: "s3.tags", value: []string{"a", "b"}, data: raw, want: true},
+		{name: "other array", path: "s3.tags", value: []string{"b", "a"}, data: r},
+		{name: "object against a scalar", path: "s3.bucket", value: 7, data: r},
+		{name: "missing field", path: "s3.object.key", value: "key", data: r},
+		{name: "missing last field", path: "s3.bucket.owner", value: nil, data: raw},
+		{name: "field of a scalar", path: "s3.bucket.id.value", value: 7, data: raw},
+		{name: "field of an array", path: "s3.tags.0", value: "a", data: r},
+		{name: "empty path segment", path: "s3..id", value: 7, data: r},
+		{name: "data not JSON", path: "s3", value: 7, data: json.RawMessage(`not json`)},
+		{name: "data not an object", path: "s3", value: 7, data: 7},
+		{name: "value not JSON", path: "s3.bucket.id", value: func() {}, data: r},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			filter := event_bus.WithField(tc.path, tc.value).Filter
+			if got := filter(event_bus.Event{EventName: "s3:ObjectCreated:Put", Data: tc.data}); got != tc.want {
+				t.Fatalf("WithField(%q, %v) accepted %v, want %v", tc.path, tc.value, got, tc.want)
+			}
+		})
+	}
+}